@@ -4,7 +4,11 @@
 // Package apitype contains types for the Tailscale LocalAPI and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+)
 
 // LocalAPIHost is the Host header value used by the LocalAPI.
 const LocalAPIHost = "local-tailscaled.sock"
@@ -35,6 +39,24 @@ type WaitingFile struct {
 	Size int64
 }
 
+// BundleManifest describes the files of a Taildrop bundle: a directory of
+// files that is sent and delivered as a unit.
+type BundleManifest struct {
+	Files []BundleFile
+}
+
+// BundleFile is a file in a BundleManifest.
+type BundleFile struct {
+	// Path is the slash-separated path of the file, relative to the
+	// bundle's directory.
+	Path string
+
+	Size int64
+
+	// SHA256 is the hex-encoded SHA-256 of the contents of the file.
+	SHA256 string
+}
+
 // SetPushDeviceTokenRequest is the body POSTed to the LocalAPI endpoint /set-device-token.
 type SetPushDeviceTokenRequest struct {
 	// PushDeviceToken is the iOS/macOS APNs device token (and any future Android equivalent).
@@ -57,3 +79,25 @@ type ExitNodeSuggestionResponse struct {
 	Name     string
 	Location tailcfg.LocationView `json:",omitempty"`
 }
+
+// DebugCaptureFilesStatus is the status of tailscaled's background debug
+// capture to rotated files, returned by the LocalAPI debug-capture-files
+// endpoints.
+type DebugCaptureFilesStatus struct {
+	// Running is whether a capture is running. If not, the other fields
+	// describe the last capture, if any.
+	Running bool
+
+	// Err is the error that stopped the last capture, if any.
+	Err string `json:",omitempty"`
+
+	Started      time.Time
+	Filter       string `json:",omitempty"` // capture filter expression
+	Pattern      string `json:",omitempty"` // glob matching the capture's files
+	MaxFileSize  int64  `json:",omitempty"` // size limit of each file
+	MaxFiles     int    `json:",omitempty"` // number of files kept
+	MaxTotalSize int64  `json:",omitempty"` // size limit of all captures' files
+
+	// Files are the paths of the capture's files, oldest first.
+	Files []string `json:",omitempty"`
+}
@@ -14,10 +14,12 @@
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/netip"
+	"net/textproto"
 	"net/url"
 	"os/exec"
 	"runtime"
@@ -35,8 +37,10 @@
 	"tailscale.com/net/netutil"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
+	"tailscale.com/sessionrecording"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tka"
+	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 	"tailscale.com/types/tkatype"
 )
@@ -382,6 +386,43 @@ func (lc *LocalClient) TailDaemonLogs(ctx context.Context) (io.Reader, error) {
 	return res.Body, nil
 }
 
+// DNSQueryLog returns a snapshot of the MagicDNS resolver's query log.
+func (lc *LocalClient) DNSQueryLog(ctx context.Context) (*dnstype.QueryLog, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/dns-query-log")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*dnstype.QueryLog](body)
+}
+
+// SetDNSQueryLogSize sets the number of entries retained in the MagicDNS
+// resolver's query log. Zero disables the query log.
+func (lc *LocalClient) SetDNSQueryLogSize(ctx context.Context, n int) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/dns-query-log?size="+strconv.Itoa(n), http.StatusNoContent, nil)
+	return err
+}
+
+// TailDNSQueryLog returns a stream of new entries in the MagicDNS resolver's
+// query log, each a JSON-encoded dnstype.QueryLogEntry on its own line.
+// Entries are streamed even if the query log is disabled.
+//
+// The caller must close the returned ReadCloser when done.
+func (lc *LocalClient) TailDNSQueryLog(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/dns-query-log?follow=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, errors.New(res.Status)
+	}
+	return res.Body, nil
+}
+
 // Pprof returns a pprof profile of the Tailscale daemon.
 func (lc *LocalClient) Pprof(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	var secArg string
@@ -681,6 +722,16 @@ func (lc *LocalClient) FileTargets(ctx context.Context) ([]apitype.FileTarget, e
 	return decodeJSON[[]apitype.FileTarget](body)
 }
 
+// FileHistory returns the Taildrop transfers that have finished, both sent
+// and received, oldest first.
+func (lc *LocalClient) FileHistory(ctx context.Context) ([]ipn.FileTransfer, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/file-history")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]ipn.FileTransfer](body)
+}
+
 // PushFile sends Taildrop file r to target.
 //
 // A size of -1 means unknown.
@@ -705,6 +756,72 @@ func (lc *LocalClient) PushFile(ctx context.Context, target tailcfg.StableNodeID
 	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
 }
 
+// PushBundle sends the files in manifest to the target node as a single
+// Taildrop bundle with the given name. The open func is called in manifest
+// order to read each file's contents.
+//
+// The peer delivers the bundle only once it has every file. If an earlier
+// PushBundle of the same bundle failed, files the peer already has are
+// skipped and a partially sent file is resumed.
+func (lc *LocalClient) PushBundle(ctx context.Context, target tailcfg.StableNodeID, name string, manifest apitype.BundleManifest, open func(path string) (io.ReadCloser, error)) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeBundleParts(mw, manifest, open))
+	}()
+	defer pr.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+"/localapi/v0/file-put-bundle/"+string(target)+"/"+url.PathEscape(name), pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 200 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	all, _ := io.ReadAll(res.Body)
+	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
+}
+
+// writeBundleParts writes the multipart body of a PushBundle request to mw
+// and closes it.
+func writeBundleParts(mw *multipart.Writer, manifest apitype.BundleManifest, open func(path string) (io.ReadCloser, error)) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="manifest"`)
+	h.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(manifest); err != nil {
+		return err
+	}
+	for _, f := range manifest.Files {
+		// The path goes in the form name, as Part.FileName drops
+		// its directories.
+		part, err := mw.CreateFormField(f.Path)
+		if err != nil {
+			return err
+		}
+		rc, err := open(f.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
 // CheckIPForwarding asks the local Tailscale daemon whether it looks like the
 // machine is properly configured to forward IP packets as a subnet router
 // or exit node.
@@ -1239,6 +1356,41 @@ func (lc *LocalClient) NetworkLockSubmitRecoveryAUM(ctx context.Context, aum tka
 	return nil
 }
 
+// NetworkLockPrepareBundle returns a bundle of unsigned AUMs which add and/or
+// remove keys in the tailnet key authority, for signing offline. The bundle
+// is the JSON encoding of a tka.Bundle.
+func (lc *LocalClient) NetworkLockPrepareBundle(ctx context.Context, addKeys, removeKeys []tka.Key) ([]byte, error) {
+	vr := struct {
+		AddKeys    []tka.Key
+		RemoveKeys []tka.Key
+	}{addKeys, removeKeys}
+
+	body, err := lc.send(ctx, "POST", "/localapi/v0/tka/prepare-bundle", 200, jsonBody(vr))
+	if err != nil {
+		return nil, fmt.Errorf("sending prepare-bundle: %w", err)
+	}
+	return body, nil
+}
+
+// NetworkLockSignBundle signs the AUMs in bundle using the node's tailnet lock
+// key, and returns the updated bundle.
+func (lc *LocalClient) NetworkLockSignBundle(ctx context.Context, bundle []byte) ([]byte, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/tka/sign-bundle", 200, bytes.NewReader(bundle))
+	if err != nil {
+		return nil, fmt.Errorf("sending sign-bundle: %w", err)
+	}
+	return body, nil
+}
+
+// NetworkLockSubmitBundle submits the signed AUMs in bundle to the control
+// plane.
+func (lc *LocalClient) NetworkLockSubmitBundle(ctx context.Context, bundle []byte) error {
+	if _, err := lc.send(ctx, "POST", "/localapi/v0/tka/submit-bundle", 200, bytes.NewReader(bundle)); err != nil {
+		return fmt.Errorf("sending submit-bundle: %w", err)
+	}
+	return nil
+}
+
 // SetServeConfig sets or replaces the serving settings.
 // If config is nil, settings are cleared and serving is disabled.
 func (lc *LocalClient) SetServeConfig(ctx context.Context, config *ipn.ServeConfig) error {
@@ -1280,6 +1432,17 @@ func (lc *LocalClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, er
 	return sc, nil
 }
 
+// ServeBackendStatus returns the health of the backends of the load
+// balanced serve handlers, keyed by "host:port/mount" for web handlers and
+// "tcp:port" for TCP forwarders.
+func (lc *LocalClient) ServeBackendStatus(ctx context.Context) (map[string][]ipn.ServeBackendStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/serve-backends")
+	if err != nil {
+		return nil, fmt.Errorf("getting serve backend status: %w", err)
+	}
+	return decodeJSON[map[string][]ipn.ServeBackendStatus](body)
+}
+
 func getServeConfigFromJSON(body []byte) (sc *ipn.ServeConfig, err error) {
 	if err := json.Unmarshal(body, &sc); err != nil {
 		return nil, err
@@ -1447,7 +1610,37 @@ func (lc *LocalClient) DebugSetExpireIn(ctx context.Context, d time.Duration) er
 // The provided context does not determine the lifetime of the
 // returned io.ReadCloser.
 func (lc *LocalClient) StreamDebugCapture(ctx context.Context) (io.ReadCloser, error) {
-	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+"/localapi/v0/debug-capture", nil)
+	return lc.StreamDebugCaptureOpts(ctx, nil)
+}
+
+// DebugCaptureOpts contains options for the StreamDebugCaptureOpts command.
+type DebugCaptureOpts struct {
+	// Filter is a capture filter expression selecting the packets to
+	// capture, in the syntax documented on capture.Filter. The empty
+	// string captures all packets.
+	Filter string
+
+	// Format is the format of the streamed capture: "pcap" or "pcapng".
+	// The empty string means "pcap". pcapng captures annotate packets
+	// with the peers they're from or to, and can be read by Wireshark
+	// without the Tailscale dissector.
+	Format string
+}
+
+// StreamDebugCaptureOpts is like StreamDebugCapture, but with options. opts
+// may be nil.
+func (lc *LocalClient) StreamDebugCaptureOpts(ctx context.Context, opts *DebugCaptureOpts) (io.ReadCloser, error) {
+	if opts == nil {
+		opts = &DebugCaptureOpts{}
+	}
+	vals := make(url.Values)
+	if opts.Filter != "" {
+		vals.Set("filter", opts.Filter)
+	}
+	if opts.Format != "" {
+		vals.Set("format", opts.Format)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+"/localapi/v0/debug-capture?"+vals.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1456,12 +1649,77 @@ func (lc *LocalClient) StreamDebugCapture(ctx context.Context) (io.ReadCloser, e
 		return nil, err
 	}
 	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
 		res.Body.Close()
-		return nil, errors.New(res.Status)
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, body)
 	}
 	return res.Body, nil
 }
 
+// DebugCaptureFilesOpts contains options for the StartDebugCaptureFiles
+// command.
+type DebugCaptureFilesOpts struct {
+	// Filter is a capture filter expression, as in DebugCaptureOpts.
+	Filter string
+
+	// MaxFileSize and MaxFiles are the size in bytes of each file, and the
+	// number of files kept. Zero means the default: 10 files of 100 MiB.
+	MaxFileSize int64
+	MaxFiles    int
+
+	// MaxTotalSize is the size in bytes that the capture files in the
+	// state directory, including those of earlier captures, are kept
+	// under. Zero means the default of 2 GiB.
+	MaxTotalSize int64
+}
+
+// StartDebugCaptureFiles starts a packet capture that tailscaled writes in
+// the background to a ring of pcapng files in its state directory, until
+// StopDebugCaptureFiles is called. opts may be nil.
+func (lc *LocalClient) StartDebugCaptureFiles(ctx context.Context, opts *DebugCaptureFilesOpts) (*apitype.DebugCaptureFilesStatus, error) {
+	if opts == nil {
+		opts = &DebugCaptureFilesOpts{}
+	}
+	vals := make(url.Values)
+	if opts.Filter != "" {
+		vals.Set("filter", opts.Filter)
+	}
+	if opts.MaxFileSize > 0 {
+		vals.Set("max-file-size", strconv.FormatInt(opts.MaxFileSize, 10))
+	}
+	if opts.MaxFiles > 0 {
+		vals.Set("max-files", strconv.Itoa(opts.MaxFiles))
+	}
+	if opts.MaxTotalSize > 0 {
+		vals.Set("max-total-size", strconv.FormatInt(opts.MaxTotalSize, 10))
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-capture-files/start?"+vals.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugCaptureFilesStatus](body)
+}
+
+// StopDebugCaptureFiles stops the capture started by StartDebugCaptureFiles,
+// and returns its final status.
+func (lc *LocalClient) StopDebugCaptureFiles(ctx context.Context) (*apitype.DebugCaptureFilesStatus, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-capture-files/stop", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugCaptureFilesStatus](body)
+}
+
+// DebugCaptureFilesStatus returns the status of the capture started by
+// StartDebugCaptureFiles, or of the last one if it has stopped.
+func (lc *LocalClient) DebugCaptureFilesStatus(ctx context.Context) (*apitype.DebugCaptureFilesStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-capture-files/status")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DebugCaptureFilesStatus](body)
+}
+
 // WatchIPNBus subscribes to the IPN notification bus. It returns a watcher
 // once the bus is connected successfully.
 //
@@ -1615,3 +1873,32 @@ func (lc *LocalClient) SuggestExitNode(ctx context.Context) (apitype.ExitNodeSug
 	}
 	return decodeJSON[apitype.ExitNodeSuggestionResponse](body)
 }
+
+// SSHRecordings returns the Tailscale SSH sessions recorded to the local
+// disk of the node, oldest first.
+func (lc *LocalClient) SSHRecordings(ctx context.Context) ([]sessionrecording.Info, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/ssh-recordings/")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]sessionrecording.Info](body)
+}
+
+// SSHRecording returns the local recording of a Tailscale SSH session, in
+// asciicast v2 format. The caller must close the returned ReadCloser.
+func (lc *LocalClient) SSHRecording(ctx context.Context, id string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/ssh-recordings/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	return res.Body, nil
+}
@@ -22,6 +22,12 @@
 //	                100.85.80.41 -> 192.168.0.101:41641   16.00    2.23Ki   10.40      1.40Ki
 //	               100.107.177.2 -> 192.168.0.100:41641    0.80   83.20      0.80     83.20
 //	=========================================================================================
+//
+// With --listen, it instead receives the IPFIX or NetFlow v9 messages that
+// tailscaled exports to a flow collector (see "tailscale set --flow-collector")
+// and formats them in the same way:
+//
+//	$ go run tailscale.com/cmd/netlogfmt --listen=:4739
 package main
 
 import (
@@ -33,6 +39,7 @@
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/netip"
 	"os"
@@ -44,6 +51,7 @@
 	"github.com/dsnet/try"
 	jsonv2 "github.com/go-json-experiment/json"
 	"github.com/go-json-experiment/json/jsontext"
+	"tailscale.com/net/flowexport"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netlogtype"
 	"tailscale.com/util/must"
@@ -53,6 +61,7 @@
 	resolveNames = flag.Bool("resolve-names", false, "convert tailscale IP addresses to hostnames; must also specify --api-key and --tailnet-id")
 	apiKey       = flag.String("api-key", "", "API key to query the Tailscale API with; see https://login.tailscale.com/admin/settings/keys")
 	tailnetName  = flag.String("tailnet-name", "", "tailnet domain name to lookup devices in; see https://login.tailscale.com/admin/settings/general")
+	listen       = flag.String("listen", "", "UDP address to receive IPFIX or NetFlow v9 messages on, such as \":4739\", instead of reading JSON from stdin")
 )
 
 var namesByAddr map[netip.Addr]string
@@ -63,6 +72,13 @@ func main() {
 		namesByAddr = mustMakeNamesByAddr()
 	}
 
+	if *listen != "" {
+		if err := processFlows(*listen); err != nil {
+			log.Fatalf("processFlows: %v", err)
+		}
+		return
+	}
+
 	// The logic handles a stream of arbitrary JSON.
 	// So long as a JSON object seems like a network log message,
 	// then this will unmarshal and print it.
@@ -135,6 +151,49 @@ func processObject(dec *jsontext.Decoder) {
 	}
 }
 
+// flowQuietPeriod is how long to wait for more flow export messages before
+// printing the flows received so far. tailscaled exports all the flows of a
+// polling period at once, in as many messages as it needs.
+const flowQuietPeriod = 250 * time.Millisecond
+
+// processFlows receives IPFIX or NetFlow v9 messages on the UDP address addr
+// and prints their flows.
+func processFlows(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("listening for flows on %v", conn.LocalAddr())
+
+	var dec flowexport.Decoder
+	var recs []flowexport.Record
+	buf := make([]byte, 64<<10)
+	for {
+		if len(recs) > 0 {
+			conn.SetReadDeadline(time.Now().Add(flowQuietPeriod))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				for _, m := range flowexport.Messages(recs) {
+					printMessage(message{Logged: time.Now(), Message: m})
+				}
+				recs = nil
+				continue
+			}
+			return err
+		}
+		r, err := dec.Decode(buf[:n])
+		if err != nil {
+			log.Printf("decoding message from %v: %v", from, err)
+		}
+		recs = append(recs, r...)
+	}
+}
+
 type message struct {
 	Logtail struct {
 		ID     logid.PublicID `json:"id"`
@@ -184,6 +184,7 @@ func newRootCmd() *ffcli.Command {
 			pingCmd,
 			ncCmd,
 			sshCmd,
+			sshRecordingsCmd,
 			funnelCmd(),
 			serveCmd(),
 			versionCmd,
@@ -198,6 +199,7 @@ func newRootCmd() *ffcli.Command {
 			whoisCmd,
 			debugCmd,
 			driveCmd,
+			dnsCmd,
 			idTokenCmd,
 		},
 		FlagSet: rootfs,
@@ -1476,3 +1476,52 @@ func TestParseNLArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestDNSOverrideEdits(t *testing.T) {
+	a := ipn.DNSOverride{Name: "staging.example.com", Type: "A", Value: "10.1.2.3"}
+	aaaa := ipn.DNSOverride{Name: "staging.example.com", Type: "AAAA", Value: "fd00::3"}
+	nx := ipn.DNSOverride{Name: "ads.example.com", Type: "NXDOMAIN"}
+	cur := []ipn.DNSOverride{a, nx}
+
+	tests := []struct {
+		name    string
+		edits   []string
+		want    []ipn.DNSOverride
+		wantErr string
+	}{
+		{"add", []string{"staging.example.com=AAAA:fd00::3"}, []ipn.DNSOverride{a, nx, aaaa}, ""},
+		{"add-existing", []string{"staging.example.com=A:10.1.2.3"}, []ipn.DNSOverride{a, nx}, ""},
+		{"remove-one", []string{"-staging.example.com=A:10.1.2.3"}, []ipn.DNSOverride{nx}, ""},
+		{"remove-name", []string{"staging.example.com=AAAA:fd00::3", "-Staging.Example.com."}, []ipn.DNSOverride{nx}, ""},
+		{"clear", []string{""}, nil, ""},
+		{"clear-and-add", []string{"", "ads.example.com=NXDOMAIN"}, []ipn.DNSOverride{nx}, ""},
+		{"remove-missing", []string{"-other.example.com"}, nil, `no DNS overrides for "other.example.com"`},
+		{"remove-missing-one", []string{"-ads.example.com=FORWARD:10.0.0.53"}, nil, `no DNS override "ads.example.com=FORWARD:10.0.0.53"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e dnsOverrideEdits
+			for _, v := range tt.edits {
+				if err := e.Set(v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := e.apply(cur)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+	if err := new(dnsOverrideEdits).Set("staging.example.com=A:nope"); err == nil {
+		t.Error("Set accepted an invalid override")
+	}
+}
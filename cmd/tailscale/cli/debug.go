@@ -192,6 +192,18 @@
 			Exec:       debugControlKnobs,
 			ShortHelp:  "See current control knobs",
 		},
+		{
+			Name:       "dns-cache",
+			ShortUsage: "tailscale debug dns-cache",
+			Exec:       debugDNSCache,
+			ShortHelp:  "Print MagicDNS forwarder response cache statistics",
+		},
+		{
+			Name:       "dns-blocklist",
+			ShortUsage: "tailscale debug dns-blocklist",
+			Exec:       debugDNSBlocklist,
+			ShortHelp:  "Print exit node DNS blocklist statistics",
+		},
 		{
 			Name:       "prefs",
 			ShortUsage: "tailscale debug prefs",
@@ -278,12 +290,40 @@
 		},
 		{
 			Name:       "capture",
-			ShortUsage: "tailscale debug capture",
+			ShortUsage: "tailscale debug capture [--filter=<expr>] [--format=pcap|pcapng] [-o <file> | --rotate | --status | --stop]",
 			Exec:       runCapture,
 			ShortHelp:  "Streams pcaps for debugging",
+			LongHelp: strings.TrimSpace(`
+'tailscale debug capture' captures the packets traversing tailscaled.
+
+--filter selects the packets to capture, using a subset of tcpdump's syntax
+("host", "net", "port", "tcp", "udp", "icmp", "proto", with "src", "dst",
+"and", "or", "not" and parentheses), plus "node <MagicDNS name>" for a peer's
+packets and "path <FromLocal|FromPeer|SynthesizedToLocal|SynthesizedToPeer|
+DroppedFromPeer|Disco>" for where in tailscaled a packet was captured.
+
+With --format=pcapng, each path is a separate interface, and packets are
+annotated with the MagicDNS name and node key of the peer they're from or to.
+Such captures can be read by Wireshark and tshark without the Tailscale
+dissector, which is only needed to decode disco frames.
+
+With --rotate, tailscaled writes the capture in the background to a ring of
+pcapng files in its state directory, deleting the oldest file when there are
+more than --max-files, and the oldest files of any capture when they total
+more than --max-total-mb. The capture runs until it's stopped with --stop,
+or tailscaled exits. --status shows its files.
+`),
 			FlagSet: (func() *flag.FlagSet {
 				fs := newFlagSet("capture")
 				fs.StringVar(&captureArgs.outFile, "o", "", "path to stream the pcap (or - for stdout), leave empty to start wireshark")
+				fs.StringVar(&captureArgs.filter, "filter", "", "capture filter expression; empty captures all packets")
+				fs.StringVar(&captureArgs.format, "format", "pcap", `capture format: "pcap" or "pcapng"`)
+				fs.BoolVar(&captureArgs.rotate, "rotate", false, "write the capture to rotated files in tailscaled's state directory")
+				fs.IntVar(&captureArgs.maxFileMB, "max-file-mb", 100, "with --rotate, the size of each file in MiB")
+				fs.IntVar(&captureArgs.maxFiles, "max-files", 10, "with --rotate, the number of files to keep")
+				fs.IntVar(&captureArgs.maxTotalMB, "max-total-mb", 2048, "with --rotate, the total size in MiB of the files of all captures")
+				fs.BoolVar(&captureArgs.status, "status", false, "show the status of the capture started with --rotate")
+				fs.BoolVar(&captureArgs.stop, "stop", false, "stop the capture started with --rotate")
 				return fs
 			})(),
 		},
@@ -957,11 +997,69 @@ func runSetExpire(ctx context.Context, args []string) error {
 }
 
 var captureArgs struct {
-	outFile string
+	outFile    string
+	filter     string
+	format     string
+	rotate     bool
+	maxFileMB  int
+	maxFiles   int
+	maxTotalMB int
+	status     bool
+	stop       bool
 }
 
 func runCapture(ctx context.Context, args []string) error {
-	stream, err := localClient.StreamDebugCapture(ctx)
+	if len(args) > 0 {
+		return errors.New("unexpected arguments; use --filter to select packets")
+	}
+	modes := 0
+	for _, set := range []bool{captureArgs.outFile != "", captureArgs.rotate, captureArgs.status, captureArgs.stop} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return errors.New("-o, --rotate, --status and --stop are mutually exclusive")
+	}
+	switch {
+	case captureArgs.rotate:
+		st, err := localClient.StartDebugCaptureFiles(ctx, &tailscale.DebugCaptureFilesOpts{
+			Filter:       captureArgs.filter,
+			MaxFileSize:  int64(captureArgs.maxFileMB) << 20,
+			MaxFiles:     captureArgs.maxFiles,
+			MaxTotalSize: int64(captureArgs.maxTotalMB) << 20,
+		})
+		if err != nil {
+			return err
+		}
+		printf("Capturing to %s (up to %d files of %d MiB).\n", st.Pattern, st.MaxFiles, st.MaxFileSize>>20)
+		printf("Run 'tailscale debug capture --stop' to stop.\n")
+		return nil
+	case captureArgs.status:
+		st, err := localClient.DebugCaptureFilesStatus(ctx)
+		if err != nil {
+			return err
+		}
+		printCaptureFilesStatus(st)
+		return nil
+	case captureArgs.stop:
+		st, err := localClient.StopDebugCaptureFiles(ctx)
+		if err != nil {
+			return err
+		}
+		printCaptureFilesStatus(st)
+		return nil
+	}
+
+	switch captureArgs.format {
+	case "pcap", "pcapng":
+	default:
+		return fmt.Errorf("unknown --format %q; want pcap or pcapng", captureArgs.format)
+	}
+	stream, err := localClient.StreamDebugCaptureOpts(ctx, &tailscale.DebugCaptureOpts{
+		Filter: captureArgs.filter,
+		Format: captureArgs.format,
+	})
 	if err != nil {
 		return err
 	}
@@ -1000,6 +1098,27 @@ func runCapture(ctx context.Context, args []string) error {
 	return err
 }
 
+func printCaptureFilesStatus(st *apitype.DebugCaptureFilesStatus) {
+	switch {
+	case st.Running:
+		printf("Capture running since %v.\n", st.Started.Local().Format(time.DateTime))
+	case st.Started.IsZero():
+		printf("No capture has run.\n")
+		return
+	default:
+		printf("Capture stopped; it started at %v.\n", st.Started.Local().Format(time.DateTime))
+	}
+	if st.Err != "" {
+		printf("Error: %s\n", st.Err)
+	}
+	if st.Filter != "" {
+		printf("Filter: %s\n", st.Filter)
+	}
+	for _, f := range st.Files {
+		printf("%s\n", f)
+	}
+}
+
 var debugPortmapArgs struct {
 	duration    time.Duration
 	gatewayAddr string
@@ -1110,6 +1229,34 @@ func debugControlKnobs(ctx context.Context, args []string) error {
 	return nil
 }
 
+func debugDNSCache(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	v, err := localClient.DebugResultJSON(ctx, "dns-cache")
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+	return nil
+}
+
+func debugDNSBlocklist(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	v, err := localClient.DebugResultJSON(ctx, "dns-blocklist")
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+	return nil
+}
+
 var debugDialTypesArgs struct {
 	network string
 }
@@ -0,0 +1,198 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/types/dnstype"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "tailscale dns <subcommand> [flags]",
+	ShortHelp:  "Inspect the MagicDNS resolver",
+	Subcommands: []*ffcli.Command{
+		dnsLogCmd,
+	},
+}
+
+var dnsLogCmd = &ffcli.Command{
+	Name:       "log",
+	ShortUsage: "tailscale dns log [--follow] [--stats] [--json] [--size=N]",
+	ShortHelp:  "Show queries answered by the MagicDNS resolver (100.100.100.100)",
+	LongHelp: strings.TrimSpace(`
+'tailscale dns log' shows the queries recently answered by the MagicDNS
+resolver, and whether each was answered by MagicDNS itself, a split DNS
+route, or the fallback resolver.
+
+The query log is off by default. Use --size=N to keep the last N queries,
+or --size=0 to turn it off again. With --follow, new queries are shown as
+they're answered, even while the query log is off.
+
+If TS_OBSCURE_LOGGED_IPS is set for tailscaled, non-Tailscale IP addresses
+are redacted from the log.
+`),
+	Exec: runDNSLog,
+	FlagSet: func() *flag.FlagSet {
+		fs := newFlagSet("log")
+		fs.BoolVar(&dnsLogArgs.follow, "follow", false, "stream new queries as they're answered")
+		fs.BoolVar(&dnsLogArgs.stats, "stats", false, "show per-client statistics instead of queries")
+		fs.BoolVar(&dnsLogArgs.json, "json", false, "output in JSON format")
+		fs.IntVar(&dnsLogArgs.size, "size", -1, "if non-negative, set the number of queries to keep in the log and exit; 0 turns the log off")
+		return fs
+	}(),
+}
+
+var dnsLogArgs struct {
+	follow bool
+	stats  bool
+	json   bool
+	size   int
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale dns log'")
+	}
+	if dnsLogArgs.size >= 0 {
+		if err := localClient.SetDNSQueryLogSize(ctx, dnsLogArgs.size); err != nil {
+			return err
+		}
+		if dnsLogArgs.size == 0 {
+			printf("DNS query log turned off.\n")
+		} else {
+			printf("DNS query log now keeps the last %d queries.\n", dnsLogArgs.size)
+		}
+		return nil
+	}
+	if dnsLogArgs.follow {
+		if dnsLogArgs.stats {
+			return errors.New("--stats and --follow are mutually exclusive")
+		}
+		return followDNSLog(ctx)
+	}
+
+	ql, err := localClient.DNSQueryLog(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsLogArgs.json {
+		j, err := json.MarshalIndent(ql, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	if ql.Size == 0 {
+		printf("The DNS query log is off. Turn it on with 'tailscale dns log --size=1000', or use --follow.\n")
+		return nil
+	}
+	if dnsLogArgs.stats {
+		printDNSQueryStats(ql.Clients)
+		return nil
+	}
+	for _, e := range ql.Entries {
+		outln(formatDNSQueryLogEntry(e))
+	}
+	return nil
+}
+
+func followDNSLog(ctx context.Context) error {
+	rc, err := localClient.TailDNSQueryLog(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dec := json.NewDecoder(bufio.NewReader(rc))
+	for {
+		var e dnstype.QueryLogEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if dnsLogArgs.json {
+			j, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			outln(string(j))
+		} else {
+			outln(formatDNSQueryLogEntry(e))
+		}
+	}
+}
+
+// formatDNSQueryLogEntry formats e as a single line for humans.
+func formatDNSQueryLogEntry(e dnstype.QueryLogEntry) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %-21v %-5s %s via %s", e.Time.Local().Format("15:04:05.000"), dnsQueryLogSource(e), e.Type, e.Name, dnsQueryLogRoute(e.Route))
+	if e.RCode != "" {
+		fmt.Fprintf(&sb, ": %s", e.RCode)
+	}
+	if e.Err != "" {
+		fmt.Fprintf(&sb, ": %s", e.Err)
+	}
+	fmt.Fprintf(&sb, " (%v", e.Latency.Round(100*time.Microsecond))
+	if e.Cached {
+		sb.WriteString(", cached")
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+func dnsQueryLogRoute(route string) string {
+	switch route {
+	case "":
+		return "(no resolver)"
+	case ".":
+		return "default route"
+	case dnstype.QueryLogRouteMagicDNS, dnstype.QueryLogRouteFallback:
+		return route
+	}
+	return "route " + route
+}
+
+// dnsQueryLogSource returns the address e came from, which may be redacted.
+func dnsQueryLogSource(e dnstype.QueryLogEntry) string {
+	if e.RedactedSource != "" {
+		return e.RedactedSource
+	}
+	return e.Source.String()
+}
+
+func printDNSQueryStats(clients map[netip.Addr]dnstype.QueryStats) {
+	ips := make([]netip.Addr, 0, len(clients))
+	for ip := range clients {
+		ips = append(ips, ip)
+	}
+	slices.SortFunc(ips, func(a, b netip.Addr) int { return a.Compare(b) })
+
+	w := tabwriter.NewWriter(Stdout, 10, 5, 3, ' ', 0)
+	fmt.Fprintf(w, "CLIENT\tQUERIES\tCACHED\tFAILED\n")
+	for _, ip := range ips {
+		st := clients[ip]
+		name := ip.String()
+		if !ip.IsValid() {
+			name = "(redacted)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", name, st.Queries, st.Cached, st.Failed)
+	}
+	w.Flush()
+}
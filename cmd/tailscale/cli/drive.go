@@ -5,19 +5,29 @@
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/drive"
+	"tailscale.com/drive/drivesync"
+	"tailscale.com/net/tsaddr"
 )
 
 const (
-	driveShareUsage   = "tailscale drive share <name> <path>"
+	driveShareUsage   = "tailscale drive share [--max-bytes=<n>] [--max-files=<n>] [--snapshot=hardlink|copy] <name> <path>"
 	driveRenameUsage  = "tailscale drive rename <oldname> <newname>"
 	driveUnshareUsage = "tailscale drive unshare <name>"
 	driveListUsage    = "tailscale drive list"
+	driveSyncUsage    = "tailscale drive sync [--once] [--delete] <machine>/<share> <localdir>"
 )
 
 var driveCmd = &ffcli.Command{
@@ -28,6 +38,7 @@
 		driveRenameUsage,
 		driveUnshareUsage,
 		driveListUsage,
+		driveSyncUsage,
 	}, "\n"),
 	LongHelp:  buildShareLongHelp(),
 	UsageFunc: usageFuncNoDefaultValues,
@@ -37,6 +48,13 @@
 			ShortUsage: driveShareUsage,
 			Exec:       runDriveShare,
 			ShortHelp:  "[ALPHA] Create or modify a share",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("share")
+				fs.Int64Var(&driveShareArgs.maxBytes, "max-bytes", 0, "most bytes of files that may be stored in the share, or 0 for no limit")
+				fs.Int64Var(&driveShareArgs.maxFiles, "max-files", 0, "most files that may be stored in the share, or 0 for no limit")
+				fs.StringVar(&driveShareArgs.snapshot, "snapshot", "", `serve a read-only snapshot of the directory, taken with "hardlink" or "copy"; share again to take a new snapshot`)
+				return fs
+			})(),
 		},
 		{
 			Name:       "rename",
@@ -56,9 +74,27 @@
 			ShortHelp:  "[ALPHA] List current shares",
 			Exec:       runDriveList,
 		},
+		{
+			Name:       "sync",
+			ShortUsage: driveSyncUsage,
+			ShortHelp:  "[ALPHA] Mirror a share from another machine into a local directory",
+			Exec:       runDriveSync,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("sync")
+				fs.BoolVar(&driveSyncArgs.once, "once", false, "copy the share once and exit, rather than following its changes")
+				fs.BoolVar(&driveSyncArgs.delete, "delete", false, "allow syncing into a non-empty directory that wasn't synced before, removing its files that aren't in the share")
+				return fs
+			})(),
+		},
 	},
 }
 
+var driveShareArgs struct {
+	maxBytes int64
+	maxFiles int64
+	snapshot string
+}
+
 // runDriveShare is the entry point for the "tailscale drive share" command.
 func runDriveShare(ctx context.Context, args []string) error {
 	if len(args) != 2 {
@@ -72,12 +108,23 @@ func runDriveShare(ctx context.Context, args []string) error {
 		return err
 	}
 
-	err = localClient.DriveShareSet(ctx, &drive.Share{
-		Name: name,
-		Path: absolutePath,
-	})
+	share := &drive.Share{
+		Name:     name,
+		Path:     absolutePath,
+		MaxBytes: driveShareArgs.maxBytes,
+		MaxFiles: driveShareArgs.maxFiles,
+		Snapshot: drive.SnapshotMode(driveShareArgs.snapshot),
+	}
+	if err := share.Validate(); err != nil {
+		return err
+	}
+	err = localClient.DriveShareSet(ctx, share)
 	if err == nil {
-		fmt.Printf("Sharing %q as %q\n", path, name)
+		if share.Snapshot != "" {
+			fmt.Printf("Sharing a snapshot of %q as %q\n", path, name)
+		} else {
+			fmt.Printf("Sharing %q as %q\n", path, name)
+		}
 	}
 	return err
 }
@@ -146,6 +193,63 @@ func runDriveList(ctx context.Context, args []string) error {
 	return nil
 }
 
+var driveSyncArgs struct {
+	once   bool
+	delete bool
+}
+
+// runDriveSync is the entry point for the "tailscale drive sync" command.
+func runDriveSync(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s", driveSyncUsage)
+	}
+	remote, dir := args[0], args[1]
+
+	// The share is <machine>/<share> on the current tailnet, or
+	// /<tailnet>/<machine>/<share>.
+	parts := strings.Split(strings.Trim(remote, "/"), "/")
+	if !strings.HasPrefix(remote, "/") {
+		st, err := localClient.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if st.CurrentTailnet == nil {
+			return errors.New("not connected to a tailnet")
+		}
+		parts = append([]string{st.CurrentTailnet.Name}, parts...)
+	}
+	if len(parts) != 3 || slices.Contains(parts, "") {
+		return fmt.Errorf("usage: %s", driveSyncUsage)
+	}
+	// Go through the local Taildrive WebDAV server, as file managers do.
+	u := "http://" + net.JoinHostPort(tsaddr.TailscaleServiceIPString, "8080")
+	for _, part := range parts {
+		u += "/" + url.PathEscape(part)
+	}
+
+	m := &drivesync.Mirror{
+		URL:    u,
+		Dir:    dir,
+		Logf:   func(format string, a ...any) { printf(format+"\n", a...) },
+		Delete: driveSyncArgs.delete,
+	}
+	var err error
+	if driveSyncArgs.once {
+		err = m.Sync(ctx)
+	} else {
+		ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+		defer cancel()
+		printf("Mirroring %s into %s; press Ctrl+C to stop\n", remote, dir)
+		if err = m.Run(ctx); ctx.Err() != nil {
+			err = nil
+		}
+	}
+	if errors.Is(err, drivesync.ErrNotMirror) {
+		return fmt.Errorf("%w; use --delete to sync into it anyway, removing files that aren't in the share", err)
+	}
+	return err
+}
+
 func buildShareLongHelp() string {
 	longHelpAs := ""
 	if drive.AllowShareAs() {
@@ -217,6 +321,14 @@ func buildShareLongHelp() string {
 	  }
 	}]
 
+You can limit how much remote machines may store in a share. Writes that would exceed the limits fail. For example, to allow at most 1 GB in 1000 files:
+
+  $ tailscale drive share --max-bytes=1000000000 --max-files=1000 docs /Users/me/Documents
+
+To share a directory whose files are still being written, such as build output, you can share a read-only snapshot of it instead. The snapshot is kept in the tailscaled state directory until the share is removed, and is made of hardlinks or copies of its files. Hardlinks can only be used if the directory is on the same file system. Share the directory again to take a new snapshot:
+
+  $ tailscale drive share --snapshot=hardlink builds /Users/me/project/out
+
 You can rename shares, for example you could rename the above share by running:
 
   $ tailscale drive rename docs newdocs
@@ -227,7 +339,13 @@ func buildShareLongHelp() string {
 
 You can get a list of currently published shares by running:
 
-  $ tailscale drive list`
+  $ tailscale drive list
+
+You can mirror a share from another machine into a local directory, and keep it up to date as the share changes, by running:
+
+  $ tailscale drive sync mylaptop/docs ./docs
+
+Files in the local directory that aren't in the share are removed. To avoid removing unrelated files, the local directory must be empty or missing the first time, unless you pass --delete.`
 
 const shareLongHelpAs = `
 
@@ -6,10 +6,14 @@
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
 	"net/http"
@@ -19,6 +23,7 @@
 	"path/filepath"
 	"strings"
 	"sync/atomic"
+	"text/tabwriter"
 	"time"
 	"unicode/utf8"
 
@@ -39,11 +44,12 @@
 
 var fileCmd = &ffcli.Command{
 	Name:       "file",
-	ShortUsage: "tailscale file <cp|get> ...",
+	ShortUsage: "tailscale file <cp|get|history> ...",
 	ShortHelp:  "Send or receive files",
 	Subcommands: []*ffcli.Command{
 		fileCpCmd,
 		fileGetCmd,
+		fileHistoryCmd,
 	},
 }
 
@@ -61,7 +67,7 @@ func (c *countingReader) Read(buf []byte) (int, error) {
 var fileCpCmd = &ffcli.Command{
 	Name:       "cp",
 	ShortUsage: "tailscale file cp <files...> <target>:",
-	ShortHelp:  "Copy file(s) to a host",
+	ShortHelp:  "Copy files or directories to a host",
 	Exec:       runCp,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("cp")
@@ -150,7 +156,14 @@ func runCp(ctx context.Context, args []string) error {
 				return err
 			}
 			if fi.IsDir() {
-				return errors.New("directories not supported")
+				f.Close()
+				if name == "" {
+					name = filepath.Base(fileArg)
+				}
+				if err := sendDir(ctx, stableID, name, fileArg, target, ip); err != nil {
+					return err
+				}
+				continue
 			}
 			contentLength = fi.Size()
 			fileContents = &countingReader{Reader: io.LimitReader(f, contentLength)}
@@ -187,6 +200,78 @@ func runCp(ctx context.Context, args []string) error {
 	return nil
 }
 
+// sendDir sends the regular files under dir to the node with stableID as a
+// single bundle named name. Symlinks and other special files are skipped.
+func sendDir(ctx context.Context, stableID tailcfg.StableNodeID, name, dir, target, ip string) error {
+	var manifest apitype.BundleManifest
+	var contentLength int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		size, err := io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, apitype.BundleFile{
+			Path:   filepath.ToSlash(rel),
+			Size:   size,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+		contentLength += size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(manifest.Files) == 0 {
+		return fmt.Errorf("directory %s has no files to send", dir)
+	}
+
+	if cpArgs.verbose {
+		log.Printf("sending directory %q (%d files) to %v/%v/%v ...", name, len(manifest.Files), target, ip, stableID)
+	}
+
+	counter := &countingReader{}
+	var group syncs.WaitGroup
+	ctxProgress, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	if isatty.IsTerminal(os.Stderr.Fd()) {
+		group.Go(func() { progressPrinter(ctxProgress, name, counter.n.Load, contentLength) })
+	}
+
+	err = localClient.PushBundle(ctx, stableID, name, manifest, func(rel string) (io.ReadCloser, error) {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		counter.Reader = f
+		return struct {
+			io.Reader
+			io.Closer
+		}{counter, f}, nil
+	})
+	cancelProgress()
+	group.Wait() // wait for progress printer to stop before reporting the error
+	if err != nil {
+		return err
+	}
+	if cpArgs.verbose {
+		log.Printf("sent %q", name)
+	}
+	return nil
+}
+
 func progressPrinter(ctx context.Context, name string, contentCount func() int64, contentLength int64) {
 	var rateValueFast, rateValueSlow tsrate.Value
 	rateValueFast.HalfLife = 1 * time.Second  // fast response for rate measurement
@@ -486,6 +571,14 @@ func receiveFile(ctx context.Context, wf apitype.WaitingFile, dir string) (targe
 		return "", 0, fmt.Errorf("opening inbox file %q: %w", wf.Name, err)
 	}
 	defer rc.Close()
+	// Files of a bundle are named by their slash-separated path within it.
+	if sub, base := path.Split(wf.Name); sub != "" {
+		dir = filepath.Join(dir, filepath.FromSlash(sub))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", 0, err
+		}
+		wf.Name = base
+	}
 	f, err := openFileOrSubstitute(dir, wf.Name, getArgs.conflict)
 	if err != nil {
 		return "", 0, err
@@ -637,3 +730,64 @@ func waitForFile(ctx context.Context) error {
 		}
 	}
 }
+
+var fileHistoryCmd = &ffcli.Command{
+	Name:       "history",
+	ShortUsage: "tailscale file history [--json]",
+	ShortHelp:  "Show recently sent and received files",
+	Exec:       runFileHistory,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("history")
+		fs.BoolVar(&historyArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var historyArgs struct {
+	json bool
+}
+
+func runFileHistory(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: tailscale file history [--json]")
+	}
+	history, err := localClient.FileHistory(ctx)
+	if err != nil {
+		return err
+	}
+	if historyArgs.json {
+		ec := json.NewEncoder(Stdout)
+		ec.SetIndent("", "  ")
+		return ec.Encode(history)
+	}
+	if len(history) == 0 {
+		printf("No files have been sent or received.\n")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(Stdout, 10, 5, 3, ' ', 0)
+	fmt.Fprintf(w, "TIME\tDIRECTION\tPEER\tNAME\tSIZE\tDURATION\tRESULT\n")
+	for _, t := range history {
+		dir, peer := "received", "from "
+		if t.Outgoing {
+			dir, peer = "sent", "to "
+		}
+		if t.PeerName != "" {
+			peer += strings.TrimSuffix(t.PeerName, ".")
+		} else {
+			peer += string(t.PeerID)
+		}
+		size := "-"
+		if t.Size >= 0 {
+			size = formatIEC(float64(t.Size), "B")
+		}
+		result := "ok"
+		if !t.Succeeded {
+			result = "failed: " + t.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%s\n",
+			t.Started.Local().Format(time.DateTime), dir, peer, t.Name, size,
+			t.Duration.Round(time.Second/10), result)
+	}
+	return w.Flush()
+}
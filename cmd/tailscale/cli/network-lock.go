@@ -5,7 +5,9 @@
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -18,6 +20,7 @@
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/atomicfile"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tka"
 	"tailscale.com/types/key"
@@ -40,6 +43,9 @@
 		nlLogCmd,
 		nlLocalDisableCmd,
 		nlRevokeKeysCmd,
+		nlPrepareCmd,
+		nlSignOfflineCmd,
+		nlSubmitCmd,
 	},
 	Exec: runNetworkLockNoSubcommand,
 }
@@ -829,3 +835,238 @@ func runNetworkLockRevokeKeys(ctx context.Context, args []string) error {
 
 	return nil
 }
+
+var nlPrepareArgs struct {
+	add    string
+	remove string
+	out    string
+}
+
+var nlPrepareCmd = &ffcli.Command{
+	Name:       "prepare",
+	ShortUsage: "tailscale lock prepare [--add=<public-key>,...] [--remove=<public-key>,...] -o <bundle-file>",
+	ShortHelp:  "Prepare changes to tailnet lock for signing offline",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale lock prepare' command starts a change to the trusted
+tailnet lock keys that is signed by keys kept on machines that are not
+connected, such as air-gapped machines.
+
+It writes the unsigned change to a bundle file, which also describes the
+change, for review. Move the file to a machine with a trusted tailnet lock
+key and sign it with 'tailscale lock sign-offline', then move it back to a
+connected node and apply the change with 'tailscale lock submit'.
+
+The node running this command does not need a trusted tailnet lock key.
+The change must be submitted before any other change is made to tailnet
+lock.
+
+`),
+	Exec: runNetworkLockPrepare,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("lock prepare")
+		fs.StringVar(&nlPrepareArgs.add, "add", "", "comma-separated tailnet lock keys to trust, each with an optional '?<votes>' suffix")
+		fs.StringVar(&nlPrepareArgs.remove, "remove", "", "comma-separated tailnet lock keys to stop trusting")
+		fs.StringVar(&nlPrepareArgs.out, "o", "", "file to write the bundle to")
+		return fs
+	})(),
+}
+
+func runNetworkLockPrepare(ctx context.Context, args []string) error {
+	if len(args) > 0 || nlPrepareArgs.out == "" {
+		return errors.New("usage: tailscale lock prepare [--add=<public-key>,...] [--remove=<public-key>,...] -o <bundle-file>")
+	}
+	addKeys, _, err := parseNLArgs(splitNonEmpty(nlPrepareArgs.add), true, false)
+	if err != nil {
+		return err
+	}
+	removeKeys, _, err := parseNLArgs(splitNonEmpty(nlPrepareArgs.remove), true, false)
+	if err != nil {
+		return err
+	}
+	if len(addKeys) == 0 && len(removeKeys) == 0 {
+		return errors.New("no keys to add or remove")
+	}
+
+	b, err := localClient.NetworkLockPrepareBundle(ctx, addKeys, removeKeys)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	bundle, err := tka.ParseBundle(b)
+	if err != nil {
+		return err
+	}
+	if err := writeNLBundle(nlPrepareArgs.out, bundle); err != nil {
+		return err
+	}
+	printNLBundle(bundle)
+	fmt.Printf("\nWrote the unsigned changes to %s. Sign them with 'tailscale lock sign-offline'.\n", nlPrepareArgs.out)
+	return nil
+}
+
+var nlSignOfflineArgs struct {
+	key     string
+	out     string
+	confirm bool
+}
+
+var nlSignOfflineCmd = &ffcli.Command{
+	Name:       "sign-offline",
+	ShortUsage: "tailscale lock sign-offline [--key=<key-file>] [-o <bundle-file>] <bundle-file>",
+	ShortHelp:  "Sign changes to tailnet lock prepared with 'tailscale lock prepare'",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale lock sign-offline' command signs the changes in a bundle
+written by 'tailscale lock prepare', after showing them for review. It
+does not need the machine to be connected.
+
+The changes are signed with the tailnet lock key in the file named by
+--key, which holds a private key of the form "nlpriv:...". Without --key,
+they are signed with this node's tailnet lock key.
+
+A bundle of a single change can be signed by several keys in turn. A
+bundle of several changes can only be signed once.
+
+The signed bundle replaces the input file, unless -o is given.
+
+`),
+	Exec: runNetworkLockSignOffline,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("lock sign-offline")
+		fs.StringVar(&nlSignOfflineArgs.key, "key", "", "file holding the tailnet lock private key to sign with, instead of this node's key")
+		fs.StringVar(&nlSignOfflineArgs.out, "o", "", "file to write the signed bundle to, instead of replacing the input file")
+		fs.BoolVar(&nlSignOfflineArgs.confirm, "confirm", false, "do not prompt for confirmation")
+		return fs
+	})(),
+}
+
+func runNetworkLockSignOffline(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale lock sign-offline [--key=<key-file>] [-o <bundle-file>] <bundle-file>")
+	}
+	bundle, err := readNLBundle(args[0])
+	if err != nil {
+		return err
+	}
+	var priv key.NLPrivate
+	if nlSignOfflineArgs.key != "" {
+		b, err := os.ReadFile(nlSignOfflineArgs.key)
+		if err != nil {
+			return err
+		}
+		if err := priv.UnmarshalText(bytes.TrimSpace(b)); err != nil {
+			return fmt.Errorf("reading tailnet lock key from %s: %w", nlSignOfflineArgs.key, err)
+		}
+	}
+
+	printNLBundle(bundle)
+	if !nlSignOfflineArgs.confirm {
+		fmt.Println()
+		if !promptYesNo("Are you sure you want to sign these changes?") {
+			return errors.New("aborting")
+		}
+	}
+
+	if !priv.IsZero() {
+		if err := bundle.Sign(priv); err != nil {
+			return err
+		}
+	} else {
+		b, err := bundle.Marshal()
+		if err != nil {
+			return err
+		}
+		if b, err = localClient.NetworkLockSignBundle(ctx, b); err != nil {
+			return fixTailscaledConnectError(err)
+		}
+		if bundle, err = tka.ParseBundle(b); err != nil {
+			return err
+		}
+	}
+
+	out := cmp.Or(nlSignOfflineArgs.out, args[0])
+	if err := writeNLBundle(out, bundle); err != nil {
+		return err
+	}
+	fmt.Printf("Signed. Wrote the bundle to %s.\n", out)
+	return nil
+}
+
+var nlSubmitCmd = &ffcli.Command{
+	Name:       "submit",
+	ShortUsage: "tailscale lock submit <bundle-file>",
+	ShortHelp:  "Apply changes to tailnet lock signed with 'tailscale lock sign-offline'",
+	Exec:       runNetworkLockSubmit,
+}
+
+func runNetworkLockSubmit(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale lock submit <bundle-file>")
+	}
+	bundle, err := readNLBundle(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := bundle.Marshal()
+	if err != nil {
+		return err
+	}
+	printNLBundle(bundle)
+	if err := localClient.NetworkLockSubmitBundle(ctx, b); err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	fmt.Println("\nChanges applied.")
+	return nil
+}
+
+// splitNonEmpty splits the comma-separated list s, dropping empty elements.
+func splitNonEmpty(s string) []string {
+	var out []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func readNLBundle(path string) (*tka.Bundle, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := tka.ParseBundle(b)
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle %s: %w", path, err)
+	}
+	return bundle, nil
+}
+
+func writeNLBundle(path string, bundle *tka.Bundle) error {
+	b, err := bundle.Marshal()
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// printNLBundle prints the changes in bundle, and the keys that have signed
+// them.
+func printNLBundle(bundle *tka.Bundle) {
+	fmt.Printf("Changes to tailnet lock at head %v:\n", bundle.Parent)
+	for i, c := range bundle.Changes {
+		fmt.Printf("  %d. %s\n", i+1, c)
+	}
+	signers, err := bundle.Signers()
+	if err != nil {
+		return
+	}
+	if len(signers) == 0 {
+		fmt.Println("Not signed yet.")
+		return
+	}
+	fmt.Println("Signed by:")
+	for _, id := range signers {
+		fmt.Printf("  %s\n", key.NLPublicFromEd25519Unsafe(ed25519.PublicKey(id)).CLIString())
+	}
+}
@@ -21,6 +21,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -140,6 +141,7 @@ type localServeClient interface {
 	QueryFeature(ctx context.Context, feature string) (*tailcfg.QueryFeatureResponse, error)
 	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error)
 	IncrementCounter(ctx context.Context, name string, delta int) error
+	ServeBackendStatus(context.Context) (map[string][]ipn.ServeBackendStatus, error)
 }
 
 // serveEnv is the environment the serve command runs within. All I/O should be
@@ -159,8 +161,22 @@ type serveEnv struct {
 	http             uint      // HTTP port
 	tcp              uint      // TCP port
 	tlsTerminatedTCP uint      // a TLS terminated TCP port
+	udp              uint      // UDP port
 	subcmd           serveMode // subcommand
 	yes              bool      // update without prompt
+	status           uint      // HTTP status code of text and redirect targets
+	requestHeaders   headerRulesFlag
+	responseHeaders  headerRulesFlag
+	allow            string        // comma-separated allow rules of a mount point
+	noListing        bool          // don't list served directories
+	indexFile        string        // index file of served directories
+	allowUploads     bool          // accept uploads into served directories
+	maxUploadMB      int           // size limit of uploaded files, in MiB
+	backends         stringsFlag   // more backends to load balance across
+	lbPolicy         string        // load balancing policy
+	healthCheck      string        // "tcp" or an HTTP path to health check backends with
+	healthInterval   time.Duration // time between health checks
+	udpIdleTimeout   time.Duration // idle timeout of forwarded UDP flows
 
 	lc localServeClient // localClient interface, specific to serve
 
@@ -605,7 +621,17 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		return err
 	}
 	if e.json {
-		j, err := json.MarshalIndent(sc, "", "  ")
+		out := struct {
+			*ipn.ServeConfig
+			BackendHealth map[string][]ipn.ServeBackendStatus `json:",omitempty"`
+		}{ServeConfig: sc}
+		if hasLoadBalancer(sc) {
+			out.BackendHealth, err = e.lc.ServeBackendStatus(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		j, err := json.MarshalIndent(out, "", "  ")
 		if err != nil {
 			return err
 		}
@@ -614,7 +640,7 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		return nil
 	}
 	printFunnelStatus(ctx)
-	if sc == nil || (len(sc.TCP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
+	if sc == nil || (len(sc.TCP) == 0 && len(sc.UDP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
 		printf("No serve config\n")
 		return nil
 	}
@@ -628,6 +654,10 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		}
 		printf("\n")
 	}
+	if len(sc.UDP) > 0 {
+		printUDPStatusTree(sc, st)
+		printf("\n")
+	}
 	for hp := range sc.Web {
 		err := e.printWebStatusTree(sc, hp)
 		if err != nil {
@@ -659,11 +689,21 @@ func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.S
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(p)))
 			printf("|-- tcp://%s\n", ipp)
 		}
-		printf("|--> tcp://%s\n", h.TCPForward)
+		printf("|--> tcp://%s\n", backendsDesc(h.TCPForward, h.LoadBalancer))
 	}
 	return nil
 }
 
+func printUDPStatusTree(sc *ipn.ServeConfig, st *ipnstate.Status) {
+	for p, h := range sc.UDP {
+		for _, a := range st.TailscaleIPs {
+			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(p)))
+			printf("|-- udp://%s\n", ipp)
+		}
+		printf("|--> udp://%s\n", udpForwardDesc(h))
+	}
+}
+
 func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) error {
 	// No-op if no serve config
 	if sc == nil {
@@ -700,7 +740,7 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 		case h.Path != "":
 			return "path", h.Path
 		case h.Proxy != "":
-			return "proxy", h.Proxy
+			return "proxy", backendsDesc(h.Proxy, h.LoadBalancer)
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
 		}
@@ -720,11 +760,43 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 		h := sc.Web[hp].Handlers[m]
 		t, d := srvTypeAndDesc(h)
 		printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
+		if rules := sc.Web[hp].Allow[m]; len(rules) > 0 {
+			printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), "allow", strings.Join(rules, ", "))
+		}
 	}
 
 	return nil
 }
 
+// hasLoadBalancer reports whether any handler of sc, including those of
+// its foreground configs, is load balanced.
+func hasLoadBalancer(sc *ipn.ServeConfig) bool {
+	if sc == nil {
+		return false
+	}
+	for _, h := range sc.TCP {
+		if h != nil && h.LoadBalancer != nil {
+			return true
+		}
+	}
+	for _, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		for _, h := range wsc.Handlers {
+			if h != nil && h.LoadBalancer != nil {
+				return true
+			}
+		}
+	}
+	for _, fg := range sc.Foreground {
+		if hasLoadBalancer(fg) {
+			return true
+		}
+	}
+	return false
+}
+
 func elipticallyTruncate(s string, max int) string {
 	if len(s) <= max {
 		return s
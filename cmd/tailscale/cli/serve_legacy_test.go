@@ -912,6 +912,10 @@ func (lc *fakeLocalServeClient) WatchIPNBus(ctx context.Context, mask ipn.Notify
 	return nil, nil // unused in tests
 }
 
+func (lc *fakeLocalServeClient) ServeBackendStatus(ctx context.Context) (map[string][]ipn.ServeBackendStatus, error) {
+	return nil, nil
+}
+
 func (lc *fakeLocalServeClient) IncrementCounter(ctx context.Context, name string, delta int) error {
 	return nil // unused in tests
 }
@@ -4,6 +4,7 @@
 package cli
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -13,14 +14,17 @@
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -40,9 +44,11 @@ type commandInfo struct {
 }
 
 var serveHelpCommon = strings.TrimSpace(`
-<target> can be a file, directory, text, or most commonly the location to a service running on the
+<target> can be a file, directory, text, redirect, or most commonly the location to a service running on the
 local machine. The location to the location service can be expressed as a port number (e.g., 3000),
 a partial URL (e.g., localhost:3000), or a full URL including a path (e.g., http://localhost:3000/foo).
+Text is given as text:<text>, and a redirect as redirect:<url>, where ${HOST} and ${REQUEST_URI} in
+<url> expand to the host and the path and query of the request.
 
 EXAMPLES
   - Expose an HTTP server running at 127.0.0.1:3000 in the foreground:
@@ -54,6 +60,24 @@ type commandInfo struct {
   - Expose an HTTPS server with invalid or self-signed certificates at https://localhost:8443
     $ tailscale %[1]s https+insecure://localhost:8443
 
+  - Permanently redirect requests under /docs/ to another site, keeping the path:
+    $ tailscale %[1]s --bg --set-path=/docs --status=301 'redirect:https://docs.example.com${REQUEST_URI}'
+
+  - Pass the requesting user's login to a server in its own header, and stop it from being cached:
+    $ tailscale %[1]s --request-header='X-Remote-User: ${Tailscale-User-Login}' --response-header='Cache-Control: no-store' 3000
+
+  - Expose an admin server only to members of the tailnet tagged tag:ops and to alice@example.com:
+    $ tailscale %[1]s --bg --set-path=/admin --allow=tag:ops,alice@example.com 8080
+
+  - Share a directory that tailnet users can upload files to, without listing its contents:
+    $ tailscale %[1]s --bg --set-path=/drop --no-listing --allow-uploads /srv/drop
+
+  - Load balance requests across three local servers, skipping any that fail health checks:
+    $ tailscale %[1]s --bg --backend=3001 --backend=3002 --health-check=/healthz 3000
+
+  - Forward UDP datagrams on port 53 to a DNS server at 127.0.0.1:5353 (serve only):
+    $ tailscale serve --bg --udp=53 5353
+
 For more examples and use cases visit our docs site https://tailscale.com/kb/1247/funnel-serve-use-cases
 `)
 
@@ -71,6 +95,7 @@ type commandInfo struct {
 	serveTypeHTTP
 	serveTypeTCP
 	serveTypeTLSTerminatedTCP
+	serveTypeUDP
 )
 
 var infoMap = map[serveMode]commandInfo{
@@ -126,7 +151,23 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 			}
 			fs.UintVar(&e.tcp, "tcp", 0, "Expose a TCP forwarder to forward raw TCP packets at the specified port")
 			fs.UintVar(&e.tlsTerminatedTCP, "tls-terminated-tcp", 0, "Expose a TCP forwarder to forward TLS-terminated TCP packets at the specified port")
+			if subcmd == serve {
+				fs.UintVar(&e.udp, "udp", 0, "Expose a UDP forwarder to forward UDP datagrams at the specified port")
+				fs.DurationVar(&e.udpIdleTimeout, "udp-idle-timeout", 0, "Time after which a forwarded UDP flow with no datagrams in either direction is closed (default 2m)")
+			}
 			fs.BoolVar(&e.yes, "yes", false, "Update without interactive prompts (default false)")
+			fs.UintVar(&e.status, "status", 0, "HTTP status code of responses to text: and redirect: targets (default 200 for text, 302 for redirects)")
+			fs.Var(&e.requestHeaders, "request-header", `Set ("Name: value") or remove ("-Name") a header of requests to the target; ${Tailscale-User-Login}, ${Tailscale-User-Name} and ${Tailscale-User-Profile-Pic} in values expand to the identity of the requesting user. May be repeated`)
+			fs.Var(&e.responseHeaders, "response-header", `Set ("Name: value") or remove ("-Name") a header of responses; like --request-header. May be repeated`)
+			fs.StringVar(&e.allow, "allow", "", `Comma-separated tailnet identities allowed to use the mount point: user logins, tags ("tag:ci") or peer capabilities ("cap:example.com/cap/admin"). Others get 403 Forbidden (default all)`)
+			fs.BoolVar(&e.noListing, "no-listing", false, "Do not list the contents of served directories without an index file")
+			fs.StringVar(&e.indexFile, "index", "", "Name of the file to serve for requests for a served directory that contains it (default index.html)")
+			fs.BoolVar(&e.allowUploads, "allow-uploads", false, "Allow tailnet users to upload files into a served directory with PUT requests")
+			fs.IntVar(&e.maxUploadMB, "max-upload-mb", 0, "Maximum size in MiB of a file uploaded with --allow-uploads (default 1024)")
+			fs.Var(&e.backends, "backend", "Another backend to load balance requests or connections to, in the same form as the target. May be repeated")
+			fs.StringVar(&e.lbPolicy, "lb-policy", "", `How to select among backends, "round-robin" or "least-conn" (default round-robin)`)
+			fs.StringVar(&e.healthCheck, "health-check", "", `Check the health of backends by connecting to them ("tcp") or requesting an HTTP path, such as "/healthz", and stop using unhealthy ones`)
+			fs.DurationVar(&e.healthInterval, "health-interval", 0, "Time between health checks of a backend (default 10s)")
 		}),
 		UsageFunc: usageFuncNoDefaultValues,
 		Subcommands: []*ffcli.Command{
@@ -333,6 +374,20 @@ func (e *serveEnv) runServeCombined(subcmd serveMode) execFunc {
 const backgroundExistsMsg = "background configuration already exists, use `tailscale %s --%s=%d off` to remove the existing configuration"
 
 func (e *serveEnv) validateConfig(sc *ipn.ServeConfig, port uint16, wantServe serveType) error {
+	if wantServe == serveTypeUDP {
+		// UDP ports are independent of the TCP ports used by the other types.
+		sc, isFg := sc.FindUDPConfig(port)
+		if sc == nil {
+			return nil
+		}
+		if isFg {
+			return errors.New("foreground already exists under this port")
+		}
+		if !e.bg {
+			return fmt.Errorf(backgroundExistsMsg, infoMap[e.subcmd].Name, wantServe.String(), port)
+		}
+		return nil
+	}
 	sc, isFg := sc.FindConfig(port)
 	if sc == nil {
 		return nil
@@ -378,11 +433,41 @@ func (e *serveEnv) setServe(sc *ipn.ServeConfig, st *ipnstate.Status, dnsName st
 		if e.setPath != "" {
 			return fmt.Errorf("cannot mount a path for TCP serve")
 		}
+		if e.status != 0 || len(e.requestHeaders) > 0 || len(e.responseHeaders) > 0 {
+			return fmt.Errorf("cannot set HTTP status or headers for TCP serve")
+		}
+		if e.allow != "" {
+			return fmt.Errorf("cannot set allow rules for TCP serve")
+		}
+		if e.noListing || e.indexFile != "" || e.allowUploads || e.maxUploadMB != 0 {
+			return fmt.Errorf("cannot set directory options for TCP serve")
+		}
 
 		err := e.applyTCPServe(sc, dnsName, srvType, srvPort, target)
 		if err != nil {
 			return fmt.Errorf("failed to apply TCP serve: %w", err)
 		}
+	case serveTypeUDP:
+		if e.setPath != "" {
+			return fmt.Errorf("cannot mount a path for UDP serve")
+		}
+		if e.status != 0 || len(e.requestHeaders) > 0 || len(e.responseHeaders) > 0 {
+			return fmt.Errorf("cannot set HTTP status or headers for UDP serve")
+		}
+		if e.allow != "" {
+			return fmt.Errorf("cannot set allow rules for UDP serve")
+		}
+		if e.noListing || e.indexFile != "" || e.allowUploads || e.maxUploadMB != 0 {
+			return fmt.Errorf("cannot set directory options for UDP serve")
+		}
+		if e.wantLoadBalancer() {
+			return fmt.Errorf("cannot load balance UDP serve")
+		}
+		if err := e.applyUDPServe(sc, srvPort, target); err != nil {
+			return fmt.Errorf("failed to apply UDP serve: %w", err)
+		}
+		// Funnel is per TCP port; leave any on srvPort alone.
+		return nil
 	default:
 		return fmt.Errorf("invalid type %q", srvType)
 	}
@@ -408,7 +493,7 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 
 	hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))
 
-	if sc.AllowFunnel[hp] == true {
+	if srvType != serveTypeUDP && sc.AllowFunnel[hp] == true {
 		output.WriteString(msgFunnelAvailable)
 	} else {
 		output.WriteString(msgServeAvailable)
@@ -431,14 +516,30 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 		case h.Path != "":
 			return "path", h.Path
 		case h.Proxy != "":
-			return "proxy", h.Proxy
+			return "proxy", backendsDesc(h.Proxy, h.LoadBalancer)
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+		case h.Redirect != "":
+			code := h.Status
+			if code == 0 {
+				code = http.StatusFound
+			}
+			return "redirect", fmt.Sprintf("%s (%d)", h.Redirect, code)
+		case h.Status != 0:
+			return "status", strconv.Itoa(h.Status)
 		}
 		return "", ""
 	}
 
-	if sc.Web[hp] != nil {
+	if srvType == serveTypeUDP {
+		if h := sc.UDP[srvPort]; h != nil {
+			for _, a := range st.TailscaleIPs {
+				ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(srvPort)))
+				output.WriteString(fmt.Sprintf("|-- udp://%s\n", ipp))
+			}
+			output.WriteString(fmt.Sprintf("|--> udp://%s\n", udpForwardDesc(h)))
+		}
+	} else if sc.Web[hp] != nil {
 		var mounts []string
 
 		for k := range sc.Web[hp].Handlers {
@@ -452,7 +553,11 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 			h := sc.Web[hp].Handlers[m]
 			t, d := srvTypeAndDesc(h)
 			output.WriteString(fmt.Sprintf("%s://%s%s%s\n", scheme, dnsName, portPart, m))
-			output.WriteString(fmt.Sprintf("%s %-5s %s\n\n", "|--", t, d))
+			output.WriteString(fmt.Sprintf("%s %-5s %s\n", "|--", t, d))
+			if rules := sc.Web[hp].Allow[m]; len(rules) > 0 {
+				output.WriteString(fmt.Sprintf("%s %-5s %s\n", "|--", "allow", strings.Join(rules, ", ")))
+			}
+			output.WriteString("\n")
 		}
 	} else if sc.TCP[srvPort] != nil {
 		h := sc.TCP[srvPort]
@@ -468,7 +573,7 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(srvPort)))
 			output.WriteString(fmt.Sprintf("|-- tcp://%s\n", ipp))
 		}
-		output.WriteString(fmt.Sprintf("|--> tcp://%s\n", h.TCPForward))
+		output.WriteString(fmt.Sprintf("|--> tcp://%s\n", backendsDesc(h.TCPForward, h.LoadBalancer)))
 	}
 
 	if !e.bg {
@@ -496,6 +601,11 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case strings.HasPrefix(target, "redirect:"):
+		h.Redirect = strings.TrimPrefix(target, "redirect:")
+		if h.Redirect == "" {
+			return errors.New("unable to serve; redirect URL cannot be empty")
+		}
 	case filepath.IsAbs(target):
 		if version.IsMacAppStore() || version.IsMacSys() {
 			// The Tailscale network extension cannot serve arbitrary paths on macOS due to sandbox restrictions (2024-03-26)
@@ -523,12 +633,69 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 		h.Proxy = t
 	}
 
+	if e.status != 0 {
+		if h.Text == "" && h.Redirect == "" {
+			return errors.New("--status can only be used with text: and redirect: targets")
+		}
+		h.Status = int(e.status)
+	}
+	if e.noListing || e.indexFile != "" || e.allowUploads {
+		if h.Path == "" {
+			return errors.New("--no-listing, --index and --allow-uploads can only be used with directory targets")
+		}
+		h.NoListing = e.noListing
+		h.IndexFile = e.indexFile
+		h.AllowUploads = e.allowUploads
+	}
+	if e.maxUploadMB != 0 {
+		if !e.allowUploads || e.maxUploadMB < 0 {
+			return errors.New("--max-upload-mb must be positive and can only be used with --allow-uploads")
+		}
+		h.MaxUploadSize = int64(e.maxUploadMB) << 20
+	}
+	h.RequestHeaders = slices.Clone(e.requestHeaders)
+	h.ResponseHeaders = slices.Clone(e.responseHeaders)
+	if e.wantLoadBalancer() {
+		if h.Proxy == "" {
+			return errors.New("--backend can only be used with proxy targets")
+		}
+		lb, err := e.loadBalancer(func(backend string) (string, error) {
+			return ipn.ExpandProxyTargetValue(backend, []string{"http", "https", "https+insecure"}, "http")
+		})
+		if err != nil {
+			return err
+		}
+		h.LoadBalancer = lb
+	}
+	if err := h.Check(); err != nil {
+		return err
+	}
+
 	// TODO: validation needs to check nested foreground configs
 	if sc.IsTCPForwardingOnPort(srvPort) {
 		return errors.New("cannot serve web; already serving TCP")
 	}
 
+	var allow []string
+	if e.allow != "" {
+		allow = strings.Split(e.allow, ",")
+		for _, r := range allow {
+			if err := ipn.CheckServeAllowRule(r); err != nil {
+				return err
+			}
+		}
+	}
+
 	sc.SetWebHandler(h, dnsName, srvPort, mount, useTLS)
+	wsc := sc.Web[ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))]
+	if allow != nil {
+		mak.Set(&wsc.Allow, mount, allow)
+	} else {
+		delete(wsc.Allow, mount)
+		if len(wsc.Allow) == 0 {
+			wsc.Allow = nil
+		}
+	}
 
 	return nil
 }
@@ -559,11 +726,108 @@ func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType se
 		return fmt.Errorf("cannot serve TCP; already serving web on %d", srcPort)
 	}
 
+	var lb *ipn.LoadBalancer
+	if e.wantLoadBalancer() {
+		lb, err = e.loadBalancer(func(backend string) (string, error) {
+			u, err := ipn.ExpandProxyTargetValue(backend, []string{"tcp"}, "tcp")
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimPrefix(u, "tcp://"), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	sc.SetTCPForwarding(srcPort, dstURL.Host, terminateTLS, dnsName)
+	if lb != nil {
+		sc.TCP[srcPort].LoadBalancer = lb
+		if err := sc.TCP[srcPort].Check(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+func (e *serveEnv) applyUDPServe(sc *ipn.ServeConfig, srcPort uint16, target string) error {
+	targetURL, err := ipn.ExpandProxyTargetValue(target, []string{"udp"}, "udp")
+	if err != nil {
+		return fmt.Errorf("unable to expand target: %v", err)
+	}
+	dstURL, err := url.Parse(targetURL)
+	if err != nil {
+		return fmt.Errorf("invalid UDP target %q: %v", target, err)
+	}
+	if e.udpIdleTimeout < 0 || (e.udpIdleTimeout > 0 && e.udpIdleTimeout < time.Second) {
+		return errors.New("--udp-idle-timeout must be at least 1s")
+	}
+	sc.SetUDPForwarding(srcPort, dstURL.Host, e.udpIdleTimeout)
+	return nil
+}
+
+// udpForwardDesc describes the target of a UDP forwarder for status output.
+func udpForwardDesc(h *ipn.UDPPortHandler) string {
+	if h.IdleTimeoutSeconds == 0 {
+		return h.UDPForward
+	}
+	idle := time.Duration(h.IdleTimeoutSeconds) * time.Second
+	return fmt.Sprintf("%s (idle timeout %v)", h.UDPForward, idle)
+}
+
+// wantLoadBalancer reports whether any of the load balancing flags are set.
+func (e *serveEnv) wantLoadBalancer() bool {
+	return len(e.backends) > 0 || e.lbPolicy != "" || e.healthCheck != "" || e.healthInterval != 0
+}
+
+// loadBalancer returns the load balancer configured by the flags, using
+// expand to expand each --backend like the target.
+func (e *serveEnv) loadBalancer(expand func(backend string) (string, error)) (*ipn.LoadBalancer, error) {
+	if len(e.backends) == 0 {
+		return nil, errors.New("--lb-policy, --health-check and --health-interval require at least one --backend")
+	}
+	lb := &ipn.LoadBalancer{Policy: e.lbPolicy}
+	for _, b := range e.backends {
+		t, err := expand(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend %q: %w", b, err)
+		}
+		lb.Backends = append(lb.Backends, t)
+	}
+	switch {
+	case e.healthCheck == "tcp":
+		lb.HealthCheck = new(ipn.HealthCheck)
+	case strings.HasPrefix(e.healthCheck, "/"):
+		lb.HealthCheck = &ipn.HealthCheck{Path: e.healthCheck}
+	case e.healthCheck != "":
+		return nil, fmt.Errorf("invalid --health-check %q; want \"tcp\" or an HTTP path", e.healthCheck)
+	}
+	if e.healthInterval != 0 {
+		if lb.HealthCheck == nil {
+			return nil, errors.New("--health-interval requires --health-check")
+		}
+		if e.healthInterval < time.Second {
+			return nil, errors.New("--health-interval must be at least 1s")
+		}
+		lb.HealthCheck.IntervalSeconds = int(e.healthInterval / time.Second)
+	}
+	if err := lb.Check(); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+// backendsDesc describes the backends of a handler with the primary
+// backend and lb, which may be nil, for status output.
+func backendsDesc(primary string, lb *ipn.LoadBalancer) string {
+	if lb == nil {
+		return primary
+	}
+	policy := cmp.Or(lb.Policy, ipn.LBRoundRobin)
+	return fmt.Sprintf("%s (%s)", strings.Join(append([]string{primary}, lb.Backends...), ", "), policy)
+}
+
 func (e *serveEnv) applyFunnel(sc *ipn.ServeConfig, dnsName string, srvPort uint16, allowFunnel bool) {
 	hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))
 
@@ -592,6 +856,11 @@ func (e *serveEnv) unsetServe(sc *ipn.ServeConfig, dnsName string, srvType serve
 		if err != nil {
 			return fmt.Errorf("failed to remove TCP serve: %w", err)
 		}
+	case serveTypeUDP:
+		if sc == nil || sc.UDP[srvPort] == nil {
+			return errors.New("error: serve config does not exist")
+		}
+		sc.RemoveUDPForwarding(srvPort)
 	default:
 		return fmt.Errorf("invalid type %q", srvType)
 	}
@@ -607,6 +876,7 @@ func srvTypeAndPortFromFlags(e *serveEnv) (srvType serveType, srvPort uint16, er
 		serveTypeHTTPS:            e.https,
 		serveTypeTCP:              e.tcp,
 		serveTypeTLSTerminatedTCP: e.tlsTerminatedTCP,
+		serveTypeUDP:              e.udp,
 	}
 
 	var srcTypeCount int
@@ -785,6 +1055,37 @@ func (e *serveEnv) removeTCPServe(sc *ipn.ServeConfig, src uint16) error {
 	return nil
 }
 
+// headerRulesFlag is a repeatable flag of HTTP header rules, in the form
+// accepted by ipn.ParseHeaderRule.
+type headerRulesFlag []ipn.HeaderRule
+
+func (f *headerRulesFlag) String() string {
+	var s []string
+	for _, r := range *f {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func (f *headerRulesFlag) Set(s string) error {
+	r, err := ipn.ParseHeaderRule(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ", ") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
 // cleanURLPath ensures the path is clean and has a leading "/".
 func cleanURLPath(urlPath string) (string, error) {
 	if urlPath == "" {
@@ -814,6 +1115,8 @@ func (s serveType) String() string {
 		return "tcp"
 	case serveTypeTLSTerminatedTCP:
 		return "tls-terminated-tcp"
+	case serveTypeUDP:
+		return "udp"
 	default:
 		return "unknownServeType"
 	}
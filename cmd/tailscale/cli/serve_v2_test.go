@@ -482,6 +482,65 @@ type group struct {
 				},
 			},
 		},
+		{
+			name: "udp",
+			steps: []step{
+				{
+					command: cmd("serve --bg --udp=53 5353"),
+					want: &ipn.ServeConfig{
+						UDP: map[uint16]*ipn.UDPPortHandler{
+							53: {UDPForward: "127.0.0.1:5353"},
+						},
+					},
+				},
+				{ // UDP and TCP ports are independent
+					command: cmd("serve --bg --tcp=53 localhost:5353"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							53: {TCPForward: "localhost:5353"},
+						},
+						UDP: map[uint16]*ipn.UDPPortHandler{
+							53: {UDPForward: "127.0.0.1:5353"},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --udp=53 --udp-idle-timeout=30s udp://localhost:5354"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							53: {TCPForward: "localhost:5353"},
+						},
+						UDP: map[uint16]*ipn.UDPPortHandler{
+							53: {UDPForward: "localhost:5354", IdleTimeoutSeconds: 30},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --udp=54 tcp://localhost:5353"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --udp=54 --set-path=/foo 5353"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --udp=54 --udp-idle-timeout=10ms 5353"),
+					wantErr: anyErr(),
+				},
+				{ // handler doesn't exist
+					command: cmd("serve --udp=54 off"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --udp=53 off"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							53: {TCPForward: "localhost:5353"},
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "text",
 			steps: []step{{
@@ -496,6 +555,180 @@ type group struct {
 				},
 			}},
 		},
+		{
+			name: "redirect_status_headers",
+			steps: []step{
+				{
+					command: cmd("serve --https=443 --bg --set-path=/old --status=301 redirect:https://example.com${REQUEST_URI}"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old": {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --https=443 --bg --set-path=/gone --status=410 text:gone"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old":  {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+								"/gone": {Text: "gone", Status: 410},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --https=443 --bg --request-header=X-User:${Tailscale-User-Login} --request-header=-Cookie --response-header=Cache-Control:no-store 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old":  {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+								"/gone": {Text: "gone", Status: 410},
+								"/": {
+									Proxy: "http://127.0.0.1:3000",
+									RequestHeaders: []ipn.HeaderRule{
+										{Name: "X-User", Value: "${Tailscale-User-Login}"},
+										{Name: "Cookie", Remove: true},
+									},
+									ResponseHeaders: []ipn.HeaderRule{
+										{Name: "Cache-Control", Value: "no-store"},
+									},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --https=443 --bg --status=404 3000"), // status of a proxy
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --https=443 --bg --status=200 redirect:/x"), // non-3xx redirect
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --https=443 --bg --request-header=Bad text:x"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --tcp=5432 --bg --response-header=X:y localhost:5432"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "allow",
+			steps: []step{
+				{
+					command: cmd("serve --https=443 --bg --set-path=/admin --allow=tag:ci,alice@example.com,cap:example.com/cap/admin 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {
+								Handlers: map[string]*ipn.HTTPHandler{
+									"/admin": {Proxy: "http://127.0.0.1:3000"},
+								},
+								Allow: map[string][]string{
+									"/admin": {"tag:ci", "alice@example.com", "cap:example.com/cap/admin"},
+								},
+							},
+						},
+					},
+				},
+				{
+					command: cmd("serve --https=443 --bg --set-path=/admin 3001"), // replacing the handler drops its rules
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {
+								Handlers: map[string]*ipn.HTTPHandler{
+									"/admin": {Proxy: "http://127.0.0.1:3001"},
+								},
+							},
+						},
+					},
+				},
+				{
+					command: cmd("serve --https=443 --bg --allow=alice 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --tcp=5432 --bg --allow=tag:ci localhost:5432"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "load_balancer",
+			steps: []step{
+				{
+					command: cmd("serve --https=443 --bg --backend=3001 --backend=localhost:3002 --lb-policy=least-conn --health-check=/healthz --health-interval=5s 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy: "http://127.0.0.1:3000",
+									LoadBalancer: &ipn.LoadBalancer{
+										Backends:    []string{"http://127.0.0.1:3001", "http://localhost:3002"},
+										Policy:      ipn.LBLeastConn,
+										HealthCheck: &ipn.HealthCheck{Path: "/healthz", IntervalSeconds: 5},
+									},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --tcp=5432 --bg --backend=5433 --health-check=tcp localhost:5431"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							443: {HTTPS: true},
+							5432: {
+								TCPForward: "localhost:5431",
+								LoadBalancer: &ipn.LoadBalancer{
+									Backends:    []string{"127.0.0.1:5433"},
+									HealthCheck: &ipn.HealthCheck{},
+								},
+							},
+						},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy: "http://127.0.0.1:3000",
+									LoadBalancer: &ipn.LoadBalancer{
+										Backends:    []string{"http://127.0.0.1:3001", "http://localhost:3002"},
+										Policy:      ipn.LBLeastConn,
+										HealthCheck: &ipn.HealthCheck{Path: "/healthz", IntervalSeconds: 5},
+									},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --https=8443 --bg --lb-policy=least-conn 3000"), // no --backend
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --https=8443 --bg --backend=3001 --lb-policy=random 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --https=8443 --bg --backend=3001 text:hi"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --tcp=5433 --bg --backend=5434 --health-check=/healthz localhost:5432"),
+					wantErr: anyErr(),
+				},
+			},
+		},
 		{
 			name: "path",
 			steps: []step{
@@ -524,6 +757,44 @@ type group struct {
 				},
 			},
 		},
+		{
+			name: "path_directory_options",
+			steps: []step{
+				{
+					command: cmd("serve --bg --https=443 --set-path=/drop --no-listing --index=home.html --allow-uploads --max-upload-mb=10 " + filepath.Join(td, "subdir")),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/drop/": {
+									Path:          filepath.Join(td, "subdir"),
+									NoListing:     true,
+									IndexFile:     "home.html",
+									AllowUploads:  true,
+									MaxUploadSize: 10 << 20,
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --https=443 --no-listing 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --https=443 --index=a/b.html " + filepath.Join(td, "subdir")),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --tcp=5432 --allow-uploads localhost:5432"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --https=443 --set-path=/drop2 --max-upload-mb=10 " + filepath.Join(td, "subdir")),
+					wantErr: anyErr(),
+				},
+			},
+		},
 		{
 			name: "bad_path",
 			steps: []step{{
@@ -5,11 +5,15 @@
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net/netip"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -61,6 +65,17 @@ type setArgsT struct {
 	snat                   bool
 	statefulFiltering      bool
 	netfilterMode          string
+	dnsOverrides           dnsOverrideEdits
+	dnsBlocklist           string
+	dnsBlocklistResponse   string
+	trafficShaping         string
+	flowCollector          string
+	taildropReceivePolicy  string
+	sshRecordingPolicy     string
+	sshUserCA              string
+	sshUserCertLifetime    string
+	newFlowsPerSecond      int
+	newFlowsBurst          int
 }
 
 func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
@@ -81,6 +96,17 @@ func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
 	setf.BoolVar(&setArgs.updateApply, "auto-update", false, "automatically update to the latest available version")
 	setf.BoolVar(&setArgs.postureChecking, "posture-checking", false, hidden+"allow management plane to gather device posture information")
 	setf.BoolVar(&setArgs.runWebClient, "webclient", false, "expose the web interface for managing this node over Tailscale at port 5252")
+	setf.Var(&setArgs.dnsOverrides, "dns-override", `add a local DNS override ("name=A:ip", "name=AAAA:ip", "name=CNAME:target", "name=TXT:text", "suffix=NXDOMAIN" or "suffix=FORWARD:resolver"), remove one ("-name" or "-name=TYPE:value"), or remove all (""); may be repeated`)
+	setf.StringVar(&setArgs.dnsBlocklist, "dns-blocklist", "", "blocklist files (comma-separated) of DNS names to refuse to resolve for exit node clients, or empty string to not block any names")
+	setf.StringVar(&setArgs.trafficShaping, "traffic-shaping", "", `space-separated rules limiting the rate of traffic to and from peers, in bits per second ("peer=RATE" or "peer=in:RATE,out:RATE", where peer is "*", a tag, IP, node ID or MagicDNS name, and RATE is like "10M"); the first matching rule for a peer applies; empty string to not shape traffic`)
+	setf.StringVar(&setArgs.dnsBlocklistResponse, "dns-blocklist-response", "", `how to answer queries for blocked names: "nxdomain" (the default) or "zero" for 0.0.0.0 and ::`)
+	setf.StringVar(&setArgs.flowCollector, "flow-collector", "", `flow collector to export network flow logs to over UDP, as "ipfix://host[:port]" or "netflow9://host[:port]", or empty string to not export flows`)
+	setf.StringVar(&setArgs.taildropReceivePolicy, "taildrop-receive-policy", "", "JSON file of the policy limiting which Taildrop files this node accepts and where it puts them, or empty string to accept any file")
+	setf.StringVar(&setArgs.sshRecordingPolicy, "ssh-recording-policy", "", "JSON file of the policy saying when Tailscale SSH sessions are recorded to local disk and how long recordings are kept, or empty string to not record sessions locally")
+	setf.StringVar(&setArgs.sshUserCA, "ssh-user-ca", "", "absolute path of the OpenSSH private key to issue Tailscale SSH user certificates with, generated if it doesn't exist, or empty string to not issue certificates")
+	setf.StringVar(&setArgs.sshUserCertLifetime, "ssh-user-cert-lifetime", "", `how long the Tailscale SSH user certificates issued with --ssh-user-ca are valid, like "10m"`)
+	setf.IntVar(&setArgs.newFlowsPerSecond, "new-flows-per-second", 0, "limit on the rate at which each peer may open new TCP connections to each port on this node or the subnets it routes, or 0 for no limit")
+	setf.IntVar(&setArgs.newFlowsBurst, "new-flows-burst", 0, "number of new TCP connections a peer may open at once before --new-flows-per-second applies, or 0 for the same as --new-flows-per-second")
 
 	ffcomplete.Flag(setf, "exit-node", func(args []string) ([]string, ffcomplete.ShellCompDirective, error) {
 		st, err := localClient.Status(context.Background())
@@ -151,11 +177,63 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 			AppConnector: ipn.AppConnectorPrefs{
 				Advertise: setArgs.advertiseConnector,
 			},
-			PostureChecking:     setArgs.postureChecking,
-			NoStatefulFiltering: opt.NewBool(!setArgs.statefulFiltering),
+			PostureChecking:      setArgs.postureChecking,
+			NoStatefulFiltering:  opt.NewBool(!setArgs.statefulFiltering),
+			DNSBlocklistResponse: setArgs.dnsBlocklistResponse,
+			FlowCollector:        setArgs.flowCollector,
+			NewFlowsPerSecond:    setArgs.newFlowsPerSecond,
+			NewFlowsBurst:        setArgs.newFlowsBurst,
 		},
 	}
 
+	if setArgs.dnsBlocklist != "" {
+		for _, f := range strings.Split(setArgs.dnsBlocklist, ",") {
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return err
+			}
+			maskedPrefs.Prefs.DNSBlocklistFiles = append(maskedPrefs.Prefs.DNSBlocklistFiles, abs)
+		}
+	}
+
+	if setArgs.taildropReceivePolicy != "" {
+		b, err := os.ReadFile(setArgs.taildropReceivePolicy)
+		if err != nil {
+			return err
+		}
+		p := new(ipn.TaildropReceivePolicy)
+		if err := json.Unmarshal(b, p); err != nil {
+			return fmt.Errorf("parsing %s: %w", setArgs.taildropReceivePolicy, err)
+		}
+		if err := p.Check(); err != nil {
+			return err
+		}
+		maskedPrefs.Prefs.TaildropReceivePolicy = p
+	}
+
+	if setArgs.sshRecordingPolicy != "" {
+		b, err := os.ReadFile(setArgs.sshRecordingPolicy)
+		if err != nil {
+			return err
+		}
+		p := new(ipn.SSHRecordingPolicy)
+		if err := json.Unmarshal(b, p); err != nil {
+			return fmt.Errorf("parsing %s: %w", setArgs.sshRecordingPolicy, err)
+		}
+		if err := p.Check(); err != nil {
+			return err
+		}
+		maskedPrefs.Prefs.SSHRecordingPolicy = p
+	}
+
+	for _, f := range strings.Fields(setArgs.trafficShaping) {
+		r, err := ipn.ParseShapeRule(f)
+		if err != nil {
+			return err
+		}
+		maskedPrefs.Prefs.TrafficShaping = append(maskedPrefs.Prefs.TrafficShaping, r)
+	}
+
 	if effectiveGOOS() == "linux" {
 		nfMode, warning, err := netfilterModeFromFlag(setArgs.netfilterMode)
 		if err != nil {
@@ -203,6 +281,20 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 		}
 	}
 
+	if maskedPrefs.DNSOverridesSet {
+		maskedPrefs.DNSOverrides, err = setArgs.dnsOverrides.apply(curPrefs.DNSOverrides)
+		if err != nil {
+			return err
+		}
+	}
+
+	if maskedPrefs.SSHUserCASet {
+		maskedPrefs.SSHUserCA, err = calcSSHUserCAForSet(setFlagSet, curPrefs, setArgs)
+		if err != nil {
+			return err
+		}
+	}
+
 	if maskedPrefs.RunSSHSet {
 		wantSSH, haveSSH := maskedPrefs.RunSSH, curPrefs.RunSSH
 		if err := presentSSHToggleRisk(wantSSH, haveSSH, setArgs.acceptedRisks); err != nil {
@@ -244,6 +336,34 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 	return nil
 }
 
+// calcSSHUserCAForSet returns the new value for Prefs.SSHUserCA, from the
+// current value and the --ssh-user-ca and --ssh-user-cert-lifetime flags
+// passed to "tailscale set".
+func calcSSHUserCAForSet(setFlagSet *flag.FlagSet, curPrefs *ipn.Prefs, setArgs setArgsT) (*ipn.SSHUserCA, error) {
+	ca := curPrefs.SSHUserCA.Clone()
+	if ca == nil {
+		ca = new(ipn.SSHUserCA)
+	}
+	setFlagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ssh-user-ca":
+			ca.KeyPath = setArgs.sshUserCA
+		case "ssh-user-cert-lifetime":
+			ca.CertLifetime = setArgs.sshUserCertLifetime
+		}
+	})
+	if ca.KeyPath == "" {
+		if setArgs.sshUserCertLifetime != "" {
+			return nil, errors.New("--ssh-user-cert-lifetime requires --ssh-user-ca")
+		}
+		return nil, nil
+	}
+	if err := ca.Check(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
 // calcAdvertiseRoutesForSet returns the new value for Prefs.AdvertiseRoutes based on the
 // current value, the flags passed to "tailscale set".
 // advertiseExitNodeSet is whether the --advertise-exit-node flag was set.
@@ -273,3 +393,71 @@ func calcAdvertiseRoutesForSet(advertiseExitNodeSet, advertiseRoutesSet bool, cu
 	}
 	return nil, nil
 }
+
+// dnsOverrideEdits is the value of the repeatable --dns-override flag to
+// "tailscale set": a list of edits to apply, in order, to the current
+// Prefs.DNSOverrides.
+type dnsOverrideEdits []string
+
+func (e *dnsOverrideEdits) String() string { return strings.Join(*e, " ") }
+
+func (e *dnsOverrideEdits) Set(v string) error {
+	if _, err := parseDNSOverrideEdit(v); err != nil {
+		return err
+	}
+	*e = append(*e, v)
+	return nil
+}
+
+// dnsOverrideEdit is a parsed --dns-override value.
+type dnsOverrideEdit struct {
+	clear  bool            // remove all overrides
+	remove bool            // remove rather than add
+	name   string          // if non-empty, remove all overrides for name
+	o      ipn.DNSOverride // otherwise, the override to add or remove
+}
+
+func parseDNSOverrideEdit(v string) (dnsOverrideEdit, error) {
+	if v == "" {
+		return dnsOverrideEdit{clear: true}, nil
+	}
+	rest, remove := strings.CutPrefix(v, "-")
+	if remove && !strings.Contains(rest, "=") {
+		return dnsOverrideEdit{remove: true, name: rest}, nil
+	}
+	o, err := ipn.ParseDNSOverride(rest)
+	return dnsOverrideEdit{remove: remove, o: o}, err
+}
+
+// apply returns the result of applying the edits in e to cur, which it
+// does not modify.
+func (e dnsOverrideEdits) apply(cur []ipn.DNSOverride) ([]ipn.DNSOverride, error) {
+	ret := slices.Clone(cur)
+	for _, v := range e {
+		ed, err := parseDNSOverrideEdit(v)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case ed.clear:
+			ret = nil
+		case ed.name != "":
+			n := len(ret)
+			ret = slices.DeleteFunc(ret, func(o ipn.DNSOverride) bool {
+				return strings.EqualFold(strings.TrimSuffix(o.Name, "."), strings.TrimSuffix(ed.name, "."))
+			})
+			if len(ret) == n {
+				return nil, fmt.Errorf("no DNS overrides for %q", ed.name)
+			}
+		case ed.remove:
+			i := slices.Index(ret, ed.o)
+			if i < 0 {
+				return nil, fmt.Errorf("no DNS override %q", ed.o)
+			}
+			ret = slices.Delete(ret, i, i+1)
+		case !slices.Contains(ret, ed.o):
+			ret = append(ret, ed.o)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/sessionrecording"
+)
+
+var sshRecordingsCmd = &ffcli.Command{
+	Name:       "ssh-recordings",
+	ShortUsage: "tailscale ssh-recordings <list|play|export> ...",
+	ShortHelp:  "Review Tailscale SSH sessions recorded to this machine's disk",
+	LongHelp: strings.TrimSpace(`
+Tailscale SSH sessions are recorded to the local disk of the machine serving
+them if the policy set with "tailscale set --ssh-recording-policy" asks for it.
+The recordings are in asciicast v2 format, and are kept under tailscaled's
+state directory.
+
+These commands list, replay and export the recordings, without needing a
+separate recorder.
+`),
+	Subcommands: []*ffcli.Command{
+		sshRecordingsListCmd,
+		sshRecordingsPlayCmd,
+		sshRecordingsExportCmd,
+	},
+}
+
+var sshRecordingsListCmd = &ffcli.Command{
+	Name:       "list",
+	ShortUsage: "tailscale ssh-recordings list [--json]",
+	ShortHelp:  "List the recorded SSH sessions",
+	Exec:       runSSHRecordingsList,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("list")
+		fs.BoolVar(&sshRecordingsArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var sshRecordingsPlayCmd = &ffcli.Command{
+	Name:       "play",
+	ShortUsage: "tailscale ssh-recordings play [--speed=<n>] [--max-idle=<duration>] <id|file.cast>",
+	ShortHelp:  "Replay a recorded SSH session in the terminal",
+	LongHelp: strings.TrimSpace(`
+Replays the output of a recorded SSH session, at the pace it was recorded.
+The argument is an ID from "tailscale ssh-recordings list", or the path of
+an exported recording.
+`),
+	Exec: runSSHRecordingsPlay,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("play")
+		fs.Float64Var(&sshRecordingsArgs.speed, "speed", 1, "playback speed multiplier")
+		fs.DurationVar(&sshRecordingsArgs.maxIdle, "max-idle", 2*time.Second, "longest pause to replay; 0 for no limit")
+		return fs
+	})(),
+}
+
+var sshRecordingsExportCmd = &ffcli.Command{
+	Name:       "export",
+	ShortUsage: "tailscale ssh-recordings export [-o <file>] <id>",
+	ShortHelp:  "Write a recorded SSH session in asciicast v2 format",
+	Exec:       runSSHRecordingsExport,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("export")
+		fs.StringVar(&sshRecordingsArgs.out, "o", "", "file to write the recording to, instead of stdout")
+		return fs
+	})(),
+}
+
+var sshRecordingsArgs struct {
+	json    bool
+	speed   float64
+	maxIdle time.Duration
+	out     string
+}
+
+func runSSHRecordingsList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: tailscale ssh-recordings list [--json]")
+	}
+	recs, err := localClient.SSHRecordings(ctx)
+	if err != nil {
+		return err
+	}
+	if sshRecordingsArgs.json {
+		ec := json.NewEncoder(Stdout)
+		ec.SetIndent("", "  ")
+		return ec.Encode(recs)
+	}
+	if len(recs) == 0 {
+		printf("No SSH sessions have been recorded locally.\n")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(Stdout, 10, 5, 3, ' ', 0)
+	fmt.Fprintf(w, "ID\tSTART\tDURATION\tFROM\tUSER\tCOMMAND\tSIZE\n")
+	for _, r := range recs {
+		from := r.SrcNode
+		if r.SrcNodeUser != "" {
+			from += " (" + r.SrcNodeUser + ")"
+		} else if len(r.SrcNodeTags) > 0 {
+			from += " (" + strings.Join(r.SrcNodeTags, ",") + ")"
+		}
+		user := r.SSHUser
+		if r.LocalUser != "" && r.LocalUser != r.SSHUser {
+			user += " as " + r.LocalUser
+		}
+		cmd := r.Command
+		if cmd == "" {
+			cmd = "(shell)"
+		}
+		if r.Part > 1 {
+			cmd += fmt.Sprintf(" [part %d]", r.Part)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\t%s\n",
+			r.ID, r.Start.Local().Format(time.DateTime), r.Duration.Round(time.Second),
+			from, user, cmd, formatIEC(float64(r.Size), "B"))
+	}
+	return w.Flush()
+}
+
+func runSSHRecordingsPlay(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale ssh-recordings play [--speed=<n>] [--max-idle=<duration>] <id|file.cast>")
+	}
+	var rc io.ReadCloser
+	if strings.HasSuffix(args[0], ".cast") {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		rc = f
+	} else {
+		var err error
+		rc, err = localClient.SSHRecording(ctx, args[0])
+		if err != nil {
+			return err
+		}
+	}
+	defer rc.Close()
+	return sessionrecording.Play(Stdout, rc, sshRecordingsArgs.speed, sshRecordingsArgs.maxIdle)
+}
+
+func runSSHRecordingsExport(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale ssh-recordings export [-o <file>] <id>")
+	}
+	rc, err := localClient.SSHRecording(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if sshRecordingsArgs.out == "" {
+		_, err := io.Copy(Stdout, rc)
+		return err
+	}
+	f, err := os.OpenFile(sshRecordingsArgs.out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
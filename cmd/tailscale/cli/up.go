@@ -766,6 +766,17 @@ func init() {
 	addPrefFlagMapping("auto-update", "AutoUpdate.Apply")
 	addPrefFlagMapping("advertise-connector", "AppConnector")
 	addPrefFlagMapping("posture-checking", "PostureChecking")
+	addPrefFlagMapping("dns-override", "DNSOverrides")
+	addPrefFlagMapping("dns-blocklist", "DNSBlocklistFiles")
+	addPrefFlagMapping("dns-blocklist-response", "DNSBlocklistResponse")
+	addPrefFlagMapping("traffic-shaping", "TrafficShaping")
+	addPrefFlagMapping("flow-collector", "FlowCollector")
+	addPrefFlagMapping("taildrop-receive-policy", "TaildropReceivePolicy")
+	addPrefFlagMapping("ssh-recording-policy", "SSHRecordingPolicy")
+	addPrefFlagMapping("ssh-user-ca", "SSHUserCA")
+	addPrefFlagMapping("ssh-user-cert-lifetime", "SSHUserCA")
+	addPrefFlagMapping("new-flows-per-second", "NewFlowsPerSecond")
+	addPrefFlagMapping("new-flows-burst", "NewFlowsBurst")
 }
 
 func addPrefFlagMapping(flagName string, prefNames ...string) {
@@ -33,6 +33,7 @@
 	"tailscale.com/client/tailscale"
 	"tailscale.com/cmd/tailscaled/childproc"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/drive"
 	"tailscale.com/drive/driveimpl"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
@@ -412,7 +413,11 @@ func run() (err error) {
 		debugMux = newDebugMux()
 	}
 
-	sys.Set(driveimpl.NewFileSystemForRemote(logf))
+	fsr := driveimpl.NewFileSystemForRemote(logf)
+	if varRoot := ipnServerOpts().VarRoot; varRoot != "" {
+		fsr.SetSnapshotDir(filepath.Join(varRoot, "drive-snapshots"))
+	}
+	sys.Set(fsr)
 
 	return startIPNServer(context.Background(), logf, pol.PublicID, sys)
 }
@@ -865,7 +870,26 @@ func beChild(args []string) error {
 //
 // serveDrive prints the address on which it's listening to stdout so that the
 // parent process knows where to connect to.
+//
+// Shares named in --snapshot flags serve a snapshot of their directory, which
+// serveDrive takes before it starts serving.
 func serveDrive(args []string) error {
+	type snapshot struct {
+		dir  string
+		mode drive.SnapshotMode
+		at   time.Time
+	}
+	snapshots := make(map[string]snapshot)
+	fs := flag.NewFlagSet("serve-taildrive", flag.ContinueOnError)
+	fs.Func("snapshot", "`name=mode@unixnano@dir` of a share to snapshot into dir", func(v string) error {
+		name, dir, mode, at, err := driveimpl.ParseSnapshotFlag(v)
+		snapshots[name] = snapshot{dir, mode, at}
+		return err
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
 	if len(args) == 0 {
 		return errors.New("missing shares")
 	}
@@ -878,7 +902,14 @@ func serveDrive(args []string) error {
 	}
 	shares := make(map[string]string)
 	for i := 0; i < len(args); i += 2 {
-		shares[args[i]] = args[i+1]
+		name, path := args[i], args[i+1]
+		if snap, ok := snapshots[name]; ok {
+			path, err = driveimpl.TakeSnapshot(path, snap.dir, snap.mode, snap.at)
+			if err != nil {
+				return fmt.Errorf("share %q: %w", name, err)
+			}
+		}
+		shares[name] = path
 	}
 	s.SetShares(shares)
 	fmt.Printf("%v\n", s.Addr())
@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package drive
+
+import "time"
+
+// The change feed of a shared directory is read with a GET request for the
+// directory with the query parameter "changes", like
+//
+//	GET /<tailnet>/<machine>/<share>/some/dir?changes&cursor=<cursor>&wait=30
+//
+// The response is a JSON Changes listing what changed in the directory and
+// its subdirectories since cursor. If nothing has changed, the request waits
+// up to wait seconds (at most MaxChangesWait) for something to change.
+const (
+	ChangesQuery   = "changes"
+	MaxChangesWait = 60 * time.Second
+)
+
+// Changes is a response from the change feed of a shared directory.
+type Changes struct {
+	// Cursor is passed in the next request to get the changes after this
+	// response.
+	Cursor string `json:"cursor"`
+
+	// Reset is set if the changes since the requested cursor are unknown,
+	// such as when no cursor was given, the cursor is too old, or the
+	// node serving the share restarted. The client must then assume that
+	// anything in the directory may have changed.
+	Reset bool `json:"reset,omitempty"`
+
+	// Paths are the files and directories that were created, modified or
+	// removed, relative to the requested directory and separated by
+	// slashes. A changed directory may have had anything in it change.
+	Paths []string `json:"paths,omitempty"`
+}
@@ -5,6 +5,10 @@
 
 package drive
 
+import (
+	"time"
+)
+
 // Clone makes a deep copy of Share.
 // The result aliases no memory with the original.
 func (src *Share) Clone() *Share {
@@ -23,6 +27,10 @@ func (src *Share) Clone() *Share {
 	Path         string
 	As           string
 	BookmarkData []byte
+	MaxBytes     int64
+	MaxFiles     int64
+	Snapshot     SnapshotMode
+	SnapshotAt   time.Time
 }{})
 
 // Clone duplicates src into dst and reports whether it succeeded.
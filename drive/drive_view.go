@@ -8,6 +8,7 @@
 import (
 	"encoding/json"
 	"errors"
+	"time"
 
 	"tailscale.com/types/views"
 )
@@ -65,6 +66,10 @@ func (v ShareView) As() string   { return v.ж.As }
 func (v ShareView) BookmarkData() views.ByteSlice[[]byte] {
 	return views.ByteSliceOf(v.ж.BookmarkData)
 }
+func (v ShareView) MaxBytes() int64        { return v.ж.MaxBytes }
+func (v ShareView) MaxFiles() int64        { return v.ж.MaxFiles }
+func (v ShareView) Snapshot() SnapshotMode { return v.ж.Snapshot }
+func (v ShareView) SnapshotAt() time.Time  { return v.ж.SnapshotAt }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ShareViewNeedsRegeneration = Share(struct {
@@ -72,4 +77,8 @@ func (v ShareView) BookmarkData() views.ByteSlice[[]byte] {
 	Path         string
 	As           string
 	BookmarkData []byte
+	MaxBytes     int64
+	MaxFiles     int64
+	Snapshot     SnapshotMode
+	SnapshotAt   time.Time
 }{})
@@ -0,0 +1,332 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"tailscale.com/drive"
+)
+
+// maxChanges is the number of changes a changeFeed remembers. Clients that
+// fall further behind are told to reset.
+const maxChanges = 10000
+
+// maxWatches is the most watches a changeFeed adds before it falls back to
+// polling its directory, to avoid running out of file descriptors or
+// inotify watches on large shares.
+var maxWatches = 4096
+
+// pollInterval is how often a changeFeed that fell back to polling scans its
+// directory for changes.
+var pollInterval = 10 * time.Second
+
+// kqueueWatchesFiles reports whether fsnotify uses kqueue, which opens a file
+// descriptor for each file in a watched directory, not just for the
+// directory.
+var kqueueWatchesFiles = runtime.GOOS == "darwin" || runtime.GOOS == "dragonfly" ||
+	runtime.GOOS == "freebsd" || runtime.GOOS == "netbsd" || runtime.GOOS == "openbsd"
+
+var errTooManyWatches = errors.New("too many files to watch")
+
+// changeFeed watches a shared directory and its subdirectories, and remembers
+// the paths that recently changed in them. If there are too many of them to
+// watch, it polls the directory instead.
+type changeFeed struct {
+	dir   string
+	epoch string // identifies this feed in cursors
+	w     *fsnotify.Watcher
+	done  chan struct{} // closed by Close
+
+	closeOnce sync.Once
+
+	// watches is roughly the number of watches in w, counting each file
+	// in a watched directory where kqueueWatchesFiles. It's only used
+	// before run starts, and then by run.
+	watches int
+
+	mu      sync.Mutex
+	seq     int64    // sequence number of the last change
+	oldest  int64    // sequence number of the oldest remembered change
+	changes []string // the remembered changed paths, oldest first
+	wake    chan struct{}
+}
+
+func newChangeFeed(dir string) (*changeFeed, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	f := &changeFeed{
+		dir:    dir,
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		w:      w,
+		done:   make(chan struct{}),
+		oldest: 1,
+		wake:   make(chan struct{}),
+	}
+	switch err := f.watchTree(dir); {
+	case errors.Is(err, errTooManyWatches):
+		w.Close()
+		log.Printf("taildrive: too many files to watch in %s, polling it instead", dir)
+		prev, err := scanTree(dir)
+		if err != nil {
+			return nil, err
+		}
+		go f.pollTree(prev)
+	case err != nil:
+		w.Close()
+		return nil, err
+	default:
+		go f.run()
+	}
+	return f, nil
+}
+
+// watchTree watches dir and all of its subdirectories. It returns an error
+// wrapping errTooManyWatches if that would make more than maxWatches.
+func (f *changeFeed) watchTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if p != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil // removed since it was listed
+			}
+			return err
+		}
+		if !de.IsDir() && !kqueueWatchesFiles {
+			return nil
+		}
+		if f.watches++; f.watches > maxWatches {
+			return errTooManyWatches
+		}
+		if !de.IsDir() {
+			return nil
+		}
+		err = f.w.Add(p)
+		if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENOSPC) {
+			return fmt.Errorf("%w: %w", errTooManyWatches, err)
+		}
+		return err
+	})
+}
+
+func (f *changeFeed) run() {
+	for {
+		select {
+		case ev, ok := <-f.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Create) {
+				// Watch new directories. Files created in them before
+				// the watch is added are covered by the directory itself
+				// being reported as changed.
+				err := f.watchTree(ev.Name)
+				if errors.Is(err, errTooManyWatches) {
+					log.Printf("taildrive: too many files to watch in %s, polling it instead", f.dir)
+					f.w.Close()
+					prev, err := scanTree(f.dir)
+					if err != nil {
+						log.Printf("taildrive: scanning %s: %v", f.dir, err)
+					}
+					f.lostChanges()
+					go f.pollTree(prev)
+					return
+				}
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					log.Printf("taildrive: watching %s: %v", ev.Name, err)
+				}
+			}
+			if (ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename)) && kqueueWatchesFiles && f.watches > 0 {
+				f.watches--
+			}
+			if rel, err := filepath.Rel(f.dir, ev.Name); err == nil && rel != "." {
+				f.record(filepath.ToSlash(rel))
+			}
+		case err, ok := <-f.w.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				f.lostChanges()
+			} else {
+				log.Printf("taildrive: watching %s: %v", f.dir, err)
+			}
+		}
+	}
+}
+
+// fileState is what pollTree compares to find changed files.
+type fileState struct {
+	dir     bool
+	size    int64
+	modTime int64 // unix nanos
+}
+
+// pollTree records the changes to f.dir found by scanning it every
+// pollInterval, until f is closed. prev is the state of f.dir from an
+// earlier scanTree.
+func (f *changeFeed) pollTree(prev map[string]fileState) {
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-t.C:
+		}
+		cur, err := scanTree(f.dir)
+		if err != nil {
+			log.Printf("taildrive: scanning %s: %v", f.dir, err)
+			continue
+		}
+		for p, st := range cur {
+			if old, ok := prev[p]; !ok || old != st {
+				f.record(p)
+			}
+		}
+		for p := range prev {
+			if _, ok := cur[p]; !ok {
+				f.record(p)
+			}
+		}
+		prev = cur
+	}
+}
+
+// scanTree returns the state of the files and directories in dir, by their
+// slash-separated paths relative to dir.
+func scanTree(dir string) (map[string]fileState, error) {
+	m := make(map[string]fileState)
+	err := filepath.WalkDir(dir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if p != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil // removed since it was listed
+			}
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return nil // removed since it was listed
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		m[filepath.ToSlash(rel)] = fileState{
+			dir:     de.IsDir(),
+			size:    fi.Size(),
+			modTime: fi.ModTime().UnixNano(),
+		}
+		return nil
+	})
+	return m, err
+}
+
+// record records a change to the path p, relative to f.dir.
+func (f *changeFeed) record(p string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	f.changes = append(f.changes, p)
+	if n := len(f.changes) - maxChanges; n > 0 {
+		f.changes = slices.Delete(f.changes, 0, n)
+		f.oldest += int64(n)
+	}
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// lostChanges makes clients reset, because some changes were missed.
+func (f *changeFeed) lostChanges() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	f.changes = nil
+	f.oldest = f.seq + 1
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// poll returns the changes in the subdirectory sub of f.dir since cursor.
+// If there are none, it waits up to wait for some.
+func (f *changeFeed) poll(ctx context.Context, sub, cursor string, wait time.Duration) drive.Changes {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	since, ok := f.parseCursor(cursor)
+	for {
+		f.mu.Lock()
+		seq, wake := f.seq, f.wake
+		if !ok || since < f.oldest-1 || since > seq {
+			f.mu.Unlock()
+			return drive.Changes{Cursor: f.cursor(seq), Reset: true}
+		}
+		var paths []string
+		for _, p := range f.changes[since-f.oldest+1:] {
+			if rel, ok := relativeTo(p, sub); ok && !slices.Contains(paths, rel) {
+				paths = append(paths, rel)
+			}
+		}
+		f.mu.Unlock()
+
+		if len(paths) > 0 {
+			return drive.Changes{Cursor: f.cursor(seq), Paths: paths}
+		}
+		since = seq
+		select {
+		case <-wake:
+		case <-timer.C:
+			return drive.Changes{Cursor: f.cursor(seq)}
+		case <-ctx.Done():
+			return drive.Changes{Cursor: f.cursor(seq)}
+		}
+	}
+}
+
+func (f *changeFeed) cursor(seq int64) string {
+	return fmt.Sprintf("%s.%d", f.epoch, seq)
+}
+
+// parseCursor returns the sequence number in cursor, and reports whether
+// cursor is one of f's.
+func (f *changeFeed) parseCursor(cursor string) (int64, bool) {
+	epoch, s, ok := strings.Cut(cursor, ".")
+	if !ok || epoch != f.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(s, 10, 64)
+	return seq, err == nil
+}
+
+func (f *changeFeed) Close() error {
+	f.closeOnce.Do(func() { close(f.done) })
+	return f.w.Close()
+}
+
+// relativeTo returns the slash-separated path p relative to the directory
+// dir, and reports whether p is in dir. The empty dir is the root.
+func relativeTo(p, dir string) (string, bool) {
+	if dir == "" {
+		return p, true
+	}
+	rel, ok := strings.CutPrefix(p, dir+"/")
+	return rel, ok
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+)
+
+func TestChangeFeedPolling(t *testing.T) {
+	tstest.Replace(t, &maxWatches, 1)
+	tstest.Replace(t, &pollInterval, 10*time.Millisecond)
+
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := newChangeFeed(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cursor := f.poll(context.Background(), "", "", 0).Cursor
+	if err := os.WriteFile(filepath.Join(dir, "b", "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		ch := f.poll(context.Background(), "b", cursor, 5*time.Second)
+		if ch.Reset {
+			t.Fatalf("got reset, want changes")
+		}
+		if slices.Contains(ch.Paths, "new.txt") {
+			return
+		}
+		cursor = ch.Cursor
+	}
+	t.Fatal("change to b/new.txt not found by polling")
+}
@@ -184,6 +184,9 @@ func (h *Handler) delegate(mpl int, pathComponents []string, w http.ResponseWrit
 		return
 	}
 	u.Path = path.Join(u.Path, shared.Join(pathComponents[1:]...))
+	// Keep the query, which is used by the change feed (see
+	// drive.ChangesQuery).
+	u.RawQuery = r.URL.RawQuery
 	r.URL = u
 	r.Host = u.Host
 	child.rp.ServeHTTP(w, r)
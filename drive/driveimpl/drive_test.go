@@ -4,6 +4,8 @@
 package driveimpl
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -26,6 +28,7 @@
 	"github.com/studio-b12/gowebdav"
 	"tailscale.com/drive"
 	"tailscale.com/drive/driveimpl/shared"
+	"tailscale.com/drive/drivesync"
 	"tailscale.com/tstest"
 )
 
@@ -133,6 +136,136 @@ func TestPermissions(t *testing.T) {
 	}
 }
 
+func TestQuotas(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.setShareOptions(remote1, share11, drive.Share{MaxBytes: 10, MaxFiles: 2})
+
+	s.writeFile("writing file within quotas should succeed", remote1, share11, "a", "hello", true)
+	s.writeFile("writing file over byte quota should fail", remote1, share11, "b", "hello world", false)
+	s.writeFile("replacing file within byte quota should succeed", remote1, share11, "a", "hello worl", true)
+	s.writeFile("writing file over byte quota should fail", remote1, share11, "b", "x", false)
+	if err := s.client.Mkdir(pathTo(remote1, share11, "dir"), 0755); err != nil {
+		t.Errorf("making directory should succeed, but got %v", err)
+	}
+
+	s.setShareOptions(remote1, share11, drive.Share{MaxFiles: 2})
+	s.writeFile("writing second file should succeed", remote1, share11, "dir/b", "x", true)
+	s.writeFile("writing file over file quota should fail", remote1, share11, "c", "x", false)
+	if err := s.client.Copy(pathTo(remote1, share11, "a"), pathTo(remote1, share11, "c"), false); err == nil {
+		t.Error("copying file over file quota should fail")
+	}
+	if err := s.client.Copy(pathTo(remote1, share11, "dir/b"), pathTo(remote1, share11, "a"), true); err != nil {
+		t.Errorf("copying over existing file should succeed, but got %v", err)
+	}
+	if err := s.client.Remove(pathTo(remote1, share11, "a")); err != nil {
+		t.Errorf("deleting file should succeed, but got %v", err)
+	}
+	s.writeFile("writing file after deleting one should succeed", remote1, share11, "c", "x", true)
+	s.renameFile("moving file within share should succeed", remote1, share11, "c", share11, "dir/c", true)
+	s.writeFile("writing file after moving one should fail", remote1, share11, "d", "x", false)
+}
+
+func TestSnapshotShare(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadWrite)
+	s.write(remote1, share11, file111, "hello world")
+	s.setShareOptions(remote1, share11, drive.Share{Snapshot: drive.SnapshotCopy})
+
+	s.checkFileContents(remote1, share11, file111)
+	s.writeFile("writing file to snapshot share should fail", remote1, share11, file112, "hello world", false)
+	if err := s.client.Remove(pathTo(remote1, share11, file111)); err == nil {
+		t.Error("deleting file from snapshot share should fail")
+	}
+}
+
+func TestSync(t *testing.T) {
+	s := newSystem(t)
+
+	s.addRemote(remote1)
+	s.addShare(remote1, share11, drive.PermissionReadOnly)
+	s.write(remote1, share11, file111, "hello world")
+	if err := os.Mkdir(filepath.Join(s.remotes[remote1].shares[share11], "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.write(remote1, share11, "sub/"+file112, "in sub")
+
+	dir := t.TempDir()
+	m := &drivesync.Mirror{
+		URL:    fmt.Sprintf("http://%s%s", s.local.l.Addr(), shared.JoinEscaped(domain, remote1, share11)),
+		Dir:    dir,
+		Client: &http.Client{Transport: &http.Transport{DisableKeepAlives: true}},
+		Logf:   t.Logf,
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stale"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkMirror := func(want map[string]string) {
+		t.Helper()
+		var got map[string]string
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+			got = make(map[string]string)
+			filepath.WalkDir(dir, func(p string, de fs.DirEntry, err error) error {
+				if err == nil && de.Type().IsRegular() && de.Name() != drivesync.MarkerFile {
+					b, _ := os.ReadFile(p)
+					rel, _ := filepath.Rel(dir, p)
+					got[filepath.ToSlash(rel)] = string(b)
+				}
+				return nil
+			})
+			if cmp.Equal(got, want) {
+				return
+			}
+		}
+		t.Fatalf("mirror has %q, want %q", got, want)
+	}
+
+	if err := m.Sync(context.Background()); !errors.Is(err, drivesync.ErrNotMirror) {
+		t.Fatalf("syncing into non-empty directory got %v, want ErrNotMirror", err)
+	}
+	checkMirror(map[string]string{"stale": ""})
+	m.Delete = true
+	if err := m.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkMirror(map[string]string{file111: "hello world", "sub/" + file112: "in sub"})
+	m.Delete = false // the directory is now marked as a mirror
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Wait for Run to start following the change feed, then change the
+	// share.
+	time.Sleep(500 * time.Millisecond)
+	s.write(remote1, share11, "sub/new.txt", "new")
+	if err := os.Remove(filepath.Join(s.remotes[remote1].shares[share11], file111)); err != nil {
+		t.Fatal(err)
+	}
+	checkMirror(map[string]string{"sub/" + file112: "in sub", "sub/new.txt": "new"})
+
+	// A change that keeps the size and modification time, which WebDAV
+	// only has to the second, is copied too.
+	p := filepath.Join(s.remotes[remote1].shares[share11], "sub", file112)
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.write(remote1, share11, "sub/"+file112, "IN SUB")
+	if err := os.Chtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	checkMirror(map[string]string{"sub/" + file112: "IN SUB", "sub/new.txt": "new"})
+}
+
 // TestSecretTokenAuth verifies that the fileserver running at localhost cannot
 // be accessed directly without the correct secret token. This matters because
 // if a victim can be induced to visit the localhost URL and access a malicious
@@ -372,6 +505,7 @@ type remote struct {
 	fs          *FileSystemForRemote
 	fileServer  *FileServer
 	shares      map[string]string
+	options     map[string]drive.Share
 	permissions map[string]drive.Permission
 	mu          sync.RWMutex
 }
@@ -449,6 +583,7 @@ func (s *system) addRemote(name string) string {
 		fileServer:  fileServer,
 		fs:          NewFileSystemForRemote(log.Printf),
 		shares:      make(map[string]string),
+		options:     make(map[string]drive.Share),
 		permissions: make(map[string]drive.Permission),
 	}
 	r.fs.SetFileServerAddr(fileServer.Addr())
@@ -482,12 +617,30 @@ func (s *system) addShare(remoteName, shareName string, permission drive.Permiss
 	f := s.t.TempDir()
 	r.shares[shareName] = f
 	r.permissions[shareName] = permission
+	r.setShares()
+}
+
+// setShareOptions sets the quotas and snapshot mode of a share, leaving the
+// rest of opts unused.
+func (s *system) setShareOptions(remoteName, shareName string, opts drive.Share) {
+	r, ok := s.remotes[remoteName]
+	if !ok {
+		s.t.Fatalf("unknown remote %q", remoteName)
+	}
+	r.options[shareName] = opts
+	r.setShares()
+}
 
+func (r *remote) setShares() {
 	shares := make([]*drive.Share, 0, len(r.shares))
 	for shareName, folder := range r.shares {
+		opts := r.options[shareName]
 		shares = append(shares, &drive.Share{
-			Name: shareName,
-			Path: folder,
+			Name:     shareName,
+			Path:     folder,
+			MaxBytes: opts.MaxBytes,
+			MaxFiles: opts.MaxFiles,
+			Snapshot: opts.Snapshot,
 		})
 	}
 	slices.SortFunc(shares, drive.CompareShares)
@@ -680,7 +833,7 @@ func pathTo(remote, share, name string) string {
 type noopAuthorizer struct{}
 
 func (a *noopAuthorizer) NewAuthenticator(body io.Reader) (gowebdav.Authenticator, io.Reader) {
-	return &noopAuthenticator{}, nil
+	return &noopAuthenticator{}, body
 }
 
 func (a *noopAuthorizer) AddAuthenticator(key string, fn gowebdav.AuthFactory) {
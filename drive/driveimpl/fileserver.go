@@ -7,12 +7,19 @@
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/tailscale/xnet/webdav"
+	"tailscale.com/drive"
 	"tailscale.com/drive/driveimpl/shared"
 )
 
@@ -23,7 +30,13 @@ type FileServer struct {
 	l             net.Listener
 	secretToken   string
 	shareHandlers map[string]http.Handler
+	sharePaths    map[string]string
 	sharesMu      sync.RWMutex
+
+	// feedsMu guards feeds, which maps the paths of shared directories to
+	// their change feeds. Feeds are started on first use.
+	feedsMu sync.Mutex
+	feeds   map[string]*changeFeed
 }
 
 // NewFileServer constructs a FileServer.
@@ -58,6 +71,8 @@ func NewFileServer() (*FileServer, error) {
 		l:             l,
 		secretToken:   secretToken,
 		shareHandlers: make(map[string]http.Handler),
+		sharePaths:    make(map[string]string),
+		feeds:         make(map[string]*changeFeed),
 	}, nil
 }
 
@@ -87,8 +102,21 @@ func (s *FileServer) LockShares() {
 	s.sharesMu.Lock()
 }
 
-// UnlockShares unlocks the map of shares.
+// UnlockShares unlocks the map of shares. It stops the change feeds of
+// directories that are no longer shared.
 func (s *FileServer) UnlockShares() {
+	inUse := make(map[string]bool, len(s.sharePaths))
+	for _, path := range s.sharePaths {
+		inUse[path] = true
+	}
+	s.feedsMu.Lock()
+	for path, f := range s.feeds {
+		if !inUse[path] {
+			f.Close()
+			delete(s.feeds, path)
+		}
+	}
+	s.feedsMu.Unlock()
 	s.sharesMu.Unlock()
 }
 
@@ -96,6 +124,7 @@ func (s *FileServer) UnlockShares() {
 // been called first.
 func (s *FileServer) ClearSharesLocked() {
 	s.shareHandlers = make(map[string]http.Handler)
+	s.sharePaths = make(map[string]string)
 }
 
 // AddShareLocked adds a share to the map of shares, assuming that LockShares()
@@ -105,6 +134,7 @@ func (s *FileServer) AddShareLocked(share, path string) {
 		FileSystem: &birthTimingFS{webdav.Dir(path)},
 		LockSystem: webdav.NewMemLS(),
 	}
+	s.sharePaths[share] = path
 }
 
 // SetShares sets the full map of shares to the new value, mapping name->path.
@@ -146,17 +176,65 @@ func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	share := parts[1]
 	s.sharesMu.RLock()
 	h, found := s.shareHandlers[share]
+	sharePath := s.sharePaths[share]
 	s.sharesMu.RUnlock()
 	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if r.Method == "GET" && r.URL.Query().Has(drive.ChangesQuery) {
+		s.serveChanges(w, r, sharePath)
+		return
+	}
 	// WebDAV's locking code compares the lock resources with the request's
 	// host header, set this to empty to avoid mismatches.
 	r.Host = ""
 	h.ServeHTTP(w, r)
 }
 
+// serveChanges serves the change feed of the directory at r.URL.Path in the
+// share at sharePath. See drive.ChangesQuery.
+func (s *FileServer) serveChanges(w http.ResponseWriter, r *http.Request, sharePath string) {
+	sub := strings.Trim(r.URL.Path, "/")
+	if fi, err := os.Stat(filepath.Join(sharePath, filepath.FromSlash(sub))); err != nil || !fi.IsDir() {
+		http.Error(w, "not a directory", http.StatusNotFound)
+		return
+	}
+	wait := time.Duration(0)
+	if v := r.URL.Query().Get("wait"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(secs)*time.Second, drive.MaxChangesWait)
+	}
+
+	s.feedsMu.Lock()
+	f, ok := s.feeds[sharePath]
+	if !ok {
+		var err error
+		f, err = newChangeFeed(sharePath)
+		if err != nil {
+			s.feedsMu.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.feeds[sharePath] = f
+	}
+	s.feedsMu.Unlock()
+
+	changes := f.poll(r.Context(), sub, r.URL.Query().Get("cursor"), wait)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
 func (s *FileServer) Close() error {
+	s.feedsMu.Lock()
+	for path, f := range s.feeds {
+		f.Close()
+		delete(s.feeds, path)
+	}
+	s.feedsMu.Unlock()
 	return s.l.Close()
 }
@@ -0,0 +1,299 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/drive"
+	"tailscale.com/drive/driveimpl/compositedav"
+	"tailscale.com/drive/driveimpl/shared"
+	"tailscale.com/util/mak"
+)
+
+var (
+	errQuotaExceeded  = errors.New("share quota exceeded")
+	errLengthRequired = errors.New("share has a byte quota, uploads need a Content-Length")
+)
+
+// usagePropfind is the body of the PROPFIND request used to find a share's
+// usage.
+const usagePropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/></D:prop></D:propfind>`
+
+// multistatus is the part of a PROPFIND response needed to find a share's
+// usage.
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// quotaUsageMaxAge is how long the usage of a share is kept up to date from
+// the writes made through Taildrive, before it's found again to notice
+// changes made to the share's directory by other means.
+const quotaUsageMaxAge = time.Minute
+
+// shareUsage is how much of its quotas a share uses.
+type shareUsage struct {
+	found time.Time // when the usage was found with a PROPFIND
+	bytes int64
+	files int64
+	// sizes maps the paths of the share's files, relative to the share and
+	// without leading or trailing slashes, to their sizes. Directories
+	// map to -1.
+	sizes map[string]int64
+}
+
+// isUnder reports whether name is p or inside the directory p, relative to
+// the share.
+func isUnder(name, p string) bool {
+	return p == "" || name == p || strings.HasPrefix(name, p+"/")
+}
+
+// under returns the bytes and files used by the file or directory p, relative
+// to the share.
+func (u *shareUsage) under(p string) (bytes, files int64) {
+	if p == "" {
+		return u.bytes, u.files
+	}
+	for name, size := range u.sizes {
+		if size >= 0 && isUnder(name, p) {
+			bytes += size
+			files++
+		}
+	}
+	return bytes, files
+}
+
+// set records that the file p has size bytes, or that it's a directory if
+// size is -1.
+func (u *shareUsage) set(p string, size int64) {
+	if old, ok := u.sizes[p]; ok && old >= 0 {
+		u.bytes -= old
+		u.files--
+	}
+	u.sizes[p] = size
+	if size >= 0 {
+		u.bytes += size
+		u.files++
+	}
+}
+
+// remove records that the file or directory p was removed.
+func (u *shareUsage) remove(p string) {
+	for name, size := range u.sizes {
+		if isUnder(name, p) {
+			delete(u.sizes, name)
+			if size >= 0 {
+				u.bytes -= size
+				u.files--
+			}
+		}
+	}
+}
+
+// copy records that the file or directory src was copied to dst, which it
+// replaced.
+func (u *shareUsage) copy(src, dst string) {
+	copied := make(map[string]int64)
+	for name, size := range u.sizes {
+		if isUnder(name, src) {
+			copied[dst+strings.TrimPrefix(name, src)] = size
+		}
+	}
+	u.remove(dst)
+	for name, size := range copied {
+		u.set(name, size)
+	}
+}
+
+// getShareUsage finds the usage of the share served by child, by listing
+// all of its files with a PROPFIND request.
+func getShareUsage(ctx context.Context, child *compositedav.Child) (*shareUsage, error) {
+	baseURL, err := child.BaseURL()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", baseURL+"/", strings.NewReader(usagePropfind))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "infinity")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := (&http.Client{Transport: child.Transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND: unexpected status %v", resp.Status)
+	}
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND: %w", err)
+	}
+
+	u := &shareUsage{found: time.Now(), sizes: make(map[string]int64, len(ms.Responses))}
+	for _, r := range ms.Responses {
+		name, err := url.PathUnescape(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("PROPFIND: bad href %q", r.Href)
+		}
+		name = strings.Trim(name, "/")
+		if name == "" {
+			continue
+		}
+		size := int64(-1)
+		for _, ps := range r.Propstats {
+			if ps.Prop.ResourceType.Collection != nil {
+				size = -1
+				break
+			}
+			if ps.Prop.ContentLength != "" {
+				size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+		}
+		u.sizes[name] = size
+		if size >= 0 {
+			u.bytes += size
+			u.files++
+		}
+	}
+	return u, nil
+}
+
+// trackQuota returns errQuotaExceeded if the write request r to share, which
+// is served by child, would make the share exceed its quotas. Only requests
+// that add data (PUT and COPY) are checked, so that a share over its quotas
+// can always be cleaned up.
+//
+// Otherwise, it records the change the request makes to the usage of the
+// share, and returns a func to call with the request's HTTP status once it
+// has been handled. If the request fails, the usage is found again for the
+// next one.
+func (s *FileSystemForRemote) trackQuota(share *drive.Share, child *compositedav.Child, r *http.Request) (done func(status int), err error) {
+	if r.Method == "PUT" && share.MaxBytes > 0 && r.ContentLength < 0 {
+		return nil, errLengthRequired
+	}
+
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	u := s.usage[share.Name]
+	if u == nil || time.Since(u.found) > quotaUsageMaxAge {
+		u, err = getShareUsage(r.Context(), child)
+		if err != nil {
+			return nil, fmt.Errorf("finding share usage: %w", err)
+		}
+		mak.Set(&s.usage, share.Name, u)
+	}
+	done = func(status int) {
+		if status >= 200 && status < 300 {
+			return
+		}
+		s.usageMu.Lock()
+		defer s.usageMu.Unlock()
+		if s.usage[share.Name] == u {
+			delete(s.usage, share.Name)
+		}
+	}
+
+	target := inShare(r.URL.Path)
+	var dest string
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		du, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			return done, nil // let the file server reject it
+		}
+		if parts := shared.CleanAndSplit(du.Path); parts[0] != share.Name {
+			// Not within the share; find its usage again after.
+			delete(s.usage, share.Name)
+			return done, nil
+		}
+		dest = inShare(du.Path)
+	}
+	overwrite := r.Header.Get("Overwrite") != "F"
+
+	var addBytes, addFiles int64
+	switch r.Method {
+	case "PUT":
+		addBytes, addFiles = r.ContentLength, 1
+		if size, ok := u.sizes[target]; ok && size >= 0 {
+			// Replacing an existing file.
+			addBytes, addFiles = addBytes-size, 0
+		}
+	case "COPY":
+		addBytes, addFiles = u.under(target)
+		if overwrite {
+			b, f := u.under(dest)
+			addBytes, addFiles = addBytes-b, addFiles-f
+		}
+	}
+	if share.MaxBytes > 0 && addBytes > 0 && u.bytes+addBytes > share.MaxBytes ||
+		share.MaxFiles > 0 && addFiles > 0 && u.files+addFiles > share.MaxFiles {
+		return nil, errQuotaExceeded
+	}
+
+	switch r.Method {
+	case "PUT":
+		u.set(target, r.ContentLength)
+	case "MKCOL":
+		u.set(target, -1)
+	case "DELETE":
+		u.remove(target)
+	case "COPY", "MOVE":
+		if _, exists := u.sizes[dest]; exists && !overwrite {
+			break // fails
+		}
+		u.copy(target, dest)
+		if r.Method == "MOVE" {
+			u.remove(target)
+		}
+	}
+	return done, nil
+}
+
+// statusRecorder is an http.ResponseWriter that records the status of the
+// response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// inShare returns the path of the request path p relative to the share it
+// names, without leading or trailing slashes.
+func inShare(p string) string {
+	parts := shared.CleanAndSplit(p)
+	return strings.Join(parts[1:], "/")
+}
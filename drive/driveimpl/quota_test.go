@@ -0,0 +1,46 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestShareUsage(t *testing.T) {
+	u := &shareUsage{sizes: make(map[string]int64)}
+	check := func(label string, wantBytes, wantFiles int64, wantSizes map[string]int64) {
+		t.Helper()
+		if u.bytes != wantBytes || u.files != wantFiles {
+			t.Errorf("%s: got %d bytes in %d files, want %d bytes in %d files", label, u.bytes, u.files, wantBytes, wantFiles)
+		}
+		if !maps.Equal(u.sizes, wantSizes) {
+			t.Errorf("%s: got sizes %v, want %v", label, u.sizes, wantSizes)
+		}
+	}
+
+	u.set("a", 5)
+	u.set("dir", -1)
+	u.set("dir/b", 3)
+	check("set", 8, 2, map[string]int64{"a": 5, "dir": -1, "dir/b": 3})
+
+	u.set("a", 2)
+	check("replace", 5, 2, map[string]int64{"a": 2, "dir": -1, "dir/b": 3})
+
+	if b, f := u.under("dir"); b != 3 || f != 1 {
+		t.Errorf("under(dir) = %d, %d; want 3, 1", b, f)
+	}
+
+	u.copy("dir", "dir2")
+	check("copy", 8, 3, map[string]int64{"a": 2, "dir": -1, "dir/b": 3, "dir2": -1, "dir2/b": 3})
+
+	u.copy("a", "dir2")
+	check("copy over directory", 7, 3, map[string]int64{"a": 2, "dir": -1, "dir/b": 3, "dir2": 2})
+
+	u.remove("dir")
+	check("remove", 4, 2, map[string]int64{"a": 2, "dir2": 2})
+
+	u.remove("di")
+	check("remove prefix of name", 4, 2, map[string]int64{"a": 2, "dir2": 2})
+}
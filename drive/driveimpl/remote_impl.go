@@ -57,6 +57,15 @@ type FileSystemForRemote struct {
 	shares                 []*drive.Share
 	children               map[string]*compositedav.Child
 	userServers            map[string]*userServer
+	// snapshotDir is the directory that snapshot shares keep their
+	// snapshots in, or empty if there is none.
+	snapshotDir string
+
+	// usageMu guards usage.
+	usageMu sync.Mutex
+	// usage is the usage of shares with quotas, by share name, as far as
+	// it's known.
+	usage map[string]*shareUsage
 }
 
 // SetFileServerAddr implements drive.FileSystemForRemote.
@@ -66,6 +75,15 @@ func (s *FileSystemForRemote) SetFileServerAddr(addr string) {
 	s.mu.Unlock()
 }
 
+// SetSnapshotDir sets the directory that snapshot shares keep their
+// snapshots in, typically in tailscaled's state directory. Without one,
+// snapshot shares can't be served. It must be called before SetShares.
+func (s *FileSystemForRemote) SetSnapshotDir(dir string) {
+	s.mu.Lock()
+	s.snapshotDir = dir
+	s.mu.Unlock()
+}
+
 // SetShares implements drive.FileSystemForRemote. Shares must be sorted
 // according to drive.CompareShares.
 func (s *FileSystemForRemote) SetShares(shares []*drive.Share) {
@@ -79,17 +97,28 @@ func (s *FileSystemForRemote) SetShares(shares []*drive.Share) {
 			return
 		}
 
+		s.mu.RLock()
+		snapshotDir := s.snapshotDir
+		s.mu.RUnlock()
 		for _, share := range shares {
 			p, found := userServers[share.As]
 			if !found {
 				p = &userServer{
-					logf:       s.logf,
-					username:   share.As,
-					executable: executable,
+					logf:         s.logf,
+					username:     share.As,
+					executable:   executable,
+					snapshotDirs: make(map[string]string),
 				}
 				userServers[share.As] = p
 			}
 			p.shares = append(p.shares, share)
+			if share.Snapshot != "" && snapshotDir != "" {
+				dir, err := makeSnapshotDir(snapshotDir, share)
+				if err != nil {
+					s.logf("taildrive: snapshots of share %q: %v", share.Name, err)
+				}
+				p.snapshotDirs[share.Name] = dir
+			}
 		}
 		for _, p := range userServers {
 			go p.runLoop()
@@ -109,25 +138,36 @@ func (s *FileSystemForRemote) SetShares(shares []*drive.Share) {
 	s.userServers = userServers
 	s.mu.Unlock()
 
+	s.usageMu.Lock()
+	s.usage = nil
+	s.usageMu.Unlock()
+
 	s.stopUserServers(oldUserServers)
 	s.closeChildren(oldChildren)
+
+	// Remove the snapshots of shares that are gone or no longer snapshot
+	// shares, now that the servers that served them are stopped.
+	if drive.AllowShareAs() {
+		s.mu.RLock()
+		snapshotDir := s.snapshotDir
+		s.mu.RUnlock()
+		if snapshotDir != "" {
+			if err := removeOldSnapshots(snapshotDir, shares); err != nil {
+				s.logf("taildrive: removing old snapshots: %v", err)
+			}
+		}
+	}
 }
 
 func (s *FileSystemForRemote) buildChild(share *drive.Share) *compositedav.Child {
 	getTokenAndAddr := func(shareName string) (string, string, error) {
 		s.mu.RLock()
-		var share *drive.Share
-		i, shareFound := slices.BinarySearchFunc(s.shares, shareName, func(s *drive.Share, name string) int {
-			return strings.Compare(s.Name, name)
-		})
-		if shareFound {
-			share = s.shares[i]
-		}
+		share := s.shareLocked(shareName)
 		userServers := s.userServers
 		fileServerTokenAndAddr := s.fileServerTokenAndAddr
 		s.mu.RUnlock()
 
-		if !shareFound {
+		if share == nil {
 			return "", "", fmt.Errorf("unknown share %v", shareName)
 		}
 
@@ -198,12 +238,24 @@ func (s *FileSystemForRemote) buildChild(share *drive.Share) *compositedav.Child
 	}
 }
 
+// shareLocked returns the share named name, or nil if there is none.
+// s.mu must be held.
+func (s *FileSystemForRemote) shareLocked(name string) *drive.Share {
+	i, found := slices.BinarySearchFunc(s.shares, name, func(s *drive.Share, name string) int {
+		return strings.Compare(s.Name, name)
+	})
+	if !found {
+		return nil
+	}
+	return s.shares[i]
+}
+
 // ServeHTTPWithPerms implements drive.FileSystemForRemote.
 func (s *FileSystemForRemote) ServeHTTPWithPerms(permissions drive.Permissions, w http.ResponseWriter, r *http.Request) {
 	isWrite := writeMethods[r.Method]
 	if isWrite {
-		share := shared.CleanAndSplit(r.URL.Path)[0]
-		switch permissions.For(share) {
+		shareName := shared.CleanAndSplit(r.URL.Path)[0]
+		switch permissions.For(shareName) {
 		case drive.PermissionNone:
 			// If we have no permissions to this share, treat it as not found
 			// to avoid leaking any information about the share's existence.
@@ -213,6 +265,33 @@ func (s *FileSystemForRemote) ServeHTTPWithPerms(permissions drive.Permissions,
 			http.Error(w, "permission denied", http.StatusForbidden)
 			return
 		}
+
+		s.mu.RLock()
+		share := s.shareLocked(shareName)
+		child := s.children[shareName]
+		s.mu.RUnlock()
+		if share != nil && share.Snapshot != "" {
+			http.Error(w, "share is a read-only snapshot", http.StatusForbidden)
+			return
+		}
+		if share != nil && child != nil && (share.MaxBytes > 0 || share.MaxFiles > 0) {
+			done, err := s.trackQuota(share, child, r)
+			switch {
+			case err == errQuotaExceeded:
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			case err == errLengthRequired:
+				http.Error(w, err.Error(), http.StatusLengthRequired)
+				return
+			case err != nil:
+				s.logf("taildrive: %v", err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			sr := &statusRecorder{ResponseWriter: w}
+			defer func() { done(sr.status) }()
+			w = sr
+		}
 	}
 
 	s.mu.RLock()
@@ -272,6 +351,9 @@ type userServer struct {
 	shares     []*drive.Share
 	username   string
 	executable string
+	// snapshotDirs are the directories that snapshot shares keep their
+	// snapshots in, by share name.
+	snapshotDirs map[string]string
 
 	// mu guards the below values. Acquire a write lock before updating any of
 	// them, acquire a read lock before reading any of them.
@@ -329,6 +411,11 @@ func (s *userServer) runLoop() {
 func (s *userServer) run() error {
 	// set up the command
 	args := []string{"serve-taildrive"}
+	for _, share := range s.shares {
+		if share.Snapshot != "" {
+			args = append(args, "--snapshot="+SnapshotFlag(share, s.snapshotDirs[share.Name]))
+		}
+	}
 	for _, s := range s.shares {
 		args = append(args, s.Name, s.Path)
 	}
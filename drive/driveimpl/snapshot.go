@@ -0,0 +1,256 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/drive"
+)
+
+// TakeSnapshot takes a snapshot of the directory dir requested at time at,
+// and returns the path of the snapshot. The snapshot is made in snapDir,
+// which holds only the snapshots of dir. If the snapshot for mode and at
+// already exists, it is reused. Other snapshots in snapDir are removed.
+//
+// TakeSnapshot should run as the user that the share is served as, so that
+// the snapshot has the same permissions as the directory. Files that can't
+// be hardlinked, such as when snapDir is on another file system than dir,
+// are copied.
+func TakeSnapshot(dir, snapDir string, mode drive.SnapshotMode, at time.Time) (string, error) {
+	if snapDir == "" {
+		return "", errors.New("snapshot: no directory to keep snapshots in")
+	}
+	snap := filepath.Join(snapDir, string(mode)+"-"+strconv.FormatInt(at.UnixNano(), 10))
+	if fi, err := os.Stat(snap); err == nil && fi.IsDir() {
+		return snap, nil
+	}
+	if err := os.MkdirAll(snapDir, 0700); err != nil {
+		return "", fmt.Errorf("snapshot: %w", err)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	tmp, err := os.MkdirTemp(snapDir, "tmp-")
+	if err != nil {
+		return "", fmt.Errorf("snapshot: %w", err)
+	}
+	if err := copyTree(tmp, dir, mode); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("snapshot: %w", err)
+	}
+	if err := os.Chmod(tmp, fi.Mode().Perm()); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, snap); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("snapshot: %w", err)
+	}
+
+	// Remove older snapshots, and any left behind half-made.
+	if entries, err := os.ReadDir(snapDir); err == nil {
+		for _, de := range entries {
+			if name := de.Name(); name != filepath.Base(snap) {
+				os.RemoveAll(filepath.Join(snapDir, name))
+			}
+		}
+	}
+	return snap, nil
+}
+
+// SnapshotFlag returns the value of the serve-taildrive --snapshot flag for
+// share, whose snapshots are kept in snapDir, of the form
+// "name=mode@unixnano@snapdir".
+func SnapshotFlag(share *drive.Share, snapDir string) string {
+	return fmt.Sprintf("%s=%s@%d@%s", share.Name, share.Snapshot, share.SnapshotAt.UnixNano(), snapDir)
+}
+
+// ParseSnapshotFlag parses a value returned by SnapshotFlag.
+func ParseSnapshotFlag(v string) (name, snapDir string, mode drive.SnapshotMode, at time.Time, err error) {
+	name, rest, ok := strings.Cut(v, "=")
+	m, rest, ok2 := strings.Cut(rest, "@")
+	ns, snapDir, ok3 := strings.Cut(rest, "@")
+	n, err := strconv.ParseInt(ns, 10, 64)
+	if !ok || !ok2 || !ok3 || err != nil {
+		return "", "", "", time.Time{}, fmt.Errorf("invalid snapshot %q", v)
+	}
+	return name, snapDir, drive.SnapshotMode(m), time.Unix(0, n), nil
+}
+
+// snapshotDirFor returns the directory in root that the snapshots of share
+// are kept in, as root/user/name.
+func snapshotDirFor(root string, share *drive.Share) string {
+	return filepath.Join(root, share.As, share.Name)
+}
+
+// makeSnapshotDir makes the directory in root that the snapshots of share
+// are kept in, and returns its path. If running as root, the directory is
+// owned by the user that the share is served as, who alone may access it.
+func makeSnapshotDir(root string, share *drive.Share) (string, error) {
+	if share.As == "" || strings.ContainsAny(share.As, `/\`) || share.As == "." || share.As == ".." {
+		return "", fmt.Errorf("can't keep snapshots for user %q", share.As)
+	}
+	// Users may pass through root, but not list it.
+	if err := os.MkdirAll(root, 0711); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(root, 0711); err != nil {
+		return "", err
+	}
+	userDir := filepath.Join(root, share.As)
+	if err := os.Mkdir(userDir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if os.Getuid() == 0 {
+		u, err := user.Lookup(share.As)
+		if err != nil {
+			return "", err
+		}
+		uid, err := strconv.Atoi(u.Uid)
+		if err != nil {
+			return "", err
+		}
+		gid, err := strconv.Atoi(u.Gid)
+		if err != nil {
+			return "", err
+		}
+		if err := os.Lchown(userDir, uid, gid); err != nil {
+			return "", err
+		}
+	}
+	// The share's directory is made by serve-taildrive, as the user.
+	return snapshotDirFor(root, share), nil
+}
+
+// removeOldSnapshots removes the snapshots in root of shares that are no
+// longer snapshot shares, or are now served as another user.
+func removeOldSnapshots(root string, shares []*drive.Share) error {
+	keep := make(map[string]bool)
+	for _, share := range shares {
+		if share.Snapshot != "" {
+			keep[snapshotDirFor(root, share)] = true
+		}
+	}
+	users, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var errs []error
+	for _, u := range users {
+		userDir := filepath.Join(root, u.Name())
+		names, err := os.ReadDir(userDir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		kept := false
+		for _, n := range names {
+			if p := filepath.Join(userDir, n.Name()); keep[p] {
+				kept = true
+			} else if err := os.RemoveAll(p); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if !kept {
+			os.Remove(userDir)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// copyTree copies the contents of the directory src into the existing
+// directory dst, hardlinking regular files if mode is drive.SnapshotHardlink.
+// Symlinks are copied as is, and other special files are skipped.
+func copyTree(dst, src string, mode drive.SnapshotMode) error {
+	type dirPerm struct {
+		path string
+		perm fs.FileMode
+	}
+	var dirs []dirPerm
+	err := filepath.WalkDir(src, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case de.IsDir():
+			// Create directories writable for now, and set their
+			// permissions once their contents are in place.
+			dirs = append(dirs, dirPerm{target, fi.Mode().Perm()})
+			return os.Mkdir(target, 0700)
+		case de.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case de.Type().IsRegular():
+			if mode == drive.SnapshotHardlink && os.Link(p, target) == nil {
+				return nil
+			}
+			return copyFile(target, p, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file src, whose info is fi, to dst, keeping
+// its permissions and modification time.
+func copyFile(dst, src string, fi fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
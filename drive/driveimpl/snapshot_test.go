@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driveimpl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/drive"
+)
+
+func TestTakeSnapshot(t *testing.T) {
+	for _, mode := range []drive.SnapshotMode{drive.SnapshotHardlink, drive.SnapshotCopy} {
+		t.Run(string(mode), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "out")
+			snapDir := filepath.Join(t.TempDir(), "snapshots")
+			if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			write := func(name, contents string) {
+				t.Helper()
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			read := func(dir, name string) string {
+				t.Helper()
+				b, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(b)
+			}
+			write("a", "one")
+			write("sub/b", "two")
+
+			at := time.Unix(1, 0)
+			snap, err := TakeSnapshot(dir, snapDir, mode, at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Dir(snap) != snapDir {
+				t.Errorf("snapshot %s is not in %s", snap, snapDir)
+			}
+			if got := read(snap, "a"); got != "one" {
+				t.Errorf("a = %q, want one", got)
+			}
+			if got := read(snap, "sub/b"); got != "two" {
+				t.Errorf("sub/b = %q, want two", got)
+			}
+
+			// Replacing a file doesn't change the snapshot.
+			os.Remove(filepath.Join(dir, "a"))
+			write("a", "three")
+			if got := read(snap, "a"); got != "one" {
+				t.Errorf("a = %q after replacing it, want one", got)
+			}
+
+			if again, err := TakeSnapshot(dir, snapDir, mode, at); err != nil || again != snap {
+				t.Errorf("TakeSnapshot again = %q, %v; want %q", again, err, snap)
+			}
+			newer, err := TakeSnapshot(dir, snapDir, mode, at.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := read(newer, "a"); got != "three" {
+				t.Errorf("a = %q in newer snapshot, want three", got)
+			}
+			if _, err := os.Stat(snap); !os.IsNotExist(err) {
+				t.Errorf("older snapshot not removed: %v", err)
+			}
+			if entries, err := os.ReadDir(snapDir); err != nil || len(entries) != 1 {
+				t.Errorf("snapshot directory has %d entries (%v), want 1", len(entries), err)
+			}
+		})
+	}
+}
+
+func TestSnapshotFlag(t *testing.T) {
+	share := &drive.Share{Name: "docs", Snapshot: drive.SnapshotCopy, SnapshotAt: time.Unix(1, 2)}
+	name, dir, mode, at, err := ParseSnapshotFlag(SnapshotFlag(share, "/var/lib/tailscale/drive-snapshots/alice@example/docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != share.Name || dir != "/var/lib/tailscale/drive-snapshots/alice@example/docs" || mode != share.Snapshot || !at.Equal(share.SnapshotAt) {
+		t.Errorf("ParseSnapshotFlag = %q, %q, %q, %v", name, dir, mode, at)
+	}
+}
+
+func TestRemoveOldSnapshots(t *testing.T) {
+	root := t.TempDir()
+	alice := func(name string, mode drive.SnapshotMode) *drive.Share {
+		return &drive.Share{Name: name, As: "alice", Snapshot: mode}
+	}
+	for _, share := range []*drive.Share{alice("kept", drive.SnapshotCopy), alice("unshared", drive.SnapshotCopy), alice("live", drive.SnapshotCopy), {Name: "moved", As: "bob", Snapshot: drive.SnapshotCopy}} {
+		if err := os.MkdirAll(filepath.Join(snapshotDirFor(root, share), "copy-1"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shares := []*drive.Share{
+		alice("kept", drive.SnapshotCopy),
+		alice("live", ""),
+		alice("moved", drive.SnapshotCopy),
+	}
+	if err := removeOldSnapshots(root, shares); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "alice", "kept", "copy-1")); err != nil {
+		t.Errorf("snapshot of a snapshot share was removed: %v", err)
+	}
+	for _, p := range []string{"alice/unshared", "alice/live", "bob"} {
+		if _, err := os.Stat(filepath.Join(root, p)); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package drivesync mirrors a Taildrive share into a local directory. After
+// copying the whole share once, it follows the share's change feed to copy
+// only what changed.
+package drivesync
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/drive"
+	"tailscale.com/types/logger"
+)
+
+// MarkerFile is the name of the file that marks a directory as a mirror of a
+// share, which files may be removed from. Mirror creates it in Dir.
+const MarkerFile = ".tailscale-drive-sync"
+
+// ErrNotMirror is returned by Mirror when Dir has files but is not a mirror
+// of a share, and Delete is not set.
+var ErrNotMirror = errors.New("directory is not empty and was not made by an earlier sync")
+
+// Mirror mirrors the shared directory at URL into Dir. Files in Dir that
+// aren't in the share are removed.
+//
+// To avoid removing files that were never part of a share, Dir must be
+// missing, empty, or marked by an earlier Mirror with a MarkerFile, unless
+// Delete is set.
+type Mirror struct {
+	// URL is the WebDAV URL of the shared directory, like
+	// http://100.100.100.100:8080/<tailnet>/<machine>/<share>.
+	URL string
+
+	// Dir is the local directory to mirror the share into.
+	Dir string
+
+	// Client is used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Logf logs the files copied and removed, and errors that Run retries
+	// after. If nil, log.Printf is used.
+	Logf logger.Logf
+
+	// Delete allows mirroring into a directory that has files but was not
+	// made by an earlier Mirror, removing the files that aren't in the
+	// share.
+	Delete bool
+}
+
+// retryDelay is how long Run waits after an error before trying again.
+var retryDelay = 5 * time.Second
+
+// changesWait is how long each change feed request waits for changes.
+const changesWait = 30 * time.Second
+
+// Run mirrors the share into Dir, then keeps Dir up to date with the share
+// until ctx is done.
+func (m *Mirror) Run(ctx context.Context) error {
+	if err := m.markDir(); err != nil {
+		return err
+	}
+	cursor := ""
+	for {
+		ch, err := m.changes(ctx, cursor)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, errNoChangeFeed) {
+				return err
+			}
+			m.logf("reading changes: %v", err)
+			if !sleep(ctx, retryDelay) {
+				return ctx.Err()
+			}
+			continue
+		}
+		cursor = ch.Cursor
+		if ch.Reset {
+			err = m.syncDir(ctx, "")
+		}
+		for _, p := range ch.Paths {
+			if err != nil {
+				break
+			}
+			err = m.syncPath(ctx, p)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			m.logf("syncing: %v", err)
+			cursor = "" // copy everything again
+			if !sleep(ctx, retryDelay) {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Sync mirrors the whole share into Dir once.
+func (m *Mirror) Sync(ctx context.Context) error {
+	if err := m.markDir(); err != nil {
+		return err
+	}
+	return m.syncDir(ctx, "")
+}
+
+// markDir creates Dir if needed, and marks it as a mirror with a
+// MarkerFile. It returns ErrNotMirror if Dir has files but no MarkerFile,
+// and m.Delete is not set.
+func (m *Mirror) markDir() error {
+	marker := filepath.Join(m.Dir, MarkerFile)
+	if _, err := os.Lstat(marker); err == nil {
+		return nil
+	}
+	des, err := os.ReadDir(m.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(des) > 0 && !m.Delete {
+		return fmt.Errorf("%s: %w", m.Dir, ErrNotMirror)
+	}
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(marker, []byte(m.URL+"\n"), 0644)
+}
+
+// isMarker reports whether p, relative to the share, is the MarkerFile,
+// which is never copied or removed.
+func isMarker(p string) bool {
+	return p == MarkerFile
+}
+
+var errNoChangeFeed = errors.New("share has no change feed; the sharing node may need to be updated")
+
+// changes reads the changes since cursor from the share's change feed.
+func (m *Mirror) changes(ctx context.Context, cursor string) (*drive.Changes, error) {
+	q := url.Values{"cursor": {cursor}}
+	if cursor != "" {
+		q.Set("wait", strconv.Itoa(int(changesWait/time.Second)))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", m.url("")+"/?"+drive.ChangesQuery+"&"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return nil, errNoChangeFeed
+	}
+	var ch drive.Changes
+	if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// entry is a file or directory in the share.
+type entry struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+// syncPath mirrors the file or directory p, relative to the share.
+func (m *Mirror) syncPath(ctx context.Context, p string) error {
+	if !filepath.IsLocal(filepath.FromSlash(p)) {
+		return fmt.Errorf("invalid path %q", p)
+	}
+	if isMarker(p) {
+		return nil
+	}
+	es, err := m.propfind(ctx, p, "0")
+	if errors.Is(err, os.ErrNotExist) {
+		return m.remove(p)
+	}
+	if err != nil {
+		return err
+	}
+	if es[0].dir {
+		return m.syncDir(ctx, p)
+	}
+	// The change feed says the file changed, even if it has the same size
+	// and, to the second, modification time.
+	return m.syncFile(ctx, p, es[0], true)
+}
+
+// syncDir mirrors the directory dir, relative to the share, and everything
+// in it.
+func (m *Mirror) syncDir(ctx context.Context, dir string) error {
+	es, err := m.propfind(ctx, dir, "1")
+	if err != nil {
+		return err
+	}
+	local := m.local(dir)
+	if fi, err := os.Lstat(local); err == nil && !fi.IsDir() {
+		if err := m.remove(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+
+	inShare := make(map[string]bool)
+	for _, e := range es[1:] {
+		p := path.Join(dir, e.name)
+		if isMarker(p) {
+			continue
+		}
+		inShare[e.name] = true
+		if e.dir {
+			err = m.syncDir(ctx, p)
+		} else {
+			err = m.syncFile(ctx, p, e, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	des, err := os.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		if !inShare[de.Name()] && !isMarker(path.Join(dir, de.Name())) {
+			if err := m.remove(path.Join(dir, de.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncFile copies the file p, relative to the share, whose entry in the
+// share is e, unless the local copy already has its size and modification
+// time and force is false.
+func (m *Mirror) syncFile(ctx context.Context, p string, e entry, force bool) error {
+	local := m.local(p)
+	fi, err := os.Lstat(local)
+	if !force && err == nil && fi.Mode().IsRegular() && fi.Size() == e.size && fi.ModTime().Equal(e.modTime) {
+		return nil
+	}
+	if err == nil && !fi.Mode().IsRegular() {
+		if err := os.RemoveAll(local); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", m.url(p), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return m.remove(p) // removed since it was listed
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %v", p, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(local), ".tailscale-sync-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("GET %s: %w", p, err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if !e.modTime.IsZero() {
+		if err := os.Chtimes(f.Name(), e.modTime, e.modTime); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(f.Name(), local); err != nil {
+		return err
+	}
+	m.logf("copied %s", p)
+	return nil
+}
+
+// remove removes the local copy of the file or directory p, relative to the
+// share, if there is one.
+func (m *Mirror) remove(p string) error {
+	local := m.local(p)
+	if _, err := os.Lstat(local); err != nil {
+		return nil
+	}
+	if err := os.RemoveAll(local); err != nil {
+		return err
+	}
+	m.logf("removed %s", p)
+	return nil
+}
+
+// propfindBody is the body of PROPFIND requests.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind lists the file or directory p, relative to the share, and if depth
+// is "1", its contents. The first entry is p itself. It returns an error
+// wrapping os.ErrNotExist if p doesn't exist.
+func (m *Mirror) propfind(ctx context.Context, p, depth string) ([]entry, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", m.url(p), strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := m.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("PROPFIND %s: %w", p, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s: %v", p, resp.Status)
+	}
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: %w", p, err)
+	}
+
+	// The requested resource is listed first. The other hrefs are only
+	// used for their last, escaped element, because the prefix added by
+	// the local Taildrive proxy is not escaped.
+	var es []entry
+	for i, r := range ms.Responses {
+		base := path.Base(strings.TrimSuffix(r.Href, "/"))
+		name, err := url.PathUnescape(base)
+		if err != nil {
+			name = base
+		}
+		e := entry{name: name}
+		for _, ps := range r.Propstats {
+			prop := ps.Prop
+			if prop.ResourceType.Collection != nil {
+				e.dir = true
+			}
+			if prop.ContentLength != "" {
+				e.size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			}
+			if prop.LastModified != "" {
+				e.modTime, _ = http.ParseTime(prop.LastModified)
+			}
+		}
+		if i > 0 && (!filepath.IsLocal(name) || strings.ContainsAny(name, `/\`)) {
+			return nil, fmt.Errorf("PROPFIND %s: invalid name %q", p, name)
+		}
+		es = append(es, e)
+	}
+	if len(es) == 0 {
+		return nil, fmt.Errorf("PROPFIND %s: empty response", p)
+	}
+	return es, nil
+}
+
+// url returns the URL of p, relative to the share.
+func (m *Mirror) url(p string) string {
+	u := strings.TrimSuffix(m.URL, "/")
+	for _, part := range strings.Split(p, "/") {
+		if part != "" {
+			u += "/" + url.PathEscape(part)
+		}
+	}
+	return u
+}
+
+// local returns the local path of p, relative to the share.
+func (m *Mirror) local(p string) string {
+	return filepath.Join(m.Dir, filepath.FromSlash(p))
+}
+
+func (m *Mirror) client() *http.Client {
+	if m.Client != nil {
+		return m.Client
+	}
+	return http.DefaultClient
+}
+
+func (m *Mirror) logf(format string, args ...any) {
+	if m.Logf != nil {
+		m.Logf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// sleep waits for d, and reports whether ctx is still not done.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -11,6 +11,7 @@
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var (
@@ -19,6 +20,8 @@
 	DisallowShareAs     = false
 	ErrDriveNotEnabled  = errors.New("Taildrive not enabled")
 	ErrInvalidShareName = errors.New("Share names may only contain the letters a-z, underscore _, parentheses (), or spaces")
+	ErrInvalidSnapshot  = errors.New("Share snapshot mode must be hardlink or copy")
+	ErrInvalidQuota     = errors.New("Share quotas may not be negative")
 )
 
 var (
@@ -51,6 +54,52 @@ type Share struct {
 	// hold on to a security-scoped bookmark. That bookmark is stored here. See
 	// https://developer.apple.com/documentation/security/app_sandbox/accessing_files_from_the_macos_app_sandbox#4144043
 	BookmarkData []byte `json:"bookmarkData,omitempty"`
+
+	// MaxBytes is the most bytes of files that remote nodes may store in
+	// the share. Writes that would exceed it fail with HTTP status 507
+	// Insufficient Storage. If zero, there is no limit.
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+
+	// MaxFiles is the most files that remote nodes may store in the share,
+	// not counting directories. Writes that would exceed it fail with HTTP
+	// status 507 Insufficient Storage. If zero, there is no limit.
+	MaxFiles int64 `json:"maxFiles,omitempty"`
+
+	// Snapshot, if set, makes the share serve a read-only snapshot of the
+	// directory taken at SnapshotAt, rather than the live directory, so
+	// that remote nodes never see files that are still being written.
+	Snapshot SnapshotMode `json:"snapshot,omitempty"`
+
+	// SnapshotAt is when the snapshot was requested. Setting the share
+	// again with a newer SnapshotAt takes a new snapshot.
+	SnapshotAt time.Time `json:"snapshotAt,omitempty"`
+}
+
+// SnapshotMode is how a snapshot of a share's directory is taken.
+type SnapshotMode string
+
+const (
+	// SnapshotHardlink hardlinks the directory's files into the snapshot.
+	// This is fast and takes little space, but files that are modified in
+	// place rather than replaced change in the snapshot too. Files that
+	// can't be hardlinked are copied.
+	SnapshotHardlink SnapshotMode = "hardlink"
+
+	// SnapshotCopy copies the directory's files into the snapshot.
+	SnapshotCopy SnapshotMode = "copy"
+)
+
+// Validate returns an error if the share's quotas or snapshot mode are
+// invalid. It does not check the share's name, see NormalizeShareName.
+func (s *Share) Validate() error {
+	if s.MaxBytes < 0 || s.MaxFiles < 0 {
+		return ErrInvalidQuota
+	}
+	switch s.Snapshot {
+	case "", SnapshotHardlink, SnapshotCopy:
+		return nil
+	}
+	return ErrInvalidSnapshot
 }
 
 func ShareViewsEqual(a, b ShareView) bool {
@@ -60,7 +109,9 @@ func ShareViewsEqual(a, b ShareView) bool {
 	if !a.Valid() || !b.Valid() {
 		return false
 	}
-	return a.Name() == b.Name() && a.Path() == b.Path() && a.As() == b.As() && a.BookmarkData().Equal(b.ж.BookmarkData)
+	return a.Name() == b.Name() && a.Path() == b.Path() && a.As() == b.As() && a.BookmarkData().Equal(b.ж.BookmarkData) &&
+		a.MaxBytes() == b.MaxBytes() && a.MaxFiles() == b.MaxFiles() &&
+		a.Snapshot() == b.Snapshot() && a.SnapshotAt().Equal(b.SnapshotAt())
 }
 
 func SharesEqual(a, b *Share) bool {
@@ -70,7 +121,9 @@ func SharesEqual(a, b *Share) bool {
 	if a == nil || b == nil {
 		return false
 	}
-	return a.Name == b.Name && a.Path == b.Path && a.As == b.As && bytes.Equal(a.BookmarkData, b.BookmarkData)
+	return a.Name == b.Name && a.Path == b.Path && a.As == b.As && bytes.Equal(a.BookmarkData, b.BookmarkData) &&
+		a.MaxBytes == b.MaxBytes && a.MaxFiles == b.MaxFiles &&
+		a.Snapshot == b.Snapshot && a.SnapshotAt.Equal(b.SnapshotAt)
 }
 
 func CompareShares(a, b *Share) int {
@@ -123,6 +123,11 @@ type Notify struct {
 	// successful or failed. This slice is sorted by Started time, then Name.
 	OutgoingFiles []*OutgoingFile `json:",omitempty"`
 
+	// FileTransfer, if non-nil, is a Taildrop transfer that just finished,
+	// whether it succeeded or failed, and was added to the transfer
+	// history.
+	FileTransfer *FileTransfer `json:",omitempty"`
+
 	// LocalTCPPort, if non-nil, informs the UI frontend which
 	// (non-zero) localhost TCP port it's listening on.
 	// This is currently only used by Tailscale when run in the
@@ -182,6 +187,9 @@ func (n Notify) String() string {
 	if len(n.IncomingFiles) != 0 {
 		sb.WriteString("IncomingFiles ")
 	}
+	if n.FileTransfer != nil {
+		sb.WriteString("FileTransfer ")
+	}
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
@@ -223,6 +231,21 @@ type OutgoingFile struct {
 	Succeeded    bool                 // for a finished transfer, indicates whether or not it was successful
 }
 
+// FileTransfer is a finished Taildrop transfer, sent or received, as
+// recorded in the transfer history.
+type FileTransfer struct {
+	Outgoing  bool                 // whether the file was sent, rather than received
+	PeerID    tailcfg.StableNodeID // the peer the file was sent to or received from
+	PeerName  string               `json:",omitempty"` // e.g. "laptop.example.ts.net", if known
+	Name      string               // e.g. "foo.jpg", or the name of a bundle
+	Size      int64                // or -1 if unknown
+	Started   time.Time            // time the transfer started
+	Duration  time.Duration        // how long the transfer took
+	SHA256    string               `json:",omitempty"` // hex SHA-256 of the file, if known; never set for bundles
+	Succeeded bool                 // whether the transfer succeeded
+	Error     string               `json:",omitempty"` // why the transfer failed, if it did
+}
+
 // StateKey is an opaque identifier for a set of LocalBackend state
 // (preferences, private keys, etc.). It is also used as a key for
 // the various LoginProfiles that the instance may be signed into.
@@ -46,6 +46,41 @@ type ConfigVAlpha struct {
 	// should advertise amongst its wireguard endpoints.
 	StaticEndpoints []netip.AddrPort `json:",omitempty"`
 
+	// DNSOverrides are local DNS records and rules layered on top of the
+	// tailnet's DNS configuration.
+	DNSOverrides []DNSOverride `json:",omitempty"`
+
+	// DNSBlocklistFiles and DNSBlocklistResponse configure the blocklist
+	// applied to exit node clients' DNS queries. See the Prefs fields of
+	// the same names.
+	DNSBlocklistFiles    []string `json:",omitempty"`
+	DNSBlocklistResponse *string  `json:",omitempty"`
+
+	// TrafficShaping are rules limiting the rate of traffic to and from
+	// peers. See Prefs.TrafficShaping.
+	TrafficShaping []ShapeRule `json:",omitempty"`
+
+	// FlowCollector is the flow collector to export network flow logs to.
+	// See Prefs.FlowCollector.
+	FlowCollector *string `json:",omitempty"`
+
+	// TaildropReceivePolicy limits what Taildrop files this node accepts.
+	// See Prefs.TaildropReceivePolicy.
+	TaildropReceivePolicy *TaildropReceivePolicy `json:",omitempty"`
+
+	// SSHRecordingPolicy says when Tailscale SSH sessions are recorded to
+	// local disk. See Prefs.SSHRecordingPolicy.
+	SSHRecordingPolicy *SSHRecordingPolicy `json:",omitempty"`
+
+	// SSHUserCA is the certificate authority that Tailscale SSH issues
+	// user certificates with. See Prefs.SSHUserCA.
+	SSHUserCA *SSHUserCA `json:",omitempty"`
+
+	// NewFlowsPerSecond and NewFlowsBurst limit the rate at which each
+	// peer may open new TCP connections. See Prefs.NewFlowsPerSecond.
+	NewFlowsPerSecond *int `json:",omitempty"`
+	NewFlowsBurst     *int `json:",omitempty"`
+
 	// TODO(bradfitz,maisem): future something like:
 	// Profile map[string]*Config // keyed by alice@gmail.com, corp.com (TailnetSID)
 }
@@ -137,5 +172,59 @@ func (c *ConfigVAlpha) ToPrefs() (MaskedPrefs, error) {
 		mp.AutoUpdate = *c.AutoUpdate
 		mp.AutoUpdateSet = AutoUpdatePrefsMask{ApplySet: true, CheckSet: true}
 	}
+	if c.DNSOverrides != nil {
+		for _, o := range c.DNSOverrides {
+			if err := o.Check(); err != nil {
+				return mp, err
+			}
+		}
+		mp.DNSOverrides = c.DNSOverrides
+		mp.DNSOverridesSet = true
+	}
+	if c.DNSBlocklistFiles != nil {
+		mp.DNSBlocklistFiles = c.DNSBlocklistFiles
+		mp.DNSBlocklistFilesSet = true
+	}
+	if c.DNSBlocklistResponse != nil {
+		mp.DNSBlocklistResponse = *c.DNSBlocklistResponse
+		mp.DNSBlocklistResponseSet = true
+	}
+	if c.TrafficShaping != nil {
+		mp.TrafficShaping = c.TrafficShaping
+		mp.TrafficShapingSet = true
+	}
+	if c.FlowCollector != nil {
+		mp.FlowCollector = *c.FlowCollector
+		mp.FlowCollectorSet = true
+	}
+	if c.TaildropReceivePolicy != nil {
+		if err := c.TaildropReceivePolicy.Check(); err != nil {
+			return mp, err
+		}
+		mp.TaildropReceivePolicy = c.TaildropReceivePolicy
+		mp.TaildropReceivePolicySet = true
+	}
+	if c.SSHRecordingPolicy != nil {
+		if err := c.SSHRecordingPolicy.Check(); err != nil {
+			return mp, err
+		}
+		mp.SSHRecordingPolicy = c.SSHRecordingPolicy
+		mp.SSHRecordingPolicySet = true
+	}
+	if c.SSHUserCA != nil {
+		if err := c.SSHUserCA.Check(); err != nil {
+			return mp, err
+		}
+		mp.SSHUserCA = c.SSHUserCA
+		mp.SSHUserCASet = true
+	}
+	if c.NewFlowsPerSecond != nil {
+		mp.NewFlowsPerSecond = *c.NewFlowsPerSecond
+		mp.NewFlowsPerSecondSet = true
+	}
+	if c.NewFlowsBurst != nil {
+		mp.NewFlowsBurst = *c.NewFlowsBurst
+		mp.NewFlowsBurstSet = true
+	}
 	return mp, nil
 }
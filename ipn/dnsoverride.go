@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"tailscale.com/util/dnsname"
+)
+
+// DNSOverride types.
+const (
+	DNSOverrideA        = "A"        // Value is an IPv4 address
+	DNSOverrideAAAA     = "AAAA"     // Value is an IPv6 address
+	DNSOverrideCNAME    = "CNAME"    // Value is the canonical name
+	DNSOverrideTXT      = "TXT"      // Value is the text of the record
+	DNSOverrideNXDOMAIN = "NXDOMAIN" // Value is empty
+	DNSOverrideForward  = "FORWARD"  // Value is a resolver address
+)
+
+// DNSOverride is a DNS record or rule that's local to this node and layered
+// on top of the tailnet's DNS configuration. Overrides take precedence over
+// the control plane's records and routes for the same name.
+type DNSOverride struct {
+	// Name is the DNS name the override applies to. For NXDOMAIN and
+	// FORWARD overrides, it's a suffix that also matches all names
+	// beneath it.
+	Name string
+
+	// Type is one of the DNSOverride* constants.
+	Type string
+
+	// Value is the override's data, as documented on the DNSOverride*
+	// constants. A FORWARD override's Value is in the same format as
+	// dnstype.Resolver.Addr.
+	Value string `json:",omitempty"`
+}
+
+// ParseDNSOverride parses a DNSOverride in the form "name=TYPE:value", or
+// "name=NXDOMAIN".
+func ParseDNSOverride(s string) (DNSOverride, error) {
+	name, rest, ok := strings.Cut(s, "=")
+	if !ok {
+		return DNSOverride{}, fmt.Errorf("invalid DNS override %q: want name=TYPE:value", s)
+	}
+	typ, value, _ := strings.Cut(rest, ":")
+	o := DNSOverride{
+		Name:  name,
+		Type:  strings.ToUpper(typ),
+		Value: value,
+	}
+	if err := o.Check(); err != nil {
+		return DNSOverride{}, err
+	}
+	return o, nil
+}
+
+// String returns o in the form accepted by ParseDNSOverride.
+func (o DNSOverride) String() string {
+	if o.Value == "" {
+		return o.Name + "=" + o.Type
+	}
+	return o.Name + "=" + o.Type + ":" + o.Value
+}
+
+// Check reports whether o is well-formed.
+func (o DNSOverride) Check() error {
+	if _, err := dnsname.ToFQDN(o.Name); err != nil || o.Name == "" || o.Name == "." {
+		return fmt.Errorf("invalid DNS override name %q", o.Name)
+	}
+	var err error
+	switch o.Type {
+	case DNSOverrideA:
+		if ip, perr := netip.ParseAddr(o.Value); perr != nil || !ip.Is4() {
+			err = errors.New("not an IPv4 address")
+		}
+	case DNSOverrideAAAA:
+		if ip, perr := netip.ParseAddr(o.Value); perr != nil || !ip.Is6() {
+			err = errors.New("not an IPv6 address")
+		}
+	case DNSOverrideCNAME:
+		if _, perr := dnsname.ToFQDN(o.Value); perr != nil || o.Value == "" {
+			err = errors.New("invalid canonical name")
+		}
+	case DNSOverrideTXT:
+		if len(o.Value) > 255 {
+			err = errors.New("TXT records are limited to 255 bytes")
+		}
+	case DNSOverrideNXDOMAIN:
+		if o.Value != "" {
+			err = errors.New("NXDOMAIN overrides take no value")
+		}
+	case DNSOverrideForward:
+		err = checkDNSOverrideResolver(o.Value)
+	default:
+		return fmt.Errorf("invalid DNS override %q: unknown type %q", o.String(), o.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid DNS override %q: %w", o.String(), err)
+	}
+	return nil
+}
+
+// checkDNSOverrideResolver checks that addr is a resolver address that
+// doesn't need bootstrap resolution.
+func checkDNSOverrideResolver(addr string) error {
+	if _, err := netip.ParseAddr(addr); err == nil {
+		return nil
+	}
+	if _, err := netip.ParseAddrPort(addr); err == nil {
+		return nil
+	}
+	if strings.HasPrefix(addr, "https://") {
+		return nil
+	}
+	if hostPort, ok := strings.CutPrefix(addr, "tls://"); ok {
+		if _, err := netip.ParseAddr(strings.Trim(hostPort, "[]")); err == nil {
+			return nil
+		}
+		if _, err := netip.ParseAddrPort(hostPort); err == nil {
+			return nil
+		}
+		return errors.New("DNS-over-TLS resolvers must be given by IP address")
+	}
+	return fmt.Errorf("invalid resolver address %q", addr)
+}
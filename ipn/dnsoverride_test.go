@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import "testing"
+
+func TestParseDNSOverride(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    DNSOverride
+		wantErr bool
+	}{
+		{in: "staging.example.com=A:10.1.2.3", want: DNSOverride{Name: "staging.example.com", Type: "A", Value: "10.1.2.3"}},
+		{in: "staging.example.com=aaaa:fd00::3", want: DNSOverride{Name: "staging.example.com", Type: "AAAA", Value: "fd00::3"}},
+		{in: "www.example.com=CNAME:staging.example.com", want: DNSOverride{Name: "www.example.com", Type: "CNAME", Value: "staging.example.com"}},
+		{in: "_acme.example.com=TXT:a=b:c", want: DNSOverride{Name: "_acme.example.com", Type: "TXT", Value: "a=b:c"}},
+		{in: "ads.example.com=NXDOMAIN", want: DNSOverride{Name: "ads.example.com", Type: "NXDOMAIN"}},
+		{in: "corp.example.com=FORWARD:10.0.0.53", want: DNSOverride{Name: "corp.example.com", Type: "FORWARD", Value: "10.0.0.53"}},
+		{in: "corp.example.com=FORWARD:[fd00::53]:5353", want: DNSOverride{Name: "corp.example.com", Type: "FORWARD", Value: "[fd00::53]:5353"}},
+		{in: "corp.example.com=FORWARD:tls://10.0.0.53", want: DNSOverride{Name: "corp.example.com", Type: "FORWARD", Value: "tls://10.0.0.53"}},
+		{in: "corp.example.com=FORWARD:https://dns.example.com/dns-query", want: DNSOverride{Name: "corp.example.com", Type: "FORWARD", Value: "https://dns.example.com/dns-query"}},
+		{in: "staging.example.com", wantErr: true},
+		{in: "=A:10.1.2.3", wantErr: true},
+		{in: ".=NXDOMAIN", wantErr: true},
+		{in: "staging.example.com=A:fd00::3", wantErr: true},
+		{in: "staging.example.com=AAAA:10.1.2.3", wantErr: true},
+		{in: "staging.example.com=MX:mail", wantErr: true},
+		{in: "ads.example.com=NXDOMAIN:x", wantErr: true},
+		{in: "corp.example.com=FORWARD:tls://dns.example.com", wantErr: true},
+		{in: "corp.example.com=FORWARD:dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDNSOverride(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDNSOverride(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDNSOverride(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+		if err == nil {
+			if back, err := ParseDNSOverride(got.String()); err != nil || back != got {
+				t.Errorf("round trip of %q = %+v, %v", got.String(), back, err)
+			}
+		}
+	}
+}
@@ -37,6 +37,12 @@ func (src *Prefs) Clone() *Prefs {
 			}
 		}
 	}
+	dst.DNSOverrides = append(src.DNSOverrides[:0:0], src.DNSOverrides...)
+	dst.DNSBlocklistFiles = append(src.DNSBlocklistFiles[:0:0], src.DNSBlocklistFiles...)
+	dst.TrafficShaping = append(src.TrafficShaping[:0:0], src.TrafficShaping...)
+	dst.TaildropReceivePolicy = src.TaildropReceivePolicy.Clone()
+	dst.SSHRecordingPolicy = src.SSHRecordingPolicy.Clone()
+	dst.SSHUserCA = src.SSHUserCA.Clone()
 	dst.Persist = src.Persist.Clone()
 	return dst
 }
@@ -71,6 +77,16 @@ func (src *Prefs) Clone() *Prefs {
 	PostureChecking        bool
 	NetfilterKind          string
 	DriveShares            []*drive.Share
+	DNSOverrides           []DNSOverride
+	DNSBlocklistFiles      []string
+	DNSBlocklistResponse   string
+	TrafficShaping         []ShapeRule
+	FlowCollector          string
+	TaildropReceivePolicy  *TaildropReceivePolicy
+	SSHRecordingPolicy     *SSHRecordingPolicy
+	SSHUserCA              *SSHUserCA
+	NewFlowsPerSecond      int
+	NewFlowsBurst          int
 	AllowSingleHosts       marshalAsTrueInJSON
 	Persist                *persist.Persist
 }{})
@@ -89,7 +105,17 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			if v == nil {
 				dst.TCP[k] = nil
 			} else {
-				dst.TCP[k] = ptr.To(*v)
+				dst.TCP[k] = v.Clone()
+			}
+		}
+	}
+	if dst.UDP != nil {
+		dst.UDP = map[uint16]*UDPPortHandler{}
+		for k, v := range src.UDP {
+			if v == nil {
+				dst.UDP[k] = nil
+			} else {
+				dst.UDP[k] = ptr.To(*v)
 			}
 		}
 	}
@@ -120,6 +146,7 @@ func (src *ServeConfig) Clone() *ServeConfig {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigCloneNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 	Foreground  map[string]*ServeConfig
@@ -134,6 +161,7 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	}
 	dst := new(TCPPortHandler)
 	*dst = *src
+	dst.LoadBalancer = src.LoadBalancer.Clone()
 	return dst
 }
 
@@ -143,6 +171,24 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	HTTP         bool
 	TCPForward   string
 	TerminateTLS string
+	LoadBalancer *LoadBalancer
+}{})
+
+// Clone makes a deep copy of UDPPortHandler.
+// The result aliases no memory with the original.
+func (src *UDPPortHandler) Clone() *UDPPortHandler {
+	if src == nil {
+		return nil
+	}
+	dst := new(UDPPortHandler)
+	*dst = *src
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerCloneNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward         string
+	IdleTimeoutSeconds int
 }{})
 
 // Clone makes a deep copy of HTTPHandler.
@@ -153,14 +199,26 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.RequestHeaders = append(src.RequestHeaders[:0:0], src.RequestHeaders...)
+	dst.ResponseHeaders = append(src.ResponseHeaders[:0:0], src.ResponseHeaders...)
+	dst.LoadBalancer = src.LoadBalancer.Clone()
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path            string
+	Proxy           string
+	Text            string
+	Redirect        string
+	Status          int
+	RequestHeaders  []HeaderRule
+	ResponseHeaders []HeaderRule
+	LoadBalancer    *LoadBalancer
+	NoListing       bool
+	IndexFile       string
+	AllowUploads    bool
+	MaxUploadSize   int64
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -174,11 +232,13 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 	if dst.Handlers != nil {
 		dst.Handlers = map[string]*HTTPHandler{}
 		for k, v := range src.Handlers {
-			if v == nil {
-				dst.Handlers[k] = nil
-			} else {
-				dst.Handlers[k] = ptr.To(*v)
-			}
+			dst.Handlers[k] = v.Clone()
+		}
+	}
+	if dst.Allow != nil {
+		dst.Allow = map[string][]string{}
+		for k := range src.Allow {
+			dst.Allow[k] = append([]string{}, src.Allow[k]...)
 		}
 	}
 	return dst
@@ -187,4 +247,27 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _WebServerConfigCloneNeedsRegeneration = WebServerConfig(struct {
 	Handlers map[string]*HTTPHandler
+	Allow    map[string][]string
+}{})
+
+// Clone makes a deep copy of LoadBalancer.
+// The result aliases no memory with the original.
+func (src *LoadBalancer) Clone() *LoadBalancer {
+	if src == nil {
+		return nil
+	}
+	dst := new(LoadBalancer)
+	*dst = *src
+	dst.Backends = append(src.Backends[:0:0], src.Backends...)
+	if dst.HealthCheck != nil {
+		dst.HealthCheck = ptr.To(*src.HealthCheck)
+	}
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _LoadBalancerCloneNeedsRegeneration = LoadBalancer(struct {
+	Backends    []string
+	Policy      string
+	HealthCheck *HealthCheck
 }{})
@@ -18,7 +18,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,UDPPortHandler,HTTPHandler,WebServerConfig,LoadBalancer
 
 // View returns a readonly view of Prefs.
 func (p *Prefs) View() PrefsView {
@@ -97,6 +97,26 @@ func (v PrefsView) NetfilterKind() string                 { return v.ж.Netfilte
 func (v PrefsView) DriveShares() views.SliceView[*drive.Share, drive.ShareView] {
 	return views.SliceOfViews[*drive.Share, drive.ShareView](v.ж.DriveShares)
 }
+func (v PrefsView) DNSOverrides() views.Slice[DNSOverride] { return views.SliceOf(v.ж.DNSOverrides) }
+func (v PrefsView) DNSBlocklistFiles() views.Slice[string] {
+	return views.SliceOf(v.ж.DNSBlocklistFiles)
+}
+func (v PrefsView) DNSBlocklistResponse() string { return v.ж.DNSBlocklistResponse }
+func (v PrefsView) TrafficShaping() views.Slice[ShapeRule] {
+	return views.SliceOf(v.ж.TrafficShaping)
+}
+func (v PrefsView) FlowCollector() string { return v.ж.FlowCollector }
+func (v PrefsView) TaildropReceivePolicy() *TaildropReceivePolicy {
+	return v.ж.TaildropReceivePolicy.Clone()
+}
+func (v PrefsView) SSHRecordingPolicy() *SSHRecordingPolicy {
+	return v.ж.SSHRecordingPolicy.Clone()
+}
+func (v PrefsView) SSHUserCA() *SSHUserCA {
+	return v.ж.SSHUserCA.Clone()
+}
+func (v PrefsView) NewFlowsPerSecond() int                { return v.ж.NewFlowsPerSecond }
+func (v PrefsView) NewFlowsBurst() int                    { return v.ж.NewFlowsBurst }
 func (v PrefsView) AllowSingleHosts() marshalAsTrueInJSON { return v.ж.AllowSingleHosts }
 func (v PrefsView) Persist() persist.PersistView          { return v.ж.Persist.View() }
 
@@ -130,6 +150,16 @@ func (v PrefsView) Persist() persist.PersistView          { return v.ж.Persist.
 	PostureChecking        bool
 	NetfilterKind          string
 	DriveShares            []*drive.Share
+	DNSOverrides           []DNSOverride
+	DNSBlocklistFiles      []string
+	DNSBlocklistResponse   string
+	TrafficShaping         []ShapeRule
+	FlowCollector          string
+	TaildropReceivePolicy  *TaildropReceivePolicy
+	SSHRecordingPolicy     *SSHRecordingPolicy
+	SSHUserCA              *SSHUserCA
+	NewFlowsPerSecond      int
+	NewFlowsBurst          int
 	AllowSingleHosts       marshalAsTrueInJSON
 	Persist                *persist.Persist
 }{})
@@ -185,6 +215,12 @@ func (v ServeConfigView) TCP() views.MapFn[uint16, *TCPPortHandler, TCPPortHandl
 	})
 }
 
+func (v ServeConfigView) UDP() views.MapFn[uint16, *UDPPortHandler, UDPPortHandlerView] {
+	return views.MapFnOf(v.ж.UDP, func(t *UDPPortHandler) UDPPortHandlerView {
+		return t.View()
+	})
+}
+
 func (v ServeConfigView) Web() views.MapFn[HostPort, *WebServerConfig, WebServerConfigView] {
 	return views.MapFnOf(v.ж.Web, func(t *WebServerConfig) WebServerConfigView {
 		return t.View()
@@ -205,6 +241,7 @@ func (v ServeConfigView) ETag() string { return v.ж.ETag }
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigViewNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 	Foreground  map[string]*ServeConfig
@@ -260,6 +297,9 @@ func (v TCPPortHandlerView) HTTPS() bool          { return v.ж.HTTPS }
 func (v TCPPortHandlerView) HTTP() bool           { return v.ж.HTTP }
 func (v TCPPortHandlerView) TCPForward() string   { return v.ж.TCPForward }
 func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
+func (v TCPPortHandlerView) LoadBalancer() LoadBalancerView {
+	return v.ж.LoadBalancer.View()
+}
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerViewNeedsRegeneration = TCPPortHandler(struct {
@@ -267,6 +307,61 @@ func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
 	HTTP         bool
 	TCPForward   string
 	TerminateTLS string
+	LoadBalancer *LoadBalancer
+}{})
+
+// View returns a readonly view of UDPPortHandler.
+func (p *UDPPortHandler) View() UDPPortHandlerView {
+	return UDPPortHandlerView{ж: p}
+}
+
+// UDPPortHandlerView provides a read-only view over UDPPortHandler.
+//
+// Its methods should only be called if `Valid()` returns true.
+type UDPPortHandlerView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *UDPPortHandler
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v UDPPortHandlerView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v UDPPortHandlerView) AsStruct() *UDPPortHandler {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v UDPPortHandlerView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *UDPPortHandlerView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x UDPPortHandler
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v UDPPortHandlerView) UDPForward() string      { return v.ж.UDPForward }
+func (v UDPPortHandlerView) IdleTimeoutSeconds() int { return v.ж.IdleTimeoutSeconds }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerViewNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward         string
+	IdleTimeoutSeconds int
 }{})
 
 // View returns a readonly view of HTTPHandler.
@@ -314,15 +409,37 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string     { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string    { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string     { return v.ж.Text }
+func (v HTTPHandlerView) Redirect() string { return v.ж.Redirect }
+func (v HTTPHandlerView) Status() int      { return v.ж.Status }
+func (v HTTPHandlerView) RequestHeaders() views.Slice[HeaderRule] {
+	return views.SliceOf(v.ж.RequestHeaders)
+}
+func (v HTTPHandlerView) ResponseHeaders() views.Slice[HeaderRule] {
+	return views.SliceOf(v.ж.ResponseHeaders)
+}
+func (v HTTPHandlerView) LoadBalancer() LoadBalancerView { return v.ж.LoadBalancer.View() }
+func (v HTTPHandlerView) NoListing() bool                { return v.ж.NoListing }
+func (v HTTPHandlerView) IndexFile() string              { return v.ж.IndexFile }
+func (v HTTPHandlerView) AllowUploads() bool             { return v.ж.AllowUploads }
+func (v HTTPHandlerView) MaxUploadSize() int64           { return v.ж.MaxUploadSize }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path            string
+	Proxy           string
+	Text            string
+	Redirect        string
+	Status          int
+	RequestHeaders  []HeaderRule
+	ResponseHeaders []HeaderRule
+	LoadBalancer    *LoadBalancer
+	NoListing       bool
+	IndexFile       string
+	AllowUploads    bool
+	MaxUploadSize   int64
 }{})
 
 // View returns a readonly view of WebServerConfig.
@@ -376,7 +493,74 @@ func (v WebServerConfigView) Handlers() views.MapFn[string, *HTTPHandler, HTTPHa
 	})
 }
 
+func (v WebServerConfigView) Allow() views.MapSlice[string, string] {
+	return views.MapSliceOf(v.ж.Allow)
+}
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _WebServerConfigViewNeedsRegeneration = WebServerConfig(struct {
 	Handlers map[string]*HTTPHandler
+	Allow    map[string][]string
+}{})
+
+// View returns a readonly view of LoadBalancer.
+func (p *LoadBalancer) View() LoadBalancerView {
+	return LoadBalancerView{ж: p}
+}
+
+// LoadBalancerView provides a read-only view over LoadBalancer.
+//
+// Its methods should only be called if `Valid()` returns true.
+type LoadBalancerView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *LoadBalancer
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v LoadBalancerView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v LoadBalancerView) AsStruct() *LoadBalancer {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v LoadBalancerView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *LoadBalancerView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x LoadBalancer
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v LoadBalancerView) Backends() views.Slice[string] { return views.SliceOf(v.ж.Backends) }
+func (v LoadBalancerView) Policy() string                { return v.ж.Policy }
+func (v LoadBalancerView) HealthCheck() *HealthCheck {
+	if v.ж.HealthCheck == nil {
+		return nil
+	}
+	x := *v.ж.HealthCheck
+	return &x
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _LoadBalancerViewNeedsRegeneration = LoadBalancer(struct {
+	Backends    []string
+	Policy      string
+	HealthCheck *HealthCheck
 }{})
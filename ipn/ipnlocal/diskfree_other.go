@@ -0,0 +1,13 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !darwin && !freebsd && !windows
+
+package ipnlocal
+
+import "errors"
+
+// diskFree is not implemented on this platform.
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("not implemented")
+}
@@ -327,6 +327,52 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
 			},
 		},
+		{
+			name: "dns_overrides",
+			nm: &netmap.NetworkMap{
+				DNS: tailcfg.DNSConfig{
+					Resolvers: []*dnstype.Resolver{{Addr: "8.8.8.8"}},
+					Routes: map[string][]*dnstype.Resolver{
+						"corp.example.com.": {{Addr: "10.0.0.53"}},
+					},
+					ExtraRecords: []tailcfg.DNSRecord{
+						{Name: "staging.example.com", Value: "100.64.0.10"},
+						{Name: "ads.example.net", Value: "100.64.0.11"},
+					},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS: true,
+				DNSOverrides: []ipn.DNSOverride{
+					{Name: "staging.example.com", Type: "A", Value: "10.1.2.3"},
+					{Name: "staging.example.com", Type: "AAAA", Value: "fd00::3"},
+					{Name: "www.staging.example.com", Type: "CNAME", Value: "staging.example.com"},
+					{Name: "_acme.staging.example.com", Type: "TXT", Value: "token"},
+					{Name: "example.net", Type: "NXDOMAIN"},
+					{Name: "corp.example.com", Type: "FORWARD", Value: "10.9.9.9"},
+					{Name: "corp.example.com", Type: "FORWARD", Value: "tls://10.9.9.10"},
+					{Name: "bad.example.com", Type: "A", Value: "not-an-ip"},
+				},
+			},
+			want: &dns.Config{
+				DefaultResolvers: []*dnstype.Resolver{{Addr: "8.8.8.8"}},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{
+					"corp.example.com.":    {{Addr: "10.9.9.9"}, {Addr: "tls://10.9.9.10"}},
+					"example.net.":         nil,
+					"staging.example.com.": nil, // also covers the CNAME and TXT records
+				},
+				Hosts: map[dnsname.FQDN][]netip.Addr{
+					"staging.example.com.": ips("10.1.2.3", "fd00::3"),
+				},
+				TXTRecords: map[dnsname.FQDN][]string{
+					"_acme.staging.example.com.": {"token"},
+				},
+				CNAMERecords: map[dnsname.FQDN]dnsname.FQDN{
+					"www.staging.example.com.": "staging.example.com.",
+				},
+			},
+			wantLog: `[unexpected] ignoring invalid DNS override "bad.example.com=A:not-an-ip": not an IPv4 address` + "\n",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
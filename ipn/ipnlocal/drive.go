@@ -65,12 +65,21 @@ func (b *LocalBackend) DriveSetServerAddr(addr string) error {
 // replaces the existing share if one with the same name already exists. To
 // avoid potential incompatibilities across file systems, share names are
 // limited to alphanumeric characters and the underscore _.
+//
+// If the share is a snapshot share without a SnapshotAt, SnapshotAt is set to
+// now, so that setting the share again takes a new snapshot.
 func (b *LocalBackend) DriveSetShare(share *drive.Share) error {
 	var err error
 	share.Name, err = drive.NormalizeShareName(share.Name)
 	if err != nil {
 		return err
 	}
+	if err := share.Validate(); err != nil {
+		return err
+	}
+	if share.Snapshot != "" && share.SnapshotAt.IsZero() {
+		share.SnapshotAt = b.clock.Now()
+	}
 
 	b.mu.Lock()
 	shares, err := b.driveSetShareLocked(share)
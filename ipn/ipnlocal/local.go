@@ -61,8 +61,10 @@
 	"tailscale.com/log/sockstatlog"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
+	"tailscale.com/net/flowexport"
 	"tailscale.com/net/ipset"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netkernelconf"
@@ -73,6 +75,7 @@
 	"tailscale.com/net/tsdial"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
+	"tailscale.com/sessionrecording"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/taildrop"
@@ -199,6 +202,7 @@ type LocalBackend struct {
 	exposeRemoteWebClientAtomicBool atomic.Bool
 	shutdownCalled                  bool // if Shutdown has been called
 	debugSink                       *capture.Sink
+	captureFiles                    *debugCaptureFiles // last background capture to files, or nil
 	sockstatLogger                  *sockstatlog.Logger
 
 	// getTCPHandlerForFunnelFlow returns a handler for an incoming TCP flow for
@@ -220,6 +224,7 @@ type LocalBackend struct {
 	filterAtomic                 atomic.Pointer[filter.Filter]
 	containsViaIPFuncAtomic      syncs.AtomicValue[func(netip.Addr) bool]
 	shouldInterceptTCPPortAtomic syncs.AtomicValue[func(uint16) bool]
+	shouldInterceptUDPPortAtomic syncs.AtomicValue[func(uint16) bool]
 	numClientStatusCalls         atomic.Uint32
 
 	// The mutex protects the following elements.
@@ -309,6 +314,8 @@ type LocalBackend struct {
 
 	serveListeners     map[netip.AddrPort]*localListener // listeners for local serve traffic
 	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *reverseProxy
+	udpFlows           udpFlows                          // UDP flows forwarded by serve
+	serveBalancers     sync.Map                          // string (serveBalancerKey) => *serveBalancer
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -444,6 +451,7 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 	b.e.SetJailedFilter(noneFilter)
 
 	b.setTCPPortsIntercepted(nil)
+	b.setUDPPortsIntercepted(nil)
 
 	b.statusChanged = sync.NewCond(&b.statusLock)
 	b.e.SetStatusCallback(b.setWgengineStatus)
@@ -596,6 +604,50 @@ func (b *LocalBackend) SetDirectFileRoot(dir string) {
 	b.directFileRoot = dir
 }
 
+// SSHLocalRecordingPolicy returns the policy that says when Tailscale SSH
+// sessions are recorded to local disk, and how long the recordings are kept,
+// from the SSHRecordingPolicy pref.
+func (b *LocalBackend) SSHLocalRecordingPolicy() sessionrecording.LocalPolicy {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p := b.pm.CurrentPrefs().SSHRecordingPolicy(); p != nil {
+		return *p
+	}
+	return sessionrecording.LocalPolicy{}
+}
+
+// SSHUserCA returns the certificate authority that Tailscale SSH issues user
+// certificates with, from the SSHUserCA pref. Its KeyPath is empty if there
+// is none.
+func (b *LocalBackend) SSHUserCA() ipn.SSHUserCA {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ca := b.pm.CurrentPrefs().SSHUserCA(); ca != nil {
+		return *ca
+	}
+	return ipn.SSHUserCA{}
+}
+
+// SSHRecordings returns the Tailscale SSH sessions recorded to local disk,
+// oldest first.
+func (b *LocalBackend) SSHRecordings() ([]sessionrecording.Info, error) {
+	root := b.TailscaleVarRoot()
+	if root == "" {
+		return nil, errors.New("no state directory for SSH recordings")
+	}
+	return sessionrecording.List(sessionrecording.Dir(root))
+}
+
+// OpenSSHRecording opens the local recording of a Tailscale SSH session with
+// the given ID, as returned by SSHRecordings.
+func (b *LocalBackend) OpenSSHRecording(id string) (*os.File, error) {
+	root := b.TailscaleVarRoot()
+	if root == "" {
+		return nil, errors.New("no state directory for SSH recordings")
+	}
+	return sessionrecording.Open(sessionrecording.Dir(root), id)
+}
+
 // ReloadConfig reloads the backend's config from disk.
 //
 // It returns (false, nil) if not running in declarative mode, (true, nil) on
@@ -1546,6 +1598,7 @@ func (b *LocalBackend) updateNetmapDeltaLocked(muts []netmap.NodeMutation) (hand
 	for nid, n := range mutableNodes {
 		b.peers[nid] = n.View()
 	}
+	b.updateCaptureNodeLookupLocked()
 	return true
 }
 
@@ -1990,6 +2043,7 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 		localNetsB   netipx.IPSetBuilder
 		logNetsB     netipx.IPSetBuilder
 		shieldsUp    = !prefs.Valid() || prefs.ShieldsUp() // Be conservative when not ready
+		flowLimit    = newFlowLimit(prefs)
 	)
 	// Log traffic for Tailscale IPs.
 	logNetsB.AddPrefix(tsaddr.CGNATRange())
@@ -2067,7 +2121,8 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 		LogNets     []netipx.IPRange
 		ShieldsUp   bool
 		SSHPolicy   tailcfg.SSHPolicy
-	}{haveNetmap, addrs, packetFilter, localNets.Ranges(), logNets.Ranges(), shieldsUp, sshPol})
+		FlowLimit   filter.NewFlowLimit
+	}{haveNetmap, addrs, packetFilter, localNets.Ranges(), logNets.Ranges(), shieldsUp, sshPol, flowLimit})
 	if !changed {
 		return
 	}
@@ -2086,7 +2141,9 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 		b.setFilter(filter.NewShieldsUpFilter(localNets, logNets, oldFilter, b.logf))
 	} else {
 		b.logf("[v1] netmap packet filter: %v filters", len(packetFilter))
-		b.setFilter(filter.New(packetFilter, b.srcIPHasCapForFilter, localNets, logNets, oldFilter, b.logf))
+		filt := filter.New(packetFilter, b.srcIPHasCapForFilter, localNets, logNets, oldFilter, b.logf)
+		filt.SetNewFlowLimit(flowLimit)
+		b.setFilter(filt)
 	}
 	// The filter for a jailed node is the exact same as a ShieldsUp filter.
 	oldJailedFilter := b.e.GetJailedFilter()
@@ -2141,6 +2198,35 @@ func (b *LocalBackend) setFilter(f *filter.Filter) {
 	b.e.SetFilter(f)
 }
 
+// newFlowLimit returns the limit on the rate at which each peer may open new
+// TCP connections to each port on this node or the subnets it routes, from
+// the NewFlowsPerSecond and NewFlowsBurst prefs. By default, there's no
+// limit.
+func newFlowLimit(prefs ipn.PrefsView) filter.NewFlowLimit {
+	if !prefs.Valid() {
+		return filter.NewFlowLimit{}
+	}
+	rate := prefs.NewFlowsPerSecond()
+	if rate <= 0 {
+		return filter.NewFlowLimit{}
+	}
+	burst := prefs.NewFlowsBurst()
+	if burst <= 0 {
+		burst = rate
+	}
+	return filter.NewFlowLimit{PerSecond: float64(rate), Burst: int64(burst)}
+}
+
+// DebugPacketFilterLimits returns statistics about the packet filter's
+// limit on new inbound connections.
+func (b *LocalBackend) DebugPacketFilterLimits() filter.NewFlowLimitStats {
+	filt := b.filterAtomic.Load()
+	if filt == nil {
+		return filter.NewFlowLimitStats{}
+	}
+	return filt.NewFlowLimitStats()
+}
+
 var removeFromDefaultRoute = []netip.Prefix{
 	// RFC1918 LAN ranges
 	netip.MustParsePrefix("192.168.0.0/16"),
@@ -2809,6 +2895,18 @@ func (b *LocalBackend) clearMachineKeyLocked() error {
 // efficient func for ShouldInterceptTCPPort to use, which is called on every
 // incoming packet.
 func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptTCPPortAtomic.Store(portSetFunc(ports))
+}
+
+// setUDPPortsIntercepted is like setTCPPortsIntercepted, but for
+// ShouldInterceptUDPPort.
+func (b *LocalBackend) setUDPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptUDPPortAtomic.Store(portSetFunc(ports))
+}
+
+// portSetFunc returns an efficient func that reports whether a port is one
+// of ports. It sorts ports in place.
+func portSetFunc(ports []uint16) func(uint16) bool {
 	slices.Sort(ports)
 	uniq.ModifySlice(&ports)
 	var f func(uint16) bool
@@ -2839,11 +2937,12 @@ func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
 			}
 		}
 	}
-	b.shouldInterceptTCPPortAtomic.Store(f)
+	return f
 }
 
 // setAtomicValuesFromPrefsLocked populates sshAtomicBool, containsViaIPFuncAtomic,
-// shouldInterceptTCPPortAtomic, and exposeRemoteWebClientAtomicBool from the prefs p,
+// shouldInterceptTCPPortAtomic, shouldInterceptUDPPortAtomic, and
+// exposeRemoteWebClientAtomicBool from the prefs p,
 // which may be !Valid().
 func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	b.sshAtomicBool.Store(p.Valid() && p.RunSSH() && envknob.CanSSHD())
@@ -2852,6 +2951,7 @@ func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	if !p.Valid() {
 		b.containsViaIPFuncAtomic.Store(ipset.FalseContainsIPFunc())
 		b.setTCPPortsIntercepted(nil)
+		b.setUDPPortsIntercepted(nil)
 		b.lastServeConfJSON = mem.B(nil)
 		b.serveConfig = ipn.ServeConfigView{}
 	} else {
@@ -3163,9 +3263,59 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 	if err := b.checkAutoUpdatePrefsLocked(p); err != nil {
 		errs = append(errs, err)
 	}
+	for _, o := range p.DNSOverrides {
+		if err := o.Check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := checkDNSBlocklistPrefs(p); err != nil {
+		errs = append(errs, err)
+	}
+	for _, r := range p.TrafficShaping {
+		if err := r.Check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.FlowCollector != "" {
+		if _, _, err := flowexport.ParseCollector(p.FlowCollector); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.TaildropReceivePolicy != nil {
+		if err := p.TaildropReceivePolicy.Check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.SSHRecordingPolicy != nil {
+		if err := p.SSHRecordingPolicy.Check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.SSHUserCA != nil {
+		if err := p.SSHUserCA.Check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.NewFlowsPerSecond < 0 || p.NewFlowsBurst < 0 {
+		errs = append(errs, errors.New("new flow limits may not be negative"))
+	}
 	return multierr.New(errs...)
 }
 
+func checkDNSBlocklistPrefs(p *ipn.Prefs) error {
+	switch p.DNSBlocklistResponse {
+	case "", "nxdomain", "zero":
+	default:
+		return fmt.Errorf("invalid DNS blocklist response %q; want \"nxdomain\" or \"zero\"", p.DNSBlocklistResponse)
+	}
+	for _, f := range p.DNSBlocklistFiles {
+		if !filepath.IsAbs(f) {
+			return fmt.Errorf("DNS blocklist file %q must be an absolute path", f)
+		}
+	}
+	return nil
+}
+
 func (b *LocalBackend) checkSSHPrefsLocked(p *ipn.Prefs) error {
 	if !p.RunSSH {
 		return nil
@@ -3439,6 +3589,10 @@ func (b *LocalBackend) setPrefsLockedOnEntry(newp *ipn.Prefs, unlock unlockOnce)
 
 	b.updateFilterLocked(netMap, newp.View())
 
+	if b.peerAPIServer != nil && !oldp.TaildropReceivePolicy().Equal(newp.TaildropReceivePolicy) {
+		b.peerAPIServer.taildrop.SetReceivePolicy(newp.TaildropReceivePolicy)
+	}
+
 	if oldp.ShouldSSHBeRunning() && !newp.ShouldSSHBeRunning() {
 		if b.sshServer != nil {
 			go b.sshServer.Shutdown()
@@ -3764,6 +3918,19 @@ func (b *LocalBackend) reconfigAppConnectorLocked(nm *netmap.NetworkMap, prefs i
 	b.appConnector.UpdateDomainsAndRoutes(domains, routes)
 }
 
+// reconfigDNSBlocklist applies the DNS blocklist in prefs to queries from
+// peers using this node as an exit node.
+func (b *LocalBackend) reconfigDNSBlocklist(prefs ipn.PrefsView) {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return
+	}
+	r.SetBlocklist(resolver.BlocklistConfig{
+		Files:  prefs.DNSBlocklistFiles().AsSlice(),
+		ZeroIP: prefs.DNSBlocklistResponse() == "zero",
+	})
+}
+
 // authReconfig pushes a new configuration into wgengine, if engine
 // updates are not currently blocked, based on the cached netmap and
 // user prefs.
@@ -3777,10 +3944,14 @@ func (b *LocalBackend) authReconfig() {
 	userDialUseRoutes := nm.HasCap(tailcfg.NodeAttrUserDialUseRoutes)
 	dohURL, dohURLOK := exitNodeCanProxyDNS(nm, b.peers, prefs.ExitNodeID())
 	dcfg := dnsConfigForNetmap(nm, b.peers, prefs, b.logf, version.OS())
+	shapeLimits := shapeLimitsForNetmap(nm, b.peers, prefs, b.logf)
 	// If the current node is an app connector, ensure the app connector machine is started
 	b.reconfigAppConnectorLocked(nm, prefs)
 	b.mu.Unlock()
 
+	b.reconfigDNSBlocklist(prefs)
+	b.reconfigShaping(shapeLimits)
+
 	if blocked {
 		b.logf("[v1] authReconfig: blocked, skipping.")
 		return
@@ -3819,6 +3990,7 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("wgcfg: %v", err)
 		return
 	}
+	cfg.NetworkLogging.Collector = prefs.FlowCollector()
 
 	oneCGNATRoute := shouldUseOneCGNATRoute(b.logf, b.sys.ControlKnobs(), version.OS())
 	rcfg := b.routerConfig(cfg, prefs, oneCGNATRoute)
@@ -3957,6 +4129,7 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 		}
 		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
 	}
+	addDNSOverrideRecords(dcfg, prefs.DNSOverrides(), logf)
 
 	if !prefs.CorpDNS() {
 		return dcfg
@@ -3983,6 +4156,7 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 	// to run a DoH DNS proxy, then send all our DNS traffic through it.
 	if dohURL, ok := exitNodeCanProxyDNS(nm, peers, prefs.ExitNodeID()); ok {
 		addDefault([]*dnstype.Resolver{{Addr: dohURL}})
+		addDNSOverrideRoutes(dcfg, prefs.DNSOverrides())
 		return dcfg
 	}
 
@@ -4043,9 +4217,111 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 		// No settings requiring split DNS, no problem.
 	}
 
+	addDNSOverrideRoutes(dcfg, prefs.DNSOverrides())
 	return dcfg
 }
 
+// addDNSOverrideRecords adds the records from the local DNS overrides to
+// dcfg. They replace any records from the control plane for the same names,
+// and the control plane's records for names blocked by an NXDOMAIN override
+// are removed.
+func addDNSOverrideRecords(dcfg *dns.Config, overrides views.Slice[ipn.DNSOverride], logf logger.Logf) {
+	if overrides.Len() == 0 {
+		return
+	}
+	// Remove what the overrides replace first, so that overrides for the
+	// same name accumulate.
+	for i := range overrides.Len() {
+		o := overrides.At(i)
+		fqdn, err := dnsname.ToFQDN(o.Name)
+		if err != nil {
+			continue
+		}
+		switch o.Type {
+		case ipn.DNSOverrideA, ipn.DNSOverrideAAAA, ipn.DNSOverrideCNAME:
+			delete(dcfg.Hosts, fqdn)
+		case ipn.DNSOverrideNXDOMAIN:
+			for host := range dcfg.Hosts {
+				if fqdn.Contains(host) {
+					delete(dcfg.Hosts, host)
+				}
+			}
+		}
+	}
+	for i := range overrides.Len() {
+		o := overrides.At(i)
+		if err := o.Check(); err != nil {
+			logf("[unexpected] ignoring %v", err)
+			continue
+		}
+		fqdn, _ := dnsname.ToFQDN(o.Name)
+		switch o.Type {
+		case ipn.DNSOverrideA, ipn.DNSOverrideAAAA:
+			dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], netip.MustParseAddr(o.Value))
+		case ipn.DNSOverrideTXT:
+			mak.Set(&dcfg.TXTRecords, fqdn, append(dcfg.TXTRecords[fqdn], o.Value))
+		case ipn.DNSOverrideCNAME:
+			target, _ := dnsname.ToFQDN(o.Value)
+			mak.Set(&dcfg.CNAMERecords, fqdn, target)
+		}
+	}
+}
+
+// addDNSOverrideRoutes adds the routes from the local DNS overrides to dcfg,
+// replacing any routes from the control plane for the same suffixes. An
+// NXDOMAIN override makes quad-100 authoritative for its suffix, and takes
+// precedence over a FORWARD override for the same suffix. Names with local
+// records that no route covers get a route to quad-100 of their own.
+func addDNSOverrideRoutes(dcfg *dns.Config, overrides views.Slice[ipn.DNSOverride]) {
+	if overrides.Len() == 0 {
+		return
+	}
+	var forwarded set.Set[dnsname.FQDN] // suffixes with routes from overrides
+	for i := range overrides.Len() {
+		o := overrides.At(i)
+		if o.Type != ipn.DNSOverrideForward || o.Check() != nil {
+			continue
+		}
+		fqdn, _ := dnsname.ToFQDN(o.Name)
+		if !forwarded.Contains(fqdn) {
+			forwarded.Make()
+			forwarded.Add(fqdn)
+			dcfg.Routes[fqdn] = nil
+		}
+		dcfg.Routes[fqdn] = append(dcfg.Routes[fqdn], &dnstype.Resolver{Addr: o.Value})
+	}
+	for i := range overrides.Len() {
+		o := overrides.At(i)
+		if o.Type != ipn.DNSOverrideNXDOMAIN || o.Check() != nil {
+			continue
+		}
+		fqdn, _ := dnsname.ToFQDN(o.Name)
+		dcfg.Routes[fqdn] = nil // resolve internally, with no records
+	}
+	for i := range overrides.Len() {
+		o := overrides.At(i)
+		switch o.Type {
+		case ipn.DNSOverrideA, ipn.DNSOverrideAAAA, ipn.DNSOverrideTXT, ipn.DNSOverrideCNAME:
+		default:
+			continue
+		}
+		if o.Check() != nil {
+			continue
+		}
+		fqdn, _ := dnsname.ToFQDN(o.Name)
+		covered := false
+		for suffix := range dcfg.Routes {
+			if suffix.Contains(fqdn) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			dcfg.Routes[fqdn] = nil // resolve internally with dcfg.Hosts
+		}
+	}
+}
+
 // SetTCPHandlerForFunnelFlow sets the TCP handler for Funnel flows.
 // It should only be called before the LocalBackend is used.
 func (b *LocalBackend) SetTCPHandlerForFunnelFlow(h func(src netip.AddrPort, dstPort uint16) (handler func(net.Conn))) {
@@ -4183,6 +4459,10 @@ func (b *LocalBackend) initPeerAPIListener() {
 		b.logf("peerapi starting without Taildrop directory configured")
 	}
 
+	var taildropPolicy taildrop.ReceivePolicy
+	if p := b.pm.CurrentPrefs().TaildropReceivePolicy(); p != nil {
+		taildropPolicy = *p
+	}
 	ps := &peerAPIServer{
 		b: b,
 		taildrop: taildrop.ManagerOptions{
@@ -4192,6 +4472,8 @@ func (b *LocalBackend) initPeerAPIListener() {
 			Dir:            fileRoot,
 			DirectFileMode: b.directFileRoot != "",
 			SendFileNotify: b.sendFileNotify,
+			ReceivePolicy:  taildropPolicy,
+			TransferDone:   b.sendFileTransferNotify,
 		}.New(),
 	}
 	if dm, ok := b.sys.DNSManager.GetOK(); ok {
@@ -4993,6 +5275,7 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 	}
 	b.netMap = nm
 	b.updatePeersFromNetmapLocked(nm)
+	b.updateCaptureNodeLookupLocked()
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
 		b.activeLogin = login
@@ -5298,8 +5581,9 @@ func (b *LocalBackend) reloadServeConfigLocked(prefs ipn.PrefsView) {
 	b.serveConfig = conf.View()
 }
 
-// setTCPPortsInterceptedFromNetmapAndPrefsLocked calls setTCPPortsIntercepted with
-// the ports that tailscaled should handle as a function of b.netMap and b.prefs.
+// setTCPPortsInterceptedFromNetmapAndPrefsLocked calls setTCPPortsIntercepted
+// and setUDPPortsIntercepted with the ports that tailscaled should handle as
+// a function of b.netMap and b.prefs.
 //
 // b.mu must be held.
 func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.PrefsView) {
@@ -5318,7 +5602,14 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.reloadServeConfigLocked(prefs)
+	var udpPorts []uint16
 	if b.serveConfig.Valid() {
+		b.serveConfig.RangeOverUDPs(func(port uint16, _ ipn.UDPPortHandlerView) bool {
+			if port > 0 {
+				udpPorts = append(udpPorts, port)
+			}
+			return true
+		})
 		servePorts := make([]uint16, 0, 3)
 		b.serveConfig.RangeOverTCPs(func(port uint16, _ ipn.TCPPortHandlerView) bool {
 			if port > 0 {
@@ -5335,6 +5626,7 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 			b.updateServeTCPPortNetMapAddrListenersLocked(servePorts)
 		}
 	}
+	b.setServeBalancersLocked()
 	// Kick off a Hostinfo update to control if WireIngress changed.
 	if wire := b.wantIngressLocked(); b.hostinfo != nil && b.hostinfo.WireIngress != wire {
 		b.logf("Hostinfo.WireIngress changed to %v", wire)
@@ -5343,6 +5635,7 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.setTCPPortsIntercepted(handlePorts)
+	b.setUDPPortsIntercepted(udpPorts)
 }
 
 // setServeProxyHandlersLocked ensures there is an http proxy handler for each
@@ -5355,25 +5648,30 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	var backends map[string]bool
 	b.serveConfig.RangeOverWebs(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
 		conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
-			backend := h.Proxy()
-			if backend == "" {
+			if h.Proxy() == "" {
 				// Only create proxy handlers for servers with a proxy backend.
 				return true
 			}
-			mak.Set(&backends, backend, true)
-			if _, ok := b.serveProxyHandlers.Load(backend); ok {
-				return true
+			hb := []string{h.Proxy()}
+			if lb := h.LoadBalancer(); lb.Valid() {
+				hb = append(hb, lb.Backends().AsSlice()...)
 			}
+			for _, backend := range hb {
+				mak.Set(&backends, backend, true)
+				if _, ok := b.serveProxyHandlers.Load(backend); ok {
+					continue
+				}
 
-			b.logf("serve: creating a new proxy handler for %s", backend)
-			p, err := b.proxyHandlerForBackend(backend)
-			if err != nil {
-				// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
-				// in the CLI, so just log the error here.
-				b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
-				return true
+				b.logf("serve: creating a new proxy handler for %s", backend)
+				p, err := b.proxyHandlerForBackend(backend)
+				if err != nil {
+					// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
+					// in the CLI, so just log the error here.
+					b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+					continue
+				}
+				b.serveProxyHandlers.Store(backend, p)
 			}
-			b.serveProxyHandlers.Store(backend, p)
 			return true
 		})
 		return true
@@ -6165,6 +6463,13 @@ func (b *LocalBackend) ShouldInterceptTCPPort(port uint16) bool {
 	return b.shouldInterceptTCPPortAtomic.Load()(port)
 }
 
+// ShouldInterceptUDPPort reports whether the given UDP port number to a
+// Tailscale IP should be intercepted by Tailscaled and forwarded in-process,
+// as configured by ServeConfig.UDP.
+func (b *LocalBackend) ShouldInterceptUDPPort(port uint16) bool {
+	return b.shouldInterceptUDPPortAtomic.Load()(port)
+}
+
 // SwitchProfile switches to the profile with the given id.
 // It will restart the backend on success.
 // If the profile is not known, it returns an errProfileNotFound.
@@ -6344,14 +6649,15 @@ func (b *LocalBackend) ResetAuth() error {
 	return b.resetForProfileChangeLockedOnEntry(unlock)
 }
 
-// StreamDebugCapture writes a pcap stream of packets traversing
-// tailscaled to the provided response writer.
-func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) error {
+// StreamDebugCapture writes a capture of packets traversing tailscaled to
+// the provided writer, until ctx is done.
+func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer, opts capture.OutputOpts) error {
 	var s *capture.Sink
 
 	b.mu.Lock()
 	if b.debugSink == nil {
 		s = capture.New()
+		s.SetNodeLookup(b.captureNodeLookupLocked())
 		b.debugSink = s
 		b.e.InstallCaptureHook(s.LogPacket)
 	} else {
@@ -6359,7 +6665,7 @@ func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) erro
 	}
 	b.mu.Unlock()
 
-	unregister := s.RegisterOutput(w)
+	unregister := s.RegisterOutputOpts(w, opts)
 
 	select {
 	case <-ctx.Done():
@@ -6386,6 +6692,161 @@ func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) erro
 	return nil
 }
 
+// debugCaptureFiles is a background debug capture to rotated files, started
+// by StartDebugCaptureFiles.
+type debugCaptureFiles struct {
+	rot    *capture.FileRotator
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the capture stops
+
+	mu sync.Mutex
+	st apitype.DebugCaptureFilesStatus
+}
+
+func (c *debugCaptureFiles) status() apitype.DebugCaptureFilesStatus {
+	c.mu.Lock()
+	st := c.st
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+	default:
+		st.Running = true
+	}
+	st.Files = c.rot.Files()
+	return st
+}
+
+// StartDebugCaptureFiles starts a debug capture in the background to a ring
+// of at most maxFiles pcapng files of maxFileSize bytes each, in the
+// "captures" subdirectory of the state directory. If maxTotalSize is
+// positive, the oldest files in that directory, including those of earlier
+// captures, are deleted to keep its total size under it. The capture runs
+// until StopDebugCaptureFiles is called or b shuts down.
+func (b *LocalBackend) StartDebugCaptureFiles(opts capture.OutputOpts, maxFileSize int64, maxFiles int, maxTotalSize int64) (apitype.DebugCaptureFilesStatus, error) {
+	varRoot := b.TailscaleVarRoot()
+	if varRoot == "" {
+		return apitype.DebugCaptureFilesStatus{}, errors.New("no state directory to write captures to")
+	}
+	opts.Format = capture.PCAPNG
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.captureFiles; c != nil && c.status().Running {
+		return apitype.DebugCaptureFilesStatus{}, errors.New("a capture to files is already running")
+	}
+	rot, err := capture.NewFileRotator(filepath.Join(varRoot, "captures"), opts.Format, maxFileSize, maxFiles)
+	if err != nil {
+		return apitype.DebugCaptureFilesStatus{}, err
+	}
+	rot.SetMaxDirSize(maxTotalSize)
+	ctx, cancel := context.WithCancel(b.ctx)
+	c := &debugCaptureFiles{
+		rot:    rot,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		st: apitype.DebugCaptureFilesStatus{
+			Started:      b.clock.Now(),
+			Pattern:      rot.Pattern(),
+			MaxFileSize:  maxFileSize,
+			MaxFiles:     maxFiles,
+			MaxTotalSize: maxTotalSize,
+		},
+	}
+	if opts.Filter != nil {
+		c.st.Filter = opts.Filter.String()
+	}
+	b.captureFiles = c
+	go func() {
+		// Stop the capture if writing the files fails.
+		select {
+		case <-rot.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer close(c.done)
+		err := b.StreamDebugCapture(ctx, rot, opts)
+		if cerr := rot.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			b.logf("debug capture to files: %v", err)
+			c.mu.Lock()
+			c.st.Err = err.Error()
+			c.mu.Unlock()
+		}
+	}()
+	return c.status(), nil
+}
+
+// StopDebugCaptureFiles stops the background debug capture to files, and
+// returns its final status.
+func (b *LocalBackend) StopDebugCaptureFiles() (apitype.DebugCaptureFilesStatus, error) {
+	b.mu.Lock()
+	c := b.captureFiles
+	b.mu.Unlock()
+	if c == nil || !c.status().Running {
+		return apitype.DebugCaptureFilesStatus{}, errors.New("no capture to files is running")
+	}
+	c.cancel()
+	<-c.done
+	return c.status(), nil
+}
+
+// DebugCaptureFilesStatus returns the status of the background debug capture
+// to files, or of the last one if none is running.
+func (b *LocalBackend) DebugCaptureFilesStatus() apitype.DebugCaptureFilesStatus {
+	b.mu.Lock()
+	c := b.captureFiles
+	b.mu.Unlock()
+	if c == nil {
+		return apitype.DebugCaptureFilesStatus{}
+	}
+	return c.status()
+}
+
+// updateCaptureNodeLookupLocked updates the node lookup of the running debug
+// capture, if any, after b.netMap or b.peers changed.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateCaptureNodeLookupLocked() {
+	if b.debugSink != nil {
+		b.debugSink.SetNodeLookup(b.captureNodeLookupLocked())
+	}
+}
+
+// captureNodeLookupLocked returns a func that maps the Tailscale IPs of this
+// node and its peers to their MagicDNS names and node keys, as of b.netMap
+// and b.peers, for debug captures.
+//
+// b.mu must be held.
+func (b *LocalBackend) captureNodeLookupLocked() func(netip.Addr) (capture.NodeInfo, bool) {
+	var nodes map[netip.Addr]capture.NodeInfo
+	add := func(n tailcfg.NodeView) {
+		ni := capture.NodeInfo{
+			Name: strings.TrimSuffix(n.Name(), "."),
+			Key:  n.Key(),
+		}
+		addrs := n.Addresses()
+		for i := range addrs.Len() {
+			if pfx := addrs.At(i); pfx.IsSingleIP() {
+				mak.Set(&nodes, pfx.Addr(), ni)
+			}
+		}
+	}
+	if b.netMap != nil && b.netMap.SelfNode.Valid() {
+		add(b.netMap.SelfNode)
+	}
+	for _, p := range b.peers {
+		add(p)
+	}
+	return func(ip netip.Addr) (capture.NodeInfo, bool) {
+		ni, ok := nodes[ip]
+		return ni, ok
+	}
+}
+
 func (b *LocalBackend) GetPeerEndpointChanges(ctx context.Context, ip netip.Addr) ([]magicsock.EndpointChange, error) {
 	pip, ok := b.e.PeerForIP(ip)
 	if !ok {
@@ -6416,6 +6877,66 @@ func (b *LocalBackend) DebugBreakDERPConns() error {
 	return b.MagicConn().DebugBreakDERPConns()
 }
 
+// dnsResolver returns the MagicDNS (quad-100) resolver.
+func (b *LocalBackend) dnsResolver() (*resolver.Resolver, error) {
+	dm, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, errors.New("no DNS manager")
+	}
+	return dm.Resolver(), nil
+}
+
+// DebugDNSCacheStats returns statistics about the MagicDNS resolver's cache of
+// upstream DNS responses.
+func (b *LocalBackend) DebugDNSCacheStats() (resolver.CacheStats, error) {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return resolver.CacheStats{}, err
+	}
+	return r.CacheStats(), nil
+}
+
+// DebugDNSBlocklistStats returns statistics about the blocklist applied to
+// exit node clients' DNS queries.
+func (b *LocalBackend) DebugDNSBlocklistStats() (resolver.BlocklistStats, error) {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return resolver.BlocklistStats{}, err
+	}
+	return r.BlocklistStats(), nil
+}
+
+// DNSQueryLog returns a snapshot of the MagicDNS resolver's query log.
+func (b *LocalBackend) DNSQueryLog() (dnstype.QueryLog, error) {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return dnstype.QueryLog{}, err
+	}
+	return r.QueryLog(), nil
+}
+
+// SetDNSQueryLogSize sets the number of entries retained in the MagicDNS
+// resolver's query log. Zero disables the query log.
+func (b *LocalBackend) SetDNSQueryLogSize(n int) error {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return err
+	}
+	r.SetQueryLogSize(n)
+	return nil
+}
+
+// WatchDNSQueryLog registers ch to receive new entries in the MagicDNS
+// resolver's query log, whether or not the query log is enabled. The caller
+// must call unregister when done.
+func (b *LocalBackend) WatchDNSQueryLog(ch chan<- dnstype.QueryLogEntry) (unregister func(), err error) {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return nil, err
+	}
+	return r.RegisterQueryLogWatcher(ch), nil
+}
+
 func (b *LocalBackend) pushSelfUpdateProgress(up ipnstate.UpdateProgress) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
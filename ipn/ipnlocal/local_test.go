@@ -53,6 +53,7 @@
 	"tailscale.com/util/set"
 	"tailscale.com/util/syspolicy"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -3998,3 +3999,70 @@ func TestFillAllowedSuggestions(t *testing.T) {
 		})
 	}
 }
+
+func TestDebugCaptureFiles(t *testing.T) {
+	b := newTestLocalBackend(t)
+	b.SetVarRoot(t.TempDir())
+
+	if st := b.DebugCaptureFilesStatus(); st.Running || !st.Started.IsZero() {
+		t.Fatalf("initial status = %+v; want zero", st)
+	}
+	if _, err := b.StopDebugCaptureFiles(); err == nil {
+		t.Error("stopping with no capture running succeeded")
+	}
+	st, err := b.StartDebugCaptureFiles(capture.OutputOpts{}, 1<<20, 2, 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Running || st.MaxFiles != 2 || st.MaxTotalSize != 4<<20 {
+		t.Errorf("status after start = %+v", st)
+	}
+	if _, err := b.StartDebugCaptureFiles(capture.OutputOpts{}, 1<<20, 2, 4<<20); err == nil {
+		t.Error("starting a second capture succeeded")
+	}
+	// The capture outlives any request that started it.
+	if st := b.DebugCaptureFilesStatus(); !st.Running {
+		t.Error("capture not running")
+	}
+	st, err = b.StopDebugCaptureFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Running {
+		t.Error("capture still running after stop")
+	}
+	if st.Err != "" || len(st.Files) != 1 {
+		t.Errorf("status after stop = %+v; want one file and no error", st)
+	}
+	if _, err := b.StartDebugCaptureFiles(capture.OutputOpts{}, 1<<20, 2, 4<<20); err != nil {
+		t.Errorf("restarting capture: %v", err)
+	}
+	if st, _ := b.StopDebugCaptureFiles(); st.Err != "" || len(st.Files) != 1 {
+		t.Errorf("status after restart = %+v; want one file and no error", st)
+	}
+}
+
+func TestNewFlowLimitFromPrefs(t *testing.T) {
+	b := newTestLocalBackend(t)
+	tests := []struct {
+		name        string
+		rate, burst int
+		want        filter.NewFlowLimit
+	}{
+		{"none", 0, 0, filter.NewFlowLimit{}},
+		{"rate", 10, 0, filter.NewFlowLimit{PerSecond: 10, Burst: 10}},
+		{"rate_and_burst", 10, 50, filter.NewFlowLimit{PerSecond: 10, Burst: 50}},
+		{"removed", 0, 50, filter.NewFlowLimit{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefs := &ipn.Prefs{NewFlowsPerSecond: tt.rate, NewFlowsBurst: tt.burst}
+			b.mu.Lock()
+			b.updateFilterLocked(&netmap.NetworkMap{}, prefs.View())
+			b.mu.Unlock()
+			if got := b.DebugPacketFilterLimits().Limit; got != tt.want {
+				t.Errorf("limit = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
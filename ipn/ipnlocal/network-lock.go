@@ -1041,6 +1041,108 @@ func (b *LocalBackend) NetworkLockSubmitRecoveryAUM(aum *tka.AUM) error {
 	return err
 }
 
+// NetworkLockPrepareBundle returns a bundle of unsigned AUMs which add and/or
+// remove keys in the tailnet's key authority, to be signed offline with
+// NetworkLockSignBundle or tka.Bundle.Sign, and then submitted with
+// NetworkLockSubmitBundle.
+//
+// Unlike NetworkLockModify, this node needn't have a trusted key.
+func (b *LocalBackend) NetworkLockPrepareBundle(addKeys, removeKeys []tka.Key) (*tka.Bundle, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tka == nil {
+		return nil, errNetworkLockNotActive
+	}
+
+	updater := b.tka.authority.NewUpdater(nil)
+	for _, addKey := range addKeys {
+		if err := updater.AddKey(addKey); err != nil {
+			return nil, err
+		}
+	}
+	for _, removeKey := range removeKeys {
+		keyID, err := removeKey.ID()
+		if err != nil {
+			return nil, err
+		}
+		if err := updater.RemoveKey(keyID); err != nil {
+			return nil, err
+		}
+	}
+	aums, err := updater.Finalize(b.tka.storage)
+	if err != nil {
+		return nil, err
+	}
+	return tka.NewBundle(aums)
+}
+
+// NetworkLockSignBundle signs the AUMs in bundle with this node's tailnet
+// lock key. It doesn't need network lock to be active, or the node to be
+// connected, so that it can be used on offline signing nodes.
+func (b *LocalBackend) NetworkLockSignBundle(bundle *tka.Bundle) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var nlPriv key.NLPrivate
+	if p := b.pm.CurrentPrefs(); p.Valid() && p.Persist().Valid() {
+		nlPriv = p.Persist().NetworkLockKey()
+	}
+	if nlPriv.IsZero() {
+		return errors.New("this node has no tailnet lock key")
+	}
+	if b.tka != nil && !b.tka.authority.KeyTrusted(nlPriv.KeyID()) {
+		return errors.New("this node does not have a trusted tailnet lock key")
+	}
+	return bundle.Sign(nlPriv)
+}
+
+// NetworkLockSubmitBundle transmits the signed AUMs in bundle to the control
+// plane. It fails if the head of the key authority has changed since the
+// bundle was prepared.
+func (b *LocalBackend) NetworkLockSubmitBundle(bundle *tka.Bundle) error {
+	aums, err := bundle.Decode()
+	if err != nil {
+		return err
+	}
+	for i, aum := range aums {
+		if len(aum.Signatures) == 0 {
+			return fmt.Errorf("AUM %d is not signed", i+1)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tka == nil {
+		return errNetworkLockNotActive
+	}
+	var ourNodeKey key.NodePublic
+	if p := b.pm.CurrentPrefs(); p.Valid() && p.Persist().Valid() && !p.Persist().PrivateNodeKey().IsZero() {
+		ourNodeKey = p.Persist().PublicNodeKey()
+	}
+	if ourNodeKey.IsZero() {
+		return errors.New("no node-key: is tailscale logged in?")
+	}
+	head := b.tka.authority.Head()
+	if head != bundle.Parent {
+		return fmt.Errorf("tailnet lock head is %v, but the bundle was prepared for %v; prepare it again", head, bundle.Parent)
+	}
+
+	b.mu.Unlock()
+	resp, err := b.tkaDoSyncSend(ourNodeKey, head, aums, true)
+	b.mu.Lock()
+	if err != nil {
+		return err
+	}
+
+	var controlHead tka.AUMHash
+	if err := controlHead.UnmarshalText([]byte(resp.Head)); err != nil {
+		return err
+	}
+	if lastHead := aums[len(aums)-1].Hash(); controlHead != lastHead {
+		return errors.New("central tka head differs from submitted AUMs, try again")
+	}
+	return nil
+}
+
 var tkaSuffixEncoder = base64.RawStdEncoding
 
 // NetworkLockWrapPreauthKey wraps a pre-auth key with information to
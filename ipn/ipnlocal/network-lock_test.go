@@ -14,6 +14,7 @@
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	go4mem "go4.org/mem"
@@ -1293,3 +1294,143 @@ type addDetails struct {
 		})
 	}
 }
+
+func TestTKAOfflineBundleFlow(t *testing.T) {
+	nodePriv := key.NewNode()
+	nlPriv := key.NewNLPrivate() // untrusted
+	offlinePriv := key.NewNLPrivate()
+	newPriv := key.NewNLPrivate()
+
+	pm := must.Get(newProfileManager(new(mem.Store), t.Logf, new(health.Tracker)))
+	must.Do(pm.SetPrefs((&ipn.Prefs{
+		Persist: &persist.Persist{
+			PrivateNodeKey: nodePriv,
+			NetworkLockKey: nlPriv,
+		},
+	}).View(), ipn.NetworkProfile{}))
+
+	// Make a fake TKA authority, to seed local state.
+	disablementSecret := bytes.Repeat([]byte{0xa5}, 32)
+	offlineKey := tka.Key{Kind: tka.Key25519, Public: offlinePriv.Public().Verifier(), Votes: 2}
+	newKey := tka.Key{Kind: tka.Key25519, Public: newPriv.Public().Verifier(), Votes: 1}
+
+	temp := t.TempDir()
+	tkaPath := filepath.Join(temp, "tka-profile", string(pm.CurrentProfile().ID))
+	os.Mkdir(tkaPath, 0755)
+	chonk, err := tka.ChonkDir(tkaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, _, err := tka.Create(chonk, tka.State{
+		Keys:               []tka.Key{offlineKey},
+		DisablementSecrets: [][]byte{tka.DisablementKDF(disablementSecret)},
+	}, offlinePriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+
+	// The control plane has its own copy of the authority.
+	controlChonk := &tka.Mem{}
+	controlAuthority, _, err := tka.Create(controlChonk, tka.State{
+		Keys:               []tka.Key{offlineKey},
+		DisablementSecrets: [][]byte{tka.DisablementKDF(disablementSecret)},
+	}, offlinePriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+
+	ts, client := fakeNoiseServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		switch r.URL.Path {
+		case "/machine/tka/sync/send":
+			body := new(tailcfg.TKASyncSendRequest)
+			if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+				t.Fatal(err)
+			}
+			toApply := make([]tka.AUM, len(body.MissingAUMs))
+			for i, a := range body.MissingAUMs {
+				if err := toApply[i].Unserialize(a); err != nil {
+					t.Fatalf("decoding missingAUM[%d]: %v", i, err)
+				}
+			}
+			if err := controlAuthority.Inform(controlChonk, toApply); err != nil {
+				t.Errorf("bundled AUMs could not be applied: %v", err)
+			}
+			if !controlAuthority.KeyTrusted(newPriv.KeyID()) {
+				t.Error("new key was not added")
+			}
+
+			head, err := controlAuthority.Head().MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.WriteHeader(200)
+			if err := json.NewEncoder(w).Encode(tailcfg.TKASyncSendResponse{Head: string(head)}); err != nil {
+				t.Fatal(err)
+			}
+
+		default:
+			t.Errorf("unhandled endpoint path: %v", r.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	cc := fakeControlClient(t, client)
+	b := LocalBackend{
+		varRoot: temp,
+		cc:      cc,
+		ccAuto:  cc,
+		logf:    t.Logf,
+		tka: &tkaState{
+			authority: authority,
+			storage:   chonk,
+		},
+		pm:    pm,
+		store: pm.Store(),
+	}
+
+	bundle, err := b.NetworkLockPrepareBundle([]tka.Key{newKey}, nil)
+	if err != nil {
+		t.Fatalf("NetworkLockPrepareBundle() failed: %v", err)
+	}
+	if err := b.NetworkLockSignBundle(bundle); err == nil {
+		t.Error("NetworkLockSignBundle() with an untrusted key succeeded")
+	}
+	if err := b.NetworkLockSubmitBundle(bundle); err == nil {
+		t.Error("NetworkLockSubmitBundle() of an unsigned bundle succeeded")
+	}
+
+	// Sign on an offline node, with no tailnet lock state.
+	{
+		pm := must.Get(newProfileManager(new(mem.Store), t.Logf, new(health.Tracker)))
+		must.Do(pm.SetPrefs((&ipn.Prefs{
+			Persist: &persist.Persist{
+				NetworkLockKey: offlinePriv,
+			},
+		}).View(), ipn.NetworkProfile{}))
+		b := LocalBackend{
+			logf:  t.Logf,
+			pm:    pm,
+			store: pm.Store(),
+		}
+		if err := b.NetworkLockSignBundle(bundle); err != nil {
+			t.Fatalf("NetworkLockSignBundle() failed: %v", err)
+		}
+	}
+
+	if err := b.NetworkLockSubmitBundle(bundle); err != nil {
+		t.Errorf("NetworkLockSubmitBundle() failed: %v", err)
+	}
+
+	// Once the changes have synced here, the bundle is stale.
+	aums, err := bundle.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authority.Inform(chonk, aums); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.NetworkLockSubmitBundle(bundle); err == nil || !strings.Contains(err.Error(), "prepare it again") {
+		t.Errorf("NetworkLockSubmitBundle() of a stale bundle = %v; want head mismatch", err)
+	}
+}
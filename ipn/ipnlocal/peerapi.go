@@ -29,6 +29,7 @@
 	"github.com/kortschak/wol"
 	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/http/httpguts"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/drive"
 	"tailscale.com/envknob"
 	"tailscale.com/health"
@@ -319,6 +320,13 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handlePeerPut(w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/v0/bundle/") {
+		if r.Method == "PUT" {
+			metricPutCalls.Add(1)
+		}
+		h.handlePeerBundle(w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/dns-query") {
 		metricDNSCalls.Add(1)
 		h.handleDNSQuery(w, r)
@@ -708,7 +716,6 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		}
 	case "PUT":
 		t0 := h.ps.b.clock.Now()
-		id := taildrop.ClientID(h.peerNode.StableID())
 
 		var offset int64
 		if rangeHdr := r.Header.Get("Range"); rangeHdr != "" {
@@ -719,18 +726,24 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 			}
 			offset = ranges[0].Start
 		}
-		n, err := h.ps.taildrop.PutFile(taildrop.ClientID(fmt.Sprint(id)), baseName, r.Body, offset, r.ContentLength)
-		switch err {
-		case nil:
+		n, err := h.ps.taildrop.PutFile(h.taildropSender(), baseName, r.Body, offset, r.ContentLength)
+		switch {
+		case err == nil:
 			d := h.ps.b.clock.Since(t0).Round(time.Second / 10)
 			h.logf("got put of %s in %v from %v/%v", approxSize(n), d, h.remoteAddr.Addr(), h.peerNode.ComputedName)
 			io.WriteString(w, "{}\n")
-		case taildrop.ErrNoTaildrop:
+		case err == taildrop.ErrNoTaildrop:
 			http.Error(w, err.Error(), http.StatusForbidden)
-		case taildrop.ErrInvalidFileName:
+		case err == taildrop.ErrInvalidFileName:
 			http.Error(w, err.Error(), http.StatusBadRequest)
-		case taildrop.ErrFileExists:
+		case err == taildrop.ErrFileExists:
 			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, taildrop.ErrSenderNotAllowed):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, taildrop.ErrFileTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, taildrop.ErrPendingLimit):
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -739,6 +752,142 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// taildropSender returns the peer as the sender of Taildrop files, for the
+// receive policy and transfer history.
+func (h *peerAPIHandler) taildropSender() taildrop.Sender {
+	s := taildrop.Sender{
+		ID:   taildrop.ClientID(h.peerNode.StableID()),
+		Name: h.peerNode.ComputedName(),
+	}
+	if h.peerNode.IsTagged() {
+		s.Tags = h.peerNode.Tags().AsSlice()
+	} else {
+		s.User = h.peerUser.LoginName
+	}
+	return s
+}
+
+// handlePeerBundle handles the Taildrop bundle requests, where a bundle is
+// a directory of files sent as a unit:
+//
+//   - POST /v0/bundle/<name> starts the bundle with the JSON manifest in the
+//     body, and responds with the paths of the files already received.
+//   - GET /v0/bundle/<name>/<path> streams the block hashes of the partial
+//     file at path, as for /v0/put/<name>.
+//   - PUT /v0/bundle/<name>/<path> puts the file at path, with a Range
+//     header to resume it.
+//
+// The path is escaped as a single path segment.
+func (h *peerAPIHandler) handlePeerBundle(w http.ResponseWriter, r *http.Request) {
+	if !h.canPutFile() || !h.ps.b.hasCapFileSharing() {
+		http.Error(w, taildrop.ErrNoTaildrop.Error(), http.StatusForbidden)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.EscapedPath(), "/v0/bundle/")
+	if !ok {
+		http.Error(w, "misconfigured internals", http.StatusForbidden)
+		return
+	}
+	nameEscaped, pathEscaped, hasPath := strings.Cut(rest, "/")
+	baseName, err := url.PathUnescape(nameEscaped)
+	if err != nil {
+		http.Error(w, taildrop.ErrInvalidFileName.Error(), http.StatusBadRequest)
+		return
+	}
+	relPath, err := url.PathUnescape(pathEscaped)
+	if err != nil {
+		http.Error(w, taildrop.ErrInvalidFileName.Error(), http.StatusBadRequest)
+		return
+	}
+	sender := h.taildropSender()
+	writeErr := func(err error) {
+		switch {
+		case err == taildrop.ErrNoTaildrop, err == taildrop.ErrNotAccessible:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err == taildrop.ErrInvalidFileName, err == taildrop.ErrBundleMismatch:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err == taildrop.ErrFileExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err == taildrop.ErrBundleNotStarted:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, taildrop.ErrSenderNotAllowed):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, taildrop.ErrFileTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, taildrop.ErrPendingLimit):
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	switch {
+	case r.Method == "POST" && !hasPath:
+		var manifest apitype.BundleManifest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(&manifest); err != nil {
+			http.Error(w, "invalid manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := taildrop.CheckManifest(manifest); err != nil {
+			http.Error(w, "invalid manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		received, err := h.ps.taildrop.StartBundle(sender, baseName, manifest)
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Received []string }{received})
+	case r.Method == "GET" && hasPath:
+		next, close, err := h.ps.taildrop.HashPartialBundleFile(sender.ID, baseName, relPath)
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		defer close()
+		enc := json.NewEncoder(w)
+		for {
+			switch cs, err := next(); {
+			case err == io.EOF:
+				return
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				h.logf("HashPartialBundleFile.next error: %v", err)
+				return
+			default:
+				if err := enc.Encode(cs); err != nil {
+					h.logf("json.Encoder.Encode error: %v", err)
+					return
+				}
+			}
+		}
+	case r.Method == "PUT" && hasPath:
+		t0 := h.ps.b.clock.Now()
+		var offset int64
+		if rangeHdr := r.Header.Get("Range"); rangeHdr != "" {
+			ranges, ok := httphdr.ParseRange(rangeHdr)
+			if !ok || len(ranges) != 1 || ranges[0].Length != 0 {
+				http.Error(w, "invalid Range header", http.StatusBadRequest)
+				return
+			}
+			offset = ranges[0].Start
+		}
+		delivered, err := h.ps.taildrop.PutBundleFile(sender, baseName, relPath, r.Body, offset, r.ContentLength)
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		if delivered {
+			d := h.ps.b.clock.Since(t0).Round(time.Second / 10)
+			h.logf("got bundle in %v from %v/%v", d, h.remoteAddr.Addr(), h.peerNode.ComputedName)
+		}
+		io.WriteString(w, "{}\n")
+	default:
+		http.Error(w, "expected POST of a bundle, or GET or PUT of a file", http.StatusMethodNotAllowed)
+	}
+}
+
 func approxSize(n int64) string {
 	if n <= 1<<10 {
 		return "<=1KB"
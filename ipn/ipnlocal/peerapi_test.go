@@ -6,6 +6,8 @@
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -116,6 +118,21 @@ func hexAll(v string) string {
 	return sb.String()
 }
 
+// bundleManifestJSON returns the JSON bundle manifest of the given pairs of
+// file paths and contents.
+func bundleManifestJSON(pathsAndContents ...string) string {
+	var m apitype.BundleManifest
+	for i := 0; i < len(pathsAndContents); i += 2 {
+		sum := sha256.Sum256([]byte(pathsAndContents[i+1]))
+		m.Files = append(m.Files, apitype.BundleFile{
+			Path:   pathsAndContents[i],
+			Size:   int64(len(pathsAndContents[i+1])),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	return string(must.Get(json.Marshal(m)))
+}
+
 func TestHandlePeerAPI(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -123,6 +140,7 @@ func TestHandlePeerAPI(t *testing.T) {
 		capSharing bool // self node has file sharing capability
 		debugCap   bool // self node has debug capability
 		omitRoot   bool // don't configure
+		policy     taildrop.ReceivePolicy
 		reqs       []*http.Request
 		checks     []check
 	}{
@@ -514,6 +532,119 @@ func(t *testing.T, env *peerAPITestEnv) {
 				},
 			),
 		},
+		{
+			name:       "bundle",
+			isSelf:     true,
+			capSharing: true,
+			reqs: []*http.Request{
+				httptest.NewRequest("POST", "/v0/bundle/dir", strings.NewReader(bundleManifestJSON("a", "fizz", "sub/b", "buzz"))),
+				httptest.NewRequest("PUT", "/v0/bundle/dir/a", strings.NewReader("fizz")),
+				httptest.NewRequest("PUT", "/v0/bundle/dir/"+hexAll("sub/b"), strings.NewReader("buzz")),
+			},
+			checks: checks(
+				httpStatus(200),
+				fileHasContents("dir/a", "fizz"),
+				fileHasContents("dir/sub/b", "buzz"),
+			),
+		},
+		{
+			name:       "bundle_not_started",
+			isSelf:     true,
+			capSharing: true,
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/bundle/dir/a", strings.NewReader("fizz"))},
+			checks:     checks(httpStatus(http.StatusNotFound)),
+		},
+		{
+			name:       "bundle_wrong_contents",
+			isSelf:     true,
+			capSharing: true,
+			reqs: []*http.Request{
+				httptest.NewRequest("POST", "/v0/bundle/dir", strings.NewReader(bundleManifestJSON("a", "fizz"))),
+				httptest.NewRequest("PUT", "/v0/bundle/dir/a", strings.NewReader("buzz")),
+			},
+			checks: checks(
+				httpStatus(400),
+				bodyContains("does not match"),
+			),
+		},
+		{
+			name:       "bundle_traversal",
+			isSelf:     true,
+			capSharing: true,
+			reqs:       []*http.Request{httptest.NewRequest("POST", "/v0/bundle/dir", strings.NewReader(bundleManifestJSON("../a", "fizz")))},
+			checks: checks(
+				httpStatus(400),
+				bodyContains("invalid manifest"),
+			),
+		},
+		{
+			name:       "policy_sender_not_allowed",
+			isSelf:     true,
+			capSharing: true,
+			policy:     taildrop.ReceivePolicy{AllowedSenders: []string{"other@example.com"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))},
+			checks: checks(
+				httpStatus(http.StatusForbidden),
+				bodyContains("not allowed"),
+			),
+		},
+		{
+			name:       "policy_sender_allowed",
+			isSelf:     true,
+			capSharing: true,
+			policy:     taildrop.ReceivePolicy{AllowedSenders: []string{"peer@example.com"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))},
+			checks: checks(
+				httpStatus(200),
+				fileHasContents("foo", "contents"),
+			),
+		},
+		{
+			name:       "policy_file_too_large",
+			isSelf:     true,
+			capSharing: true,
+			policy:     taildrop.ReceivePolicy{MaxFileSize: 4},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))},
+			checks: checks(
+				httpStatus(http.StatusRequestEntityTooLarge),
+				bodyContains("maximum 4 bytes"),
+			),
+		},
+		{
+			name:       "policy_pending_limit",
+			isSelf:     true,
+			capSharing: true,
+			policy:     taildrop.ReceivePolicy{MaxPendingBytes: 12},
+			reqs: []*http.Request{
+				httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents")),
+				httptest.NewRequest("PUT", "/v0/put/bar", strings.NewReader("contents")),
+			},
+			checks: checks(
+				httpStatus(http.StatusInsufficientStorage),
+				fileHasContents("foo", "contents"),
+			),
+		},
+		{
+			name:       "policy_sender_dir",
+			isSelf:     true,
+			capSharing: true,
+			policy:     taildrop.ReceivePolicy{SenderDirs: map[string]string{"peer@example.com": "peer"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))},
+			checks: checks(
+				httpStatus(200),
+				fileHasContents("peer/foo", "contents"),
+			),
+		},
+		{
+			name:       "bundle_reject_non_owner",
+			isSelf:     false,
+			capSharing: true,
+			reqs:       []*http.Request{httptest.NewRequest("POST", "/v0/bundle/dir", strings.NewReader(bundleManifestJSON("a", "fizz")))},
+			checks: checks(
+				httpStatus(http.StatusForbidden),
+				bodyContains("Taildrop disabled"),
+			),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -538,6 +669,7 @@ func(t *testing.T, env *peerAPITestEnv) {
 				peerNode: (&tailcfg.Node{
 					ComputedName: "some-peer-name",
 				}).View(),
+				peerUser: tailcfg.UserProfile{LoginName: "peer@example.com"},
 				ps: &peerAPIServer{
 					b: lb,
 				},
@@ -547,8 +679,9 @@ func(t *testing.T, env *peerAPITestEnv) {
 				rootDir = t.TempDir()
 				if e.ph.ps.taildrop == nil {
 					e.ph.ps.taildrop = taildrop.ManagerOptions{
-						Logf: e.logBuf.Logf,
-						Dir:  rootDir,
+						Logf:          e.logBuf.Logf,
+						Dir:           rootDir,
+						ReceivePolicy: tt.policy,
 					}.New()
 				}
 			}
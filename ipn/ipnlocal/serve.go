@@ -12,6 +12,7 @@
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
 	"net"
 	"net/http"
@@ -20,6 +21,7 @@
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -34,8 +36,10 @@
 	"tailscale.com/net/netutil"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
+	"tailscale.com/taildrop"
 	"tailscale.com/types/lazy"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/views"
 	"tailscale.com/util/ctxkey"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
@@ -53,6 +57,10 @@
 
 var serveHTTPContextKey ctxkey.Key[*serveHTTPContext]
 
+// serveRequestHeadersKey is the context key of the request header rules of
+// the handler that a request is proxied by.
+var serveRequestHeadersKey ctxkey.Key[views.Slice[ipn.HeaderRule]]
+
 type serveHTTPContext struct {
 	SrcAddr  netip.AddrPort
 	DestPort uint16
@@ -293,6 +301,10 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 		}
 	}
 
+	if err := checkServeHandlers(config); err != nil {
+		return err
+	}
+
 	var bs []byte
 	if config != nil {
 		j, err := json.Marshal(config)
@@ -464,8 +476,25 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 	}
 
 	if backDst := tcph.TCPForward(); backDst != "" {
+		var sb *serveBalancer
+		if lb := tcph.LoadBalancer(); lb.Valid() {
+			if sb, ok = b.serveBalancerFor(serveBalancerKindTCPForward, backDst, lb); !ok {
+				b.logf("[unexpected] localbackend: no load balancer for TCP port %v", dport)
+				return nil
+			}
+		}
 		return func(conn net.Conn) error {
 			defer conn.Close()
+			backDst := backDst
+			if sb != nil {
+				be := sb.pick()
+				if be == nil {
+					b.logf("localbackend: no healthy backend to TCP proxy port %v (from %v) to", dport, srcAddr)
+					return nil
+				}
+				defer be.done()
+				backDst = be.target
+			}
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
 			cancel()
@@ -511,6 +540,14 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 }
 
 func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
+	_, h, at, ok := b.lookupServeHandler(r)
+	return h, at, ok
+}
+
+// lookupServeHandler is like getServeHandler, but also returns the config
+// of the web server the handler belongs to.
+func (b *LocalBackend) lookupServeHandler(r *http.Request) (_ ipn.WebServerConfigView, _ ipn.HTTPHandlerView, at string, ok bool) {
+	var zc ipn.WebServerConfigView
 	var z ipn.HTTPHandlerView // zero value
 
 	hostname := r.Host
@@ -529,27 +566,27 @@ func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView,
 	sctx, ok := serveHTTPContextKey.ValueOk(r.Context())
 	if !ok {
 		b.logf("[unexpected] localbackend: no serveHTTPContext in request")
-		return z, "", false
+		return zc, z, "", false
 	}
 	wsc, ok := b.webServerConfig(hostname, sctx.DestPort)
 	if !ok {
-		return z, "", false
+		return zc, z, "", false
 	}
 
 	if h, ok := wsc.Handlers().GetOk(r.URL.Path); ok {
-		return h, r.URL.Path, true
+		return wsc, h, r.URL.Path, true
 	}
 	pth := path.Clean(r.URL.Path)
 	for {
 		withSlash := pth + "/"
 		if h, ok := wsc.Handlers().GetOk(withSlash); ok {
-			return h, withSlash, true
+			return wsc, h, withSlash, true
 		}
 		if h, ok := wsc.Handlers().GetOk(pth); ok {
-			return h, pth, true
+			return wsc, h, pth, true
 		}
 		if pth == "/" {
-			return z, "", false
+			return zc, z, "", false
 		}
 		pth = path.Dir(pth)
 	}
@@ -632,6 +669,9 @@ func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Out.Host = r.In.Host
 		addProxyForwardedHeaders(r)
 		rp.lb.addTailscaleIdentityHeaders(r)
+		if rules, ok := serveRequestHeadersKey.ValueOk(r.Out.Context()); ok {
+			applyHeaderRules(r.Out.Header, rules, rp.lb.lazyServeIdentityHeaders(r.Out.Context()))
+		}
 	}}
 
 	// There is no way to autodetect h2c as per RFC 9113
@@ -714,23 +754,104 @@ func (b *LocalBackend) addTailscaleIdentityHeaders(r *httputil.ProxyRequest) {
 	r.Out.Header.Del("Tailscale-User-Profile-Pic")
 	r.Out.Header.Del("Tailscale-Headers-Info")
 
-	c, ok := serveHTTPContextKey.ValueOk(r.Out.Context())
-	if !ok {
+	ids := b.serveIdentityHeaders(r.Out.Context())
+	if ids == nil {
 		return
 	}
+	for k, v := range ids {
+		r.Out.Header.Set(k, v)
+	}
+	r.Out.Header.Set("Tailscale-Headers-Info", "https://tailscale.com/s/serve-headers")
+}
+
+// serveIdentityHeaders returns the Tailscale-User-* identity headers of the
+// user making the serve request with context ctx, or nil if the request
+// has no user identity.
+func (b *LocalBackend) serveIdentityHeaders(ctx context.Context) map[string]string {
+	c, ok := serveHTTPContextKey.ValueOk(ctx)
+	if !ok {
+		return nil
+	}
 	node, user, ok := b.WhoIs("tcp", c.SrcAddr)
 	if !ok {
-		return // traffic from outside of Tailnet (funneled)
+		return nil // traffic from outside of Tailnet (funneled)
 	}
 	if node.IsTagged() {
 		// 2023-06-14: Not setting identity headers for tagged nodes.
 		// Only currently set for nodes with user identities.
-		return
+		return nil
 	}
-	r.Out.Header.Set("Tailscale-User-Login", encTailscaleHeaderValue(user.LoginName))
-	r.Out.Header.Set("Tailscale-User-Name", encTailscaleHeaderValue(user.DisplayName))
-	r.Out.Header.Set("Tailscale-User-Profile-Pic", user.ProfilePicURL)
-	r.Out.Header.Set("Tailscale-Headers-Info", "https://tailscale.com/s/serve-headers")
+	return map[string]string{
+		"Tailscale-User-Login":       encTailscaleHeaderValue(user.LoginName),
+		"Tailscale-User-Name":        encTailscaleHeaderValue(user.DisplayName),
+		"Tailscale-User-Profile-Pic": user.ProfilePicURL,
+	}
+}
+
+// lazyServeIdentityHeaders returns a func that returns the result of
+// serveIdentityHeaders, looking it up at most once.
+func (b *LocalBackend) lazyServeIdentityHeaders(ctx context.Context) func() map[string]string {
+	return sync.OnceValue(func() map[string]string {
+		return b.serveIdentityHeaders(ctx)
+	})
+}
+
+// applyHeaderRules applies rules, in order, to h. Values that refer to the
+// identity headers returned by identity are expanded, and the headers they
+// set are removed instead if there's no identity.
+func applyHeaderRules(h http.Header, rules views.Slice[ipn.HeaderRule], identity func() map[string]string) {
+	for i := range rules.Len() {
+		r := rules.At(i)
+		if r.Remove {
+			h.Del(r.Name)
+			continue
+		}
+		v := r.Value
+		if strings.Contains(v, "${Tailscale-User-") {
+			ids := identity()
+			if ids == nil {
+				h.Del(r.Name)
+				continue
+			}
+			for k, id := range ids {
+				v = strings.ReplaceAll(v, "${"+k+"}", id)
+			}
+		}
+		h.Set(r.Name, v)
+	}
+}
+
+// headerRulesResponseWriter is an http.ResponseWriter wrapper that applies
+// header rules to the response headers when they're written.
+type headerRulesResponseWriter struct {
+	http.ResponseWriter
+	rules     views.Slice[ipn.HeaderRule]
+	identity  func() map[string]string
+	applyOnce sync.Once // guards call to apply
+}
+
+func (w *headerRulesResponseWriter) apply() {
+	applyHeaderRules(w.ResponseWriter.Header(), w.rules, w.identity)
+}
+
+func (w *headerRulesResponseWriter) WriteHeader(code int) {
+	// Leave informational responses, other than protocol switches, to
+	// the final response.
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		w.applyOnce.Do(w.apply)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerRulesResponseWriter) Write(p []byte) (int, error) {
+	w.applyOnce.Do(w.apply)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying ResponseWriter, for
+// http.ResponseController.
+func (w *headerRulesResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 // encTailscaleHeaderValue cleans or encodes as necessary v, to be suitable in
@@ -751,26 +872,69 @@ func encTailscaleHeaderValue(v string) string {
 // serveWebHandler is an http.HandlerFunc that maps incoming requests to the
 // correct *http.
 func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
-	h, mountPoint, ok := b.getServeHandler(r)
+	wsc, h, mountPoint, ok := b.lookupServeHandler(r)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
-	if s := h.Text(); s != "" {
+	if rules := wsc.Allow().Get(mountPoint); rules.Len() > 0 && !b.serveRequestAllowed(r.Context(), rules) {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if rules := h.ResponseHeaders(); rules.Len() > 0 {
+		w = &headerRulesResponseWriter{
+			ResponseWriter: w,
+			rules:          rules,
+			identity:       b.lazyServeIdentityHeaders(r.Context()),
+		}
+	}
+	if v := h.Redirect(); v != "" {
+		code := h.Status()
+		if code == 0 {
+			code = http.StatusFound
+		}
+		http.Redirect(w, r, expandServeRedirect(v, r), code)
+		return
+	}
+	if s, code := h.Text(), h.Status(); s != "" || code != 0 {
+		if code == 0 {
+			code = http.StatusOK
+		}
+		if s == "" {
+			s = http.StatusText(code)
+		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
 		io.WriteString(w, s)
 		return
 	}
 	if v := h.Path(); v != "" {
-		b.serveFileOrDirectory(w, r, v, mountPoint)
+		b.serveFileOrDirectory(w, r, h, mountPoint)
 		return
 	}
 	if v := h.Proxy(); v != "" {
+		if lb := h.LoadBalancer(); lb.Valid() {
+			sb, ok := b.serveBalancerFor(serveBalancerKindHTTP, v, lb)
+			if !ok {
+				http.Error(w, "unknown load balancer", http.StatusInternalServerError)
+				return
+			}
+			be := sb.pick()
+			if be == nil {
+				http.Error(w, "no healthy backend", http.StatusServiceUnavailable)
+				return
+			}
+			defer be.done()
+			v = be.target
+		}
 		p, ok := b.serveProxyHandlers.Load(v)
 		if !ok {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
 			return
 		}
+		if rules := h.RequestHeaders(); rules.Len() > 0 {
+			r = r.WithContext(serveRequestHeadersKey.WithValue(r.Context(), rules))
+		}
 		h := p.(http.Handler)
 		// Trim the mount point from the URL path before proxying. (#6571)
 		if r.URL.Path != "/" {
@@ -783,7 +947,107 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "empty handler", 500)
 }
 
-func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
+// serveRequestAllowed reports whether the serve request with context ctx
+// is from a tailnet identity that matches any of rules, as described on
+// ipn.CheckServeAllowRule.
+func (b *LocalBackend) serveRequestAllowed(ctx context.Context, rules views.Slice[string]) bool {
+	c, ok := serveHTTPContextKey.ValueOk(ctx)
+	if !ok {
+		return false
+	}
+	node, user, ok := b.WhoIs("tcp", c.SrcAddr)
+	if !ok {
+		return false // traffic from outside of Tailnet (funneled)
+	}
+	var caps tailcfg.PeerCapMap
+	for i := range rules.Len() {
+		rule := rules.At(i)
+		switch {
+		case strings.HasPrefix(rule, "tag:"):
+			if views.SliceContains(node.Tags(), rule) {
+				return true
+			}
+		case strings.HasPrefix(rule, "cap:"):
+			if caps == nil {
+				caps = b.PeerCaps(c.SrcAddr.Addr())
+			}
+			if caps.HasCapability(tailcfg.PeerCapability(strings.TrimPrefix(rule, "cap:"))) {
+				return true
+			}
+		default:
+			if !node.IsTagged() && strings.EqualFold(user.LoginName, rule) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandServeRedirect returns the redirect target of a request r to a
+// Redirect handler, expanding the variables documented on
+// ipn.HTTPHandler.Redirect.
+func expandServeRedirect(target string, r *http.Request) string {
+	s := strings.NewReplacer(
+		"${HOST}", r.Host,
+		"${REQUEST_URI}", r.URL.RequestURI(),
+	).Replace(target)
+	// A target that starts with a variable must not expand to a
+	// scheme-relative URL, such as for a request for //evil.example,
+	// which browsers would follow to another site.
+	if !strings.HasPrefix(target, "//") && strings.HasPrefix(s, "//") {
+		s = "/" + strings.TrimLeft(s, "/")
+	}
+	return s
+}
+
+// checkServeHandlers reports whether the web servers, TCP and UDP handlers of
+// sc, including those of its foreground configs, are well-formed.
+func checkServeHandlers(sc *ipn.ServeConfig) error {
+	if sc == nil {
+		return nil
+	}
+	for hp, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		for mount, h := range wsc.Handlers {
+			if h == nil {
+				continue
+			}
+			if err := h.Check(); err != nil {
+				return fmt.Errorf("invalid handler for %s%s: %w", hp, mount, err)
+			}
+		}
+		if err := wsc.Check(); err != nil {
+			return fmt.Errorf("invalid web config for %s: %w", hp, err)
+		}
+	}
+	for port, h := range sc.TCP {
+		if h == nil {
+			continue
+		}
+		if err := h.Check(); err != nil {
+			return fmt.Errorf("invalid handler for TCP port %d: %w", port, err)
+		}
+	}
+	for port, h := range sc.UDP {
+		if h == nil {
+			continue
+		}
+		if err := h.Check(); err != nil {
+			return fmt.Errorf("invalid handler for UDP port %d: %w", port, err)
+		}
+	}
+	for _, fg := range sc.Foreground {
+		if err := checkServeHandlers(fg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, h ipn.HTTPHandlerView, mountPoint string) {
+	fileOrDir := h.Path()
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -806,6 +1070,7 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 			return
 		}
 		defer f.Close()
+		setServeETag(w, fi)
 		http.ServeContent(w, r, path.Base(mountPoint), fi.ModTime(), f)
 		return
 	}
@@ -817,8 +1082,44 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 		http.Redirect(w, r, mountPoint, http.StatusFound)
 		return
 	}
+	if r.Method == "PUT" {
+		if !h.AllowUploads() {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "uploads not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		maxSize := h.MaxUploadSize()
+		if maxSize <= 0 {
+			maxSize = ipn.DefaultMaxUploadSize
+		}
+		b.serveUpload(w, r, fileOrDir, mountPoint, maxSize)
+		return
+	}
+
+	// Look up the file or directory that http.FileServer is about to
+	// serve, to add its ETag and apply the directory options.
+	dir := http.Dir(fileOrDir)
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(mountPoint, "/")))
+	if fi, err := statServeFile(dir, name); err == nil {
+		switch {
+		case fi.Mode().IsRegular():
+			setServeETag(w, fi)
+		case fi.IsDir() && strings.HasSuffix(r.URL.Path, "/"):
+			if idx := h.IndexFile(); idx != "" {
+				if b.serveIndexFile(w, r, dir, path.Join(name, idx)) {
+					return
+				}
+			}
+			if fi, err := statServeFile(dir, path.Join(name, "index.html")); err == nil && fi.Mode().IsRegular() {
+				setServeETag(w, fi)
+			} else if h.NoListing() {
+				http.NotFound(w, r)
+				return
+			}
+		}
+	}
 
-	var fs http.Handler = http.FileServer(http.Dir(fileOrDir))
+	var fs http.Handler = http.FileServer(dir)
 	if mountPoint != "/" {
 		fs = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), fs)
 	}
@@ -828,6 +1129,122 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 	}, r)
 }
 
+// statServeFile returns the FileInfo of name in dir.
+func statServeFile(dir http.Dir, name string) (fs.FileInfo, error) {
+	f, err := dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// serveIndexFile serves the file name in dir, if it exists, as the index
+// of its directory. It reports whether it did.
+func (b *LocalBackend) serveIndexFile(w http.ResponseWriter, r *http.Request, dir http.Dir, name string) bool {
+	f, err := dir.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	setServeETag(w, fi)
+	http.ServeContent(w, r, path.Base(name), fi.ModTime(), f)
+	return true
+}
+
+// setServeETag sets the ETag header of a response with the contents of the
+// file fi, for http.ServeContent to evaluate conditional requests with.
+// The ETag is strong: files are replaced, not modified in place, by
+// uploads, and a modification changes the size or modification time.
+func setServeETag(w http.ResponseWriter, fi fs.FileInfo) {
+	w.Header().Set("Etag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+}
+
+// serveUploadReserve is the disk space that uploads to serve Path handlers
+// leave free.
+const serveUploadReserve = 64 << 20
+
+// serveUpload handles a PUT request r to upload a file of at most maxSize
+// bytes into dir, the directory of a Path handler at mountPoint.
+func (b *LocalBackend) serveUpload(w http.ResponseWriter, r *http.Request, dir, mountPoint string, maxSize int64) {
+	c, ok := serveHTTPContextKey.ValueOk(r.Context())
+	if !ok {
+		http.Error(w, "uploads require a tailnet user", http.StatusForbidden)
+		return
+	}
+	node, user, ok := b.WhoIs("tcp", c.SrcAddr)
+	if !ok || node.IsTagged() {
+		http.Error(w, "uploads require a tailnet user", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(mountPoint, "/")+"/")
+	if err := taildrop.CheckFileName(name); err != nil {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	dst := filepath.Join(dir, name)
+	created := true
+	if fi, err := os.Lstat(dst); err == nil {
+		if !fi.Mode().IsRegular() {
+			http.Error(w, "not a regular file", http.StatusConflict)
+			return
+		}
+		created = false
+	}
+	if r.ContentLength > maxSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Without a Content-Length, assume the largest file allowed.
+	need := maxSize
+	if r.ContentLength >= 0 {
+		need = r.ContentLength
+	}
+	if free, err := diskFree(dir); err == nil && free < need+serveUploadReserve {
+		http.Error(w, "not enough disk space", http.StatusInsufficientStorage)
+		return
+	}
+
+	f, err := os.CreateTemp(dir, ".tailscale-upload-*")
+	if err != nil {
+		b.logf("serve: creating upload in %s: %v", dir, err)
+		http.Error(w, "an error occurred writing the file", 500)
+		return
+	}
+	defer os.Remove(f.Name()) // in case of failure
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, maxSize))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		f.Close()
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dst)
+	}
+	if err != nil {
+		b.logf("serve: uploading %q to %s: %v", name, dir, err)
+		http.Error(w, "an error occurred writing the file", 500)
+		return
+	}
+	b.logf("serve: %s uploaded %q (%d bytes) to %s", user.LoginName, name, n, dir)
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 // fixLocationHeaderResponseWriter is an http.ResponseWriter wrapper that, upon
 // flushing HTTP headers, prefixes any Location header with the mount point.
 type fixLocationHeaderResponseWriter struct {
@@ -0,0 +1,355 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
+)
+
+// Health check defaults, as documented on ipn.HealthCheck.
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultUnhealthyThreshold  = 2
+	defaultHealthyThreshold    = 2
+)
+
+// Kinds of load balanced serve handlers.
+const (
+	serveBalancerKindHTTP       = "http" // HTTPHandler.Proxy
+	serveBalancerKindTCPForward = "tcp"  // TCPPortHandler.TCPForward
+)
+
+// serveBalancer selects among the backends of a load balanced Proxy or
+// TCPForward serve handler, and actively health checks them if configured
+// to.
+type serveBalancer struct {
+	logf     logger.Logf
+	policy   string
+	backends []*serveBackend
+	next     atomic.Uint32 // where the next selection starts
+
+	ctx    context.Context // canceled by close
+	cancel context.CancelFunc
+}
+
+// serveBackend is a backend of a serveBalancer.
+type serveBackend struct {
+	target string // as in the serve config
+	check  func(context.Context) error
+
+	healthy atomic.Bool
+	active  atomic.Int64 // requests or connections in flight
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	lastErr   error
+	fails     int // consecutive failed checks
+	oks       int // consecutive successful checks
+}
+
+// serveBalancerKey returns the key of the serveBalancer in
+// LocalBackend.serveBalancers for a handler of the given kind, with the
+// primary backend and load balancer config. Handlers with the same key
+// share a serveBalancer.
+func serveBalancerKey(kind, primary string, lb ipn.LoadBalancerView) string {
+	j, _ := lb.MarshalJSON()
+	return kind + " " + primary + " " + string(j)
+}
+
+// rangeServeBalancers calls f for each load balanced handler in sc, with
+// where being "host:port/mount" for web handlers and "tcp:port" for TCP
+// forwarders.
+func rangeServeBalancers(sc ipn.ServeConfigView, f func(where, kind, primary string, lb ipn.LoadBalancerView)) {
+	if !sc.Valid() {
+		return
+	}
+	sc.RangeOverTCPs(func(port uint16, h ipn.TCPPortHandlerView) bool {
+		if lb := h.LoadBalancer(); lb.Valid() && h.TCPForward() != "" {
+			f("tcp:"+strconv.Itoa(int(port)), serveBalancerKindTCPForward, h.TCPForward(), lb)
+		}
+		return true
+	})
+	sc.RangeOverWebs(func(hp ipn.HostPort, conf ipn.WebServerConfigView) bool {
+		conf.Handlers().Range(func(mount string, h ipn.HTTPHandlerView) bool {
+			if lb := h.LoadBalancer(); lb.Valid() && h.Proxy() != "" {
+				f(string(hp)+mount, serveBalancerKindHTTP, h.Proxy(), lb)
+			}
+			return true
+		})
+		return true
+	})
+}
+
+// setServeBalancersLocked ensures there is a serveBalancer for each load
+// balanced handler in serveConfig, and closes those no longer in use. It
+// should be called after setServeProxyHandlersLocked, whose proxies the
+// HTTP health checks use.
+func (b *LocalBackend) setServeBalancersLocked() {
+	var keep map[string]bool
+	rangeServeBalancers(b.serveConfig, func(_, kind, primary string, lb ipn.LoadBalancerView) {
+		key := serveBalancerKey(kind, primary, lb)
+		mak.Set(&keep, key, true)
+		if _, ok := b.serveBalancers.Load(key); ok {
+			return
+		}
+		b.logf("serve: creating a load balancer for %s and %d more backends", primary, lb.Backends().Len())
+		b.serveBalancers.Store(key, b.newServeBalancer(kind, primary, lb))
+	})
+	b.serveBalancers.Range(func(key, value any) bool {
+		if !keep[key.(string)] {
+			b.serveBalancers.Delete(key)
+			value.(*serveBalancer).close()
+		}
+		return true
+	})
+}
+
+// serveBalancerFor returns the serveBalancer for a handler, as created by
+// setServeBalancersLocked.
+func (b *LocalBackend) serveBalancerFor(kind, primary string, lb ipn.LoadBalancerView) (*serveBalancer, bool) {
+	v, ok := b.serveBalancers.Load(serveBalancerKey(kind, primary, lb))
+	if !ok {
+		return nil, false
+	}
+	return v.(*serveBalancer), true
+}
+
+// ServeBackendStatus returns the health of the backends of each load
+// balanced serve handler, keyed as described on rangeServeBalancers.
+func (b *LocalBackend) ServeBackendStatus() map[string][]ipn.ServeBackendStatus {
+	b.mu.Lock()
+	sc := b.serveConfig
+	b.mu.Unlock()
+
+	var ret map[string][]ipn.ServeBackendStatus
+	rangeServeBalancers(sc, func(where, kind, primary string, lb ipn.LoadBalancerView) {
+		if sb, ok := b.serveBalancerFor(kind, primary, lb); ok {
+			mak.Set(&ret, where, sb.status())
+		}
+	})
+	return ret
+}
+
+// newServeBalancer returns a serveBalancer for a handler of the given kind,
+// starting its health checks if lb has any.
+func (b *LocalBackend) newServeBalancer(kind, primary string, lb ipn.LoadBalancerView) *serveBalancer {
+	ctx, cancel := context.WithCancel(b.ctx)
+	sb := &serveBalancer{
+		logf:   b.logf,
+		policy: lb.Policy(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	hc := lb.HealthCheck()
+	targets := append([]string{primary}, lb.Backends().AsSlice()...)
+	for _, target := range targets {
+		be := &serveBackend{target: target}
+		be.healthy.Store(true)
+		if hc != nil {
+			if kind == serveBalancerKindHTTP && hc.Path != "" {
+				be.check = b.httpHealthCheck(target, hc.Path)
+			} else {
+				be.check = b.tcpHealthCheck(kind, target)
+			}
+		}
+		sb.backends = append(sb.backends, be)
+	}
+	if hc != nil {
+		go sb.runHealthChecks(*hc)
+	}
+	return sb
+}
+
+// httpHealthCheck returns a health check of the Proxy backend target that
+// requests path from it.
+func (b *LocalBackend) httpHealthCheck(target, path string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		v, ok := b.serveProxyHandlers.Load(target)
+		if !ok {
+			return errors.New("no proxy for backend")
+		}
+		rp := v.(*reverseProxy)
+		ref, err := url.Parse(path)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", rp.url.ResolveReference(ref).String(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := rp.getTransport().RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 399 {
+			return fmt.Errorf("health check status %s", res.Status)
+		}
+		return nil
+	}
+}
+
+// tcpHealthCheck returns a health check of the backend target, of a
+// handler of the given kind, that connects to it.
+func (b *LocalBackend) tcpHealthCheck(kind, target string) func(context.Context) error {
+	addr := target
+	if kind == serveBalancerKindHTTP {
+		targetURL, _ := expandProxyArg(target)
+		if u, err := url.Parse(targetURL); err == nil {
+			addr = u.Host
+			if u.Port() == "" {
+				addr = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+			}
+		}
+	}
+	return func(ctx context.Context) error {
+		c, err := b.dialer.SystemDial(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+// runHealthChecks checks all backends of sb every interval of hc, until sb
+// is closed.
+func (sb *serveBalancer) runHealthChecks(hc ipn.HealthCheck) {
+	interval := defaultHealthCheckInterval
+	if hc.IntervalSeconds > 0 {
+		interval = time.Duration(hc.IntervalSeconds) * time.Second
+	}
+	timeout := min(defaultHealthCheckTimeout, interval)
+	if hc.TimeoutSeconds > 0 {
+		timeout = time.Duration(hc.TimeoutSeconds) * time.Second
+	}
+	unhealthyAfter := cmp.Or(hc.UnhealthyThreshold, defaultUnhealthyThreshold)
+	healthyAfter := cmp.Or(hc.HealthyThreshold, defaultHealthyThreshold)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, be := range sb.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(sb.ctx, timeout)
+				err := be.check(ctx)
+				cancel()
+				if sb.ctx.Err() != nil {
+					return
+				}
+				be.recordCheck(sb.logf, err, unhealthyAfter, healthyAfter)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-sb.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// recordCheck records the result of a health check of be, ejecting it
+// after unhealthyAfter consecutive failures and restoring it after
+// healthyAfter consecutive successes.
+func (be *serveBackend) recordCheck(logf logger.Logf, err error, unhealthyAfter, healthyAfter int) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.lastCheck = time.Now()
+	be.lastErr = err
+	if err != nil {
+		be.oks = 0
+		be.fails++
+		if be.fails == unhealthyAfter && be.healthy.Load() {
+			logf("serve: ejecting unhealthy backend %s: %v", be.target, err)
+			be.healthy.Store(false)
+		}
+		return
+	}
+	be.fails = 0
+	be.oks++
+	if be.oks == healthyAfter && !be.healthy.Load() {
+		logf("serve: backend %s is healthy again", be.target)
+		be.healthy.Store(true)
+	}
+}
+
+// pick returns the backend to use for a new request or connection, or nil
+// if no backend is healthy. The caller must call done on the returned
+// backend when the request or connection is finished.
+func (sb *serveBalancer) pick() *serveBackend {
+	n := len(sb.backends)
+	var best *serveBackend
+	if sb.policy == ipn.LBLeastConn {
+		// Start at a different backend each time to spread ties.
+		start := int((sb.next.Add(1) - 1) % uint32(n))
+		for i := range n {
+			be := sb.backends[(start+i)%n]
+			if be.healthy.Load() && (best == nil || be.active.Load() < best.active.Load()) {
+				best = be
+			}
+		}
+	} else {
+		// Advance past unhealthy backends, so that their turns are
+		// spread over the healthy ones.
+		for range n {
+			be := sb.backends[(sb.next.Add(1)-1)%uint32(n)]
+			if be.healthy.Load() {
+				best = be
+				break
+			}
+		}
+	}
+	if best != nil {
+		best.active.Add(1)
+	}
+	return best
+}
+
+// done records the end of a request or connection to be.
+func (be *serveBackend) done() {
+	be.active.Add(-1)
+}
+
+// status returns the health of each backend of sb.
+func (sb *serveBalancer) status() []ipn.ServeBackendStatus {
+	ret := make([]ipn.ServeBackendStatus, 0, len(sb.backends))
+	for _, be := range sb.backends {
+		be.mu.Lock()
+		st := ipn.ServeBackendStatus{
+			Backend:     be.target,
+			Healthy:     be.healthy.Load(),
+			ActiveConns: be.active.Load(),
+			LastCheck:   be.lastCheck,
+		}
+		if be.lastErr != nil {
+			st.LastError = be.lastErr.Error()
+		}
+		be.mu.Unlock()
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// close stops the health checks of sb.
+func (sb *serveBalancer) close() {
+	sb.cancel()
+}
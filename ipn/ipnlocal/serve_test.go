@@ -13,6 +13,8 @@
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
@@ -20,7 +22,9 @@
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -36,6 +40,7 @@
 	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
 )
 
 func TestExpandProxyArg(t *testing.T) {
@@ -552,6 +557,542 @@ type headerCheck struct {
 	}
 }
 
+func TestServeHTTPHeaderRules(t *testing.T) {
+	b := newTestBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Echo the request headers, prefixed, so that tests can check
+			// them apart from the response headers.
+			for key, val := range r.Header {
+				w.Header().Add("Req-"+key, strings.Join(val, ","))
+			}
+			w.Header().Set("Server", "backend")
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {
+					Proxy: testServ.URL,
+					RequestHeaders: []ipn.HeaderRule{
+						{Name: "X-Remote-User", Value: "${Tailscale-User-Login}"},
+						{Name: "X-Greeting", Value: "hello ${Tailscale-User-Name}!"},
+						{Name: "X-Static", Value: "static"},
+						{Name: "Cookie", Remove: true},
+						{Name: "Tailscale-User-Profile-Pic", Remove: true},
+					},
+					ResponseHeaders: []ipn.HeaderRule{
+						{Name: "Server", Remove: true},
+						{Name: "Cache-Control", Value: "no-store"},
+						{Name: "X-Served-To", Value: "${Tailscale-User-Login}"},
+					},
+				},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		srcIP       string
+		wantHeaders map[string]string
+	}{
+		{
+			name:  "user",
+			srcIP: "100.150.151.152",
+			wantHeaders: map[string]string{
+				"Req-X-Remote-User":              "someone@example.com",
+				"Req-X-Greeting":                 "hello Some One!",
+				"Req-X-Static":                   "static",
+				"Req-Cookie":                     "",
+				"Req-Tailscale-User-Login":       "someone@example.com",
+				"Req-Tailscale-User-Profile-Pic": "",
+				"Server":                         "",
+				"Cache-Control":                  "no-store",
+				"X-Served-To":                    "someone@example.com",
+			},
+		},
+		{
+			name:  "tagged-node",
+			srcIP: "100.150.151.153",
+			wantHeaders: map[string]string{
+				"Req-X-Remote-User": "",
+				"Req-X-Greeting":    "",
+				"Req-X-Static":      "static",
+				"Cache-Control":     "no-store",
+				"X-Served-To":       "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				URL:    &url.URL{Path: "/"},
+				TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+				Header: http.Header{"Cookie": {"secret=1"}, "X-Remote-User": {"spoofed"}},
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort(tt.srcIP + ":1234"),
+			}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+
+			h := w.Result().Header
+			for k, want := range tt.wantHeaders {
+				if got := h.Get(k); got != want {
+					t.Errorf("invalid %q header; want=%q, got=%q", k, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestServeLoadBalancer(t *testing.T) {
+	b := newTestBackend(t)
+
+	newBackend := func(name string, healthy bool) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && !healthy {
+				http.Error(w, "sick", http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	a, bb, c := newBackend("a", true), newBackend("b", true), newBackend("c", false)
+
+	get := func() string {
+		req := &http.Request{
+			URL: &url.URL{Path: "/"},
+			TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w.Body.String()
+	}
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {
+					Proxy: a.URL,
+					LoadBalancer: &ipn.LoadBalancer{
+						Backends: []string{bb.URL, c.URL},
+					},
+				},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	for range 6 {
+		got[get()]++
+	}
+	if want := map[string]int{"a": 2, "b": 2, "c": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("round robin without health checks: got %v, want %v", got, want)
+	}
+
+	conf.Web["example.ts.net:443"].Handlers["/"].LoadBalancer.HealthCheck = &ipn.HealthCheck{
+		Path:               "/healthz",
+		IntervalSeconds:    1,
+		UnhealthyThreshold: 1,
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	var st []ipn.ServeBackendStatus
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		st = b.ServeBackendStatus()["example.ts.net:443/"]
+		if len(st) == 3 && !st[2].LastCheck.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backends not health checked; status: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, want := range []bool{true, true, false} {
+		if st[i].Healthy != want {
+			t.Errorf("backend %s healthy = %v, want %v", st[i].Backend, st[i].Healthy, want)
+		}
+	}
+	if st[2].LastError == "" {
+		t.Errorf("unhealthy backend has no error")
+	}
+	got = map[string]int{}
+	for range 6 {
+		got[get()]++
+	}
+	if want := map[string]int{"a": 3, "b": 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with unhealthy backend: got %v, want %v", got, want)
+	}
+}
+
+func TestServeBalancerPick(t *testing.T) {
+	newBalancer := func(policy string) *serveBalancer {
+		sb := &serveBalancer{policy: policy}
+		for _, target := range []string{"a", "b", "c"} {
+			be := &serveBackend{target: target}
+			be.healthy.Store(true)
+			sb.backends = append(sb.backends, be)
+		}
+		return sb
+	}
+
+	rr := newBalancer(ipn.LBRoundRobin)
+	rr.backends[1].healthy.Store(false)
+	var got []string
+	for range 4 {
+		be := rr.pick()
+		got = append(got, be.target)
+		be.done()
+	}
+	if want := []string{"a", "c", "a", "c"}; !slices.Equal(got, want) {
+		t.Errorf("round robin picked %q, want %q", got, want)
+	}
+
+	lc := newBalancer(ipn.LBLeastConn)
+	got = nil
+	for range 3 {
+		got = append(got, lc.pick().target) // never done
+	}
+	slices.Sort(got)
+	if want := []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("least conn picked %q, want each backend once", got)
+	}
+	lc.backends[0].done()
+	if be := lc.pick(); be.target != "a" {
+		t.Errorf("least conn picked %q, want the idle backend a", be.target)
+	}
+
+	for _, be := range lc.backends {
+		be.healthy.Store(false)
+	}
+	if be := lc.pick(); be != nil {
+		t.Errorf("picked %q with no healthy backends, want nil", be.target)
+	}
+}
+
+func TestServeUDPForward(t *testing.T) {
+	b := newTestBackend(t)
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conf := &ipn.ServeConfig{
+		UDP: map[uint16]*ipn.UDPPortHandler{
+			5353: {UDPForward: echo.LocalAddr().String(), IdleTimeoutSeconds: 1},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !b.ShouldInterceptUDPPort(5353) {
+		t.Errorf("UDP port 5353 not intercepted")
+	}
+	if b.ShouldInterceptUDPPort(5354) || b.ShouldInterceptTCPPort(5353) {
+		t.Errorf("intercepting ports that are not forwarded")
+	}
+	src := netip.MustParseAddrPort("100.150.151.152:1234")
+	if h := b.udpHandlerForServe(5354, src); h != nil {
+		t.Fatalf("got a handler for a port that is not forwarded")
+	}
+	h := b.udpHandlerForServe(5353, src)
+	if h == nil {
+		t.Fatal("no handler for forwarded port")
+	}
+
+	// Stand in for netstack with a pair of UDP sockets: peer sends to
+	// flow, which the handler reads from and replies on.
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	flow, err := net.DialUDP("udp", nil, peer.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		h(flow)
+		close(done)
+	}()
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	for _, msg := range []string{"hello", "again"} {
+		if _, err := peer.WriteTo([]byte(msg), flow.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("echoed %q, want %q", got, msg)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle flow not closed")
+	}
+}
+
+func TestUDPFlowsLimits(t *testing.T) {
+	var flows udpFlows
+	closed := map[*udpFlow]bool{}
+	var mu sync.Mutex
+	newFlow := func(active int64) *udpFlow {
+		f := &udpFlow{}
+		f.close = func() {
+			mu.Lock()
+			defer mu.Unlock()
+			closed[f] = true
+		}
+		f.lastActive.Store(active)
+		return f
+	}
+
+	src := netip.MustParseAddr("100.150.151.152")
+	var first []*udpFlow
+	for i := range maxUDPFlowsPerSource {
+		f := newFlow(int64(i + 10))
+		first = append(first, f)
+		if !flows.add(src, f) {
+			t.Fatalf("flow %d refused", i)
+		}
+	}
+	// Make the second flow the least recently active, so that it's the
+	// one evicted for a new flow.
+	first[1].lastActive.Store(1)
+	if !flows.add(src, newFlow(100)) {
+		t.Fatal("flow over per-source limit refused; want oldest evicted")
+	}
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed[first[1]] || len(closed) != 1 {
+			return fmt.Errorf("closed %d flows; want only the least recently active", len(closed))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	flows.remove(src, first[1]) // no-op once evicted
+	if flows.n != maxUDPFlowsPerSource {
+		t.Errorf("flows = %d; want %d", flows.n, maxUDPFlowsPerSource)
+	}
+
+	// Other sources can add flows until the total limit.
+	for i := 0; flows.n < maxUDPFlows; i++ {
+		other := netip.AddrFrom4([4]byte{100, 64, byte(i / maxUDPFlowsPerSource), 1})
+		if !flows.add(other, newFlow(0)) {
+			t.Fatalf("flow %d refused under the total limit", flows.n)
+		}
+	}
+	if flows.add(netip.MustParseAddr("100.99.99.99"), newFlow(0)) {
+		t.Error("flow over total limit accepted")
+	}
+	for _, f := range first {
+		flows.remove(src, f)
+	}
+	if flows.n != maxUDPFlows-maxUDPFlowsPerSource+1 {
+		t.Errorf("flows after removals = %d; want %d", flows.n, maxUDPFlows-maxUDPFlowsPerSource+1)
+	}
+}
+
+func TestServeAllowRules(t *testing.T) {
+	b := newTestBackend(t)
+
+	// Grant the tagged peer a capability on this node.
+	b.netMap.SelfNode = (&tailcfg.Node{
+		Name:      "example.ts.net",
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.100.100.100/32")},
+	}).View()
+	b.setFilter(filter.New([]filter.Match{{
+		Srcs: []netip.Prefix{netip.MustParsePrefix("100.150.151.153/32")},
+		Caps: []filter.CapMatch{{
+			Dst: netip.MustParsePrefix("100.100.100.100/32"),
+			Cap: "example.com/cap/admin",
+		}},
+	}}, nil, nil, nil, nil, logger.Discard))
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {
+				Handlers: map[string]*ipn.HTTPHandler{
+					"/":       {Text: "open"},
+					"/users/": {Text: "users"},
+					"/tags/":  {Text: "tags"},
+					"/admin/": {Text: "admin"},
+				},
+				Allow: map[string][]string{
+					"/users/": {"someone@example.com"},
+					"/tags/":  {"tag:ci", "tag:server"},
+					"/admin/": {"cap:example.com/cap/admin"},
+				},
+			},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		user   = "100.150.151.152"
+		tagged = "100.150.151.153"
+		funnel = "100.160.161.162"
+	)
+	tests := []struct {
+		path  string
+		srcIP string
+		want  int
+	}{
+		{"/", user, http.StatusOK},
+		{"/", funnel, http.StatusOK},
+		{"/users/", user, http.StatusOK},
+		{"/users/x", tagged, http.StatusForbidden}, // tagged nodes have no user identity
+		{"/users/", funnel, http.StatusForbidden},
+		{"/tags/", tagged, http.StatusOK},
+		{"/tags/", user, http.StatusForbidden},
+		{"/admin/", tagged, http.StatusOK},
+		{"/admin/", user, http.StatusForbidden},
+		{"/admin/", funnel, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := &http.Request{
+			URL: &url.URL{Path: tt.path},
+			TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort(tt.srcIP + ":1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if got := w.Code; got != tt.want {
+			t.Errorf("GET %s from %s: status %d, want %d", tt.path, tt.srcIP, got, tt.want)
+		}
+	}
+
+	conf.Web["example.ts.net:443"].Allow["/missing/"] = []string{"tag:ci"}
+	if err := b.SetServeConfig(conf, ""); err == nil {
+		t.Error("SetServeConfig with rules for a missing mount succeeded, want error")
+	}
+}
+
+func TestServeRedirectAndStatus(t *testing.T) {
+	b := newTestBackend(t)
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/old/":  {Redirect: "https://new.example.com${REQUEST_URI}", Status: http.StatusMovedPermanently},
+				"/login": {Redirect: "/sso"},
+				"/gone":  {Text: "it's gone", Status: http.StatusGone},
+				"/down":  {Status: http.StatusServiceUnavailable},
+				"/hi":    {Text: "hello", ResponseHeaders: []ipn.HeaderRule{{Name: "X-Test", Value: "1"}}},
+				"/":      {Redirect: "${REQUEST_URI}/"},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path         string
+		wantCode     int
+		wantLocation string
+		wantBody     string
+		wantHeader   string // of X-Test
+	}{
+		{path: "/old/a/b?c=d", wantCode: 301, wantLocation: "https://new.example.com/old/a/b?c=d"},
+		{path: "/login", wantCode: 302, wantLocation: "/sso"},
+		{path: "/gone", wantCode: 410, wantBody: "it's gone"},
+		{path: "/down", wantCode: 503, wantBody: "Service Unavailable"},
+		{path: "/hi", wantCode: 200, wantBody: "hello", wantHeader: "1"},
+		{path: "/dir", wantCode: 302, wantLocation: "/dir/"},
+		{path: "//evil.example", wantCode: 302, wantLocation: "/evil.example/"},
+		{path: "///evil.example", wantCode: 302, wantLocation: "/evil.example/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			u, err := url.ParseRequestURI(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{
+				Method: "GET",
+				URL:    u,
+				Host:   "example.ts.net",
+				TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			res := w.Result()
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("status = %d; want %d", res.StatusCode, tt.wantCode)
+			}
+			if got := res.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q; want %q", got, tt.wantLocation)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q; want %q", w.Body.String(), tt.wantBody)
+			}
+			if got := res.Header.Get("X-Test"); got != tt.wantHeader {
+				t.Errorf("X-Test = %q; want %q", got, tt.wantHeader)
+			}
+		})
+	}
+
+	// Invalid handlers are rejected.
+	bad := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Redirect: "/x", Status: 200},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(bad, ""); err == nil {
+		t.Error("SetServeConfig with invalid handler succeeded")
+	}
+}
+
 func Test_reverseProxyConfiguration(t *testing.T) {
 	b := newTestBackend(t)
 	type test struct {
@@ -806,7 +1347,7 @@ func TestServeFileOrDirectory(t *testing.T) {
 	for _, tt := range tests {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest("GET", tt.req, nil)
-		b.serveFileOrDirectory(rec, req, td, tt.mount)
+		b.serveFileOrDirectory(rec, req, (&ipn.HTTPHandler{Path: td}).View(), tt.mount)
 		if tt.want == nil {
 			t.Errorf("no want for path %q", tt.req)
 			return
@@ -817,6 +1358,142 @@ func TestServeFileOrDirectory(t *testing.T) {
 	}
 }
 
+func TestServeDirectoryOptions(t *testing.T) {
+	b := newTestBackend(t)
+	td := t.TempDir()
+	writeFile := func(name, contents string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(td, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(td, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("files/a.txt", "this is A")
+	writeFile("files/home/home.html", "home page")
+	writeFile("files/withindex/index.html", "index page")
+	os.MkdirAll(filepath.Join(td, "files/empty"), 0700)
+	os.MkdirAll(filepath.Join(td, "up"), 0700)
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/files/": {Path: filepath.Join(td, "files"), NoListing: true, IndexFile: "home.html"},
+				"/up/":    {Path: filepath.Join(td, "up"), AllowUploads: true, MaxUploadSize: 100},
+				"/ro/":    {Path: filepath.Join(td, "files")},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, urlPath, srcIP string, hdr http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, urlPath, strings.NewReader(body))
+		if hdr.Get("Transfer-Encoding") == "chunked" {
+			req.ContentLength = -1
+		}
+		req.TLS = &tls.ConnectionState{ServerName: "example.ts.net"}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort(srcIP + ":1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		return w
+	}
+	const (
+		user   = "100.150.151.152"
+		tagged = "100.150.151.153"
+		funnel = "100.160.161.162"
+	)
+
+	t.Run("listing", func(t *testing.T) {
+		for _, tt := range []struct {
+			path string
+			want int
+			body string
+		}{
+			{"/files/", http.StatusNotFound, ""},
+			{"/files/empty/", http.StatusNotFound, ""},
+			{"/files/home/", http.StatusOK, "home page"},
+			{"/files/withindex/", http.StatusOK, "index page"},
+			{"/files/a.txt", http.StatusOK, "this is A"},
+			{"/ro/empty/", http.StatusOK, ""},
+			{"/ro/", http.StatusOK, "a.txt"},
+		} {
+			w := do("GET", tt.path, user, nil, "")
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("GET %s = %d %q; want %d containing %q", tt.path, w.Code, w.Body, tt.want, tt.body)
+			}
+		}
+	})
+
+	t.Run("etag", func(t *testing.T) {
+		for _, p := range []string{"/files/a.txt", "/files/home/", "/files/withindex/"} {
+			w := do("GET", p, user, nil, "")
+			etag := w.Header().Get("Etag")
+			if !strings.HasPrefix(etag, `"`) {
+				t.Fatalf("GET %s: ETag = %q, want a strong ETag", p, etag)
+			}
+			if w := do("GET", p, user, http.Header{"If-None-Match": {etag}}, ""); w.Code != http.StatusNotModified {
+				t.Errorf("GET %s with If-None-Match = %d, want 304", p, w.Code)
+			}
+		}
+		w := do("GET", "/files/a.txt", user, http.Header{"Range": {"bytes=0-3"}}, "")
+		if w.Code != http.StatusPartialContent || w.Body.String() != "this" {
+			t.Errorf("ranged GET = %d %q, want 206 \"this\"", w.Code, w.Body)
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		for _, tt := range []struct {
+			path  string
+			srcIP string
+			want  int
+		}{
+			{"/up/new.txt", user, http.StatusCreated},
+			{"/up/new.txt", user, http.StatusNoContent},
+			{"/up/other.txt", tagged, http.StatusForbidden},
+			{"/up/other.txt", funnel, http.StatusForbidden},
+			{"/up/bad:name", user, http.StatusBadRequest},
+			{"/up/sub/dir.txt", user, http.StatusBadRequest},
+			{"/ro/new.txt", user, http.StatusMethodNotAllowed},
+		} {
+			if w := do("PUT", tt.path, tt.srcIP, nil, "uploaded by "+tt.srcIP); w.Code != tt.want {
+				t.Errorf("PUT %s from %s = %d, want %d", tt.path, tt.srcIP, w.Code, tt.want)
+			}
+		}
+		got, err := os.ReadFile(filepath.Join(td, "up", "new.txt"))
+		if err != nil || string(got) != "uploaded by "+user {
+			t.Errorf("uploaded file = %q, %v", got, err)
+		}
+		ents, _ := os.ReadDir(filepath.Join(td, "up"))
+		if len(ents) != 1 {
+			t.Errorf("upload directory has %d entries, want only the uploaded file", len(ents))
+		}
+		if w := do("GET", "/up/new.txt", funnel, nil, ""); w.Body.String() != "uploaded by "+user {
+			t.Errorf("GET of uploaded file = %q", w.Body)
+		}
+
+		// Files over MaxUploadSize are refused, whether or not their
+		// length is known up front.
+		big := strings.Repeat("x", 101)
+		for _, hdr := range []http.Header{nil, {"Transfer-Encoding": {"chunked"}}} {
+			if w := do("PUT", "/up/big.txt", user, hdr, big); w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("PUT of large file with header %v = %d, want 413", hdr, w.Code)
+			}
+		}
+		if ents, _ := os.ReadDir(filepath.Join(td, "up")); len(ents) != 1 {
+			t.Errorf("upload directory has %d entries after large uploads, want 1", len(ents))
+		}
+	})
+}
+
 func Test_isGRPCContentType(t *testing.T) {
 	tests := []struct {
 		contentType string
@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/types/nettype"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+// defaultUDPIdleTimeout is how long a forwarded UDP flow may be idle before
+// it's closed, if its UDPPortHandler doesn't say otherwise.
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// maxUDPDatagramSize is the largest UDP payload we forward.
+const maxUDPDatagramSize = 1<<16 - 1
+
+// Limits on the number of forwarded UDP flows. When a source IP has
+// maxUDPFlowsPerSource flows, its least recently active flow is closed to
+// make room for a new one. New flows are refused while there are
+// maxUDPFlows in total.
+const (
+	maxUDPFlowsPerSource = 64
+	maxUDPFlows          = 4096
+)
+
+var (
+	metricServeUDPFlows        = clientmetric.NewGauge("serve_udp_flows")
+	metricServeUDPFlowsEvicted = clientmetric.NewCounter("serve_udp_flows_evicted")
+	metricServeUDPFlowsRefused = clientmetric.NewCounter("serve_udp_flows_refused")
+)
+
+// udpFlow is a forwarded UDP flow.
+type udpFlow struct {
+	lastActive atomic.Int64 // unix nanos of the last datagram
+	close      func()       // closes the flow's connections, ending it
+}
+
+// udpFlows are the forwarded UDP flows of a LocalBackend, by source IP.
+type udpFlows struct {
+	mu    sync.Mutex
+	bySrc map[netip.Addr]set.Set[*udpFlow]
+	n     int // total flows
+}
+
+// add adds f, a flow from src, evicting src's least recently active flow if
+// it has too many. It reports false if there are too many flows in total,
+// in which case f is not added.
+func (t *udpFlows) add(src netip.Addr, f *udpFlow) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n >= maxUDPFlows {
+		return false
+	}
+	flows := t.bySrc[src]
+	if len(flows) >= maxUDPFlowsPerSource {
+		var oldest *udpFlow
+		for g := range flows {
+			if oldest == nil || g.lastActive.Load() < oldest.lastActive.Load() {
+				oldest = g
+			}
+		}
+		flows.Delete(oldest)
+		t.n--
+		metricServeUDPFlowsEvicted.Add(1)
+		go oldest.close()
+	}
+	if flows == nil {
+		flows = set.Set[*udpFlow]{}
+		mak.Set(&t.bySrc, src, flows)
+	}
+	flows.Add(f)
+	t.n++
+	return true
+}
+
+// remove removes f, a flow from src, if it hasn't been evicted.
+func (t *udpFlows) remove(src netip.Addr, f *udpFlow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flows := t.bySrc[src]
+	if !flows.Contains(f) {
+		return
+	}
+	flows.Delete(f)
+	t.n--
+	if len(flows) == 0 {
+		delete(t.bySrc, src)
+	}
+}
+
+// UDPHandlerForDst returns a handler for the UDP flow from src to dst, or
+// nil if the flow should not be handled by LocalBackend. A flow is the
+// datagrams between one source IP:port and dst, as delivered by netstack.
+func (b *LocalBackend) UDPHandlerForDst(src, dst netip.AddrPort) func(nettype.ConnPacketConn) {
+	if !b.isLocalIP(dst.Addr()) {
+		return nil
+	}
+	return b.udpHandlerForServe(dst.Port(), src)
+}
+
+// udpHandlerForServe returns a handler for a UDP flow to port dport from
+// srcAddr, if the serve config forwards UDP on dport.
+func (b *LocalBackend) udpHandlerForServe(dport uint16, srcAddr netip.AddrPort) func(nettype.ConnPacketConn) {
+	b.mu.Lock()
+	sc := b.serveConfig
+	b.mu.Unlock()
+
+	if !sc.Valid() {
+		return nil
+	}
+	udph, ok := sc.FindUDP(dport)
+	if !ok || udph.UDPForward() == "" {
+		return nil
+	}
+	backDst := udph.UDPForward()
+	idle := defaultUDPIdleTimeout
+	if secs := udph.IdleTimeoutSeconds(); secs > 0 {
+		idle = time.Duration(secs) * time.Second
+	}
+	return func(c nettype.ConnPacketConn) {
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		backConn, err := b.dialer.SystemDial(ctx, "udp", backDst)
+		cancel()
+		if err != nil {
+			b.logf("localbackend: failed to UDP forward port %v (from %v) to %s: %v", dport, srcAddr, backDst, err)
+			return
+		}
+		defer backConn.Close()
+
+		f := &udpFlow{close: func() {
+			c.Close()
+			backConn.Close()
+		}}
+		f.lastActive.Store(time.Now().UnixNano())
+		if !b.udpFlows.add(srcAddr.Addr(), f) {
+			metricServeUDPFlowsRefused.Add(1)
+			return
+		}
+		defer b.udpFlows.remove(srcAddr.Addr(), f)
+		metricServeUDPFlows.Add(1)
+		defer metricServeUDPFlows.Add(-1)
+		forwardUDPFlow(c, backConn, idle, &f.lastActive)
+	}
+}
+
+// forwardUDPFlow copies datagrams between a and b until either fails or no
+// datagram has gone in either direction for idle. It stores the time of
+// each datagram in lastActive, as unix nanos. The caller must close a and b
+// afterwards.
+func forwardUDPFlow(a, b net.Conn, idle time.Duration, lastActive *atomic.Int64) {
+	errc := make(chan error, 2)
+	copyDatagrams := func(dst, src net.Conn) {
+		buf := make([]byte, maxUDPDatagramSize)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	go copyDatagrams(a, b)
+	go copyDatagrams(b, a)
+
+	t := time.NewTimer(idle)
+	defer t.Stop()
+	for {
+		select {
+		case <-errc:
+			return
+		case <-t.C:
+			sinceActive := time.Since(time.Unix(0, lastActive.Load()))
+			if sinceActive >= idle {
+				return
+			}
+			t.Reset(idle - sinceActive)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/tstun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+// shapeLimitsForNetmap returns the limits on the rate of traffic to and
+// from each of peers, under the rules in prefs and the rules in the
+// traffic-shaping node attribute of nm's self node. For each peer, the
+// first matching rule of each set applies, and the lower of their limits
+// wins. It returns nil if no traffic is shaped.
+func shapeLimitsForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.NodeView, prefs ipn.PrefsView, logf logger.Logf) map[key.NodePublic]tstun.ShapeLimits {
+	if nm == nil || !nm.SelfNode.Valid() {
+		return nil
+	}
+	attrRules, err := tailcfg.UnmarshalNodeCapJSON[ipn.ShapeRule](nm.SelfNode.CapMap().AsMap(), tailcfg.NodeAttrTrafficShaping)
+	if err != nil {
+		logf("[unexpected] error parsing %s node attribute: %v", tailcfg.NodeAttrTrafficShaping, err)
+	}
+	prefRules := prefs.TrafficShaping()
+	if len(attrRules) == 0 && prefRules.Len() == 0 {
+		return nil
+	}
+
+	var ret map[key.NodePublic]tstun.ShapeLimits
+	for _, p := range peers {
+		var lim tstun.ShapeLimits
+		for i := range prefRules.Len() {
+			if r := prefRules.At(i); shapeRuleMatches(r, p) {
+				lim = tstun.ShapeLimits{In: r.In, Out: r.Out}
+				break
+			}
+		}
+		for _, r := range attrRules {
+			if shapeRuleMatches(r, p) {
+				lim.In = lowerShapeRate(lim.In, r.In)
+				lim.Out = lowerShapeRate(lim.Out, r.Out)
+				break
+			}
+		}
+		if lim != (tstun.ShapeLimits{}) {
+			if ret == nil {
+				ret = make(map[key.NodePublic]tstun.ShapeLimits)
+			}
+			ret[p.Key()] = lim
+		}
+	}
+	return ret
+}
+
+// shapeRuleMatches reports whether r selects the peer n.
+func shapeRuleMatches(r ipn.ShapeRule, n tailcfg.NodeView) bool {
+	switch {
+	case r.Peer == "*":
+		return true
+	case strings.HasPrefix(r.Peer, "tag:"):
+		return n.Tags().ContainsFunc(func(tag string) bool { return tag == r.Peer })
+	case r.Peer == string(n.StableID()):
+		return true
+	}
+	if ip, err := netip.ParseAddr(r.Peer); err == nil {
+		addrs := n.Addresses()
+		for i := range addrs.Len() {
+			if pfx := addrs.At(i); pfx.IsSingleIP() && pfx.Addr() == ip {
+				return true
+			}
+		}
+		return false
+	}
+	name := strings.TrimSuffix(n.Name(), ".")
+	want := strings.TrimSuffix(r.Peer, ".")
+	if strings.EqualFold(name, want) {
+		return true
+	}
+	host, _, _ := strings.Cut(name, ".")
+	return host != "" && strings.EqualFold(host, want)
+}
+
+// lowerShapeRate returns the lower of two rates, where zero means
+// unlimited.
+func lowerShapeRate(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// reconfigShaping applies the traffic shaping limits to the TUN wrapper.
+func (b *LocalBackend) reconfigShaping(limits map[key.NodePublic]tstun.ShapeLimits) {
+	if tunWrap, ok := b.sys.Tun.GetOK(); ok {
+		tunWrap.SetShaping(limits)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/tstun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestShapeLimitsForNetmap(t *testing.T) {
+	backup := (&tailcfg.Node{
+		ID:        1,
+		StableID:  "nBACKUP",
+		Name:      "backup.tail-scale.ts.net.",
+		Key:       key.NewNode().Public(),
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		Tags:      []string{"tag:backup"},
+	}).View()
+	nas := (&tailcfg.Node{
+		ID:        2,
+		StableID:  "nNAS",
+		Name:      "nas.tail-scale.ts.net.",
+		Key:       key.NewNode().Public(),
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+	}).View()
+	laptop := (&tailcfg.Node{
+		ID:        3,
+		StableID:  "nLAPTOP",
+		Name:      "laptop.tail-scale.ts.net.",
+		Key:       key.NewNode().Public(),
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+	}).View()
+	peers := map[tailcfg.NodeID]tailcfg.NodeView{1: backup, 2: nas, 3: laptop}
+
+	nm := func(attrs ...string) *netmap.NetworkMap {
+		self := &tailcfg.Node{}
+		for _, a := range attrs {
+			self.CapMap = tailcfg.NodeCapMap{tailcfg.NodeAttrTrafficShaping: append(self.CapMap[tailcfg.NodeAttrTrafficShaping], tailcfg.RawMessage(a))}
+		}
+		return &netmap.NetworkMap{SelfNode: self.View()}
+	}
+	prefs := func(rules ...ipn.ShapeRule) ipn.PrefsView {
+		return (&ipn.Prefs{TrafficShaping: rules}).View()
+	}
+
+	tests := []struct {
+		name  string
+		nm    *netmap.NetworkMap
+		prefs ipn.PrefsView
+		want  map[key.NodePublic]tstun.ShapeLimits
+	}{
+		{
+			name:  "none",
+			nm:    nm(),
+			prefs: prefs(),
+		},
+		{
+			name: "prefs_first_match",
+			nm:   nm(),
+			prefs: prefs(
+				ipn.ShapeRule{Peer: "tag:backup", Out: 5e6},
+				ipn.ShapeRule{Peer: "nas", In: 1e6},
+				ipn.ShapeRule{Peer: "100.64.0.1", In: 1},
+				ipn.ShapeRule{Peer: "*", In: 50e6, Out: 50e6},
+			),
+			want: map[key.NodePublic]tstun.ShapeLimits{
+				backup.Key(): {Out: 5e6},
+				nas.Key():    {In: 1e6},
+				laptop.Key(): {In: 50e6, Out: 50e6},
+			},
+		},
+		{
+			name: "attr_lower_wins",
+			nm:   nm(`{"Peer":"tag:backup","In":2000000,"Out":10000000}`, `{"Peer":"nLAPTOP","Out":1000}`),
+			prefs: prefs(
+				ipn.ShapeRule{Peer: "backup.tail-scale.ts.net", Out: 5e6},
+			),
+			want: map[key.NodePublic]tstun.ShapeLimits{
+				backup.Key(): {In: 2e6, Out: 5e6},
+				laptop.Key(): {Out: 1000},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shapeLimitsForNetmap(tt.nm, peers, tt.prefs, t.Logf)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -33,3 +33,34 @@ func (b *LocalBackend) UpdateOutgoingFiles(updates map[string]*ipn.OutgoingFile)
 	})
 	b.send(ipn.Notify{OutgoingFiles: outgoingFiles})
 }
+
+// FileHistory returns the Taildrop transfers that have finished, both sent
+// and received, oldest first.
+func (b *LocalBackend) FileHistory() []ipn.FileTransfer {
+	b.mu.Lock()
+	apiSrv := b.peerAPIServer
+	b.mu.Unlock()
+	return mayDeref(apiSrv).taildrop.History()
+}
+
+// RecordFileTransfer adds the finished transfer t, of a file sent to a peer,
+// to the Taildrop transfer history and notifies IPN bus watchers of it.
+func (b *LocalBackend) RecordFileTransfer(t ipn.FileTransfer) {
+	b.mu.Lock()
+	apiSrv := b.peerAPIServer
+	if t.PeerName == "" && b.netMap != nil {
+		if n, ok := b.netMap.PeerWithStableID(t.PeerID); ok {
+			t.PeerName = n.ComputedName()
+		}
+	}
+	b.mu.Unlock()
+	if apiSrv == nil || apiSrv.taildrop == nil {
+		b.sendFileTransferNotify(t)
+		return
+	}
+	apiSrv.taildrop.RecordTransfer(t)
+}
+
+func (b *LocalBackend) sendFileTransferNotify(t ipn.FileTransfer) {
+	b.send(ipn.Notify{FileTransfer: &t})
+}
@@ -43,6 +43,7 @@
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/portmapper"
@@ -50,6 +51,7 @@
 	"tailscale.com/taildrop"
 	"tailscale.com/tka"
 	"tailscale.com/tstime"
+	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
@@ -64,6 +66,8 @@
 	"tailscale.com/util/progresstracking"
 	"tailscale.com/util/rands"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/capture"
+	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 )
 
@@ -74,10 +78,12 @@
 // then it's a prefix match.
 var handler = map[string]localAPIHandler{
 	// The prefix match handlers end with a slash:
-	"cert/":     (*Handler).serveCert,
-	"file-put/": (*Handler).serveFilePut,
-	"files/":    (*Handler).serveFiles,
-	"profiles/": (*Handler).serveProfiles,
+	"cert/":            (*Handler).serveCert,
+	"file-put-bundle/": (*Handler).serveFilePutBundle,
+	"file-put/":        (*Handler).serveFilePut,
+	"files/":           (*Handler).serveFiles,
+	"profiles/":        (*Handler).serveProfiles,
+	"ssh-recordings/":  (*Handler).serveSSHRecordings,
 
 	// The other /localapi/v0/NAME handlers are exact matches and contain only NAME
 	// without a trailing slash:
@@ -88,6 +94,9 @@
 	"component-debug-logging":     (*Handler).serveComponentDebugLogging,
 	"debug":                       (*Handler).serveDebug,
 	"debug-capture":               (*Handler).serveDebugCapture,
+	"debug-capture-files/start":   (*Handler).serveDebugCaptureFilesStart,
+	"debug-capture-files/status":  (*Handler).serveDebugCaptureFilesStatus,
+	"debug-capture-files/stop":    (*Handler).serveDebugCaptureFilesStop,
 	"debug-derp-region":           (*Handler).serveDebugDERPRegion,
 	"debug-dial-types":            (*Handler).serveDebugDialTypes,
 	"debug-log":                   (*Handler).serveDebugLog,
@@ -98,8 +107,10 @@
 	"derpmap":                     (*Handler).serveDERPMap,
 	"dev-set-state-store":         (*Handler).serveDevSetStateStore,
 	"dial":                        (*Handler).serveDial,
+	"dns-query-log":               (*Handler).serveDNSQueryLog,
 	"drive/fileserver-address":    (*Handler).serveDriveServerAddr,
 	"drive/shares":                (*Handler).serveShares,
+	"file-history":                (*Handler).serveFileHistory,
 	"file-targets":                (*Handler).serveFileTargets,
 	"goroutines":                  (*Handler).serveGoroutines,
 	"handle-push-message":         (*Handler).serveHandlePushMessage,
@@ -114,6 +125,7 @@
 	"query-feature":               (*Handler).serveQueryFeature,
 	"reload-config":               (*Handler).reloadConfig,
 	"reset-auth":                  (*Handler).serveResetAuth,
+	"serve-backends":              (*Handler).serveServeBackends,
 	"serve-config":                (*Handler).serveServeConfig,
 	"set-dns":                     (*Handler).serveSetDNS,
 	"set-expiry-sooner":           (*Handler).serveSetExpirySooner,
@@ -132,8 +144,11 @@
 	"tka/init":                    (*Handler).serveTKAInit,
 	"tka/log":                     (*Handler).serveTKALog,
 	"tka/modify":                  (*Handler).serveTKAModify,
+	"tka/prepare-bundle":          (*Handler).serveTKAPrepareBundle,
 	"tka/sign":                    (*Handler).serveTKASign,
+	"tka/sign-bundle":             (*Handler).serveTKASignBundle,
 	"tka/status":                  (*Handler).serveTKAStatus,
+	"tka/submit-bundle":           (*Handler).serveTKASubmitBundle,
 	"tka/submit-recovery-aum":     (*Handler).serveTKASubmitRecoveryAUM,
 	"tka/verify-deeplink":         (*Handler).serveTKAVerifySigningDeeplink,
 	"tka/wrap-preauth-key":        (*Handler).serveTKAWrapPreauthKey,
@@ -560,6 +575,82 @@ func (h *Handler) serveLogTap(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveDNSQueryLog serves the MagicDNS resolver's query log.
+//
+// A GET returns a snapshot of the log as JSON, or with follow=true streams
+// each new entry as a line of JSON. A POST with size=N resizes the log; zero
+// disables it.
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// Require write access (~root) as the log reveals what the
+	// device's users have been looking up.
+	if !h.PermitWrite {
+		http.Error(w, "dns query log access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		n, err := strconv.Atoi(r.FormValue("size"))
+		if err != nil || n < 0 {
+			http.Error(w, "invalid 'size' parameter", http.StatusBadRequest)
+			return
+		}
+		if n > resolver.MaxQueryLogSize {
+			http.Error(w, fmt.Sprintf("size must be at most %d", resolver.MaxQueryLogSize), http.StatusBadRequest)
+			return
+		}
+		if err := h.b.SetDNSQueryLogSize(n); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !defBool(r.FormValue("follow"), false) {
+		ql, err := h.b.DNSQueryLog()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ql)
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	entc := make(chan dnstype.QueryLogEntry, 64)
+	unreg, err := h.b.WatchDNSQueryLog(entc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unreg()
+
+	w.Header().Set("Content-Type", "application/json")
+	f.Flush()
+	enc := json.NewEncoder(w)
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-entc:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
 func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
 	// Require write access out of paranoia that the metrics
 	// might contain something sensitive.
@@ -624,6 +715,26 @@ func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
 		}
 	case "pick-new-derp":
 		err = h.b.DebugPickNewDERP()
+	case "dns-cache":
+		var st resolver.CacheStats
+		st, err = h.b.DebugDNSCacheStats()
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(st)
+			if err == nil {
+				return
+			}
+		}
+	case "dns-blocklist":
+		var st resolver.BlocklistStats
+		st, err = h.b.DebugDNSBlocklistStats()
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(st)
+			if err == nil {
+				return
+			}
+		}
 	case "":
 		err = fmt.Errorf("missing parameter 'action'")
 	default:
@@ -685,6 +796,14 @@ func (h *Handler) serveDebugPacketFilterMatches(w http.ResponseWriter, r *http.R
 
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "\t")
+	if r.FormValue("limits") == "true" {
+		// Include the new flow limit and why packets were dropped by it.
+		enc.Encode(struct {
+			Matches      []filter.Match
+			NewFlowLimit filter.NewFlowLimitStats
+		}{nm.PacketFilter, h.b.DebugPacketFilterLimits()})
+		return
+	}
 	enc.Encode(nm.PacketFilter)
 }
 
@@ -1034,6 +1153,21 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveServeBackends returns the health of the backends of load balanced
+// serve handlers.
+func (h *Handler) serveServeBackends(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "serve backends access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.ServeBackendStatus())
+}
+
 func authorizeServeConfigForGOOSAndUserContext(goos string, configIn *ipn.ServeConfig, h *Handler) error {
 	switch goos {
 	case "windows", "linux", "darwin":
@@ -1525,6 +1659,61 @@ type E struct {
 	json.NewEncoder(w).Encode(E{err.Error()})
 }
 
+// serveFileHistory returns the Taildrop transfers that have finished,
+// both sent and received, oldest first.
+func (h *Handler) serveFileHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "file history access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET to list history", http.StatusBadRequest)
+		return
+	}
+	history := h.b.FileHistory()
+	mak.NonNilSliceForJSON(&history)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// serveSSHRecordings lists the Tailscale SSH sessions recorded to local disk
+// for GET /localapi/v0/ssh-recordings/, and returns the recording with the
+// given ID, in asciicast v2 format, for GET /localapi/v0/ssh-recordings/<id>.
+func (h *Handler) serveSSHRecordings(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "SSH recording access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/localapi/v0/ssh-recordings/")
+	if id == "" {
+		infos, err := h.b.SSHRecordings()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mak.NonNilSliceForJSON(&infos)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+		return
+	}
+	f, err := h.b.OpenSSHRecording(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "no such recording", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	io.Copy(w, f)
+}
+
 func (h *Handler) serveFileTargets(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "access denied", http.StatusForbidden)
@@ -1606,21 +1795,8 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 		peerIDStr = upath
 	}
 	peerID := tailcfg.StableNodeID(peerIDStr)
-
-	var ft *apitype.FileTarget
-	for _, x := range fts {
-		if x.Node.StableID == peerID {
-			ft = x
-			break
-		}
-	}
-	if ft == nil {
-		http.Error(w, "node not found", http.StatusNotFound)
-		return
-	}
-	dstURL, err := url.Parse(ft.PeerAPIURL)
-	if err != nil {
-		http.Error(w, "bogus peer URL", http.StatusInternalServerError)
+	dstURL, ok := fileTargetURL(w, fts, peerID)
+	if !ok {
 		return
 	}
 
@@ -1663,6 +1839,29 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// fileTargetURL returns the PeerAPI URL of the file target with the given
+// stable ID. If there's no such target, it writes an error to w and returns
+// false.
+func fileTargetURL(w http.ResponseWriter, fts []*apitype.FileTarget, peerID tailcfg.StableNodeID) (_ *url.URL, ok bool) {
+	var ft *apitype.FileTarget
+	for _, x := range fts {
+		if x.Node.StableID == peerID {
+			ft = x
+			break
+		}
+	}
+	if ft == nil {
+		http.Error(w, "node not found", http.StatusNotFound)
+		return nil, false
+	}
+	dstURL, err := url.Parse(ft.PeerAPIURL)
+	if err != nil {
+		http.Error(w, "bogus peer URL", http.StatusInternalServerError)
+		return nil, false
+	}
+	return dstURL, true
+}
+
 func (h *Handler) multiFilePost(progressUpdates chan (ipn.OutgoingFile), w http.ResponseWriter, r *http.Request, peerID tailcfg.StableNodeID, dstURL *url.URL) {
 	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
@@ -1767,15 +1966,20 @@ func (h *Handler) singleFilePut(
 	outgoingFile ipn.OutgoingFile,
 ) bool {
 	outgoingFile.Started = time.Now()
+	// Hash everything read from body, including what's skipped when
+	// resuming, for the transfer history.
+	sum := sha256.New()
+	body = io.TeeReader(body, sum)
 	body = progresstracking.NewReader(body, 1*time.Second, func(n int, err error) {
 		outgoingFile.Sent = int64(n)
 		progressUpdates <- outgoingFile
 	})
 
-	fail := func() {
+	fail := func(reason string) {
 		outgoingFile.Finished = true
 		outgoingFile.Succeeded = false
 		progressUpdates <- outgoingFile
+		h.recordOutgoingFile(outgoingFile, "", reason)
 	}
 
 	// Before we PUT a file we check to see if there are any existing partial file and if so,
@@ -1791,7 +1995,7 @@ func (h *Handler) singleFilePut(
 	req, err := http.NewRequestWithContext(ctx, "GET", dstURL.String()+"/v0/put/"+outgoingFile.Name, nil)
 	if err != nil {
 		http.Error(w, "bogus peer URL", http.StatusInternalServerError)
-		fail()
+		fail("bogus peer URL")
 		return false
 	}
 	switch resp, err := client.Do(req); {
@@ -1817,7 +2021,7 @@ func (h *Handler) singleFilePut(
 	outReq, err := http.NewRequestWithContext(ctx, "PUT", "http://peer/v0/put/"+outgoingFile.Name, remainingBody)
 	if err != nil {
 		http.Error(w, "bogus outreq", http.StatusInternalServerError)
-		fail()
+		fail("bogus outreq")
 		return false
 	}
 	outReq.ContentLength = outgoingFile.DeclaredSize
@@ -1832,15 +2036,330 @@ func (h *Handler) singleFilePut(
 
 	rp := httputil.NewSingleHostReverseProxy(dstURL)
 	rp.Transport = h.b.Dialer().PeerAPITransport()
-	rp.ServeHTTP(w, outReq)
+	sw := &statusRecorder{ResponseWriter: w}
+	rp.ServeHTTP(sw, outReq)
 
 	outgoingFile.Finished = true
-	outgoingFile.Succeeded = true
+	outgoingFile.Succeeded = sw.status < 400
 	progressUpdates <- outgoingFile
 
+	if !outgoingFile.Succeeded {
+		h.recordOutgoingFile(outgoingFile, "", sw.errorMessage())
+	} else {
+		h.recordOutgoingFile(outgoingFile, hex.EncodeToString(sum.Sum(nil)), "")
+	}
 	return true
 }
 
+// recordOutgoingFile adds the finished transfer of f to the Taildrop
+// transfer history. The sum is the file's hex SHA-256, if known, and
+// reason is why the transfer failed, if it did.
+func (h *Handler) recordOutgoingFile(f ipn.OutgoingFile, sum, reason string) {
+	size := f.DeclaredSize
+	if size < 0 && reason == "" {
+		size = f.Sent
+	}
+	h.b.RecordFileTransfer(ipn.FileTransfer{
+		Outgoing:  true,
+		PeerID:    f.PeerID,
+		Name:      f.Name,
+		Size:      size,
+		Started:   f.Started,
+		Duration:  time.Since(f.Started),
+		SHA256:    sum,
+		Succeeded: reason == "",
+		Error:     reason,
+	})
+}
+
+// statusRecorder is an http.ResponseWriter that records the status code
+// and the start of the body of an error response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	errBody []byte // up to the first 1KiB of the body, if status >= 400
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	if sr.status >= 400 && len(sr.errBody) < 1<<10 {
+		sr.errBody = append(sr.errBody, p[:min(len(p), 1<<10-len(sr.errBody))]...)
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// errorMessage returns the error response as a message for the transfer
+// history.
+func (sr *statusRecorder) errorMessage() string {
+	if msg := strings.TrimSpace(string(sr.errBody)); msg != "" {
+		return msg
+	}
+	return http.StatusText(sr.status)
+}
+
+// serveFilePutBundle sends a directory of files to a peer as a single
+// Taildrop bundle, which the peer delivers only once it has every file.
+//
+// The request is a multipart/form-data POST. The first part is the
+// application/json apitype.BundleManifest, and each following part is the
+// file whose manifest path is the part's form name. Every file in the
+// manifest must be sent exactly once, or the transfer fails. Files the peer
+// already has from an earlier attempt are skipped, and partially sent files
+// are resumed.
+//
+// URL format:
+//
+//   - POST /localapi/v0/file-put-bundle/:stableID/:escaped-name
+func (h *Handler) serveFilePutBundle(w http.ResponseWriter, r *http.Request) {
+	metricFilePutCalls.Add(1)
+
+	if !h.PermitWrite {
+		http.Error(w, "file access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST to put bundle", http.StatusBadRequest)
+		return
+	}
+	upath, ok := strings.CutPrefix(r.URL.EscapedPath(), "/localapi/v0/file-put-bundle/")
+	if !ok {
+		http.Error(w, "misconfigured", http.StatusInternalServerError)
+		return
+	}
+	peerIDStr, nameEscaped, ok := strings.Cut(upath, "/")
+	if !ok || nameEscaped == "" {
+		http.Error(w, "bogus URL", http.StatusBadRequest)
+		return
+	}
+	fts, err := h.b.FileTargets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	peerID := tailcfg.StableNodeID(peerIDStr)
+	dstURL, ok := fileTargetURL(w, fts, peerID)
+	if !ok {
+		return
+	}
+	name, err := url.PathUnescape(nameEscaped)
+	if err != nil {
+		http.Error(w, "bogus bundle name", http.StatusBadRequest)
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid Content-Type for multipart POST: %s", err), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode multipart/form-data: %s", err), http.StatusBadRequest)
+		return
+	}
+	if part.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "first MIME part must be the JSON bundle manifest", http.StatusBadRequest)
+		return
+	}
+	var manifest apitype.BundleManifest
+	if err := json.NewDecoder(part).Decode(&manifest); err != nil {
+		http.Error(w, fmt.Sprintf("invalid manifest: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := taildrop.CheckManifest(manifest); err != nil {
+		http.Error(w, fmt.Sprintf("invalid manifest: %s", err), http.StatusBadRequest)
+		return
+	}
+	sizes := make(map[string]int64, len(manifest.Files))
+	var total int64
+	for _, f := range manifest.Files {
+		sizes[f.Path] = f.Size
+		total += f.Size
+	}
+
+	// The bundle is reported as a single outgoing file.
+	outgoingFile := &ipn.OutgoingFile{
+		ID:           uuid.Must(uuid.NewRandom()).String(),
+		PeerID:       peerID,
+		Name:         name,
+		Started:      time.Now(),
+		DeclaredSize: total,
+	}
+	var outgoingMu sync.Mutex
+	reportProgress := func() {
+		outgoingMu.Lock()
+		f := *outgoingFile
+		outgoingMu.Unlock()
+		h.b.UpdateOutgoingFiles(map[string]*ipn.OutgoingFile{f.ID: &f})
+	}
+	t := time.NewTicker(1 * time.Second)
+	defer t.Stop()
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		reportProgress()
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				reportProgress()
+			}
+		}
+	}()
+
+	client := &http.Client{Transport: h.b.Dialer().PeerAPITransport()}
+	bundleURL := dstURL.String() + "/v0/bundle/" + url.PathEscape(name)
+	fail := func(code int, msg string) {
+		outgoingMu.Lock()
+		outgoingFile.Finished = true
+		f := *outgoingFile
+		outgoingMu.Unlock()
+		http.Error(w, msg, code)
+		h.recordOutgoingFile(f, "", msg)
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp, err := peerBundleRequest(r.Context(), client, "POST", bundleURL, bytes.NewReader(manifestJSON), -1, 0)
+	if err != nil {
+		fail(http.StatusBadGateway, err.Error())
+		return
+	}
+	var started struct{ Received []string }
+	err = json.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	if err != nil {
+		fail(http.StatusBadGateway, fmt.Sprintf("bad response from peer: %v", err))
+		return
+	}
+	var sentBefore int64 // bytes of the files fully sent
+	skip := make(map[string]bool)
+	for _, p := range started.Received {
+		skip[p] = true
+		sentBefore += sizes[p]
+	}
+
+	received := make(map[string]bool, len(manifest.Files))
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fail(http.StatusBadRequest, fmt.Sprintf("failed to decode multipart/form-data: %s", err))
+			return
+		}
+		p := part.FormName()
+		size, ok := sizes[p]
+		if !ok {
+			fail(http.StatusBadRequest, fmt.Sprintf("file %q is not in the manifest", p))
+			return
+		}
+		if received[p] {
+			fail(http.StatusBadRequest, fmt.Sprintf("file %q is sent more than once", p))
+			return
+		}
+		received[p] = true
+		if skip[p] {
+			continue
+		}
+		body := progresstracking.NewReader(part, 1*time.Second, func(n int, err error) {
+			outgoingMu.Lock()
+			outgoingFile.Sent = sentBefore + int64(n)
+			outgoingMu.Unlock()
+		})
+		if err := h.putBundleFile(r.Context(), client, bundleURL+"/"+url.PathEscape(p), body, size); err != nil {
+			fail(http.StatusBadGateway, fmt.Sprintf("sending %s: %v", p, err))
+			return
+		}
+		sentBefore += size
+		outgoingMu.Lock()
+		outgoingFile.Sent = sentBefore
+		outgoingMu.Unlock()
+	}
+	for _, f := range manifest.Files {
+		if !received[f.Path] {
+			fail(http.StatusBadRequest, fmt.Sprintf("file %q in the manifest was not sent", f.Path))
+			return
+		}
+	}
+	outgoingMu.Lock()
+	outgoingFile.Finished = true
+	outgoingFile.Succeeded = true
+	f := *outgoingFile
+	outgoingMu.Unlock()
+	h.recordOutgoingFile(f, "", "")
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}\n")
+}
+
+// putBundleFile sends one file of a bundle to fileURL, resuming from the
+// peer's partial copy if it has one.
+func (h *Handler) putBundleFile(ctx context.Context, client *http.Client, fileURL string, body io.Reader, size int64) error {
+	var offset int64
+	remainingBody := body
+	resp, err := peerBundleRequest(ctx, client, "GET", fileURL, nil, -1, 0)
+	if err != nil {
+		h.logf("could not fetch remote hashes: %v", err)
+	} else {
+		dec := json.NewDecoder(resp.Body)
+		offset, remainingBody, err = taildrop.ResumeReader(body, func() (out taildrop.BlockChecksum, err error) {
+			err = dec.Decode(&out)
+			return out, err
+		})
+		resp.Body.Close()
+		if err != nil {
+			h.logf("reader could not be fully resumed: %v", err)
+		}
+	}
+	resp, err = peerBundleRequest(ctx, client, "PUT", fileURL, remainingBody, size-offset, offset)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// peerBundleRequest sends a request to the peer's bundle endpoint at u and
+// returns the response if its status is 200 OK. If offset is non-zero, the
+// request has a Range header starting at offset.
+func peerBundleRequest(ctx context.Context, client *http.Client, method, u string, body io.Reader, contentLength, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentLength >= 0 {
+		req.ContentLength = contentLength
+	}
+	if offset > 0 {
+		rangeHdr, _ := httphdr.FormatRange([]httphdr.Range{{Start: offset, Length: 0}})
+		req.Header.Set("Range", rangeHdr)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
 func (h *Handler) serveSetDNS(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "access denied", http.StatusForbidden)
@@ -2517,6 +3036,102 @@ func (h *Handler) serveTKASubmitRecoveryAUM(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusOK)
 }
 
+func (h *Handler) serveTKAPrepareBundle(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type prepareRequest struct {
+		AddKeys    []tka.Key
+		RemoveKeys []tka.Key
+	}
+	var req prepareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	bundle, err := h.b.NetworkLockPrepareBundle(req.AddKeys, req.RemoveKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTKABundle(w, bundle)
+}
+
+func (h *Handler) serveTKASignBundle(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bundle, ok := readTKABundle(w, r)
+	if !ok {
+		return
+	}
+	if err := h.b.NetworkLockSignBundle(bundle); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTKABundle(w, bundle)
+}
+
+func (h *Handler) serveTKASubmitBundle(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bundle, ok := readTKABundle(w, r)
+	if !ok {
+		return
+	}
+	if err := h.b.NetworkLockSubmitBundle(bundle); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// readTKABundle reads a tka.Bundle from the body of r. If it can't, it
+// writes an error to w and returns false.
+func readTKABundle(w http.ResponseWriter, r *http.Request) (*tka.Bundle, bool) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, "reading bundle", http.StatusBadRequest)
+		return nil, false
+	}
+	bundle, err := tka.ParseBundle(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return bundle, true
+}
+
+func writeTKABundle(w http.ResponseWriter, bundle *tka.Bundle) {
+	j, err := bundle.Marshal()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
 // serveProfiles serves profile switching-related endpoints. Supported methods
 // and paths are:
 //   - GET /profiles/: list all profiles (JSON-encoded array of ipn.LoginProfiles)
@@ -2672,6 +3287,27 @@ func defBool(a string, def bool) bool {
 	return v
 }
 
+// parseDebugCaptureOpts parses the filter and format parameters of a debug
+// capture request.
+func parseDebugCaptureOpts(r *http.Request) (capture.OutputOpts, error) {
+	var opts capture.OutputOpts
+	if expr := r.FormValue("filter"); expr != "" {
+		f, err := capture.ParseFilter(expr)
+		if err != nil {
+			return opts, err
+		}
+		opts.Filter = f
+	}
+	switch format := r.FormValue("format"); format {
+	case "", "pcap":
+	case "pcapng":
+		opts.Format = capture.PCAPNG
+	default:
+		return opts, fmt.Errorf("unknown capture format %q", format)
+	}
+	return opts, nil
+}
+
 func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "debug access denied", http.StatusForbidden)
@@ -2681,10 +3317,108 @@ func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
 	}
+	opts, err := parseDebugCaptureOpts(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
-	h.b.StreamDebugCapture(r.Context(), w)
+	h.b.StreamDebugCapture(r.Context(), w, opts)
+}
+
+// Default limits of a debug capture to rotated files.
+const (
+	defaultCaptureFileSize  = 100 << 20
+	defaultCaptureFiles     = 10
+	defaultCaptureTotalSize = 2 << 30 // of all captures
+)
+
+// serveDebugCaptureFilesStart starts a background capture to a ring of
+// size-limited pcapng files in the state directory, which runs until it's
+// stopped with serveDebugCaptureFilesStop. The response is its status.
+func (h *Handler) serveDebugCaptureFilesStart(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	opts, err := parseDebugCaptureOpts(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxSize, maxFiles, maxTotal := int64(defaultCaptureFileSize), defaultCaptureFiles, int64(defaultCaptureTotalSize)
+	if v := r.FormValue("max-file-size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid max-file-size", http.StatusBadRequest)
+			return
+		}
+		maxSize = n
+	}
+	if v := r.FormValue("max-files"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid max-files", http.StatusBadRequest)
+			return
+		}
+		maxFiles = n
+	}
+	if v := r.FormValue("max-total-size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid max-total-size", http.StatusBadRequest)
+			return
+		}
+		maxTotal = n
+	}
+	if maxTotal < maxSize {
+		http.Error(w, "max-total-size is less than max-file-size", http.StatusBadRequest)
+		return
+	}
+	st, err := h.b.StartDebugCaptureFiles(opts, maxSize, maxFiles, maxTotal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func (h *Handler) serveDebugCaptureFilesStop(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := h.b.StopDebugCaptureFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func (h *Handler) serveDebugCaptureFilesStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.DebugCaptureFilesStatus())
 }
 
 func (h *Handler) serveDebugLog(w http.ResponseWriter, r *http.Request) {
@@ -2850,6 +3584,10 @@ func (h *Handler) serveShares(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "invalid share name", http.StatusBadRequest)
 				return
 			}
+			if errors.Is(err, drive.ErrInvalidSnapshot) || errors.Is(err, drive.ErrInvalidQuota) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
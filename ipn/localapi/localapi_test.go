@@ -262,6 +262,28 @@ func TestShouldDenyServeConfigForGOOSAndUserContext(t *testing.T) {
 	})
 }
 
+func TestServeFileHistoryPermissions(t *testing.T) {
+	for _, tt := range []struct {
+		permitRead, permitWrite bool
+		wantStatus              int
+	}{
+		{false, false, http.StatusForbidden},
+		{true, false, http.StatusForbidden},
+		{true, true, http.StatusOK},
+	} {
+		h := &Handler{
+			PermitRead:  tt.permitRead,
+			PermitWrite: tt.permitWrite,
+			b:           newTestLocalBackend(t),
+		}
+		rec := httptest.NewRecorder()
+		h.serveFileHistory(rec, httptest.NewRequest("GET", "/localapi/v0/file-history", nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("PermitRead=%v, PermitWrite=%v: status = %d; want %d", tt.permitRead, tt.permitWrite, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
 func TestServeWatchIPNBus(t *testing.T) {
 	tstest.Replace(t, &validLocalHostForTesting, true)
 
@@ -239,6 +239,55 @@ type Prefs struct {
 	// by name.
 	DriveShares []*drive.Share
 
+	// DNSOverrides are local DNS records and rules layered on top of the
+	// tailnet's DNS configuration, in the order they were added.
+	DNSOverrides []DNSOverride `json:",omitempty"`
+
+	// DNSBlocklistFiles are the absolute paths of blocklist files applied
+	// to DNS queries from peers using this node as an exit node. See
+	// resolver.BlocklistConfig for the supported formats.
+	DNSBlocklistFiles []string `json:",omitempty"`
+
+	// DNSBlocklistResponse is how queries for blocked names are answered:
+	// "" or "nxdomain" for NXDOMAIN, or "zero" to answer A and AAAA
+	// queries with 0.0.0.0 and ::.
+	DNSBlocklistResponse string `json:",omitempty"`
+
+	// TrafficShaping are rules limiting the rate of traffic to and from
+	// peers. For each peer, the first matching rule applies, combined
+	// with any limits set by the control plane.
+	TrafficShaping []ShapeRule `json:",omitempty"`
+
+	// FlowCollector is the flow collector to export network flow logs
+	// to, as "ipfix://host[:port]" or "netflow9://host[:port]". Flows are
+	// exported whether or not the tailnet has network flow logging
+	// enabled. Empty means not to export flows.
+	FlowCollector string `json:",omitempty"`
+
+	// TaildropReceivePolicy limits what Taildrop files this node accepts
+	// and says where it puts them. If nil, any file from any sender is
+	// accepted into the Taildrop directory.
+	TaildropReceivePolicy *TaildropReceivePolicy `json:",omitempty"`
+
+	// SSHRecordingPolicy says when Tailscale SSH sessions are recorded to
+	// local disk, and how many recordings are kept. If nil, sessions are
+	// only recorded to the recorders named by the SSH policy.
+	SSHRecordingPolicy *SSHRecordingPolicy `json:",omitempty"`
+
+	// SSHUserCA is the certificate authority that Tailscale SSH issues
+	// short-lived user certificates with, to sessions whose SSH action
+	// asks for them. If nil, no certificates are issued.
+	SSHUserCA *SSHUserCA `json:",omitempty"`
+
+	// NewFlowsPerSecond, if positive, limits the rate at which each peer
+	// may open new TCP connections to each port on this node or the
+	// subnets it routes. Connections beyond the limit are dropped.
+	NewFlowsPerSecond int `json:",omitempty"`
+
+	// NewFlowsBurst is how many new connections a peer may open at once,
+	// before NewFlowsPerSecond applies. If zero, it is NewFlowsPerSecond.
+	NewFlowsBurst int `json:",omitempty"`
+
 	// AllowSingleHosts was a legacy field that was always true
 	// for the past 4.5 years. It controlled whether Tailscale
 	// peers got /32 or /127 routes for each other.
@@ -329,6 +378,16 @@ type MaskedPrefs struct {
 	PostureCheckingSet        bool                `json:",omitempty"`
 	NetfilterKindSet          bool                `json:",omitempty"`
 	DriveSharesSet            bool                `json:",omitempty"`
+	DNSOverridesSet           bool                `json:",omitempty"`
+	DNSBlocklistFilesSet      bool                `json:",omitempty"`
+	DNSBlocklistResponseSet   bool                `json:",omitempty"`
+	TrafficShapingSet         bool                `json:",omitempty"`
+	FlowCollectorSet          bool                `json:",omitempty"`
+	TaildropReceivePolicySet  bool                `json:",omitempty"`
+	SSHRecordingPolicySet     bool                `json:",omitempty"`
+	SSHUserCASet              bool                `json:",omitempty"`
+	NewFlowsPerSecondSet      bool                `json:",omitempty"`
+	NewFlowsBurstSet          bool                `json:",omitempty"`
 }
 
 // SetsInternal reports whether mp has any of the Internal*Set field bools set
@@ -542,6 +601,34 @@ func (p *Prefs) pretty(goos string) string {
 	if p.NetfilterKind != "" {
 		fmt.Fprintf(&sb, "netfilterKind=%s ", p.NetfilterKind)
 	}
+	if len(p.DNSOverrides) > 0 {
+		fmt.Fprintf(&sb, "dnsOverrides=%d ", len(p.DNSOverrides))
+	}
+	if len(p.DNSBlocklistFiles) > 0 {
+		fmt.Fprintf(&sb, "dnsBlocklist=%d", len(p.DNSBlocklistFiles))
+		if p.DNSBlocklistResponse != "" {
+			fmt.Fprintf(&sb, ":%s", p.DNSBlocklistResponse)
+		}
+		sb.WriteString(" ")
+	}
+	if len(p.TrafficShaping) > 0 {
+		fmt.Fprintf(&sb, "trafficShaping=%d ", len(p.TrafficShaping))
+	}
+	if p.FlowCollector != "" {
+		fmt.Fprintf(&sb, "flowCollector=%s ", p.FlowCollector)
+	}
+	if p.TaildropReceivePolicy != nil {
+		sb.WriteString("taildropReceivePolicy ")
+	}
+	if p.SSHRecordingPolicy != nil {
+		sb.WriteString("sshRecordingPolicy ")
+	}
+	if p.SSHUserCA != nil {
+		fmt.Fprintf(&sb, "sshUserCA=%s ", p.SSHUserCA.KeyPath)
+	}
+	if p.NewFlowsPerSecond > 0 {
+		fmt.Fprintf(&sb, "newFlows=%d/s,burst=%d ", p.NewFlowsPerSecond, p.NewFlowsBurst)
+	}
 	sb.WriteString(p.AutoUpdate.Pretty())
 	sb.WriteString(p.AppConnector.Pretty())
 	if p.Persist != nil {
@@ -604,6 +691,16 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.AppConnector == p2.AppConnector &&
 		p.PostureChecking == p2.PostureChecking &&
 		slices.EqualFunc(p.DriveShares, p2.DriveShares, drive.SharesEqual) &&
+		slices.Equal(p.DNSOverrides, p2.DNSOverrides) &&
+		slices.Equal(p.DNSBlocklistFiles, p2.DNSBlocklistFiles) &&
+		p.DNSBlocklistResponse == p2.DNSBlocklistResponse &&
+		slices.Equal(p.TrafficShaping, p2.TrafficShaping) &&
+		p.FlowCollector == p2.FlowCollector &&
+		p.TaildropReceivePolicy.Equal(p2.TaildropReceivePolicy) &&
+		p.SSHRecordingPolicy.Equal(p2.SSHRecordingPolicy) &&
+		p.SSHUserCA.Equal(p2.SSHUserCA) &&
+		p.NewFlowsPerSecond == p2.NewFlowsPerSecond &&
+		p.NewFlowsBurst == p2.NewFlowsBurst &&
 		p.NetfilterKind == p2.NetfilterKind
 }
 
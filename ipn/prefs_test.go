@@ -64,6 +64,16 @@ func TestPrefsEqual(t *testing.T) {
 		"PostureChecking",
 		"NetfilterKind",
 		"DriveShares",
+		"DNSOverrides",
+		"DNSBlocklistFiles",
+		"DNSBlocklistResponse",
+		"TrafficShaping",
+		"FlowCollector",
+		"TaildropReceivePolicy",
+		"SSHRecordingPolicy",
+		"SSHUserCA",
+		"NewFlowsPerSecond",
+		"NewFlowsBurst",
 		"AllowSingleHosts",
 		"Persist",
 	}
@@ -12,6 +12,7 @@
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -31,6 +32,10 @@ type ServeConfig struct {
 	// the Tailscale IP addresses. (not subnet routers, etc)
 	TCP map[uint16]*TCPPortHandler `json:",omitempty"`
 
+	// UDP are the list of UDP port numbers that tailscaled should forward
+	// for the Tailscale IP addresses.
+	UDP map[uint16]*UDPPortHandler `json:",omitempty"`
+
 	// Web maps from "$SNI_NAME:$PORT" to a set of HTTP handlers
 	// keyed by mount point ("/", "/foo", etc)
 	Web map[HostPort]*WebServerConfig `json:",omitempty"`
@@ -96,6 +101,56 @@ type FunnelConn struct {
 // WebServerConfig describes a web server's configuration.
 type WebServerConfig struct {
 	Handlers map[string]*HTTPHandler // mountPoint => handler
+
+	// Allow restricts requests to the handlers of some mount points to
+	// those from tailnet identities that match at least one of the
+	// rules for the mount point, as described on CheckServeAllowRule.
+	// Other requests, including any over Funnel, are denied. Mount
+	// points without rules are open to all.
+	Allow map[string][]string `json:",omitempty"` // mountPoint => rules
+}
+
+// Check reports whether c is well-formed.
+func (c *WebServerConfig) Check() error {
+	for mount, rules := range c.Allow {
+		if _, ok := c.Handlers[mount]; !ok {
+			return fmt.Errorf("allow rules for %q, which has no handler", mount)
+		}
+		for _, r := range rules {
+			if err := CheckServeAllowRule(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckServeAllowRule reports whether rule is a valid WebServerConfig.Allow
+// rule. A rule is one of:
+//
+//   - a user login name, such as "alice@example.com", matching requests
+//     from the untagged nodes of that user;
+//   - a tag, such as "tag:ci", matching requests from nodes with the tag;
+//   - "cap:" and a peer capability, such as "cap:example.com/cap/admin",
+//     matching requests from nodes granted the capability on this node.
+func CheckServeAllowRule(rule string) error {
+	switch {
+	case strings.HasPrefix(rule, "tag:"):
+		if len(rule) == len("tag:") {
+			return fmt.Errorf("invalid allow rule %q: empty tag", rule)
+		}
+	case strings.HasPrefix(rule, "cap:"):
+		if len(rule) == len("cap:") {
+			return fmt.Errorf("invalid allow rule %q: empty capability", rule)
+		}
+	case strings.Contains(rule, "@"):
+	default:
+		return fmt.Errorf("invalid allow rule %q: want a user login, tag:<tag> or cap:<capability>", rule)
+	}
+	if strings.ContainsAny(rule, " ,") {
+		return fmt.Errorf("invalid allow rule %q", rule)
+	}
+	return nil
 }
 
 // TCPPortHandler describes what to do when handling a TCP
@@ -125,9 +180,27 @@ type TCPPortHandler struct {
 	// SNI name with this value. It is only used if TCPForward is non-empty.
 	// (the HTTPS mode uses ServeConfig.Web)
 	TerminateTLS string `json:",omitempty"`
+
+	// LoadBalancer, if non-nil, spreads connections across TCPForward
+	// and further backends. It is only used if TCPForward is non-empty.
+	LoadBalancer *LoadBalancer `json:",omitempty"`
+}
+
+// UDPPortHandler describes what to do with UDP datagrams received on a port.
+type UDPPortHandler struct {
+	// UDPForward is the IP:port to forward UDP datagrams to. Each source
+	// IP:port is a separate flow, forwarded from its own local socket so
+	// that replies reach the right peer.
+	UDPForward string `json:",omitempty"`
+
+	// IdleTimeoutSeconds is how long a flow may go without datagrams in
+	// either direction before it is closed. If zero, it defaults to two
+	// minutes.
+	IdleTimeoutSeconds int `json:",omitempty"`
 }
 
-// HTTPHandler is either a path or a proxy to serve.
+// HTTPHandler is either a path, a proxy, a redirect or a static response
+// to serve.
 type HTTPHandler struct {
 	// Exactly one of the following may be set.
 
@@ -136,8 +209,294 @@ type HTTPHandler struct {
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
-	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
-	// temporary ones? Error codes? Redirects?
+	// Redirect is the URL to redirect requests to. The variables
+	// ${HOST} and ${REQUEST_URI} expand to the host and the path and
+	// query of the request. Leading slashes of an expansion that would
+	// redirect to another host, such as "//evil.example", are collapsed
+	// into one.
+	Redirect string `json:",omitempty"`
+
+	// Status is the HTTP status code of the response to Text or Redirect.
+	// It defaults to 200 (OK) for Text and 302 (Found) for Redirect. If
+	// Status is set without any of the above, requests are answered with
+	// Status and its standard text.
+	Status int `json:",omitempty"`
+
+	// RequestHeaders and ResponseHeaders are rules, applied in order, to
+	// set or remove headers of requests to the handler and of its
+	// responses. Request headers only matter to Proxy handlers.
+	RequestHeaders  []HeaderRule `json:",omitempty"`
+	ResponseHeaders []HeaderRule `json:",omitempty"`
+
+	// LoadBalancer, if non-nil, spreads requests across Proxy and further
+	// backends. It is only used if Proxy is non-empty.
+	LoadBalancer *LoadBalancer `json:",omitempty"`
+
+	// The following only apply to Path handlers of directories.
+
+	// NoListing, if true, means that requests for a directory without an
+	// index file are answered with 404 Not Found, rather than a listing
+	// of the directory.
+	NoListing bool `json:",omitempty"`
+
+	// IndexFile is the name of the file to serve for requests for a
+	// directory that contains it. If empty, or if the directory has no
+	// such file, index.html is served if present.
+	IndexFile string `json:",omitempty"`
+
+	// AllowUploads, if true, means that files may be uploaded into the
+	// directory with PUT requests from tailnet users. Requests over
+	// Funnel or from tagged nodes are denied. Existing files are
+	// replaced.
+	AllowUploads bool `json:",omitempty"`
+
+	// MaxUploadSize is the maximum size in bytes of a file uploaded with
+	// AllowUploads. Zero means DefaultMaxUploadSize.
+	MaxUploadSize int64 `json:",omitempty"`
+
+	// TODO(bradfitz): TTL on mapping for temporary ones?
+}
+
+// DefaultMaxUploadSize is the default HTTPHandler.MaxUploadSize.
+const DefaultMaxUploadSize = 1 << 30
+
+// Check reports whether h is well-formed.
+func (h *HTTPHandler) Check() error {
+	var kinds int
+	for _, v := range []string{h.Path, h.Proxy, h.Text, h.Redirect} {
+		if v != "" {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return errors.New("only one of Path, Proxy, Text and Redirect may be set")
+	}
+	switch {
+	case h.Status == 0:
+	case h.Path != "" || h.Proxy != "":
+		return errors.New("Status may only be set for Text and Redirect handlers")
+	case h.Redirect != "" && (h.Status < 300 || h.Status > 399):
+		return fmt.Errorf("invalid redirect status %d; want 3xx", h.Status)
+	case h.Status < 200 || h.Status > 599:
+		return fmt.Errorf("invalid status %d", h.Status)
+	}
+	if h.Redirect != "" && !strings.HasPrefix(h.Redirect, "/") && !strings.Contains(h.Redirect, "://") &&
+		!strings.HasPrefix(h.Redirect, "${") {
+		return fmt.Errorf("invalid redirect %q; want an absolute URL or path", h.Redirect)
+	}
+	for _, r := range h.RequestHeaders {
+		if err := r.Check(); err != nil {
+			return err
+		}
+	}
+	for _, r := range h.ResponseHeaders {
+		if err := r.Check(); err != nil {
+			return err
+		}
+	}
+	if (h.NoListing || h.IndexFile != "" || h.AllowUploads) && h.Path == "" {
+		return errors.New("NoListing, IndexFile and AllowUploads may only be set for Path handlers")
+	}
+	if h.MaxUploadSize != 0 && (!h.AllowUploads || h.MaxUploadSize < 0) {
+		return errors.New("MaxUploadSize must be positive, and may only be set with AllowUploads")
+	}
+	if f := h.IndexFile; f != "" && (strings.ContainsAny(f, `/\`) || f == "." || f == "..") {
+		return fmt.Errorf("invalid index file %q; want a file name", f)
+	}
+	if h.LoadBalancer != nil {
+		if h.Proxy == "" {
+			return errors.New("LoadBalancer may only be set for Proxy handlers")
+		}
+		if err := h.LoadBalancer.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check reports whether h is well-formed.
+func (h *TCPPortHandler) Check() error {
+	if h.LoadBalancer != nil {
+		if h.TCPForward == "" {
+			return errors.New("LoadBalancer may only be set for TCPForward handlers")
+		}
+		if err := h.LoadBalancer.Check(); err != nil {
+			return err
+		}
+		if hc := h.LoadBalancer.HealthCheck; hc != nil && hc.Path != "" {
+			return errors.New("HTTP health checks may only be used with Proxy handlers")
+		}
+	}
+	return nil
+}
+
+// Check reports whether h is well-formed.
+func (h *UDPPortHandler) Check() error {
+	if _, _, err := net.SplitHostPort(h.UDPForward); err != nil {
+		return fmt.Errorf("invalid UDPForward %q: %w", h.UDPForward, err)
+	}
+	if h.IdleTimeoutSeconds < 0 {
+		return errors.New("IdleTimeoutSeconds must not be negative")
+	}
+	return nil
+}
+
+// Load balancing policies for LoadBalancer.Policy.
+const (
+	// LBRoundRobin selects healthy backends in turn.
+	LBRoundRobin = "round-robin"
+
+	// LBLeastConn selects the healthy backend with the fewest active
+	// requests or connections.
+	LBLeastConn = "least-conn"
+)
+
+// LoadBalancer spreads the requests or connections of a Proxy or
+// TCPForward handler across several backends.
+type LoadBalancer struct {
+	// Backends are the backends to use in addition to the Proxy or
+	// TCPForward backend of the handler, in the same form.
+	Backends []string
+
+	// Policy is how backends are selected, LBRoundRobin or LBLeastConn.
+	// The default is LBRoundRobin.
+	Policy string `json:",omitempty"`
+
+	// HealthCheck, if non-nil, is how backends are actively checked.
+	// Unhealthy backends are not selected until they recover. Without
+	// it, all backends are considered healthy.
+	HealthCheck *HealthCheck `json:",omitempty"`
+}
+
+// Check reports whether lb is well-formed.
+func (lb *LoadBalancer) Check() error {
+	if len(lb.Backends) == 0 {
+		return errors.New("load balancer has no additional backends")
+	}
+	for _, b := range lb.Backends {
+		if b == "" {
+			return errors.New("empty load balancer backend")
+		}
+	}
+	switch lb.Policy {
+	case "", LBRoundRobin, LBLeastConn:
+	default:
+		return fmt.Errorf("unknown load balancing policy %q; want %q or %q", lb.Policy, LBRoundRobin, LBLeastConn)
+	}
+	if hc := lb.HealthCheck; hc != nil {
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("invalid health check path %q; want an absolute path", hc.Path)
+		}
+		if hc.IntervalSeconds < 0 || hc.TimeoutSeconds < 0 || hc.UnhealthyThreshold < 0 || hc.HealthyThreshold < 0 {
+			return errors.New("negative health check parameter")
+		}
+	}
+	return nil
+}
+
+// HealthCheck describes how the backends of a LoadBalancer are checked.
+type HealthCheck struct {
+	// Path, if non-empty, is the path to send an HTTP GET request to on
+	// each backend of a Proxy handler. A backend is healthy if it
+	// responds with a 2xx or 3xx status. If Path is empty, a backend is
+	// healthy if it accepts TCP connections.
+	Path string `json:",omitempty"`
+
+	// IntervalSeconds is the time between checks of a backend. It
+	// defaults to 10.
+	IntervalSeconds int `json:",omitempty"`
+
+	// TimeoutSeconds is how long a check may take before it fails. It
+	// defaults to 5, and to IntervalSeconds if that is shorter.
+	TimeoutSeconds int `json:",omitempty"`
+
+	// UnhealthyThreshold is the number of consecutive failed checks
+	// after which a backend is ejected. It defaults to 2.
+	UnhealthyThreshold int `json:",omitempty"`
+
+	// HealthyThreshold is the number of consecutive successful checks
+	// after which an ejected backend is selected again. It defaults
+	// to 2.
+	HealthyThreshold int `json:",omitempty"`
+}
+
+// ServeBackendStatus is the health of a load balanced serve backend, as
+// reported by the LocalAPI.
+type ServeBackendStatus struct {
+	// Backend is the backend as given in the serve config.
+	Backend string
+
+	// Healthy is whether the backend is selected for new requests or
+	// connections.
+	Healthy bool
+
+	// ActiveConns is the number of requests or connections in flight to
+	// the backend.
+	ActiveConns int64
+
+	// LastCheck is the time of the last health check, or the zero time
+	// if the backend is not health checked.
+	LastCheck time.Time
+
+	// LastError is the error of the last health check, if it failed.
+	LastError string `json:",omitempty"`
+}
+
+// HeaderRule sets or removes an HTTP header.
+type HeaderRule struct {
+	// Name is the name of the header.
+	Name string
+
+	// Value is the value to set the header to. It may refer to the
+	// identity of the user making the request as ${Tailscale-User-Login},
+	// ${Tailscale-User-Name} or ${Tailscale-User-Profile-Pic}; the header
+	// is removed instead if the request has no user identity, as for
+	// requests from tagged nodes or over Funnel.
+	Value string `json:",omitempty"`
+
+	// Remove is whether to remove the header, rather than set it.
+	Remove bool `json:",omitempty"`
+}
+
+// ParseHeaderRule parses a HeaderRule in the form "Name: value", to set a
+// header, or "-Name", to remove it.
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	var r HeaderRule
+	if name, ok := strings.CutPrefix(s, "-"); ok {
+		r = HeaderRule{Name: name, Remove: true}
+	} else if name, value, ok := strings.Cut(s, ":"); ok {
+		r = HeaderRule{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)}
+	} else {
+		return HeaderRule{}, fmt.Errorf("invalid header rule %q: want \"Name: value\" or \"-Name\"", s)
+	}
+	if err := r.Check(); err != nil {
+		return HeaderRule{}, err
+	}
+	return r, nil
+}
+
+// String returns r in the form accepted by ParseHeaderRule.
+func (r HeaderRule) String() string {
+	if r.Remove {
+		return "-" + r.Name
+	}
+	return r.Name + ": " + r.Value
+}
+
+// Check reports whether r is well-formed.
+func (r HeaderRule) Check() error {
+	if r.Name == "" || strings.IndexFunc(r.Name, func(c rune) bool {
+		return c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+	}) >= 0 {
+		return fmt.Errorf("invalid header name %q", r.Name)
+	}
+	if r.Remove && r.Value != "" {
+		return fmt.Errorf("header rule for %q both sets and removes it", r.Name)
+	}
+	if strings.ContainsAny(r.Value, "\r\n") {
+		return fmt.Errorf("invalid value for header %q", r.Name)
+	}
+	return nil
 }
 
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
@@ -254,6 +613,22 @@ func (sc *ServeConfig) FindConfig(port uint16) (*ServeConfig, bool) {
 	return nil, false
 }
 
+// FindUDPConfig is like FindConfig, but for the UDP forwarder on port.
+func (sc *ServeConfig) FindUDPConfig(port uint16) (*ServeConfig, bool) {
+	if sc == nil {
+		return nil, false
+	}
+	if _, ok := sc.UDP[port]; ok {
+		return sc, false
+	}
+	for _, sc := range sc.Foreground {
+		if _, ok := sc.UDP[port]; ok {
+			return sc, true
+		}
+	}
+	return nil, false
+}
+
 // SetWebHandler sets the given HTTPHandler at the specified host, port,
 // and mount in the serve config. sc.TCP is also updated to reflect web
 // serving usage of the given port.
@@ -282,6 +657,7 @@ func (sc *ServeConfig) SetWebHandler(handler *HTTPHandler, host string, port uin
 		m2 := strings.TrimSuffix(k, "/")
 		if m1 == m2 {
 			delete(sc.Web[hp].Handlers, k)
+			delete(sc.Web[hp].Allow, k)
 		}
 	}
 }
@@ -329,6 +705,7 @@ func (sc *ServeConfig) RemoveWebHandler(host string, port uint16, mounts []strin
 	// Delete existing handler, then cascade delete if empty.
 	for _, m := range mounts {
 		delete(sc.Web[hp].Handlers, m)
+		delete(sc.Web[hp].Allow, m)
 	}
 	if len(sc.Web[hp].Handlers) == 0 {
 		delete(sc.Web, hp)
@@ -359,6 +736,28 @@ func (sc *ServeConfig) RemoveTCPForwarding(port uint16) {
 	}
 }
 
+// SetUDPForwarding sets the fwdAddr (IP:port form) to which to forward
+// UDP datagrams from the given port, closing flows that are idle for
+// idleTimeout. An idleTimeout of zero means the default.
+func (sc *ServeConfig) SetUDPForwarding(port uint16, fwdAddr string, idleTimeout time.Duration) {
+	if sc == nil {
+		sc = new(ServeConfig)
+	}
+	mak.Set(&sc.UDP, port, &UDPPortHandler{
+		UDPForward:         fwdAddr,
+		IdleTimeoutSeconds: int(idleTimeout / time.Second),
+	})
+}
+
+// RemoveUDPForwarding deletes the UDP forwarding configuration for the given
+// port from the serve config.
+func (sc *ServeConfig) RemoveUDPForwarding(port uint16) {
+	delete(sc.UDP, port)
+	if len(sc.UDP) == 0 {
+		sc.UDP = nil
+	}
+}
+
 // IsFunnelOn reports whether if ServeConfig is currently allowing funnel
 // traffic for any host:port.
 //
@@ -564,6 +963,27 @@ func (v ServeConfigView) RangeOverTCPs(f func(port uint16, _ TCPPortHandlerView)
 	})
 }
 
+// RangeOverUDPs ranges over both background and foreground UDPs.
+// If the returned bool from the given f is false, then this function stops
+// iterating immediately and does not check other foreground configs.
+func (v ServeConfigView) RangeOverUDPs(f func(port uint16, _ UDPPortHandlerView) bool) {
+	parentCont := true
+	v.UDP().Range(func(k uint16, v UDPPortHandlerView) (cont bool) {
+		parentCont = f(k, v)
+		return parentCont
+	})
+	v.Foreground().Range(func(k string, v ServeConfigView) (cont bool) {
+		if !parentCont {
+			return false
+		}
+		v.UDP().Range(func(k uint16, v UDPPortHandlerView) (cont bool) {
+			parentCont = f(k, v)
+			return parentCont
+		})
+		return parentCont
+	})
+}
+
 // RangeOverWebs ranges over both background and foreground Webs.
 // If the returned bool from the given f is false, then this function stops
 // iterating immediately and does not check other foreground configs.
@@ -599,6 +1019,20 @@ func (v ServeConfigView) FindTCP(port uint16) (res TCPPortHandlerView, ok bool)
 	return v.TCP().GetOk(port)
 }
 
+// FindUDP returns the first UDP that matches with the given port. It
+// prefers a foreground match first followed by a background search if none
+// existed.
+func (v ServeConfigView) FindUDP(port uint16) (res UDPPortHandlerView, ok bool) {
+	v.Foreground().Range(func(_ string, v ServeConfigView) (cont bool) {
+		res, ok = v.UDP().GetOk(port)
+		return !ok
+	})
+	if ok {
+		return res, ok
+	}
+	return v.UDP().GetOk(port)
+}
+
 // FindWeb returns the first Web that matches with the given HostPort. It
 // prefers a foreground match first followed by a background search if none
 // existed.
@@ -182,3 +182,130 @@ func TestExpandProxyTargetDev(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPHandlerCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       HTTPHandler
+		wantErr bool
+	}{
+		{name: "proxy", h: HTTPHandler{Proxy: "http://127.0.0.1:3000"}},
+		{name: "redirect", h: HTTPHandler{Redirect: "https://example.com${REQUEST_URI}", Status: 301}},
+		{name: "redirect-path", h: HTTPHandler{Redirect: "/new/"}},
+		{name: "redirect-host", h: HTTPHandler{Redirect: "${HOST}/x"}},
+		{name: "text-status", h: HTTPHandler{Text: "gone", Status: 410}},
+		{name: "status-only", h: HTTPHandler{Status: 503}},
+		{name: "headers", h: HTTPHandler{
+			Proxy:           "3000",
+			RequestHeaders:  []HeaderRule{{Name: "X-User", Value: "${Tailscale-User-Login}"}, {Name: "Cookie", Remove: true}},
+			ResponseHeaders: []HeaderRule{{Name: "Cache-Control", Value: "no-store"}},
+		}},
+		{name: "two-kinds", h: HTTPHandler{Text: "hi", Redirect: "/"}, wantErr: true},
+		{name: "proxy-status", h: HTTPHandler{Proxy: "3000", Status: 404}, wantErr: true},
+		{name: "redirect-non-3xx", h: HTTPHandler{Redirect: "/", Status: 200}, wantErr: true},
+		{name: "redirect-relative", h: HTTPHandler{Redirect: "new"}, wantErr: true},
+		{name: "bad-status", h: HTTPHandler{Text: "hi", Status: 42}, wantErr: true},
+		{name: "bad-header", h: HTTPHandler{Proxy: "3000", ResponseHeaders: []HeaderRule{{Name: "Bad Name", Value: "x"}}}, wantErr: true},
+		{name: "bad-header-value", h: HTTPHandler{Proxy: "3000", RequestHeaders: []HeaderRule{{Name: "X", Value: "a\r\nB: c"}}}, wantErr: true},
+		{name: "load-balancer", h: HTTPHandler{Proxy: "3000", LoadBalancer: &LoadBalancer{
+			Backends:    []string{"3001"},
+			Policy:      LBLeastConn,
+			HealthCheck: &HealthCheck{Path: "/healthz"},
+		}}},
+		{name: "directory-options", h: HTTPHandler{Path: "/srv", NoListing: true, IndexFile: "home.html", AllowUploads: true}},
+		{name: "directory-options-proxy", h: HTTPHandler{Proxy: "3000", AllowUploads: true}, wantErr: true},
+		{name: "index-file-path", h: HTTPHandler{Path: "/srv", IndexFile: "../index.html"}, wantErr: true},
+		{name: "load-balancer-text", h: HTTPHandler{Text: "hi", LoadBalancer: &LoadBalancer{Backends: []string{"3001"}}}, wantErr: true},
+		{name: "load-balancer-no-backends", h: HTTPHandler{Proxy: "3000", LoadBalancer: &LoadBalancer{}}, wantErr: true},
+		{name: "load-balancer-policy", h: HTTPHandler{Proxy: "3000", LoadBalancer: &LoadBalancer{Backends: []string{"3001"}, Policy: "random"}}, wantErr: true},
+		{name: "health-check-path", h: HTTPHandler{Proxy: "3000", LoadBalancer: &LoadBalancer{
+			Backends:    []string{"3001"},
+			HealthCheck: &HealthCheck{Path: "healthz"},
+		}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.Check()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebServerConfigCheck(t *testing.T) {
+	handlers := map[string]*HTTPHandler{"/": {Text: "hi"}, "/admin/": {Proxy: "3000"}}
+	tests := []struct {
+		name    string
+		allow   map[string][]string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "rules", allow: map[string][]string{"/admin/": {"alice@example.com", "tag:ci", "cap:example.com/cap/admin"}}},
+		{name: "missing-mount", allow: map[string][]string{"/other/": {"tag:ci"}}, wantErr: true},
+		{name: "bare-name", allow: map[string][]string{"/": {"alice"}}, wantErr: true},
+		{name: "empty-tag", allow: map[string][]string{"/": {"tag:"}}, wantErr: true},
+		{name: "empty-cap", allow: map[string][]string{"/": {"cap:"}}, wantErr: true},
+		{name: "space", allow: map[string][]string{"/": {"tag:a b"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &WebServerConfig{Handlers: handlers, Allow: tt.allow}
+			if err := c.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUDPPortHandlerCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       UDPPortHandler
+		wantErr bool
+	}{
+		{name: "forward", h: UDPPortHandler{UDPForward: "127.0.0.1:5353"}},
+		{name: "idle-timeout", h: UDPPortHandler{UDPForward: "localhost:5353", IdleTimeoutSeconds: 30}},
+		{name: "empty", h: UDPPortHandler{}, wantErr: true},
+		{name: "no-port", h: UDPPortHandler{UDPForward: "127.0.0.1"}, wantErr: true},
+		{name: "negative-timeout", h: UDPPortHandler{UDPForward: "127.0.0.1:5353", IdleTimeoutSeconds: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.h.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseHeaderRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    HeaderRule
+		wantErr bool
+	}{
+		{in: "X-Frame-Options: DENY", want: HeaderRule{Name: "X-Frame-Options", Value: "DENY"}},
+		{in: "X-User:${Tailscale-User-Login}", want: HeaderRule{Name: "X-User", Value: "${Tailscale-User-Login}"}},
+		{in: "X-Empty:", want: HeaderRule{Name: "X-Empty"}},
+		{in: "-Server", want: HeaderRule{Name: "Server", Remove: true}},
+		{in: "Server", wantErr: true},
+		{in: ": value", wantErr: true},
+		{in: "-", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHeaderRule(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseHeaderRule(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseHeaderRule(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+		if err == nil {
+			if back, err := ParseHeaderRule(got.String()); err != nil || back != got {
+				t.Errorf("ParseHeaderRule(%q.String()) = %+v, %v; want %+v", tt.in, back, err, got)
+			}
+		}
+	}
+}
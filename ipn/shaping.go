@@ -0,0 +1,137 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ShapeRule limits the rate of traffic to and from the peers it selects.
+// Rules are set by Prefs.TrafficShaping, or by the control plane with the
+// tailcfg.NodeAttrTrafficShaping node attribute. For each peer, the first
+// matching rule of each applies, and the lower of their limits wins.
+type ShapeRule struct {
+	// Peer selects the peers the rule applies to: "*" for all peers,
+	// "tag:name" for peers with a tag, or a peer's Tailscale IP, stable
+	// node ID, or MagicDNS name (either in full or its first label).
+	Peer string
+
+	// In and Out are the rates, in bits per second, of the traffic from
+	// and to each selected peer. Zero means unlimited.
+	In  int64 `json:",omitempty"`
+	Out int64 `json:",omitempty"`
+}
+
+// ParseShapeRule parses a ShapeRule in the form "peer=RATE", limiting both
+// directions, or "peer=in:RATE,out:RATE", where either direction may be
+// omitted. RATE is in bits per second, with an optional k, M or G suffix.
+func ParseShapeRule(s string) (ShapeRule, error) {
+	peer, rest, ok := strings.Cut(s, "=")
+	if !ok {
+		return ShapeRule{}, fmt.Errorf("invalid traffic shaping rule %q: want peer=RATE or peer=in:RATE,out:RATE", s)
+	}
+	r := ShapeRule{Peer: peer}
+	if !strings.Contains(rest, ":") {
+		rate, err := ParseShapeRate(rest)
+		if err != nil {
+			return ShapeRule{}, fmt.Errorf("invalid traffic shaping rule %q: %w", s, err)
+		}
+		r.In, r.Out = rate, rate
+	} else {
+		for _, f := range strings.Split(rest, ",") {
+			dir, v, _ := strings.Cut(f, ":")
+			rate, err := ParseShapeRate(v)
+			if err != nil {
+				return ShapeRule{}, fmt.Errorf("invalid traffic shaping rule %q: %w", s, err)
+			}
+			switch dir {
+			case "in":
+				r.In = rate
+			case "out":
+				r.Out = rate
+			default:
+				return ShapeRule{}, fmt.Errorf("invalid traffic shaping rule %q: unknown direction %q", s, dir)
+			}
+		}
+	}
+	if err := r.Check(); err != nil {
+		return ShapeRule{}, err
+	}
+	return r, nil
+}
+
+// String returns r in the form accepted by ParseShapeRule.
+func (r ShapeRule) String() string {
+	if r.In == r.Out {
+		return r.Peer + "=" + FormatShapeRate(r.In)
+	}
+	var dirs []string
+	if r.In != 0 {
+		dirs = append(dirs, "in:"+FormatShapeRate(r.In))
+	}
+	if r.Out != 0 {
+		dirs = append(dirs, "out:"+FormatShapeRate(r.Out))
+	}
+	return r.Peer + "=" + strings.Join(dirs, ",")
+}
+
+// Check reports whether r is well-formed.
+func (r ShapeRule) Check() error {
+	if r.Peer == "" || strings.ContainsAny(r.Peer, " =,") {
+		return fmt.Errorf("invalid traffic shaping peer %q", r.Peer)
+	}
+	if r.Peer == "tag:" {
+		return errors.New("invalid traffic shaping peer \"tag:\": missing tag name")
+	}
+	if r.In < 0 || r.Out < 0 {
+		return fmt.Errorf("invalid traffic shaping rule %q: negative rate", r.String())
+	}
+	if r.In == 0 && r.Out == 0 {
+		return fmt.Errorf("invalid traffic shaping rule for %q: no limit", r.Peer)
+	}
+	return nil
+}
+
+// ParseShapeRate parses a rate in bits per second, such as "500k" or
+// "10M". The suffixes are decimal, and may be followed by "bit" or "bps".
+func ParseShapeRate(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(s), "bit"), "bps")
+	mult := 1.0
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'k':
+			mult = 1e3
+		case 'm':
+			mult = 1e6
+		case 'g':
+			mult = 1e9
+		}
+		if mult != 1 {
+			v = v[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || f*mult > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(f * mult), nil
+}
+
+// FormatShapeRate formats a rate in bits per second in the form accepted by
+// ParseShapeRate, using the largest suffix that represents it exactly.
+func FormatShapeRate(bps int64) string {
+	for _, u := range []struct {
+		div    int64
+		suffix string
+	}{{1e9, "G"}, {1e6, "M"}, {1e3, "k"}} {
+		if bps != 0 && bps%u.div == 0 {
+			return strconv.FormatInt(bps/u.div, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(bps, 10)
+}
@@ -0,0 +1,44 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import "testing"
+
+func TestParseShapeRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ShapeRule
+		wantErr bool
+	}{
+		{in: "*=10M", want: ShapeRule{Peer: "*", In: 10e6, Out: 10e6}},
+		{in: "tag:backup=in:10mbit,out:5M", want: ShapeRule{Peer: "tag:backup", In: 10e6, Out: 5e6}},
+		{in: "nas=out:1.5M", want: ShapeRule{Peer: "nas", Out: 1.5e6}},
+		{in: "100.64.0.2=in:500kbps", want: ShapeRule{Peer: "100.64.0.2", In: 500e3}},
+		{in: "nas.tail-scale.ts.net=1G", want: ShapeRule{Peer: "nas.tail-scale.ts.net", In: 1e9, Out: 1e9}},
+		{in: "n1234=123456", want: ShapeRule{Peer: "n1234", In: 123456, Out: 123456}},
+		{in: "nas", wantErr: true},
+		{in: "=10M", wantErr: true},
+		{in: "tag:=10M", wantErr: true},
+		{in: "nas=0", wantErr: true},
+		{in: "nas=-1M", wantErr: true},
+		{in: "nas=fast", wantErr: true},
+		{in: "nas=up:10M", wantErr: true},
+		{in: "nas=in:10M,out", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseShapeRule(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseShapeRule(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseShapeRule(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+		if err == nil {
+			if back, err := ParseShapeRule(got.String()); err != nil || back != got {
+				t.Errorf("round trip of %q = %+v, %v", got.String(), back, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Modes of recording Tailscale SSH sessions locally, for
+// SSHRecordingPolicy.Mode.
+const (
+	// SSHRecordingOff records sessions only to the recorders named by the
+	// SSH policy.
+	SSHRecordingOff = "off"
+
+	// SSHRecordingFallback records sessions locally when the SSH policy
+	// names no recorders.
+	SSHRecordingFallback = "fallback"
+
+	// SSHRecordingAlways records all sessions locally, as well as to any
+	// recorders named by the SSH policy.
+	SSHRecordingAlways = "always"
+)
+
+// SSHRecordingPolicy says when Tailscale SSH sessions are recorded to local
+// disk, such as on hosts that can't reach a recorder, and how many
+// recordings are kept. It is set by Prefs.SSHRecordingPolicy. The zero
+// value records nothing locally.
+type SSHRecordingPolicy struct {
+	// Mode is one of SSHRecordingOff (the default if empty),
+	// SSHRecordingFallback or SSHRecordingAlways.
+	Mode string `json:",omitempty"`
+
+	// MaxFileSize is the size in bytes at which a recording is continued
+	// in a new file. Each file is a complete asciicast recording of its
+	// part of the session. If zero, recordings are not split.
+	MaxFileSize int64 `json:",omitempty"`
+
+	// MaxTotalSize is the most bytes of recordings kept. When it is
+	// exceeded, the oldest recordings are removed. If zero, there is no
+	// limit.
+	MaxTotalSize int64 `json:",omitempty"`
+
+	// MaxAge is how long recordings are kept, as a Go duration like
+	// "720h". If empty, there is no limit.
+	MaxAge string `json:",omitempty"`
+}
+
+// Clone returns a copy of p, or nil if p is nil.
+func (p *SSHRecordingPolicy) Clone() *SSHRecordingPolicy {
+	if p == nil {
+		return nil
+	}
+	p2 := *p
+	return &p2
+}
+
+// Equal reports whether p and p2 are equal. A nil policy is only equal to
+// another nil policy.
+func (p *SSHRecordingPolicy) Equal(p2 *SSHRecordingPolicy) bool {
+	if p == nil || p2 == nil {
+		return p == p2
+	}
+	return *p == *p2
+}
+
+// Check reports whether p is valid.
+func (p *SSHRecordingPolicy) Check() error {
+	switch p.Mode {
+	case "", SSHRecordingOff, SSHRecordingFallback, SSHRecordingAlways:
+	default:
+		return fmt.Errorf("invalid SSH recording policy: invalid mode %q", p.Mode)
+	}
+	if p.MaxFileSize < 0 || p.MaxTotalSize < 0 {
+		return errors.New("invalid SSH recording policy: sizes may not be negative")
+	}
+	if p.MaxAge != "" {
+		if d, err := time.ParseDuration(p.MaxAge); err != nil || d < 0 {
+			return fmt.Errorf("invalid SSH recording policy: invalid MaxAge %q", p.MaxAge)
+		}
+	}
+	return nil
+}
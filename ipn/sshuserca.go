@@ -0,0 +1,60 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// SSHUserCA is the certificate authority that Tailscale SSH issues
+// short-lived OpenSSH user certificates with, to sessions whose SSH action
+// has IssueUserCerts and that request agent forwarding. The certificates are
+// offered through an agent socket in SSH_AUTH_SOCK, so that further hops to
+// hosts trusting the CA (with TrustedUserCAKeys) are authorized too. It is
+// set by Prefs.SSHUserCA.
+type SSHUserCA struct {
+	// KeyPath is the absolute path of the OpenSSH private key of the CA.
+	// If the file doesn't exist, a new ed25519 key is generated there, and
+	// its public key is written next to it with a ".pub" suffix.
+	KeyPath string `json:",omitempty"`
+
+	// CertLifetime is how long the certificates are valid, as a Go
+	// duration like "10m". New certificates are issued as needed for
+	// sessions that last longer. If empty, it is ten minutes.
+	CertLifetime string `json:",omitempty"`
+}
+
+// Clone returns a copy of c, or nil if c is nil.
+func (c *SSHUserCA) Clone() *SSHUserCA {
+	if c == nil {
+		return nil
+	}
+	c2 := *c
+	return &c2
+}
+
+// Equal reports whether c and c2 are equal. A nil CA is only equal to
+// another nil CA.
+func (c *SSHUserCA) Equal(c2 *SSHUserCA) bool {
+	if c == nil || c2 == nil {
+		return c == c2
+	}
+	return *c == *c2
+}
+
+// Check reports whether c is valid.
+func (c *SSHUserCA) Check() error {
+	if !filepath.IsAbs(c.KeyPath) {
+		return errors.New("invalid SSH user CA: KeyPath must be an absolute path")
+	}
+	if c.CertLifetime != "" {
+		if d, err := time.ParseDuration(c.CertLifetime); err != nil || d <= 0 {
+			return fmt.Errorf("invalid SSH user CA: invalid CertLifetime %q", c.CertLifetime)
+		}
+	}
+	return nil
+}
@@ -58,6 +58,10 @@
 	// has ever been received (even if partially).
 	// Any non-empty value indicates that at least one file has been received.
 	TaildropReceivedKey = StateKey("_taildrop-received")
+
+	// TaildropHistoryKey is the key under which the history of finished
+	// Taildrop transfers is stored, as a JSON array of FileTransfer.
+	TaildropHistoryKey = StateKey("_taildrop-history")
 )
 
 // CurrentProfileID returns the StateKey that stores the
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// TaildropReceivePolicy limits what Taildrop files this node accepts and
+// says where it puts them, such as on servers shared by several users. It
+// is set by Prefs.TaildropReceivePolicy. The zero value accepts any file
+// from any sender into the Taildrop directory.
+type TaildropReceivePolicy struct {
+	// MaxFileSize is the size in bytes of the largest file accepted.
+	// For a bundle, it limits each file of the bundle.
+	// If zero, there is no limit.
+	MaxFileSize int64 `json:",omitempty"`
+
+	// MaxPendingBytes is the most bytes of files that may be in the
+	// Taildrop directory at once, counting both files that are waiting
+	// to be picked up and partially received ones. A file that would
+	// exceed it is rejected. If zero, there is no limit.
+	MaxPendingBytes int64 `json:",omitempty"`
+
+	// AllowedSenders are the login names of users (like
+	// "alice@example.com") and the tags (like "tag:server") whose nodes
+	// may send files. If empty, any sender is allowed.
+	AllowedSenders []string `json:",omitempty"`
+
+	// SenderDirs maps the login names of users and tags to the
+	// subdirectory of the Taildrop directory that files sent by their
+	// nodes are put in. Each subdirectory must be a single valid file
+	// name. A node with several matching tags uses the first of its tags
+	// that matches, and its user takes precedence over its tags. Files
+	// from other senders are put in the Taildrop directory itself.
+	SenderDirs map[string]string `json:",omitempty"`
+}
+
+// Clone returns a deep copy of p, or nil if p is nil.
+func (p *TaildropReceivePolicy) Clone() *TaildropReceivePolicy {
+	if p == nil {
+		return nil
+	}
+	p2 := *p
+	p2.AllowedSenders = slices.Clone(p.AllowedSenders)
+	p2.SenderDirs = maps.Clone(p.SenderDirs)
+	return &p2
+}
+
+// Equal reports whether p and p2 are equal. A nil policy is only equal to
+// another nil policy.
+func (p *TaildropReceivePolicy) Equal(p2 *TaildropReceivePolicy) bool {
+	if p == nil || p2 == nil {
+		return p == p2
+	}
+	return p.MaxFileSize == p2.MaxFileSize &&
+		p.MaxPendingBytes == p2.MaxPendingBytes &&
+		slices.Equal(p.AllowedSenders, p2.AllowedSenders) &&
+		maps.Equal(p.SenderDirs, p2.SenderDirs)
+}
+
+// Check reports whether p is valid.
+func (p *TaildropReceivePolicy) Check() error {
+	if p.MaxFileSize < 0 || p.MaxPendingBytes < 0 {
+		return fmt.Errorf("invalid Taildrop receive policy: negative size limit")
+	}
+	for who, dir := range p.SenderDirs {
+		if dir == "" || dir == "." || dir == ".." || strings.ContainsAny(dir, `/\`) {
+			return fmt.Errorf("invalid Taildrop receive policy: sender directory %q for %q is not a single file name", dir, who)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import "testing"
+
+func TestTaildropReceivePolicyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       TaildropReceivePolicy
+		wantErr bool
+	}{
+		{name: "zero"},
+		{name: "limits", p: TaildropReceivePolicy{MaxFileSize: 1 << 20, MaxPendingBytes: 1 << 30}},
+		{name: "sender-dirs", p: TaildropReceivePolicy{SenderDirs: map[string]string{"alice@example.com": "alice", "tag:server": "servers"}}},
+		{name: "negative-size", p: TaildropReceivePolicy{MaxFileSize: -1}, wantErr: true},
+		{name: "negative-pending", p: TaildropReceivePolicy{MaxPendingBytes: -1}, wantErr: true},
+		{name: "empty-dir", p: TaildropReceivePolicy{SenderDirs: map[string]string{"alice@example.com": ""}}, wantErr: true},
+		{name: "parent-dir", p: TaildropReceivePolicy{SenderDirs: map[string]string{"alice@example.com": ".."}}, wantErr: true},
+		{name: "nested-dir", p: TaildropReceivePolicy{SenderDirs: map[string]string{"alice@example.com": "a/b"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.p.Check()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -858,6 +858,12 @@ func (l *Logger) Write(buf []byte) (int, error) {
 	return inLen, err
 }
 
+// RedactIPs returns s with IP addresses other than Tailscale ones redacted,
+// as they are in logs when TS_OBSCURE_LOGGED_IPS is set.
+func RedactIPs(s string) string {
+	return string(redactIPs([]byte(s)))
+}
+
 var (
 	regexMatchesIPv6 = regexp.MustCompile(`([0-9a-fA-F]{1,4}):([0-9a-fA-F]{1,4}):([0-9a-fA-F:]{1,4})*`)
 	regexMatchesIPv4 = regexp.MustCompile(`(\d{1,3})\.(\d{1,3})\.\d{1,3}\.\d{1,3}`)
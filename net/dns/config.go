@@ -42,6 +42,14 @@ type Config struct {
 	// it to resolve, you also need to add appropriate routes to
 	// Routes.
 	Hosts map[dnsname.FQDN][]netip.Addr
+	// TXTRecords maps DNS FQDNs to the strings of their TXT records,
+	// each its own record. Like Hosts, they're resolved locally by
+	// 100.100.100.100 and need a covering entry in Routes to resolve.
+	TXTRecords map[dnsname.FQDN][]string
+	// CNAMERecords maps DNS FQDNs that are aliases to their canonical
+	// names. Like Hosts, they're resolved locally by 100.100.100.100 and
+	// need a covering entry in Routes to resolve.
+	CNAMERecords map[dnsname.FQDN]dnsname.FQDN
 	// OnlyIPv6, if true, uses the IPv6 service IP (for MagicDNS)
 	// instead of the IPv4 version (100.100.100.100).
 	OnlyIPv6 bool
@@ -65,6 +73,9 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	if n := len(c.TXTRecords) + len(c.CNAMERecords); n > 0 {
+		fmt.Fprintf(w, " OtherRecords:%v", n)
+	}
 	w.WriteString("}")
 }
 
@@ -93,8 +104,8 @@ func (c Config) hasDefaultIPResolversOnly() bool {
 	return true
 }
 
-// hasHostsWithoutSplitDNSRoutes reports whether c contains any Host entries
-// that aren't covered by a SplitDNS route suffix.
+// hasHostsWithoutSplitDNSRoutes reports whether c contains any Host (or
+// other local record) entries that aren't covered by a SplitDNS route suffix.
 func (c Config) hasHostsWithoutSplitDNSRoutes() bool {
 	// TODO(bradfitz): this could be more efficient, but we imagine
 	// the number of SplitDNS routes and/or hosts will be small.
@@ -103,6 +114,16 @@ func (c Config) hasHostsWithoutSplitDNSRoutes() bool {
 			return true
 		}
 	}
+	for host := range c.TXTRecords {
+		if !c.hasSplitDNSRouteForHost(host) {
+			return true
+		}
+	}
+	for host := range c.CNAMERecords {
+		if !c.hasSplitDNSRouteForHost(host) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -0,0 +1,329 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bufio"
+	"io"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+const (
+	// blocklistReloadInterval is how often blocklist files are checked
+	// for changes.
+	blocklistReloadInterval = 30 * time.Second
+
+	// maxBlocklistPeers bounds the number of distinct peer addresses for
+	// which blocked query counts are kept.
+	maxBlocklistPeers = 1000
+)
+
+// BlocklistConfig configures the blocklist that the Resolver applies to DNS
+// queries from peers using this node as an exit node.
+type BlocklistConfig struct {
+	// Files are the paths of the blocklist files. Each may be in hosts
+	// format ("0.0.0.0 ads.example.com"), a plain list of names, or an
+	// RPZ zone ("ads.example.com CNAME ."). A name prefixed with "*."
+	// blocks all names beneath it, but not the name itself.
+	Files []string
+
+	// ZeroIP is whether A and AAAA queries for blocked names are answered
+	// with 0.0.0.0 and ::, rather than NXDOMAIN.
+	ZeroIP bool
+}
+
+func (c BlocklistConfig) equal(c2 BlocklistConfig) bool {
+	return slices.Equal(c.Files, c2.Files) && c.ZeroIP == c2.ZeroIP
+}
+
+// BlocklistStats are statistics about a Resolver's blocklist.
+type BlocklistStats struct {
+	Files   []string
+	Names   int                  // number of names and wildcards loaded
+	Blocked map[netip.Addr]int64 // blocked queries, by peer address
+}
+
+// blocklist is a set of names for which queries from exit node clients are
+// refused. It reloads its files when they change.
+type blocklist struct {
+	logf logger.Logf
+	cfg  BlocklistConfig // immutable
+	stop chan struct{}   // closed to stop reloading
+
+	mu        sync.Mutex
+	names     set.Set[dnsname.FQDN] // exact names
+	wildcards set.Set[dnsname.FQDN] // suffixes whose subdomains are blocked
+	stamps    map[string]fileStamp  // of cfg.Files, as of the last load
+	blocked   map[netip.Addr]int64
+}
+
+// fileStamp is the modification time and size of a file, used to notice
+// when it changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// SetBlocklist sets the blocklist applied to DNS queries from peers using
+// this node as an exit node. A config with no files disables the blocklist.
+// Files are loaded in the background, and reloaded when they change.
+func (r *Resolver) SetBlocklist(cfg BlocklistConfig) {
+	r.blocklistMu.Lock()
+	defer r.blocklistMu.Unlock()
+	old := r.blocklist
+	if old != nil && old.cfg.equal(cfg) {
+		return
+	}
+	if old != nil {
+		close(old.stop)
+		r.blocklist = nil
+	}
+	if len(cfg.Files) == 0 {
+		return
+	}
+	bl := &blocklist{
+		logf: logger.WithPrefix(r.logf, "blocklist: "),
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}
+	r.blocklist = bl
+	go bl.reloadLoop(r.closed)
+}
+
+// BlocklistStats returns statistics about r's blocklist.
+func (r *Resolver) BlocklistStats() BlocklistStats {
+	r.blocklistMu.Lock()
+	bl := r.blocklist
+	r.blocklistMu.Unlock()
+	if bl == nil {
+		return BlocklistStats{}
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	st := BlocklistStats{
+		Files: bl.cfg.Files,
+		Names: len(bl.names) + len(bl.wildcards),
+	}
+	for ip, n := range bl.blocked {
+		mak.Set(&st.Blocked, ip, n)
+	}
+	return st
+}
+
+func (bl *blocklist) reloadLoop(closed <-chan struct{}) {
+	bl.reloadIfChanged()
+	t := time.NewTicker(blocklistReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-bl.stop:
+			return
+		case <-closed:
+			return
+		case <-t.C:
+			bl.reloadIfChanged()
+		}
+	}
+}
+
+// reloadIfChanged reloads bl's files if any of them changed since they were
+// last loaded.
+func (bl *blocklist) reloadIfChanged() {
+	stamps := make(map[string]fileStamp, len(bl.cfg.Files))
+	for _, f := range bl.cfg.Files {
+		if fi, err := os.Stat(f); err == nil {
+			stamps[f] = fileStamp{fi.ModTime(), fi.Size()}
+		}
+	}
+	bl.mu.Lock()
+	changed := bl.stamps == nil || !maps.EqualFunc(stamps, bl.stamps, fileStamp.equal)
+	bl.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	var names, wildcards set.Set[dnsname.FQDN]
+	add := func(name dnsname.FQDN, wildcard bool) {
+		if wildcard {
+			wildcards.Make()
+			wildcards.Add(name)
+		} else {
+			names.Make()
+			names.Add(name)
+		}
+	}
+	for _, f := range bl.cfg.Files {
+		if err := loadBlocklistFile(f, add); err != nil {
+			bl.logf("%v", err)
+		}
+	}
+	bl.logf("loaded %d names and %d wildcards from %d files", len(names), len(wildcards), len(bl.cfg.Files))
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.names = names
+	bl.wildcards = wildcards
+	bl.stamps = stamps
+}
+
+func (s fileStamp) equal(s2 fileStamp) bool {
+	return s.modTime.Equal(s2.modTime) && s.size == s2.size
+}
+
+func loadBlocklistFile(path string, add func(name dnsname.FQDN, wildcard bool)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parseBlocklist(f, add)
+}
+
+// parseBlocklist parses a blocklist in hosts, plain list or RPZ format from
+// r, calling add for each name it blocks.
+func parseBlocklist(r io.Reader, add func(name dnsname.FQDN, wildcard bool)) error {
+	var origin string // RPZ $ORIGIN, with trailing dot
+	addName := func(s string) {
+		s = strings.ToLower(s)
+		if origin != "" {
+			// RPZ owner names are relative to the zone's origin,
+			// unless they're absolute.
+			s = strings.TrimSuffix(s, "."+origin)
+		}
+		wildcard := false
+		if rest, ok := strings.CutPrefix(s, "*."); ok {
+			s, wildcard = rest, true
+		}
+		if !strings.Contains(strings.Trim(s, "."), ".") {
+			// Skip "localhost" and friends, found in most hosts
+			// files. Nobody blocks a TLD this way on purpose.
+			return
+		}
+		if _, err := netip.ParseAddr(s); err == nil {
+			return
+		}
+		fqdn, err := dnsname.ToFQDN(s)
+		if err != nil {
+			return
+		}
+		add(fqdn, wildcard)
+	}
+
+	bs := bufio.NewScanner(r)
+	bs.Buffer(nil, 64<<10)
+	for bs.Scan() {
+		line := bs.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "$ORIGIN" && len(fields) == 2:
+			origin = strings.ToLower(fields[1])
+			if !strings.HasSuffix(origin, ".") {
+				origin += "."
+			}
+		case strings.HasPrefix(fields[0], "$"):
+			// Other zone file directives, like $TTL.
+		case isIPField(fields[0]):
+			// Hosts format: an address followed by names.
+			for _, name := range fields[1:] {
+				if name != "localhost.localdomain" {
+					addName(name)
+				}
+			}
+		case len(fields) == 1:
+			addName(fields[0])
+		default:
+			// An RPZ record: "name [ttl] [class] CNAME target". Only
+			// the NXDOMAIN (".") and NODATA ("*.") actions block.
+			i := slices.IndexFunc(fields, func(f string) bool { return strings.EqualFold(f, "CNAME") })
+			if i > 0 && i == len(fields)-2 && (fields[i+1] == "." || fields[i+1] == "*.") {
+				addName(fields[0])
+			}
+		}
+	}
+	return bs.Err()
+}
+
+func isIPField(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+// isBlocked reports whether name is blocked.
+func (bl *blocklist) isBlocked(name dnsname.FQDN) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.names.Contains(name) {
+		return true
+	}
+	if len(bl.wildcards) == 0 {
+		return false
+	}
+	s := string(name)
+	for {
+		_, rest, ok := strings.Cut(s, ".")
+		if !ok || rest == "" {
+			return false
+		}
+		if bl.wildcards.Contains(dnsname.FQDN(rest)) {
+			return true
+		}
+		s = rest
+	}
+}
+
+// respondBlocked returns a response to resp's question from the peer at
+// from if its name is on r's blocklist. It reports false if the query
+// isn't blocked.
+func (r *Resolver) respondBlocked(resp *response, from netip.AddrPort) (res []byte, blocked bool, err error) {
+	r.blocklistMu.Lock()
+	bl := r.blocklist
+	r.blocklistMu.Unlock()
+	if bl == nil {
+		return nil, false, nil
+	}
+	rawName := resp.Question.Name.Data[:resp.Question.Name.Length]
+	name, err := dnsname.ToFQDN(rawNameToLower(rawName))
+	if err != nil || !bl.isBlocked(name) {
+		return nil, false, nil
+	}
+
+	metricDNSExitProxyBlocked.Add(1)
+	bl.mu.Lock()
+	if _, ok := bl.blocked[from.Addr()]; ok || len(bl.blocked) < maxBlocklistPeers {
+		mak.Set(&bl.blocked, from.Addr(), bl.blocked[from.Addr()]+1)
+	}
+	bl.mu.Unlock()
+
+	if !bl.cfg.ZeroIP {
+		resp.Header.RCode = dns.RCodeNameError
+	} else {
+		resp.Header.RCode = dns.RCodeSuccess
+		switch resp.Question.Type {
+		case dns.TypeA:
+			resp.IP = netip.IPv4Unspecified()
+		case dns.TypeAAAA:
+			resp.IP = netip.IPv6Unspecified()
+		}
+	}
+	res, err = marshalResponse(resp)
+	return res, true, err
+}
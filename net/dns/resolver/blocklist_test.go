@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	const list = `
+# hosts format
+127.0.0.1 localhost localhost.localdomain
+::1 ip6-localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com Tracker.Example.com # trailing comment
+:: ads6.example.com
+
+# plain list
+malware.example.net
+*.doubleclick.example
+
+; RPZ zone
+$TTL 300
+$ORIGIN rpz.example.org.
+@ IN SOA ns.example.org. hostmaster.example.org. (
+	1 ; serial
+	3600 )
+bad.example.org CNAME .
+*.bad.example.org 300 IN CNAME .
+nodata.example.org CNAME *.
+passthru.example.org CNAME rpz-passthru.
+absolute.example.com.rpz.example.org. CNAME .
+`
+	type entry struct {
+		name     dnsname.FQDN
+		wildcard bool
+	}
+	var got []entry
+	if err := parseBlocklist(strings.NewReader(list), func(name dnsname.FQDN, wildcard bool) {
+		got = append(got, entry{name, wildcard})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []entry{
+		{"ads.example.com.", false},
+		{"tracker.example.com.", false},
+		{"ads6.example.com.", false},
+		{"malware.example.net.", false},
+		{"doubleclick.example.", true},
+		{"bad.example.org.", false},
+		{"bad.example.org.", true},
+		{"nodata.example.org.", false},
+		{"absolute.example.com.", false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n*.tracker.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newResolver(t)
+	defer r.Close()
+	r.SetBlocklist(BlocklistConfig{Files: []string{path}})
+	r.blocklist.reloadIfChanged() // don't wait for the reload loop
+	if got := r.BlocklistStats().Names; got != 2 {
+		t.Fatalf("loaded %d names; want 2", got)
+	}
+
+	peer := netip.MustParseAddrPort("100.64.0.2:1234")
+	query := func(name dnsname.FQDN, typ dns.Type) *dns.Message {
+		t.Helper()
+		res, err := r.HandlePeerDNSQuery(context.Background(), dnspacket(name, typ, noEdns), peer, func(string) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dns.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+	for _, name := range []dnsname.FQDN{"ads.example.com.", "ADS.example.com.", "x.tracker.example.", "a.b.tracker.example."} {
+		if msg := query(name, dns.TypeA); msg.Header.RCode != dns.RCodeNameError {
+			t.Errorf("%s: rcode = %v; want NXDOMAIN", name, msg.Header.RCode)
+		}
+	}
+	if st := r.BlocklistStats(); st.Blocked[peer.Addr()] != 4 {
+		t.Errorf("blocked counts = %v; want 4 for %v", st.Blocked, peer.Addr())
+	}
+
+	r.SetBlocklist(BlocklistConfig{Files: []string{path}, ZeroIP: true})
+	r.blocklist.reloadIfChanged()
+	msg := query("ads.example.com.", dns.TypeA)
+	if msg.Header.RCode != dns.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("zero IP response = %+v", msg)
+	}
+	if a := msg.Answers[0].Body.(*dns.AResource).A; a != [4]byte{} {
+		t.Errorf("answer = %v; want 0.0.0.0", a)
+	}
+	if msg := query("ads.example.com.", dns.TypeMX); msg.Header.RCode != dns.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("MX response = %+v; want NOERROR with no answers", msg)
+	}
+
+	// Changing the file reloads it.
+	if err := os.WriteFile(path, []byte("other.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	r.blocklist.reloadIfChanged()
+	bl := r.blocklist
+	if bl.isBlocked("ads.example.com.") || !bl.isBlocked("other.example.com.") {
+		t.Errorf("after reload, names = %v", bl.names)
+	}
+
+	r.SetBlocklist(BlocklistConfig{})
+	if r.blocklist != nil {
+		t.Error("blocklist still set after disabling")
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/tstime"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// cacheMaxEntries is the maximum number of forwarded responses kept in
+	// a Resolver's response cache. Responses are at most maxResponseBytes
+	// each, so this bounds the cache to a few megabytes in the worst case.
+	cacheMaxEntries = 1000
+
+	// cacheMaxTTL caps how long a positive response is cached, regardless
+	// of what the upstream said.
+	cacheMaxTTL = time.Hour
+
+	// cacheMaxNegativeTTL caps how long a negative (NXDOMAIN or NODATA)
+	// response is cached. Negative responses are only cached if the
+	// upstream included an SOA record, per RFC 2308.
+	cacheMaxNegativeTTL = 5 * time.Minute
+
+	// minUDPResponseBytes is the size that all DNS clients must accept over
+	// UDP when they didn't advertise anything larger via EDNS.
+	minUDPResponseBytes = 512
+)
+
+var disableCache = envknob.RegisterBool("TS_DEBUG_DNS_DISABLE_CACHE")
+
+// cacheKey is the key of a responseCache entry.
+type cacheKey struct {
+	name  dnsname.FQDN // lowercase
+	typ   dns.Type
+	class dns.Class
+
+	// route is the suffix of the forwarding route that matched name
+	// when the response was cached, so that a response from one set of
+	// upstreams is never returned for a query routed to another.
+	route dnsname.FQDN
+}
+
+// cacheEntry is a cached upstream response.
+type cacheEntry struct {
+	msg      *dns.Message // never mutated once cached
+	stored   time.Time
+	expires  time.Time
+	negative bool
+}
+
+// CacheStats are statistics about a Resolver's response cache.
+type CacheStats struct {
+	Entries    int
+	MaxEntries int
+	Hits       int64
+	Misses     int64
+}
+
+// responseCache is a bounded, TTL-honoring cache of responses from upstream
+// resolvers, used by Resolver.Query to avoid re-forwarding identical queries.
+//
+// The zero value is not valid; use newResponseCache.
+type responseCache struct {
+	clock tstime.Clock
+
+	mu     sync.Mutex
+	lru    lru.Cache[cacheKey, *cacheEntry]
+	hits   int64
+	misses int64
+}
+
+func newResponseCache(clock tstime.Clock) *responseCache {
+	c := &responseCache{clock: clock}
+	c.lru.MaxEntries = cacheMaxEntries
+	return c
+}
+
+// cacheQuery is the subset of a DNS query needed to look it up in the
+// cache and to build a response from a cached entry.
+type cacheQuery struct {
+	id       uint16
+	question dns.Question
+	maxSize  int // largest response the client will accept
+}
+
+// parseCacheQuery parses the query bs and reports whether it's eligible for
+// caching. Only queries with exactly one question are cached.
+func parseCacheQuery(bs []byte, family string) (q cacheQuery, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(bs)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return q, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 {
+		return q, false
+	}
+	q.id = h.ID
+	q.question = qs[0]
+	q.maxSize = minUDPResponseBytes
+	if family == "tcp" {
+		q.maxSize = 65535
+		return q, true
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return q, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return q, false
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return q, false
+		}
+		if rh.Type == dns.TypeOPT {
+			// The class of an OPT record is the requestor's UDP payload size.
+			q.maxSize = max(int(rh.Class), minUDPResponseBytes)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return q, false
+		}
+	}
+	return q, true
+}
+
+// cacheKeyForQuery parses the query bs and returns its cache key.
+// It reports ok=false if the response to bs should not be cached.
+func (r *Resolver) cacheKeyForQuery(bs []byte, family string) (q cacheQuery, k cacheKey, ok bool) {
+	if disableCache() {
+		return q, k, false
+	}
+	q, ok = parseCacheQuery(bs, family)
+	if !ok {
+		return q, k, false
+	}
+	rawName := q.question.Name.Data[:q.question.Name.Length]
+	name, err := dnsname.ToFQDN(rawNameToLower(rawName))
+	if err != nil {
+		return q, k, false
+	}
+	route, _ := r.forwarder.route(name)
+	return q, cacheKey{
+		name:  name,
+		typ:   q.question.Type,
+		class: q.question.Class,
+		route: route,
+	}, true
+}
+
+// get returns a response to q built from a cached entry for k, with its
+// TTLs reduced by the time the entry has spent in the cache.
+func (c *responseCache) get(k cacheKey, q *cacheQuery) (res []byte, ok bool) {
+	now := c.clock.Now()
+
+	c.mu.Lock()
+	e, ok := c.lru.GetOk(k)
+	if ok && !now.Before(e.expires) {
+		c.lru.Delete(k)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+	c.mu.Unlock()
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	msg := *e.msg
+	msg.Header.ID = q.id
+	msg.Questions = []dns.Question{q.question} // echo the client's 0x20 casing
+	msg.Answers = resourcesWithTTLReduced(e.msg.Answers, elapsed)
+	msg.Authorities = resourcesWithTTLReduced(e.msg.Authorities, elapsed)
+	msg.Additionals = resourcesWithTTLReduced(e.msg.Additionals, elapsed)
+	res, err := msg.Pack()
+	if err != nil || len(res) > q.maxSize {
+		// Let the client get a fresh (possibly truncated) answer from
+		// upstream instead.
+		c.mu.Lock()
+		c.misses++
+		c.mu.Unlock()
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	metricDNSFwdCacheHit.Add(1)
+	if e.negative {
+		metricDNSFwdCacheHitNegative.Add(1)
+	}
+	return res, true
+}
+
+// resourcesWithTTLReduced returns a copy of rrs with each TTL reduced by
+// elapsed seconds. OPT pseudo-records are left alone, as their TTL field
+// holds extended flags rather than a TTL.
+func resourcesWithTTLReduced(rrs []dns.Resource, elapsed uint32) []dns.Resource {
+	if len(rrs) == 0 {
+		return nil
+	}
+	ret := make([]dns.Resource, len(rrs))
+	for i, rr := range rrs {
+		if rr.Header.Type != dns.TypeOPT {
+			if rr.Header.TTL > elapsed {
+				rr.Header.TTL -= elapsed
+			} else {
+				rr.Header.TTL = 0
+			}
+		}
+		ret[i] = rr
+	}
+	return ret
+}
+
+// put caches the upstream response res under k, if res is cacheable.
+func (c *responseCache) put(k cacheKey, res []byte) {
+	msg := new(dns.Message)
+	if err := msg.Unpack(res); err != nil {
+		return
+	}
+	ttl, negative, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+	now := c.clock.Now()
+	e := &cacheEntry{
+		msg:      msg,
+		stored:   now,
+		expires:  now.Add(ttl),
+		negative: negative,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Set(k, e)
+	metricDNSFwdCacheStore.Add(1)
+}
+
+// cacheTTL reports how long msg may be cached for, and whether it's a
+// negative response. It returns ok=false if msg must not be cached.
+func cacheTTL(msg *dns.Message) (ttl time.Duration, negative, ok bool) {
+	if !msg.Header.Response || msg.Header.Truncated {
+		return 0, false, false
+	}
+	switch msg.Header.RCode {
+	case dns.RCodeSuccess:
+		negative = len(msg.Answers) == 0
+	case dns.RCodeNameError:
+		negative = true
+	default:
+		// SERVFAIL, REFUSED, etc are transient or policy decisions and
+		// are worth retrying.
+		return 0, false, false
+	}
+
+	var minTTL uint32
+	var found bool
+	if negative {
+		// RFC 2308 section 5: the negative TTL is the minimum of the SOA
+		// record's TTL and its MINIMUM field. Without an SOA, don't cache.
+		for _, rr := range msg.Authorities {
+			soa, isSOA := rr.Body.(*dns.SOAResource)
+			if !isSOA {
+				continue
+			}
+			minTTL, found = min(rr.Header.TTL, soa.MinTTL), true
+			break
+		}
+	} else {
+		for _, rr := range msg.Answers {
+			if !found || rr.Header.TTL < minTTL {
+				minTTL, found = rr.Header.TTL, true
+			}
+		}
+	}
+	if !found || minTTL == 0 {
+		return 0, false, false
+	}
+	ttl = time.Duration(minTTL) * time.Second
+	if negative {
+		ttl = min(ttl, cacheMaxNegativeTTL)
+	} else {
+		ttl = min(ttl, cacheMaxTTL)
+	}
+	return ttl, negative, true
+}
+
+// flush removes all entries from the cache.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Clear()
+}
+
+func (c *responseCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:    c.lru.Len(),
+		MaxEntries: c.lru.MaxEntries,
+		Hits:       c.hits,
+		Misses:     c.misses,
+	}
+}
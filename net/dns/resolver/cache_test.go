@@ -0,0 +1,197 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miekdns "github.com/miekg/dns"
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstest"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// resolveWithTTL returns a handler that answers A queries with ip and the
+// given TTL, NXDOMAINs everything else with an SOA of the given TTL, and
+// counts the queries it receives in n.
+func resolveWithTTL(ip netip.Addr, ttl uint32, n *atomic.Int32) miekdns.HandlerFunc {
+	return func(w miekdns.ResponseWriter, req *miekdns.Msg) {
+		n.Add(1)
+		m := new(miekdns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype != miekdns.TypeA {
+			m.Rcode = miekdns.RcodeNameError
+			m.Ns = append(m.Ns, &miekdns.SOA{
+				Hdr:    miekdns.RR_Header{Name: "site.", Rrtype: miekdns.TypeSOA, Class: miekdns.ClassINET, Ttl: ttl},
+				Ns:     "ns.site.",
+				Mbox:   "hostmaster.site.",
+				Minttl: ttl,
+			})
+		} else {
+			m.Answer = append(m.Answer, &miekdns.A{
+				Hdr: miekdns.RR_Header{Name: q.Name, Rrtype: miekdns.TypeA, Class: miekdns.ClassINET, Ttl: ttl},
+				A:   ip.AsSlice(),
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	var n atomic.Int32
+	server := serveDNS(t, "127.0.0.1:0", "cached.site.", resolveWithTTL(testipv4, 60, &n))
+	defer server.Shutdown()
+
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	r := newResolver(t)
+	defer r.Close()
+	r.cache = newResponseCache(clock)
+
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: server.PacketConn.LocalAddr().String()}},
+	}
+	r.SetConfig(cfg)
+
+	query := func(name dnsname.FQDN, typ dns.Type) *dns.Message {
+		t.Helper()
+		res, err := r.Query(context.Background(), dnspacket(name, typ, noEdns), "udp", netip.AddrPort{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dns.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+	wantUpstream := func(want int32) {
+		t.Helper()
+		if got := n.Load(); got != want {
+			t.Fatalf("upstream queries = %d; want %d", got, want)
+		}
+	}
+
+	msg := query("cached.site.", dns.TypeA)
+	wantUpstream(1)
+	if got := msg.Answers[0].Header.TTL; got != 60 {
+		t.Errorf("first TTL = %d; want 60", got)
+	}
+
+	clock.Advance(20 * time.Second)
+	msg = query("CACHED.site.", dns.TypeA)
+	wantUpstream(1)
+	if got := msg.Answers[0].Header.TTL; got != 40 {
+		t.Errorf("cached TTL = %d; want 40", got)
+	}
+	if got, want := msg.Questions[0].Name.String(), "CACHED.site."; got != want {
+		t.Errorf("cached question = %q; want %q", got, want)
+	}
+
+	msg = query("cached.site.", dns.TypeTXT)
+	wantUpstream(2)
+	if msg.Header.RCode != dns.RCodeNameError {
+		t.Errorf("rcode = %v; want NXDOMAIN", msg.Header.RCode)
+	}
+	query("cached.site.", dns.TypeTXT)
+	wantUpstream(2)
+
+	clock.Advance(41 * time.Second)
+	query("cached.site.", dns.TypeA)
+	wantUpstream(3)
+
+	r.SetConfig(cfg)
+	query("cached.site.", dns.TypeA)
+	wantUpstream(4)
+
+	st := r.CacheStats()
+	if st.Hits != 2 || st.Misses != 4 {
+		t.Errorf("stats = %+v; want 2 hits, 4 misses", st)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	name := dns.MustNewName("foo.site.")
+	a := func(ttl uint32) dns.Resource {
+		return dns.Resource{
+			Header: dns.ResourceHeader{Name: name, Type: dns.TypeA, Class: dns.ClassINET, TTL: ttl},
+			Body:   &dns.AResource{A: [4]byte{1, 2, 3, 4}},
+		}
+	}
+	soa := func(ttl, minTTL uint32) dns.Resource {
+		return dns.Resource{
+			Header: dns.ResourceHeader{Name: dns.MustNewName("site."), Type: dns.TypeSOA, Class: dns.ClassINET, TTL: ttl},
+			Body: &dns.SOAResource{
+				NS:     dns.MustNewName("ns.site."),
+				MBox:   dns.MustNewName("hostmaster.site."),
+				MinTTL: minTTL,
+			},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		msg          dns.Message
+		wantTTL      time.Duration
+		wantNegative bool
+		wantOK       bool
+	}{
+		{
+			name:    "min-answer-ttl",
+			msg:     dns.Message{Header: dns.Header{Response: true}, Answers: []dns.Resource{a(300), a(30)}},
+			wantTTL: 30 * time.Second,
+			wantOK:  true,
+		},
+		{
+			name:    "capped",
+			msg:     dns.Message{Header: dns.Header{Response: true}, Answers: []dns.Resource{a(86400)}},
+			wantTTL: cacheMaxTTL,
+			wantOK:  true,
+		},
+		{
+			name: "zero-ttl",
+			msg:  dns.Message{Header: dns.Header{Response: true}, Answers: []dns.Resource{a(0)}},
+		},
+		{
+			name: "truncated",
+			msg:  dns.Message{Header: dns.Header{Response: true, Truncated: true}, Answers: []dns.Resource{a(60)}},
+		},
+		{
+			name: "servfail",
+			msg:  dns.Message{Header: dns.Header{Response: true, RCode: dns.RCodeServerFailure}},
+		},
+		{
+			name:         "nxdomain-soa",
+			msg:          dns.Message{Header: dns.Header{Response: true, RCode: dns.RCodeNameError}, Authorities: []dns.Resource{soa(3600, 120)}},
+			wantTTL:      120 * time.Second,
+			wantNegative: true,
+			wantOK:       true,
+		},
+		{
+			name:         "nodata-soa-capped",
+			msg:          dns.Message{Header: dns.Header{Response: true}, Authorities: []dns.Resource{soa(3600, 3600)}},
+			wantTTL:      cacheMaxNegativeTTL,
+			wantNegative: true,
+			wantOK:       true,
+		},
+		{
+			name: "nxdomain-no-soa",
+			msg:  dns.Message{Header: dns.Header{Response: true, RCode: dns.RCodeNameError}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, negative, ok := cacheTTL(&tt.msg)
+			if ttl != tt.wantTTL || negative != tt.wantNegative || ok != tt.wantOK {
+				t.Errorf("cacheTTL = (%v, %v, %v); want (%v, %v, %v)", ttl, negative, ok, tt.wantTTL, tt.wantNegative, tt.wantOK)
+			}
+		})
+	}
+}
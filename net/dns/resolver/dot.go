@@ -0,0 +1,432 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/health"
+	"tailscale.com/net/sockstats"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// dotDefaultPort is the default port for DNS-over-TLS (RFC 7858).
+	dotDefaultPort = 853
+
+	// dotIdleTimeout is how long to keep an idle DNS-over-TLS connection
+	// open for reuse. Like dohTransportTimeout, this is pretty arbitrary.
+	dotIdleTimeout = 30 * time.Second
+)
+
+var errDoTConnClosed = errors.New("DNS-over-TLS connection closed")
+
+// dotUpstreamWarnable is unhealthy while any DNS-over-TLS upstream can't be
+// reached or fails its TLS handshake. See forwarder.setDoTHealth.
+var dotUpstreamWarnable = health.Register(&health.Warnable{
+	Code:      "dns-over-tls-upstream-failed",
+	Title:     "DNS-over-TLS server unavailable",
+	Severity:  health.SeverityMedium,
+	DependsOn: []*health.Warnable{health.NetworkStatusWarnable},
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("Tailscale could not query the DNS-over-TLS server %q: %v", args[health.ArgServerName], args[health.ArgError])
+	},
+})
+
+// parseDoTResolver parses a "tls://host[:port]" resolver into the TLS server
+// name to verify and the addresses to dial.
+//
+// If host is not an IP address, r.BootstrapResolution must be set: resolving
+// the DoT server's own name via the system resolver could loop back to us.
+func parseDoTResolver(r *dnstype.Resolver) (serverName string, addrs []netip.AddrPort, err error) {
+	hostPort, ok := strings.CutPrefix(r.Addr, "tls://")
+	if !ok {
+		return "", nil, fmt.Errorf("not a tls:// resolver: %q", r.Addr)
+	}
+	hostPort = strings.TrimSuffix(hostPort, "/")
+	host, port := hostPort, uint16(dotDefaultPort)
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		pn, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || pn == 0 {
+			return "", nil, fmt.Errorf("invalid port in %q", r.Addr)
+		}
+		host, port = h, uint16(pn)
+	} else {
+		// Might be a bare IPv6 address in brackets.
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if host == "" {
+		return "", nil, fmt.Errorf("missing host in %q", r.Addr)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return host, []netip.AddrPort{netip.AddrPortFrom(ip, port)}, nil
+	}
+	if len(r.BootstrapResolution) == 0 {
+		return "", nil, fmt.Errorf("tls:// resolver %q requires an IP address or BootstrapResolution", r.Addr)
+	}
+	for _, ip := range r.BootstrapResolution {
+		addrs = append(addrs, netip.AddrPortFrom(ip, port))
+	}
+	return host, addrs, nil
+}
+
+// dotConn is a pipelined DNS-over-TLS connection to an upstream resolver,
+// shared by all queries to that resolver (RFC 7858 section 3.3).
+//
+// Queries are rewritten to use a connection-unique DNS ID, since queries
+// from different clients may otherwise collide, and the original ID is
+// restored in the response.
+type dotConn struct {
+	f    *forwarder
+	addr string // dnstype.Resolver.Addr; key in forwarder.dotConns
+	conn net.Conn
+	done chan struct{} // closed when conn is closed
+
+	wmu sync.Mutex // serializes writes to conn
+
+	mu      sync.Mutex // guards following
+	closed  bool
+	err     error // why the conn was closed, if closed
+	nextID  uint16
+	pending map[uint16]chan []byte
+	idle    *time.Timer // closes the conn when it's been idle a while
+}
+
+// getDoTConn returns a connection to the DoT resolver r, dialing one if there
+// isn't an open connection to it already. It reports whether the connection
+// was reused.
+func (f *forwarder) getDoTConn(ctx context.Context, r *dnstype.Resolver) (c *dotConn, reused bool, err error) {
+	f.mu.Lock()
+	c, ok := f.dotConns[r.Addr]
+	f.mu.Unlock()
+	if ok && !c.isClosed() {
+		return c, true, nil
+	}
+
+	serverName, addrs, err := parseDoTResolver(r)
+	if err != nil {
+		return nil, false, err
+	}
+	var conn net.Conn
+	for _, ipp := range addrs {
+		conn, err = f.dialDoT(ctx, serverName, ipp)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, false, err
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	c = newDoTConn(f, r.Addr, conn)
+
+	f.mu.Lock()
+	if f.ctx.Err() != nil {
+		f.mu.Unlock()
+		c.closeWithError(net.ErrClosed)
+		return nil, false, net.ErrClosed
+	}
+	if existing, ok := f.dotConns[r.Addr]; ok && !existing.isClosed() {
+		// Lost a race with another dialer; use theirs.
+		f.mu.Unlock()
+		c.closeWithError(errDoTConnClosed)
+		return existing, true, nil
+	}
+	mak.Set(&f.dotConns, r.Addr, c)
+	f.mu.Unlock()
+
+	go c.readLoop()
+	return c, false, nil
+}
+
+// newDoTConn returns a new dotConn for the resolver addr using the
+// established connection conn. The caller must start its readLoop.
+func newDoTConn(f *forwarder, addr string, conn net.Conn) *dotConn {
+	c := &dotConn{
+		f:       f,
+		addr:    addr,
+		conn:    conn,
+		done:    make(chan struct{}),
+		pending: map[uint16]chan []byte{},
+	}
+	c.idle = time.AfterFunc(dotIdleTimeout, c.closeIfIdle)
+	return c
+}
+
+// dialDoT dials ipp and completes a TLS handshake, verifying the server's
+// certificate for serverName.
+func (f *forwarder) dialDoT(ctx context.Context, serverName string, ipp netip.AddrPort) (net.Conn, error) {
+	tcpFam := "tcp4"
+	if ipp.Addr().Is6() {
+		tcpFam = "tcp6"
+	}
+	nc, err := f.getDialerType()(ctx, tcpFam, ipp.String())
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(nc, tlsdial.Config(serverName, f.health, nil))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		metricDNSFwdDoTErrorHandshake.Add(1)
+		return nil, err
+	}
+	return tc, nil
+}
+
+// removeDoTConn forgets c, if it's still the current connection for its
+// resolver.
+func (f *forwarder) removeDoTConn(c *dotConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dotConns[c.addr] == c {
+		delete(f.dotConns, c.addr)
+	}
+}
+
+// closeDoTConns closes all DoT connections. It's called by Close.
+// setDoTHealth records whether the DNS-over-TLS resolver addr is failing,
+// with err, or working, if err is nil, and updates dotUpstreamWarnable.
+func (f *forwarder) setDoTHealth(addr string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		mak.Set(&f.dotFailed, addr, err)
+	} else {
+		delete(f.dotFailed, addr)
+	}
+	f.updateDoTHealthLocked()
+}
+
+// updateDoTHealthLocked sets dotUpstreamWarnable unhealthy, naming the first
+// failing DNS-over-TLS resolver in sorted order, if any are failing, and
+// healthy otherwise. It's called with f.mu held, so that updates are applied
+// in order.
+func (f *forwarder) updateDoTHealthLocked() {
+	var addr string
+	var err error
+	for a, e := range f.dotFailed {
+		if addr == "" || a < addr {
+			addr, err = a, e
+		}
+	}
+	if err == nil {
+		f.health.SetHealthy(dotUpstreamWarnable)
+		return
+	}
+	f.health.SetUnhealthy(dotUpstreamWarnable, health.Args{
+		health.ArgServerName: strings.TrimPrefix(addr, "tls://"),
+		health.ArgError:      err.Error(),
+	})
+}
+
+func (f *forwarder) closeDoTConns() {
+	f.mu.Lock()
+	conns := f.dotConns
+	f.dotConns = nil
+	f.mu.Unlock()
+	for _, c := range conns {
+		c.closeWithError(net.ErrClosed)
+	}
+}
+
+func (c *dotConn) closeWithError(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.err = err
+	c.idle.Stop()
+	c.mu.Unlock()
+
+	c.f.removeDoTConn(c)
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *dotConn) closeIfIdle() {
+	c.mu.Lock()
+	idle := len(c.pending) == 0
+	c.mu.Unlock()
+	if idle {
+		c.closeWithError(errDoTConnClosed)
+	}
+}
+
+// closeErr returns the reason c was closed.
+func (c *dotConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// roundTrip sends the DNS query packet on c and waits for its response.
+func (c *dotConn) roundTrip(ctx context.Context, packet []byte) ([]byte, error) {
+	if len(packet) < headerBytes || len(packet) > 65535 {
+		return nil, fmt.Errorf("invalid DNS query length %d", len(packet))
+	}
+	origID := binary.BigEndian.Uint16(packet[0:2])
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errDoTConnClosed
+	}
+	if len(c.pending) >= 1<<16-1 {
+		c.mu.Unlock()
+		return nil, errors.New("too many pending DNS-over-TLS queries")
+	}
+	id := c.nextID
+	for {
+		if _, ok := c.pending[id]; !ok {
+			break
+		}
+		id++
+	}
+	c.nextID = id + 1
+	resc := make(chan []byte, 1)
+	c.pending[id] = resc
+	c.idle.Stop()
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.pending, id)
+		if len(c.pending) == 0 && !c.closed {
+			c.idle.Reset(dotIdleTimeout)
+		}
+	}()
+
+	msg := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(msg, uint16(len(packet)))
+	copy(msg[2:], packet)
+	binary.BigEndian.PutUint16(msg[2:4], id)
+
+	c.wmu.Lock()
+	if dl, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(dl)
+	}
+	_, err := c.conn.Write(msg)
+	c.wmu.Unlock()
+	if err != nil {
+		metricDNSFwdDoTErrorWrite.Add(1)
+		c.closeWithError(err)
+		return nil, err
+	}
+
+	select {
+	case res := <-resc:
+		binary.BigEndian.PutUint16(res[0:2], origID)
+		return res, nil
+	case <-c.done:
+		return nil, c.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop reads responses from c and dispatches them to their waiting
+// roundTrip calls until c is closed.
+func (c *dotConn) readLoop() {
+	for {
+		var length uint16
+		if err := binary.Read(c.conn, binary.BigEndian, &length); err != nil {
+			if !errors.Is(err, io.EOF) {
+				metricDNSFwdDoTErrorRead.Add(1)
+			}
+			c.closeWithError(err)
+			return
+		}
+		res := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, res); err != nil {
+			metricDNSFwdDoTErrorRead.Add(1)
+			c.closeWithError(err)
+			return
+		}
+		if len(res) < headerBytes {
+			continue
+		}
+		id := binary.BigEndian.Uint16(res[0:2])
+		c.mu.Lock()
+		resc, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if !ok {
+			// Response to a query whose caller gave up.
+			continue
+		}
+		resc <- res
+	}
+}
+
+// sendDoT sends a query to the DNS-over-TLS resolver rr, reusing an existing
+// connection to it if possible.
+func (f *forwarder) sendDoT(ctx context.Context, fq *forwardQuery, rr resolverAndDelay) (ret []byte, err error) {
+	metricDNSFwdDoT.Add(1)
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, f.logf)
+	ctx, cancel := context.WithTimeout(ctx, tcpQueryTimeout)
+	defer cancel()
+
+	defer func() {
+		if err == nil || errors.Is(err, errServerFailure) {
+			f.setDoTHealth(rr.name.Addr, nil)
+		} else if ctx.Err() == nil {
+			f.setDoTHealth(rr.name.Addr, err)
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		c, reused, err := f.getDoTConn(ctx, rr.name)
+		if err != nil {
+			metricDNSFwdDoTErrorConn.Add(1)
+			return nil, err
+		}
+		ret, err = c.roundTrip(ctx, fq.packet)
+		if err != nil {
+			if reused && attempt == 0 && ctx.Err() == nil {
+				// The server may have closed the connection while it
+				// was idle; retry once on a fresh one.
+				continue
+			}
+			return nil, err
+		}
+		break
+	}
+
+	if getRCode(ret) == dns.RCodeServerFailure {
+		f.logf("sendDoT: response code indicating server failure: %d", getRCode(ret))
+		metricDNSFwdDoTErrorServer.Add(1)
+		return nil, errServerFailure
+	}
+	if truncatedFlagSet(ret) {
+		metricDNSFwdTruncated.Add(1)
+	}
+	metricDNSFwdDoTSuccess.Add(1)
+	return ret, nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/health"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+func TestParseDoTResolver(t *testing.T) {
+	tests := []struct {
+		addr      string
+		bootstrap []netip.Addr
+		wantName  string
+		wantAddrs []netip.AddrPort
+		wantErr   bool
+	}{
+		{
+			addr:      "tls://1.1.1.1",
+			wantName:  "1.1.1.1",
+			wantAddrs: []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:853")},
+		},
+		{
+			addr:      "tls://1.1.1.1:8853",
+			wantName:  "1.1.1.1",
+			wantAddrs: []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:8853")},
+		},
+		{
+			addr:      "tls://[2606:4700:4700::1111]",
+			wantName:  "2606:4700:4700::1111",
+			wantAddrs: []netip.AddrPort{netip.MustParseAddrPort("[2606:4700:4700::1111]:853")},
+		},
+		{
+			addr:      "tls://dns.corp.example.com",
+			bootstrap: []netip.Addr{netip.MustParseAddr("10.0.0.53"), netip.MustParseAddr("10.0.1.53")},
+			wantName:  "dns.corp.example.com",
+			wantAddrs: []netip.AddrPort{
+				netip.MustParseAddrPort("10.0.0.53:853"),
+				netip.MustParseAddrPort("10.0.1.53:853"),
+			},
+		},
+		{
+			addr:    "tls://dns.corp.example.com",
+			wantErr: true, // no bootstrap
+		},
+		{
+			addr:    "tls://1.1.1.1:0",
+			wantErr: true,
+		},
+		{
+			addr:    "tls://",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			name, addrs, err := parseDoTResolver(&dnstype.Resolver{Addr: tt.addr, BootstrapResolution: tt.bootstrap})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tt.wantErr)
+			}
+			if name != tt.wantName {
+				t.Errorf("name = %q; want %q", name, tt.wantName)
+			}
+			if !reflect.DeepEqual(addrs, tt.wantAddrs) {
+				t.Errorf("addrs = %v; want %v", addrs, tt.wantAddrs)
+			}
+		})
+	}
+}
+
+// TestDoTConnPipelining checks that concurrent queries with colliding DNS IDs
+// share one connection and each get their own response, even when the server
+// answers out of order.
+func TestDoTConnPipelining(t *testing.T) {
+	client, server := net.Pipe()
+	f := &forwarder{}
+	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
+	defer f.Close()
+	c := newDoTConn(f, "tls://test", client)
+	go c.readLoop()
+	defer c.closeWithError(net.ErrClosed)
+
+	// The server collects two queries, then answers them in reverse order,
+	// echoing each query's question name in a TXT answer.
+	go func() {
+		var queries [][]byte
+		for range 2 {
+			var n uint16
+			if err := binary.Read(server, binary.BigEndian, &n); err != nil {
+				return
+			}
+			q := make([]byte, n)
+			if _, err := io.ReadFull(server, q); err != nil {
+				return
+			}
+			queries = append(queries, q)
+		}
+		if binary.BigEndian.Uint16(queries[0]) == binary.BigEndian.Uint16(queries[1]) {
+			t.Errorf("queries sent upstream with the same ID")
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			var msg dns.Message
+			if err := msg.Unpack(queries[i]); err != nil {
+				t.Error(err)
+				return
+			}
+			msg.Header.Response = true
+			msg.Answers = []dns.Resource{{
+				Header: dns.ResourceHeader{Name: msg.Questions[0].Name, Type: dns.TypeTXT, Class: dns.ClassINET},
+				Body:   &dns.TXTResource{TXT: []string{msg.Questions[0].Name.String()}},
+			}}
+			res, err := msg.Pack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			server.Write(binary.BigEndian.AppendUint16(nil, uint16(len(res))))
+			server.Write(res)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	names := []string{"one.example.", "two.example."}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := dnspacket(dnsname.FQDN(name), dns.TypeTXT, noEdns)
+			binary.BigEndian.PutUint16(q, 0x1234) // same ID for both
+			res, err := c.roundTrip(ctx, q)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			var msg dns.Message
+			if err := msg.Unpack(res); err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			if msg.Header.ID != 0x1234 {
+				t.Errorf("%s: response ID = %#x; want 0x1234", name, msg.Header.ID)
+			}
+			if got := msg.Answers[0].Body.(*dns.TXTResource).TXT[0]; got != name {
+				t.Errorf("%s: got answer for %q", name, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDoTHealth(t *testing.T) {
+	ht := new(health.Tracker)
+	f := &forwarder{health: ht}
+	check := func(wantServer string) {
+		t.Helper()
+		ws, ok := ht.CurrentState().Warnings[dotUpstreamWarnable.Code]
+		if wantServer == "" {
+			if ok {
+				t.Fatalf("warning for %q; want none", ws.Args[health.ArgServerName])
+			}
+			return
+		}
+		if !ok {
+			t.Fatalf("no warning; want one for %q", wantServer)
+		}
+		if got := ws.Args[health.ArgServerName]; got != wantServer {
+			t.Fatalf("warning for %q; want %q", got, wantServer)
+		}
+	}
+
+	failed := errors.New("connection refused")
+	f.setDoTHealth("tls://1.1.1.1", failed)
+	check("1.1.1.1")
+	f.setDoTHealth("tls://9.9.9.9", nil)
+	check("1.1.1.1") // another upstream working doesn't clear it
+	f.setDoTHealth("tls://9.9.9.9", failed)
+	f.setDoTHealth("tls://1.1.1.1", nil)
+	check("9.9.9.9")
+
+	// An upstream that's no longer used is forgotten.
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: "tls://1.1.1.1"}},
+	})
+	check("")
+}
@@ -23,6 +23,7 @@
 	dns "golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/control/controlknobs"
 	"tailscale.com/envknob"
+	"tailscale.com/health"
 	"tailscale.com/net/dns/publicdns"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/neterror"
@@ -188,6 +189,7 @@ type forwarder struct {
 	netMon  *netmon.Monitor     // always non-nil
 	linkSel ForwardLinkSelector // TODO(bradfitz): remove this when tsdial.Dialer absorbs it
 	dialer  *tsdial.Dialer
+	health  *health.Tracker // or nil
 
 	controlKnobs *controlknobs.Knobs // or nil
 
@@ -197,6 +199,8 @@ type forwarder struct {
 	mu sync.Mutex // guards following
 
 	dohClient map[string]*http.Client // urlBase -> client
+	dotConns  map[string]*dotConn     // tls:// resolver Addr -> conn
+	dotFailed map[string]error        // tls:// resolver Addr -> last error, while failing
 
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
@@ -219,7 +223,7 @@ type forwarder struct {
 	missingUpstreamRecovery func()
 }
 
-func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkSelector, dialer *tsdial.Dialer, knobs *controlknobs.Knobs) *forwarder {
+func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkSelector, dialer *tsdial.Dialer, health *health.Tracker, knobs *controlknobs.Knobs) *forwarder {
 	if netMon == nil {
 		panic("nil netMon")
 	}
@@ -228,6 +232,7 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 		netMon:                  netMon,
 		linkSel:                 linkSel,
 		dialer:                  dialer,
+		health:                  health,
 		controlKnobs:            knobs,
 		missingUpstreamRecovery: func() {},
 	}
@@ -237,6 +242,7 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	f.closeDoTConns()
 	return nil
 }
 
@@ -360,6 +366,24 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 	defer f.mu.Unlock()
 	f.routes = routes
 	f.cloudHostFallback = cloudHostFallback
+	// Forget the failures of DNS-over-TLS resolvers that are no longer
+	// used.
+	inUse := make(map[string]bool)
+	for _, r := range routes {
+		for _, rr := range r.Resolvers {
+			inUse[rr.name.Addr] = true
+		}
+	}
+	pruned := false
+	for addr := range f.dotFailed {
+		if !inUse[addr] {
+			delete(f.dotFailed, addr)
+			pruned = true
+		}
+	}
+	if pruned {
+		f.updateDoTHealthLocked()
+	}
 }
 
 var stdNetPacketListener nettype.PacketListenerWithNetIP = nettype.MakePacketListenerWithNetIP(new(net.ListenConfig))
@@ -501,8 +525,7 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
 	}
 	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+		return f.sendDoT(ctx, fq, rr)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -799,16 +822,24 @@ func (f *forwarder) sendTCP(ctx context.Context, fq *forwardQuery, rr resolverAn
 
 // resolvers returns the resolvers to use for domain.
 func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+	_, rr := f.route(domain)
+	return rr
+}
+
+// route returns the suffix of the route matching domain and the resolvers
+// to use for it. If no route matches, it returns the empty suffix and the
+// cloud host fallback resolvers, if any.
+func (f *forwarder) route(domain dnsname.FQDN) (suffix dnsname.FQDN, rr []resolverAndDelay) {
 	f.mu.Lock()
 	routes := f.routes
 	cloudHostFallback := f.cloudHostFallback
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix, route.Resolvers
 		}
 	}
-	return cloudHostFallback // or nil if no fallback
+	return "", cloudHostFallback // or nil if no fallback
 }
 
 // forwardQuery is information and state about a forwarded DNS query that's
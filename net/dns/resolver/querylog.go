@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/logtail"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/ringbuffer"
+	"tailscale.com/util/set"
+)
+
+// MaxQueryLogSize is the maximum number of entries in a Resolver's query log.
+const MaxQueryLogSize = 10000
+
+// maxQueryLogClients bounds the number of distinct client addresses for
+// which per-client statistics are kept.
+const maxQueryLogClients = 1000
+
+// obscureLoggedIPs is the same knob that logtail uses to redact
+// non-Tailscale IP addresses from logs; the query log follows suit.
+var obscureLoggedIPs = envknob.RegisterBool("TS_OBSCURE_LOGGED_IPS")
+
+// queryLog is an opt-in log of the queries a Resolver has answered.
+type queryLog struct {
+	mu       sync.Mutex
+	size     int                                           // 0 means disabled
+	ents     *ringbuffer.RingBuffer[dnstype.QueryLogEntry] // nil if disabled
+	clients  map[netip.Addr]*dnstype.QueryStats
+	watchers set.HandleSet[chan<- dnstype.QueryLogEntry]
+}
+
+// SetQueryLogSize sets the maximum number of entries retained in r's query
+// log, clearing it and its per-client statistics. A size of zero disables the
+// query log.
+func (r *Resolver) SetQueryLogSize(n int) {
+	n = min(max(n, 0), MaxQueryLogSize)
+	ql := &r.queryLog
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	ql.size = n
+	ql.clients = nil
+	if n == 0 {
+		ql.ents = nil
+	} else {
+		ql.ents = ringbuffer.New[dnstype.QueryLogEntry](n)
+	}
+}
+
+// QueryLogSize returns the maximum number of entries retained in r's query
+// log. Zero means the query log is disabled.
+func (r *Resolver) QueryLogSize() int {
+	ql := &r.queryLog
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	return ql.size
+}
+
+// QueryLog returns a snapshot of r's query log.
+func (r *Resolver) QueryLog() dnstype.QueryLog {
+	ql := &r.queryLog
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	ret := dnstype.QueryLog{
+		Size:    ql.size,
+		Entries: ql.ents.GetAll(),
+	}
+	for ip, st := range ql.clients {
+		mak.Set(&ret.Clients, ip, *st)
+	}
+	return ret
+}
+
+// RegisterQueryLogWatcher registers dst to get a copy of every new query log
+// entry, even if the query log is otherwise disabled. Sends to dst don't
+// block; entries are dropped if dst is full. The caller must call
+// unregister when done watching.
+func (r *Resolver) RegisterQueryLogWatcher(dst chan<- dnstype.QueryLogEntry) (unregister func()) {
+	ql := &r.queryLog
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	h := ql.watchers.Add(dst)
+	return func() {
+		ql.mu.Lock()
+		defer ql.mu.Unlock()
+		delete(ql.watchers, h)
+	}
+}
+
+// enabled reports whether query log entries should be recorded.
+func (ql *queryLog) enabled() bool {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	return ql.ents != nil || len(ql.watchers) > 0
+}
+
+func (ql *queryLog) add(e dnstype.QueryLogEntry) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	if ql.ents != nil {
+		ql.ents.Add(e)
+		ql.addStatsLocked(e)
+	}
+	for _, ch := range ql.watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (ql *queryLog) addStatsLocked(e dnstype.QueryLogEntry) {
+	ip := e.Source.Addr()
+	st, ok := ql.clients[ip]
+	if !ok {
+		if len(ql.clients) >= maxQueryLogClients {
+			return
+		}
+		st = new(dnstype.QueryStats)
+		mak.Set(&ql.clients, ip, st)
+	}
+	st.Queries++
+	if e.Cached {
+		st.Cached++
+	}
+	if e.RCode == "" || e.RCode == "ServerFailure" {
+		st.Failed++
+	}
+}
+
+// logQuery records a query log entry for the query bs received from src at
+// start, to which res (if any) was sent in response.
+func (r *Resolver) logQuery(start time.Time, bs []byte, src netip.AddrPort, route string, cached bool, res []byte, err error) {
+	e := dnstype.QueryLogEntry{
+		Time:    start,
+		Route:   route,
+		Cached:  cached,
+		Latency: time.Since(start),
+		Source:  src,
+	}
+	p := dnsParserPool.Get().(*dnsParser)
+	if p.parseQuery(bs) == nil {
+		rawName := p.Question.Name.Data[:p.Question.Name.Length]
+		e.Name = rawNameToLower(rawName)
+		e.Type = strings.TrimPrefix(p.Question.Type.String(), "Type")
+	}
+	dnsParserPool.Put(p)
+	if len(res) >= headerBytes {
+		e.RCode = strings.TrimPrefix(getRCode(res).String(), "RCode")
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	if obscureLoggedIPs() {
+		redactQueryLogEntry(&e)
+	}
+	r.queryLog.add(e)
+}
+
+// redactQueryLogEntry obscures non-Tailscale IP addresses in e, in the same
+// way that logtail does when TS_OBSCURE_LOGGED_IPS is set.
+func redactQueryLogEntry(e *dnstype.QueryLogEntry) {
+	if ip := e.Source.Addr(); ip.IsValid() && !tsaddr.IsTailscaleIP(ip) {
+		e.RedactedSource = logtail.RedactIPs(e.Source.String())
+		e.Source = netip.AddrPort{}
+	}
+	// Reverse lookups embed the address being looked up in the name.
+	if ipStr, ok := unARPA(e.Name); ok {
+		if ip, err := netip.ParseAddr(ipStr); err == nil && !tsaddr.IsTailscaleIP(ip) {
+			e.Name = "redacted.arpa."
+		}
+	}
+}
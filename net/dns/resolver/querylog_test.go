@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+func TestQueryLog(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	r.SetConfig(dnsCfg)
+
+	src := netip.MustParseAddrPort("100.64.0.2:5353")
+	query := func(name dnsname.FQDN, typ dns.Type) {
+		t.Helper()
+		if _, err := r.Query(context.Background(), dnspacket(name, typ, noEdns), "udp", src); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query("test1.ipn.dev.", dns.TypeA)
+	if ql := r.QueryLog(); ql.Size != 0 || len(ql.Entries) != 0 {
+		t.Fatalf("disabled query log = %+v; want empty", ql)
+	}
+
+	r.SetQueryLogSize(2)
+	entc := make(chan dnstype.QueryLogEntry, 10)
+	unreg := r.RegisterQueryLogWatcher(entc)
+	query("test1.ipn.dev.", dns.TypeA)
+	query("TEST2.ipn.dev.", dns.TypeAAAA)
+	query("nope.ipn.dev.", dns.TypeA)
+	unreg()
+	query("test1.ipn.dev.", dns.TypeA)
+
+	ql := r.QueryLog()
+	if ql.Size != 2 || len(ql.Entries) != 2 {
+		t.Fatalf("query log size %d with %d entries; want 2 and 2", ql.Size, len(ql.Entries))
+	}
+	e := ql.Entries[0]
+	if e.Name != "nope.ipn.dev." || e.Type != "A" || e.Route != dnstype.QueryLogRouteMagicDNS || e.RCode != "NameError" || e.Source != src {
+		t.Errorf("first entry = %+v", e)
+	}
+	if got, want := len(entc), 3; got != want {
+		t.Errorf("watcher got %d entries; want %d", got, want)
+	}
+	if e := <-entc; e.Name != "test1.ipn.dev." || e.RCode != "Success" {
+		t.Errorf("first watched entry = %+v", e)
+	}
+	if e := <-entc; e.Name != "test2.ipn.dev." || e.Type != "AAAA" {
+		t.Errorf("second watched entry = %+v", e)
+	}
+
+	st := ql.Clients[src.Addr()]
+	if st.Queries != 4 || st.Failed != 0 {
+		t.Errorf("client stats = %+v; want 4 queries, 0 failed", st)
+	}
+
+	r.SetQueryLogSize(0)
+	if ql := r.QueryLog(); ql.Size != 0 || len(ql.Entries) != 0 || len(ql.Clients) != 0 {
+		t.Errorf("after disabling, query log = %+v; want empty", ql)
+	}
+}
+
+func TestRedactQueryLogEntry(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantName   string
+		wantSource string // Source, or RedactedSource if redacted
+	}{
+		{"example.com.", "100.64.0.2:53", "example.com.", "100.64.0.2:53"},
+		{"example.com.", "192.168.1.20:1234", "example.com.", "192.168.x.x:1234"},
+		{"example.com.", "[2001:db8:1:2::3]:53", "example.com.", "[2001:db8:x]:53"},
+		{"4.3.2.1.in-addr.arpa.", "100.64.0.2:53", "redacted.arpa.", "100.64.0.2:53"},
+		{"2.0.64.100.in-addr.arpa.", "100.64.0.2:53", "2.0.64.100.in-addr.arpa.", "100.64.0.2:53"},
+	}
+	for _, tt := range tests {
+		e := dnstype.QueryLogEntry{Name: tt.name, Source: netip.MustParseAddrPort(tt.src)}
+		redactQueryLogEntry(&e)
+		src := e.RedactedSource
+		if src == "" {
+			src = e.Source.String()
+		}
+		if e.Name != tt.wantName || src != tt.wantSource {
+			t.Errorf("redact(%q, %v) = (%q, %v); want (%q, %v)", tt.name, tt.src, e.Name, src, tt.wantName, tt.wantSource)
+		}
+	}
+}
@@ -25,12 +25,14 @@
 	dns "golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/control/controlknobs"
 	"tailscale.com/envknob"
+	"tailscale.com/health"
 	"tailscale.com/net/dns/resolvconffile"
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/syncs"
+	"tailscale.com/tstime"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
@@ -73,6 +75,11 @@ type Config struct {
 	Routes map[dnsname.FQDN][]*dnstype.Resolver
 	// LocalHosts is a map of FQDNs to corresponding IPs.
 	Hosts map[dnsname.FQDN][]netip.Addr
+	// TXTRecords is a map of FQDNs to the strings of their TXT records.
+	TXTRecords map[dnsname.FQDN][]string
+	// CNAMERecords is a map of FQDNs that are aliases to their
+	// canonical names.
+	CNAMERecords map[dnsname.FQDN]dnsname.FQDN
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
@@ -205,6 +212,13 @@ type Resolver struct {
 	saveConfigForTests func(cfg Config) // used in tests to capture resolver config
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
+	// cache caches responses from upstream nameservers.
+	cache *responseCache
+	// queryLog is the opt-in log of recent queries.
+	queryLog queryLog
+
+	blocklistMu sync.Mutex
+	blocklist   *blocklist // or nil if no blocklist is configured
 
 	// closed signals all goroutines to stop.
 	closed chan struct{}
@@ -214,6 +228,8 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
 	ipToHost     map[netip.Addr]dnsname.FQDN
+	txtRecords   map[dnsname.FQDN][]string
+	cnameRecords map[dnsname.FQDN]dnsname.FQDN
 }
 
 type ForwardLinkSelector interface {
@@ -224,7 +240,9 @@ type ForwardLinkSelector interface {
 }
 
 // New returns a new resolver.
-func New(logf logger.Logf, linkSel ForwardLinkSelector, dialer *tsdial.Dialer, knobs *controlknobs.Knobs) *Resolver {
+//
+// health and knobs may be nil.
+func New(logf logger.Logf, linkSel ForwardLinkSelector, dialer *tsdial.Dialer, health *health.Tracker, knobs *controlknobs.Knobs) *Resolver {
 	if dialer == nil {
 		panic("nil Dialer")
 	}
@@ -239,8 +257,9 @@ func New(logf logger.Logf, linkSel ForwardLinkSelector, dialer *tsdial.Dialer, k
 		hostToIP: map[dnsname.FQDN][]netip.Addr{},
 		ipToHost: map[netip.Addr]dnsname.FQDN{},
 		dialer:   dialer,
+		cache:    newResponseCache(tstime.StdClock{}),
 	}
-	r.forwarder = newForwarder(r.logf, netMon, linkSel, dialer, knobs)
+	r.forwarder = newForwarder(r.logf, netMon, linkSel, dialer, health, knobs)
 	return r
 }
 
@@ -269,12 +288,17 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	}
 
 	r.forwarder.setRoutes(cfg.Routes)
+	// Routes or local names may have changed what's authoritative for a
+	// cached name, so start over.
+	r.cache.flush()
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.txtRecords = cfg.TXTRecords
+	r.cnameRecords = cfg.CNAMERecords
 	return nil
 }
 
@@ -297,6 +321,8 @@ func (r *Resolver) Close() {
 // bound on per-query resource usage.
 const dnsQueryTimeout = 10 * time.Second
 
+// Query resolves the DNS query bs received from the given address over the
+// given family ("tcp" or "udp"), either locally or by forwarding it upstream.
 func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
 	metricDNSQueryLocal.Add(1)
 	select {
@@ -306,28 +332,75 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 	default:
 	}
 
+	if !r.queryLog.enabled() {
+		out, _, _, err := r.query(ctx, bs, family, from)
+		return out, err
+	}
+	start := time.Now()
+	out, route, cached, err := r.query(ctx, bs, family, from)
+	r.logQuery(start, bs, from, route, cached, out, err)
+	return out, err
+}
+
+// query implements Query. It additionally returns the route via which the
+// query was resolved, in the form of dnstype.QueryLogEntry.Route, and
+// whether the response came from the cache.
+func (r *Resolver) query(ctx context.Context, bs []byte, family string, from netip.AddrPort) (_ []byte, route string, cached bool, _ error) {
 	out, err := r.respond(bs)
-	if err == errNotOurName {
-		responses := make(chan packet, 1)
-		ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
-		defer close(responses)
-		defer cancel()
-		err = r.forwarder.forwardWithDestChan(ctx, packet{bs, family, from}, responses)
-		if err != nil {
-			select {
-			// Best effort: use any error response sent by forwardWithDestChan.
-			// This is present in some errors paths, such as when all upstream
-			// DNS servers replied with an error.
-			case resp := <-responses:
-				return resp.bs, err
-			default:
-				return nil, err
-			}
+	if err != errNotOurName {
+		return out, dnstype.QueryLogRouteMagicDNS, false, err
+	}
+
+	cq, ck, cacheable := r.cacheKeyForQuery(bs, family)
+	if cacheable {
+		if res, ok := r.cache.get(ck, &cq); ok {
+			// Only responses from upstream resolvers get cached, so
+			// there must have been resolvers for this route.
+			return res, queryLogRoute(ck.route, true), true, nil
+		}
+	}
+	if r.queryLog.enabled() {
+		if name, err := nameFromQuery(bs); err == nil {
+			suffix, rr := r.forwarder.route(name)
+			route = queryLogRoute(suffix, len(rr) > 0)
 		}
-		return (<-responses).bs, nil
 	}
 
-	return out, err
+	responses := make(chan packet, 1)
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer close(responses)
+	defer cancel()
+	err = r.forwarder.forwardWithDestChan(ctx, packet{bs, family, from}, responses)
+	if err != nil {
+		select {
+		// Best effort: use any error response sent by forwardWithDestChan.
+		// This is present in some errors paths, such as when all upstream
+		// DNS servers replied with an error.
+		case resp := <-responses:
+			return resp.bs, route, false, err
+		default:
+			return nil, route, false, err
+		}
+	}
+	res := (<-responses).bs
+	if cacheable {
+		r.cache.put(ck, res)
+	}
+	return res, route, false, nil
+}
+
+// queryLogRoute returns the dnstype.QueryLogEntry.Route for a query that
+// matched the forwarding route suffix, as returned by forwarder.route.
+func queryLogRoute(suffix dnsname.FQDN, haveResolvers bool) string {
+	if suffix == "" && haveResolvers {
+		return dnstype.QueryLogRouteFallback
+	}
+	return string(suffix)
+}
+
+// CacheStats returns statistics about r's cache of upstream responses.
+func (r *Resolver) CacheStats() CacheStats {
+	return r.cache.stats()
 }
 
 // parseExitNodeQuery parses a DNS request packet.
@@ -368,6 +441,9 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 		resp.Header.RCode = dns.RCodeRefused
 		return marshalResponse(resp)
 	}
+	if res, blocked, err := r.respondBlocked(resp, from); blocked {
+		return res, err
+	}
 
 	switch runtime.GOOS {
 	default:
@@ -698,6 +774,44 @@ func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netip.Addr,
 	}
 }
 
+// resolveLocalRecord returns a response to resp's question about domain from
+// the local TXT and CNAME records. It reports false if neither applies,
+// in which case the query should be handled by resolveLocal.
+func (r *Resolver) resolveLocalRecord(domain dnsname.FQDN, resp *response) (_ *response, ok bool) {
+	r.mu.Lock()
+	target, isAlias := r.cnameRecords[domain]
+	txts, hasTXT := r.txtRecords[domain]
+	_, hasHost := r.hostToIP[domain]
+	var targetAddrs []netip.Addr
+	if isAlias {
+		targetAddrs = r.hostToIP[target]
+	}
+	r.mu.Unlock()
+
+	typ := resp.Question.Type
+	switch {
+	case isAlias:
+		// An alias has no other records of its own. Answer with the
+		// CNAME and, for address queries, whatever addresses we have
+		// locally for the canonical name. The client follows the CNAME
+		// itself otherwise.
+		resp.CNAME = target.WithTrailingDot()
+		for _, ip := range targetAddrs {
+			if typ == dns.TypeALL || (typ == dns.TypeA && ip.Is4()) || (typ == dns.TypeAAAA && ip.Is6()) {
+				resp.IPs = append(resp.IPs, ip)
+			}
+		}
+	case hasTXT && typ == dns.TypeTXT:
+		resp.TXT = txts
+	case hasTXT && !hasHost:
+		// The name exists, but has no records of the requested type.
+	default:
+		return nil, false
+	}
+	resp.Header.RCode = dns.RCodeSuccess
+	return resp, true
+}
+
 // resolveViaDomain synthesizes an IP address for quad-A DNS requests of the form
 // `<IPv4-address-with-hypens-instead-of-dots>-via-<siteid>[.*]`. Two prior formats that
 // didn't pan out (due to a Chrome issue and DNS search ndots issues) were
@@ -1090,6 +1204,24 @@ func marshalResponse(resp *response) ([]byte, error) {
 		return nil, err
 	}
 
+	if resp.CNAME != "" && resp.Question.Type != dns.TypeCNAME {
+		// The question's name is an alias. Answer with its CNAME,
+		// followed by any addresses of the canonical name.
+		if err := marshalCNAME(resp.Question.Name, resp.CNAME, &builder); err != nil {
+			return nil, err
+		}
+		target, err := dns.NewName(resp.CNAME)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range resp.IPs {
+			if err := marshalIP(target, ip, &builder); err != nil {
+				return nil, err
+			}
+		}
+		return builder.Finish()
+	}
+
 	switch resp.Question.Type {
 	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
 		if err := marshalIP(resp.Question.Name, resp.IP, &builder); err != nil {
@@ -1288,6 +1420,11 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
+	if resp, ok := r.resolveLocalRecord(name, parser.response()); ok {
+		metricDNSMagicDNSSuccessName.Add(1)
+		return marshalResponse(resp)
+	}
+
 	ip, rcode := r.resolveLocal(name, parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
@@ -1345,6 +1482,7 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSExitProxyErrorName       = clientmetric.NewCounter("dns_exit_node_error_name")
 	metricDNSExitProxyErrorForward    = clientmetric.NewCounter("dns_exit_node_error_forward")
 	metricDNSExitProxyErrorResolvConf = clientmetric.NewCounter("dns_exit_node_error_resolvconf")
+	metricDNSExitProxyBlocked         = clientmetric.NewCounter("dns_exit_node_blocked")
 
 	metricDNSFwd                     = clientmetric.NewCounter("dns_query_fwd")
 	metricDNSFwdDropBonjour          = clientmetric.NewCounter("dns_query_fwd_drop_bonjour")
@@ -1379,6 +1517,19 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT               = clientmetric.NewCounter("dns_query_fwd_dot")
+	metricDNSFwdDoTErrorConn      = clientmetric.NewCounter("dns_query_fwd_dot_error_conn")
+	metricDNSFwdDoTErrorHandshake = clientmetric.NewCounter("dns_query_fwd_dot_error_handshake")
+	metricDNSFwdDoTErrorWrite     = clientmetric.NewCounter("dns_query_fwd_dot_error_write")
+	metricDNSFwdDoTErrorRead      = clientmetric.NewCounter("dns_query_fwd_dot_error_read")
+	metricDNSFwdDoTErrorServer    = clientmetric.NewCounter("dns_query_fwd_dot_error_server")
+	metricDNSFwdDoTSuccess        = clientmetric.NewCounter("dns_query_fwd_dot_success")
+
+	metricDNSFwdCacheHit         = clientmetric.NewCounter("dns_query_fwd_cache_hit")
+	metricDNSFwdCacheHitNegative = clientmetric.NewCounter("dns_query_fwd_cache_hit_negative")
+	metricDNSFwdCacheMiss        = clientmetric.NewCounter("dns_query_fwd_cache_miss")
+	metricDNSFwdCacheStore       = clientmetric.NewCounter("dns_query_fwd_cache_store")
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
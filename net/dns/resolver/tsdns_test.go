@@ -354,6 +354,7 @@ func newResolver(t testing.TB) *Resolver {
 	return New(t.Logf,
 		nil, // no link selector
 		tsdial.NewDialer(netmon.NewStatic()),
+		nil, // no health tracker
 		nil, // no control knobs
 	)
 }
@@ -423,6 +424,74 @@ func TestResolveLocal(t *testing.T) {
 	}
 }
 
+func TestResolveLocalRecords(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.TXTRecords = map[dnsname.FQDN][]string{
+		"test1.ipn.dev.":  {"v=1"},
+		"_txt.ipn.dev.":   {"one", "two"},
+		"alias.ipn.dev.":  {"ignored"},
+		"alias2.ipn.dev.": {"ignored"},
+	}
+	cfg.CNAMERecords = map[dnsname.FQDN]dnsname.FQDN{
+		"alias.ipn.dev.":  "test1.ipn.dev.",
+		"alias2.ipn.dev.": "elsewhere.example.com.",
+	}
+	r.SetConfig(cfg)
+
+	tests := []struct {
+		name    string
+		qname   dnsname.FQDN
+		qtype   dns.Type
+		code    dns.RCode
+		answers []string
+	}{
+		{"txt", "_txt.ipn.dev.", dns.TypeTXT, dns.RCodeSuccess, []string{"TXT one", "TXT two"}},
+		{"txt-no-a", "_txt.ipn.dev.", dns.TypeA, dns.RCodeSuccess, nil},
+		{"txt-and-host", "test1.ipn.dev.", dns.TypeTXT, dns.RCodeSuccess, []string{"TXT v=1"}},
+		{"host-and-txt", "test1.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []string{"A " + testipv4.String()}},
+		{"cname-a", "alias.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []string{"CNAME test1.ipn.dev.", "A " + testipv4.String()}},
+		{"cname-aaaa", "alias.ipn.dev.", dns.TypeAAAA, dns.RCodeSuccess, []string{"CNAME test1.ipn.dev."}},
+		{"cname-cname", "alias.ipn.dev.", dns.TypeCNAME, dns.RCodeSuccess, []string{"CNAME test1.ipn.dev."}},
+		{"cname-txt", "alias.ipn.dev.", dns.TypeTXT, dns.RCodeSuccess, []string{"CNAME test1.ipn.dev."}},
+		{"cname-foreign", "alias2.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []string{"CNAME elsewhere.example.com."}},
+		{"nxdomain", "test3.ipn.dev.", dns.TypeTXT, dns.RCodeNameError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := r.respond(dnspacket(tt.qname, tt.qtype, noEdns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dns.Message
+			if err := msg.Unpack(res); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != tt.code {
+				t.Errorf("rcode = %v; want %v", msg.Header.RCode, tt.code)
+			}
+			var answers []string
+			for _, rr := range msg.Answers {
+				switch b := rr.Body.(type) {
+				case *dns.AResource:
+					answers = append(answers, "A "+netip.AddrFrom4(b.A).String())
+				case *dns.TXTResource:
+					answers = append(answers, "TXT "+strings.Join(b.TXT, " "))
+				case *dns.CNAMEResource:
+					answers = append(answers, "CNAME "+b.CNAME.String())
+				default:
+					answers = append(answers, rr.Header.Type.String())
+				}
+			}
+			if !reflect.DeepEqual(answers, tt.answers) {
+				t.Errorf("answers = %q; want %q", answers, tt.answers)
+			}
+		})
+	}
+}
+
 func TestResolveLocalReverse(t *testing.T) {
 	r := newResolver(t)
 	defer r.Close()
@@ -1068,7 +1137,7 @@ func TestForwardLinkSelection(t *testing.T) {
 			return "special"
 		}
 		return ""
-	}), new(tsdial.Dialer), nil /* no control knobs */)
+	}), new(tsdial.Dialer), nil /* no health */, nil /* no control knobs */)
 
 	// Test non-special IP.
 	if got, err := fwd.packetListener(netip.Addr{}); err != nil {
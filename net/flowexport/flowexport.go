@@ -0,0 +1,651 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package flowexport encodes and decodes the network traffic statistics of
+// package netlog as IPFIX (RFC 7011) and NetFlow v9 (RFC 3954) messages, for
+// export to a flow collector.
+//
+// Each netlogtype.ConnectionCounts is exported as up to two unidirectional
+// flow records: one for the transmitted counts, from the connection's
+// source to its destination, and one for the received counts, in the other
+// direction. The kind of traffic (virtual, subnet, exit or physical) is the
+// message's observation domain (IPFIX) or source ID (NetFlow v9).
+package flowexport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+// Format is a flow export protocol.
+type Format int
+
+const (
+	IPFIX     Format = iota // IPFIX, version 10 of the NetFlow format
+	NetFlowV9               // NetFlow version 9
+)
+
+func (f Format) String() string {
+	switch f {
+	case IPFIX:
+		return "ipfix"
+	case NetFlowV9:
+		return "netflow9"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Domain is the kind of traffic in a message, matching the fields of
+// netlogtype.Message. It's the IPFIX observation domain ID, or the NetFlow
+// v9 source ID, of the message.
+type Domain uint32
+
+const (
+	VirtualTraffic  Domain = 1
+	SubnetTraffic   Domain = 2
+	ExitTraffic     Domain = 3
+	PhysicalTraffic Domain = 4
+)
+
+func (d Domain) String() string {
+	switch d {
+	case VirtualTraffic:
+		return "VirtualTraffic"
+	case SubnetTraffic:
+		return "SubnetTraffic"
+	case ExitTraffic:
+		return "ExitTraffic"
+	case PhysicalTraffic:
+		return "PhysicalTraffic"
+	}
+	return fmt.Sprintf("Domain(%d)", uint32(d))
+}
+
+// Direction is the direction of a flow record, relative to the node
+// exporting it.
+type Direction uint8
+
+const (
+	Ingress Direction = 0 // received by the node
+	Egress  Direction = 1 // sent by the node
+)
+
+// Record is a unidirectional flow record.
+type Record struct {
+	Domain    Domain
+	Direction Direction
+	Proto     ipproto.Proto
+	Src, Dst  netip.AddrPort
+	Packets   uint64
+	Bytes     uint64
+	Start     time.Time // millisecond precision
+	End       time.Time // millisecond precision
+}
+
+// Information element IDs, which are the same in IPFIX and NetFlow v9 for
+// all but the flow times.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61
+
+	ieFlowStartMilliseconds = 152 // IPFIX only
+	ieFlowEndMilliseconds   = 153 // IPFIX only
+	ieLastSwitched          = 21  // NetFlow v9 only: sysUptime in ms
+	ieFirstSwitched         = 22  // NetFlow v9 only: sysUptime in ms
+)
+
+// Set IDs of template sets; data sets have the ID of their template.
+const (
+	ipfixTemplateSetID   = 2
+	netflowTemplateSetID = 0
+	minDataSetID         = 256
+)
+
+const (
+	ipfixHeaderLen   = 16
+	netflowHeaderLen = 20
+	setHeaderLen     = 4
+)
+
+// templateID returns the ID of the template of records with the given
+// address families. There's a template for each combination, since
+// physical traffic can be between an IPv4 and an IPv6 address.
+func templateID(src, dst netip.Addr) uint16 {
+	id := uint16(minDataSetID)
+	if src.Is6() {
+		id |= 2
+	}
+	if dst.Is6() {
+		id |= 1
+	}
+	return id
+}
+
+type field struct {
+	id, len uint16
+}
+
+// templateFields returns the fields of template id, in record order.
+func templateFields(f Format, id uint16) []field {
+	src, dst := field{ieSourceIPv4Address, 4}, field{ieDestinationIPv4Address, 4}
+	if id&2 != 0 {
+		src = field{ieSourceIPv6Address, 16}
+	}
+	if id&1 != 0 {
+		dst = field{ieDestinationIPv6Address, 16}
+	}
+	fields := []field{
+		src,
+		dst,
+		{ieProtocolIdentifier, 1},
+		{ieSourceTransportPort, 2},
+		{ieDestinationTransportPort, 2},
+		{ieFlowDirection, 1},
+		{iePacketDeltaCount, 8},
+		{ieOctetDeltaCount, 8},
+	}
+	if f == IPFIX {
+		return append(fields, field{ieFlowStartMilliseconds, 8}, field{ieFlowEndMilliseconds, 8})
+	}
+	return append(fields, field{ieFirstSwitched, 4}, field{ieLastSwitched, 4})
+}
+
+// Records returns the flow records of the traffic in m, skipping zero
+// counts.
+func Records(m *netlogtype.Message) []Record {
+	var recs []Record
+	add := func(d Domain, traffic []netlogtype.ConnectionCounts) {
+		for _, cc := range traffic {
+			if cc.TxPackets > 0 || cc.TxBytes > 0 {
+				recs = append(recs, Record{
+					Domain:    d,
+					Direction: Egress,
+					Proto:     cc.Proto,
+					Src:       cc.Src,
+					Dst:       cc.Dst,
+					Packets:   cc.TxPackets,
+					Bytes:     cc.TxBytes,
+					Start:     m.Start,
+					End:       m.End,
+				})
+			}
+			if cc.RxPackets > 0 || cc.RxBytes > 0 {
+				recs = append(recs, Record{
+					Domain:    d,
+					Direction: Ingress,
+					Proto:     cc.Proto,
+					Src:       cc.Dst,
+					Dst:       cc.Src,
+					Packets:   cc.RxPackets,
+					Bytes:     cc.RxBytes,
+					Start:     m.Start,
+					End:       m.End,
+				})
+			}
+		}
+	}
+	add(VirtualTraffic, m.VirtualTraffic)
+	add(SubnetTraffic, m.SubnetTraffic)
+	add(ExitTraffic, m.ExitTraffic)
+	add(PhysicalTraffic, m.PhysicalTraffic)
+	return recs
+}
+
+// Messages returns the traffic of records as netlogtype.Messages, one per
+// distinct time window, merging the two directions of each connection.
+// It's the inverse of Records.
+func Messages(recs []Record) []netlogtype.Message {
+	type window struct{ start, end time.Time }
+	type key struct {
+		d    Domain
+		conn netlogtype.Connection
+	}
+	var windows []window
+	counts := map[window]map[key]netlogtype.Counts{}
+	var order []key // of first appearance, for stable output
+	for _, r := range recs {
+		w := window{r.Start, r.End}
+		if counts[w] == nil {
+			counts[w] = map[key]netlogtype.Counts{}
+			windows = append(windows, w)
+		}
+		k := key{d: r.Domain, conn: netlogtype.Connection{Proto: r.Proto, Src: r.Src, Dst: r.Dst}}
+		var c netlogtype.Counts
+		if r.Direction == Ingress {
+			k.conn.Src, k.conn.Dst = r.Dst, r.Src
+			c = netlogtype.Counts{RxPackets: r.Packets, RxBytes: r.Bytes}
+		} else {
+			c = netlogtype.Counts{TxPackets: r.Packets, TxBytes: r.Bytes}
+		}
+		if _, ok := counts[w][k]; !ok {
+			order = append(order, k)
+		}
+		counts[w][k] = counts[w][k].Add(c)
+	}
+
+	var msgs []netlogtype.Message
+	for _, w := range windows {
+		m := netlogtype.Message{Start: w.start, End: w.end}
+		for _, k := range order {
+			c, ok := counts[w][k]
+			if !ok {
+				continue
+			}
+			delete(counts[w], k) // order may repeat keys across windows
+			cc := netlogtype.ConnectionCounts{Connection: k.conn, Counts: c}
+			switch k.d {
+			case VirtualTraffic:
+				m.VirtualTraffic = append(m.VirtualTraffic, cc)
+			case SubnetTraffic:
+				m.SubnetTraffic = append(m.SubnetTraffic, cc)
+			case ExitTraffic:
+				m.ExitTraffic = append(m.ExitTraffic, cc)
+			case PhysicalTraffic:
+				m.PhysicalTraffic = append(m.PhysicalTraffic, cc)
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// MaxMessageSize is the default maximum size of encoded messages, which
+// fits in a UDP datagram on typical links.
+const MaxMessageSize = 1400
+
+// Encoder encodes flow records as messages of an export protocol. Each
+// message includes the templates of its records, so that collectors can
+// decode it without earlier messages. An Encoder tracks the sequence
+// numbers of the messages, and must not be used concurrently.
+type Encoder struct {
+	format  Format
+	maxSize int
+	boot    time.Time         // for NetFlow v9 sysUptime
+	seq     map[Domain]uint32 // IPFIX: data records sent; NetFlow v9: messages sent
+}
+
+// NewEncoder returns an Encoder of messages in format.
+func NewEncoder(format Format) *Encoder {
+	return &Encoder{
+		format:  format,
+		maxSize: MaxMessageSize,
+		boot:    time.Now(),
+		seq:     map[Domain]uint32{},
+	}
+}
+
+// Encode encodes recs as messages of at most MaxMessageSize bytes, at the
+// export time now.
+func (e *Encoder) Encode(now time.Time, recs []Record) [][]byte {
+	byDomain := map[Domain][]Record{}
+	var domains []Domain
+	for _, r := range recs {
+		if byDomain[r.Domain] == nil {
+			domains = append(domains, r.Domain)
+		}
+		byDomain[r.Domain] = append(byDomain[r.Domain], r)
+	}
+	var msgs [][]byte
+	for _, d := range domains {
+		recs := byDomain[d]
+		for len(recs) > 0 {
+			var msg []byte
+			msg, recs = e.encodeMessage(now, d, recs)
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// encodeMessage encodes as many of recs as fit in a message, and returns
+// the message and the records left over.
+func (e *Encoder) encodeMessage(now time.Time, d Domain, recs []Record) (msg []byte, rest []Record) {
+	headerLen, templateSetID := ipfixHeaderLen, uint16(ipfixTemplateSetID)
+	if e.format == NetFlowV9 {
+		headerLen, templateSetID = netflowHeaderLen, netflowTemplateSetID
+	}
+	msg = make([]byte, headerLen, e.maxSize)
+
+	// All four templates, in a single set.
+	tmplSet := len(msg)
+	msg = append(msg, 0, 0, 0, 0) // set header, filled in below
+	for id := uint16(minDataSetID); id < minDataSetID+4; id++ {
+		fields := templateFields(e.format, id)
+		msg = binary.BigEndian.AppendUint16(msg, id)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(fields)))
+		for _, f := range fields {
+			msg = binary.BigEndian.AppendUint16(msg, f.id)
+			msg = binary.BigEndian.AppendUint16(msg, f.len)
+		}
+	}
+	binary.BigEndian.PutUint16(msg[tmplSet:], templateSetID)
+	binary.BigEndian.PutUint16(msg[tmplSet+2:], uint16(len(msg)-tmplSet))
+	numRecords := 4 // NetFlow v9 counts template records too
+
+	// Data sets of consecutive records with the same template.
+	var dataRecords int
+	set := -1 // offset of the current data set
+	var setID uint16
+	endSet := func() {
+		if set < 0 {
+			return
+		}
+		for (len(msg)-set)%4 != 0 {
+			msg = append(msg, 0)
+		}
+		binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+		set = -1
+	}
+	for len(recs) > 0 {
+		r := recs[0]
+		id := templateID(r.Src.Addr(), r.Dst.Addr())
+		need := recordLen(e.format, id)
+		if set < 0 || id != setID {
+			need += setHeaderLen + 3 // and padding
+		}
+		if len(msg)+need > e.maxSize && dataRecords > 0 {
+			break
+		}
+		if set < 0 || id != setID {
+			endSet()
+			set, setID = len(msg), id
+			msg = binary.BigEndian.AppendUint16(msg, id)
+			msg = append(msg, 0, 0)
+		}
+		msg = e.appendRecord(msg, id, r)
+		recs = recs[1:]
+		dataRecords++
+	}
+	endSet()
+	numRecords += dataRecords
+
+	// Header.
+	if e.format == NetFlowV9 {
+		binary.BigEndian.PutUint16(msg[0:], 9)
+		binary.BigEndian.PutUint16(msg[2:], uint16(numRecords))
+		binary.BigEndian.PutUint32(msg[4:], e.uptime(now))
+		binary.BigEndian.PutUint32(msg[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[12:], e.seq[d])
+		binary.BigEndian.PutUint32(msg[16:], uint32(d))
+		e.seq[d]++
+	} else {
+		binary.BigEndian.PutUint16(msg[0:], 10)
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[8:], e.seq[d])
+		binary.BigEndian.PutUint32(msg[12:], uint32(d))
+		e.seq[d] += uint32(dataRecords)
+	}
+	return msg, recs
+}
+
+func recordLen(f Format, id uint16) int {
+	var n int
+	for _, fl := range templateFields(f, id) {
+		n += int(fl.len)
+	}
+	return n
+}
+
+// appendAddr appends a to b. The invalid address, as of the endpoints
+// scrubbed from exit traffic, is encoded as the unspecified IPv4 address.
+func appendAddr(b []byte, a netip.Addr) []byte {
+	if !a.IsValid() {
+		a = netip.IPv4Unspecified()
+	}
+	return append(b, a.AsSlice()...)
+}
+
+// uptime returns the NetFlow v9 sysUptime of t, in milliseconds since the
+// Encoder was created. Flow times before then are clamped to zero, so an
+// Encoder should be created before the flows it exports start.
+func (e *Encoder) uptime(t time.Time) uint32 {
+	return uint32(max(t.Sub(e.boot).Milliseconds(), 0))
+}
+
+func (e *Encoder) appendRecord(b []byte, id uint16, r Record) []byte {
+	b = appendAddr(b, r.Src.Addr())
+	b = appendAddr(b, r.Dst.Addr())
+	b = append(b, uint8(r.Proto))
+	b = binary.BigEndian.AppendUint16(b, r.Src.Port())
+	b = binary.BigEndian.AppendUint16(b, r.Dst.Port())
+	b = append(b, uint8(r.Direction))
+	b = binary.BigEndian.AppendUint64(b, r.Packets)
+	b = binary.BigEndian.AppendUint64(b, r.Bytes)
+	if e.format == IPFIX {
+		b = binary.BigEndian.AppendUint64(b, uint64(r.Start.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(r.End.UnixMilli()))
+	} else {
+		b = binary.BigEndian.AppendUint32(b, e.uptime(r.Start))
+		b = binary.BigEndian.AppendUint32(b, e.uptime(r.End))
+	}
+	return b
+}
+
+// Decoder decodes IPFIX and NetFlow v9 messages. It remembers the
+// templates of each exporter's observation domains across messages.
+type Decoder struct {
+	templates map[templateKey][]field
+}
+
+type templateKey struct {
+	version uint16
+	domain  uint32
+	id      uint16
+}
+
+var errShort = errors.New("flowexport: truncated message")
+
+// Decode decodes the flow records in msg, an IPFIX or NetFlow v9 message.
+// Data sets with unknown templates are skipped, as are fields other than
+// those of Record.
+func (dec *Decoder) Decode(msg []byte) ([]Record, error) {
+	if len(msg) < 2 {
+		return nil, errShort
+	}
+	version := binary.BigEndian.Uint16(msg)
+	var (
+		headerLen     int
+		domain        uint32
+		templateSetID uint16
+		bootTime      time.Time // NetFlow v9: when sysUptime was zero
+	)
+	switch version {
+	case 10:
+		headerLen, templateSetID = ipfixHeaderLen, ipfixTemplateSetID
+		if len(msg) < headerLen {
+			return nil, errShort
+		}
+		n := int(binary.BigEndian.Uint16(msg[2:]))
+		if n > len(msg) || n < headerLen {
+			return nil, fmt.Errorf("flowexport: bad IPFIX message length %d", n)
+		}
+		msg = msg[:n]
+		domain = binary.BigEndian.Uint32(msg[12:])
+	case 9:
+		headerLen, templateSetID = netflowHeaderLen, netflowTemplateSetID
+		if len(msg) < headerLen {
+			return nil, errShort
+		}
+		uptime := time.Duration(binary.BigEndian.Uint32(msg[4:])) * time.Millisecond
+		exportTime := time.Unix(int64(binary.BigEndian.Uint32(msg[8:])), 0)
+		bootTime = exportTime.Add(-uptime)
+		domain = binary.BigEndian.Uint32(msg[16:])
+	default:
+		return nil, fmt.Errorf("flowexport: unsupported version %d", version)
+	}
+
+	var recs []Record
+	for b := msg[headerLen:]; len(b) > 0; {
+		if len(b) < setHeaderLen {
+			return recs, errShort
+		}
+		setID := binary.BigEndian.Uint16(b)
+		setLen := int(binary.BigEndian.Uint16(b[2:]))
+		if setLen < setHeaderLen || setLen > len(b) {
+			return recs, fmt.Errorf("flowexport: bad set length %d", setLen)
+		}
+		body := b[setHeaderLen:setLen]
+		b = b[setLen:]
+		switch {
+		case setID == templateSetID:
+			if err := dec.readTemplates(version, domain, body); err != nil {
+				return recs, err
+			}
+		case setID >= minDataSetID:
+			fields, ok := dec.templates[templateKey{version, domain, setID}]
+			if !ok {
+				continue
+			}
+			n := 0
+			for _, f := range fields {
+				n += int(f.len)
+			}
+			for n > 0 && len(body) >= n {
+				recs = append(recs, decodeRecord(version, Domain(domain), fields, body[:n], bootTime))
+				body = body[n:]
+			}
+		}
+	}
+	return recs, nil
+}
+
+func (dec *Decoder) readTemplates(version uint16, domain uint32, b []byte) error {
+	for len(b) >= 4 {
+		id := binary.BigEndian.Uint16(b)
+		count := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if id < minDataSetID {
+			return nil // padding
+		}
+		fields := make([]field, 0, count)
+		for range count {
+			if len(b) < 4 {
+				return errShort
+			}
+			f := field{binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:])}
+			b = b[4:]
+			if version == 10 && f.id&0x8000 != 0 {
+				// Enterprise-specific; skip the enterprise number.
+				if len(b) < 4 {
+					return errShort
+				}
+				f.id = 0
+				b = b[4:]
+			}
+			fields = append(fields, f)
+		}
+		if dec.templates == nil {
+			dec.templates = map[templateKey][]field{}
+		}
+		dec.templates[templateKey{version, domain, id}] = fields
+	}
+	return nil
+}
+
+func decodeRecord(version uint16, d Domain, fields []field, b []byte, bootTime time.Time) Record {
+	r := Record{Domain: d}
+	var srcIP, dstIP netip.Addr
+	var srcPort, dstPort uint16
+	for _, f := range fields {
+		v := b[:f.len]
+		b = b[f.len:]
+		num := func() uint64 {
+			var n uint64
+			for _, c := range v {
+				n = n<<8 | uint64(c)
+			}
+			return n
+		}
+		switch f.id {
+		case ieSourceIPv4Address, ieSourceIPv6Address:
+			srcIP, _ = netip.AddrFromSlice(v)
+		case ieDestinationIPv4Address, ieDestinationIPv6Address:
+			dstIP, _ = netip.AddrFromSlice(v)
+		case ieProtocolIdentifier:
+			r.Proto = ipproto.Proto(num())
+		case ieSourceTransportPort:
+			srcPort = uint16(num())
+		case ieDestinationTransportPort:
+			dstPort = uint16(num())
+		case ieFlowDirection:
+			r.Direction = Direction(num())
+		case iePacketDeltaCount:
+			r.Packets = num()
+		case ieOctetDeltaCount:
+			r.Bytes = num()
+		case ieFlowStartMilliseconds:
+			r.Start = time.UnixMilli(int64(num()))
+		case ieFlowEndMilliseconds:
+			r.End = time.UnixMilli(int64(num()))
+		case ieFirstSwitched:
+			if version == 9 {
+				r.Start = bootTime.Add(time.Duration(num()) * time.Millisecond)
+			}
+		case ieLastSwitched:
+			if version == 9 {
+				r.End = bootTime.Add(time.Duration(num()) * time.Millisecond)
+			}
+		}
+	}
+	r.Src = decodeAddrPort(srcIP, srcPort)
+	r.Dst = decodeAddrPort(dstIP, dstPort)
+	return r
+}
+
+// decodeAddrPort is the inverse of appendAddr and the port encoding.
+func decodeAddrPort(ip netip.Addr, port uint16) netip.AddrPort {
+	if ip == netip.IPv4Unspecified() && port == 0 {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ip, port)
+}
+
+// ParseCollector parses the address of a flow collector, in the form
+// "ipfix://host:port" or "netflow9://host:port". The port defaults to 4739
+// for IPFIX and 2055 for NetFlow v9.
+func ParseCollector(s string) (f Format, hostPort string, err error) {
+	scheme, addr, ok := strings.Cut(s, "://")
+	if !ok {
+		return 0, "", fmt.Errorf("invalid flow collector %q: want ipfix://host:port or netflow9://host:port", s)
+	}
+	var port string
+	switch scheme {
+	case "ipfix":
+		f, port = IPFIX, "4739"
+	case "netflow9":
+		f, port = NetFlowV9, "2055"
+	default:
+		return 0, "", fmt.Errorf("invalid flow collector %q: unknown format %q", s, scheme)
+	}
+	if addr == "" || strings.ContainsAny(addr, "/?#") {
+		return 0, "", fmt.Errorf("invalid flow collector %q: want a host and optional port", s)
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]") // no port, or a bare IPv6 address
+	} else if p != "" {
+		port = p
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 || host == "" {
+		return 0, "", fmt.Errorf("invalid flow collector %q: want a host and optional port", s)
+	}
+	return f, net.JoinHostPort(host, port), nil
+}
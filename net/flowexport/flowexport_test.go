@@ -0,0 +1,178 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flowexport
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+func TestRoundTrip(t *testing.T) {
+	start := time.UnixMilli(1700000000123)
+	end := start.Add(5 * time.Second)
+	cc := func(proto ipproto.Proto, src, dst string, tx, rx uint64) netlogtype.ConnectionCounts {
+		return netlogtype.ConnectionCounts{
+			Connection: netlogtype.Connection{
+				Proto: proto,
+				Src:   netip.MustParseAddrPort(src),
+				Dst:   netip.MustParseAddrPort(dst),
+			},
+			Counts: netlogtype.Counts{TxPackets: tx, TxBytes: tx * 100, RxPackets: rx, RxBytes: rx * 100},
+		}
+	}
+	msg := netlogtype.Message{
+		Start: start,
+		End:   end,
+		VirtualTraffic: []netlogtype.ConnectionCounts{
+			cc(ipproto.TCP, "100.64.0.1:1234", "100.64.0.2:22", 10, 5),
+			cc(ipproto.UDP, "[fd7a:115c:a1e0::1]:53", "[fd7a:115c:a1e0::2]:5353", 0, 3),
+		},
+		ExitTraffic: []netlogtype.ConnectionCounts{
+			// Exit traffic as scrubbed by netlog.
+			{
+				Connection: netlogtype.Connection{Src: netip.AddrPortFrom(netip.MustParseAddr("100.64.0.1"), 0)},
+				Counts:     netlogtype.Counts{TxPackets: 3, TxBytes: 300},
+			},
+		},
+		SubnetTraffic: []netlogtype.ConnectionCounts{
+			cc(ipproto.TCP, "100.64.0.1:1234", "10.0.0.1:80", 7, 0),
+		},
+		PhysicalTraffic: []netlogtype.ConnectionCounts{
+			{
+				Connection: netlogtype.Connection{
+					Src: netip.AddrPortFrom(netip.MustParseAddr("100.64.0.2"), 0),
+					Dst: netip.MustParseAddrPort("[2001:db8::1]:41641"),
+				},
+				Counts: netlogtype.Counts{TxPackets: 1, TxBytes: 120, RxPackets: 2, RxBytes: 240},
+			},
+		},
+	}
+	// Lots of exit traffic, to be split across messages.
+	for i := range 100 {
+		msg.ExitTraffic = append(msg.ExitTraffic, cc(ipproto.TCP, "100.64.0.1:1234", fmt.Sprintf("192.0.2.%d:443", i), uint64(i+1), uint64(i+1)))
+	}
+
+	for _, format := range []Format{IPFIX, NetFlowV9} {
+		t.Run(format.String(), func(t *testing.T) {
+			enc := NewEncoder(format)
+			enc.boot = start.Add(-time.Hour)
+			msgs := enc.Encode(end.Add(time.Second), Records(&msg))
+			if len(msgs) < 5 {
+				t.Errorf("got %d messages, want the exit traffic split over several", len(msgs))
+			}
+			var dec Decoder
+			var recs []Record
+			for _, m := range msgs {
+				if len(m) > MaxMessageSize {
+					t.Errorf("message of %d bytes, want at most %d", len(m), MaxMessageSize)
+				}
+				r, err := dec.Decode(m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				recs = append(recs, r...)
+			}
+			got := Messages(recs)
+			want := msg
+			if format == NetFlowV9 {
+				// Flow times are relative to the export time, in seconds.
+				want.Start = want.Start.Truncate(time.Second)
+				want.End = want.End.Truncate(time.Second)
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d messages, want 1", len(got))
+			}
+			if diff := cmp.Diff(want, got[0], cmpopts.EquateComparable(netip.AddrPort{})); diff != "" {
+				t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	recs := []Record{
+		{Domain: VirtualTraffic, Src: netip.MustParseAddrPort("100.64.0.1:1"), Dst: netip.MustParseAddrPort("100.64.0.2:2"), Packets: 1},
+		{Domain: VirtualTraffic, Src: netip.MustParseAddrPort("100.64.0.1:1"), Dst: netip.MustParseAddrPort("100.64.0.2:3"), Packets: 1},
+		{Domain: ExitTraffic, Src: netip.MustParseAddrPort("100.64.0.1:1"), Dst: netip.MustParseAddrPort("192.0.2.1:4"), Packets: 1},
+	}
+	now := time.Now()
+
+	ipfix := NewEncoder(IPFIX)
+	ipfix.Encode(now, recs)
+	ipfix.Encode(now, recs)
+	if got, want := ipfix.seq[VirtualTraffic], uint32(4); got != want {
+		t.Errorf("IPFIX virtual traffic sequence = %d, want %d data records", got, want)
+	}
+	if got, want := ipfix.seq[ExitTraffic], uint32(2); got != want {
+		t.Errorf("IPFIX exit traffic sequence = %d, want %d data records", got, want)
+	}
+
+	nf := NewEncoder(NetFlowV9)
+	nf.Encode(now, recs)
+	nf.Encode(now, recs)
+	if got, want := nf.seq[VirtualTraffic], uint32(2); got != want {
+		t.Errorf("NetFlow v9 virtual traffic sequence = %d, want %d messages", got, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	enc := NewEncoder(IPFIX)
+	msgs := enc.Encode(time.Now(), []Record{
+		{Domain: VirtualTraffic, Src: netip.MustParseAddrPort("100.64.0.1:1"), Dst: netip.MustParseAddrPort("100.64.0.2:2"), Packets: 1},
+	})
+	m := msgs[0]
+	var dec Decoder
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty", nil},
+		{"version", []byte{0, 5, 0, 0}},
+		{"short header", m[:10]},
+		{"bad length", append([]byte{0, 10, 0xff, 0xff}, m[4:]...)},
+		{"short set", m[:ipfixHeaderLen+2]},
+	} {
+		if _, err := dec.Decode(tt.msg); err == nil {
+			t.Errorf("%s: Decode succeeded, want error", tt.name)
+		}
+	}
+}
+
+func TestParseCollector(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		format   Format
+		hostPort string
+		wantErr  bool
+	}{
+		{in: "ipfix://collector.example:4740", format: IPFIX, hostPort: "collector.example:4740"},
+		{in: "ipfix://10.0.0.1", format: IPFIX, hostPort: "10.0.0.1:4739"},
+		{in: "netflow9://10.0.0.1", format: NetFlowV9, hostPort: "10.0.0.1:2055"},
+		{in: "netflow9://[fd00::1]:9995", format: NetFlowV9, hostPort: "[fd00::1]:9995"},
+		{in: "ipfix://fd00::1", format: IPFIX, hostPort: "[fd00::1]:4739"},
+		{in: "10.0.0.1:4739", wantErr: true},
+		{in: "sflow://10.0.0.1", wantErr: true},
+		{in: "ipfix://", wantErr: true},
+		{in: "ipfix://10.0.0.1:99999", wantErr: true},
+		{in: "ipfix://10.0.0.1/path", wantErr: true},
+	} {
+		f, hostPort, err := ParseCollector(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseCollector(%q) = %v, %q; want error", tt.in, f, hostPort)
+			}
+			continue
+		}
+		if err != nil || f != tt.format || hostPort != tt.hostPort {
+			t.Errorf("ParseCollector(%q) = %v, %q, %v; want %v, %q", tt.in, f, hostPort, err, tt.format, tt.hostPort)
+		}
+	}
+}
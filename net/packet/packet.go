@@ -40,6 +40,7 @@ type CaptureMeta struct {
 	OriginalSrc netip.AddrPort // The source address before SNAT was performed.
 	DidDNAT     bool           // DNAT was performed & the address was updated.
 	OriginalDst netip.AddrPort // The destination address before DNAT was performed.
+	DropReason  string         // Why the packet was dropped, for packets captured as dropped.
 }
 
 // Parsed is a minimal decoding of a packet suitable for use in filters.
@@ -0,0 +1,354 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tstun
+
+import (
+	"bytes"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+// ShapeLimits are the limits on the rate of traffic to and from a peer.
+type ShapeLimits struct {
+	// In and Out are the rates, in bits per second, of the traffic from
+	// and to the peer. Zero means unlimited.
+	In, Out int64
+}
+
+// Token buckets hold enough tokens for a burst of shapeBurstDuration of
+// traffic at their rate, and packets that arrive when a bucket is empty are
+// queued for up to shapeQueueDuration, after which they're dropped. Both
+// are at least shapeMinBytes, so that even very low rates let the largest
+// packets through.
+const (
+	shapeBurstDuration = 100 * time.Millisecond
+	shapeQueueDuration = 250 * time.Millisecond
+	shapeMinBytes      = 64 << 10
+)
+
+// shapeVerdict is what a shaper decided to do with a packet.
+type shapeVerdict int
+
+const (
+	shapePass    shapeVerdict = iota // send the packet now
+	shapeDelayed                     // the packet was queued, to be sent later
+	shapeDrop                        // the queue is full; drop the packet
+)
+
+// shaper is a token bucket with a queue, limiting the rate of traffic in
+// one direction to or from a peer.
+type shaper struct {
+	bytesPerSec float64
+	burst       float64 // bucket size, in bytes
+	maxQueued   int     // in bytes
+	queuedGauge *clientmetric.Metric
+	release     func([]byte) // sends a queued packet
+
+	mu     sync.Mutex
+	tokens float64   // in bytes
+	last   time.Time // when tokens was last refilled
+	queue  [][]byte  // packets waiting for tokens, oldest first
+	queued int       // total bytes in queue
+	timer  *time.Timer
+	closed bool
+}
+
+func newShaper(bitsPerSec int64, queuedGauge *clientmetric.Metric, release func([]byte)) *shaper {
+	bytesPerSec := float64(bitsPerSec) / 8
+	burst := max(bytesPerSec*shapeBurstDuration.Seconds(), shapeMinBytes)
+	return &shaper{
+		bytesPerSec: bytesPerSec,
+		burst:       burst,
+		maxQueued:   int(max(bytesPerSec*shapeQueueDuration.Seconds(), shapeMinBytes)),
+		queuedGauge: queuedGauge,
+		release:     release,
+		tokens:      burst,
+	}
+}
+
+// refillLocked adds the tokens accumulated since s.last.
+func (s *shaper) refillLocked(now time.Time) {
+	if !s.last.IsZero() {
+		s.tokens = min(s.burst, s.tokens+now.Sub(s.last).Seconds()*s.bytesPerSec)
+	}
+	s.last = now
+}
+
+// admit decides whether pkt can be sent at now. If it's delayed, a copy of
+// pkt is queued, and passed to s.release once there are enough tokens.
+func (s *shaper) admit(now time.Time, pkt []byte) shapeVerdict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return shapePass
+	}
+	s.refillLocked(now)
+	if len(s.queue) == 0 && s.tokens >= float64(len(pkt)) {
+		s.tokens -= float64(len(pkt))
+		return shapePass
+	}
+	if s.queued+len(pkt) > s.maxQueued {
+		return shapeDrop
+	}
+	s.queue = append(s.queue, bytes.Clone(pkt))
+	s.queued += len(pkt)
+	s.queuedGauge.Add(int64(len(pkt)))
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.waitLocked(), s.flush)
+	}
+	return shapeDelayed
+}
+
+// waitLocked returns how long until there are enough tokens to send the
+// packet at the head of the queue.
+func (s *shaper) waitLocked() time.Duration {
+	need := float64(len(s.queue[0])) - s.tokens
+	if need <= 0 {
+		return 0
+	}
+	return time.Duration(need / s.bytesPerSec * float64(time.Second))
+}
+
+// dequeue removes and returns the queued packets that can be sent at now.
+// If packets remain queued, it also returns how long until the next one can
+// be sent.
+func (s *shaper) dequeue(now time.Time) (pkts [][]byte, wait time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refillLocked(now)
+	for len(s.queue) > 0 && s.tokens >= float64(len(s.queue[0])) {
+		pkt := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.queued -= len(pkt)
+		s.queuedGauge.Add(-int64(len(pkt)))
+		s.tokens -= float64(len(pkt))
+		pkts = append(pkts, pkt)
+	}
+	if len(s.queue) > 0 {
+		wait = s.waitLocked()
+	}
+	return pkts, wait
+}
+
+// flush sends the queued packets that have enough tokens, and reschedules
+// itself if any remain.
+func (s *shaper) flush() {
+	pkts, wait := s.dequeue(time.Now())
+	for _, pkt := range pkts {
+		s.release(pkt)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) > 0 && !s.closed {
+		s.timer.Reset(max(wait, time.Millisecond))
+	} else {
+		s.timer = nil
+	}
+}
+
+// close stops s and drops its queued packets. Packets admitted after it's
+// closed pass unshaped.
+func (s *shaper) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.queuedGauge.Add(-int64(s.queued))
+	s.queue, s.queued = nil, 0
+}
+
+// peerShapers are the shapers of the traffic to and from a peer. Either may
+// be nil if that direction is unlimited.
+type peerShapers struct {
+	limits ShapeLimits
+	in     *shaper
+	out    *shaper
+}
+
+func (ps *peerShapers) close() {
+	if ps.in != nil {
+		ps.in.close()
+	}
+	if ps.out != nil {
+		ps.out.close()
+	}
+}
+
+// shapeState is the traffic shaping configuration of a Wrapper.
+type shapeState struct {
+	limits map[key.NodePublic]ShapeLimits
+	peers  []wgcfg.Peer                    // from the last SetWGConfig
+	byKey  map[key.NodePublic]*peerShapers // reused while limits are unchanged
+	byIP   *bart.Table[*peerShapers]       // by peer AllowedIPs, or nil if no limits
+}
+
+// SetShaping sets the limits on the rate of traffic to and from peers,
+// keyed by node key. Peers without limits are not shaped. Traffic to and
+// from netstack is shaped, but other traffic that tailscaled injects, such
+// as TSMP, is not.
+//
+// Traffic is assigned to a peer by its AllowedIPs: the destination address
+// of outbound packets and the source address of inbound packets. Packets
+// that exceed a limit are queued briefly, then dropped.
+func (t *Wrapper) SetShaping(limits map[key.NodePublic]ShapeLimits) {
+	t.shapeMu.Lock()
+	defer t.shapeMu.Unlock()
+	if maps.Equal(limits, t.shape.limits) {
+		return
+	}
+	t.shape.limits = maps.Clone(limits)
+	t.updateShapingLocked()
+}
+
+// setShapingPeers records the peers in wcfg, for assigning traffic to
+// them.
+func (t *Wrapper) setShapingPeers(wcfg *wgcfg.Config) {
+	t.shapeMu.Lock()
+	defer t.shapeMu.Unlock()
+	if wcfg == nil {
+		t.shape.peers = nil
+	} else {
+		t.shape.peers = wcfg.Peers
+	}
+	if len(t.shape.limits) > 0 || t.shape.byIP != nil {
+		t.updateShapingLocked()
+	}
+}
+
+// updateShapingLocked rebuilds the table of peer shapers, reusing those
+// whose limits are unchanged.
+//
+// t.shapeMu must be held.
+func (t *Wrapper) updateShapingLocked() {
+	byKey := map[key.NodePublic]*peerShapers{}
+	var byIP *bart.Table[*peerShapers]
+	for _, p := range t.shape.peers {
+		lim, ok := t.shape.limits[p.PublicKey]
+		if !ok || lim == (ShapeLimits{}) {
+			continue
+		}
+		ps := t.shape.byKey[p.PublicKey]
+		if ps == nil || ps.limits != lim {
+			ps = t.newPeerShapers(lim)
+		}
+		byKey[p.PublicKey] = ps
+		if byIP == nil {
+			byIP = new(bart.Table[*peerShapers])
+		}
+		for _, pfx := range p.AllowedIPs {
+			byIP.Insert(pfx, ps)
+		}
+	}
+	for k, ps := range t.shape.byKey {
+		if byKey[k] != ps {
+			ps.close()
+		}
+	}
+	t.shape.byKey = byKey
+	t.shape.byIP = byIP
+	t.shapeTable.Store(byIP)
+}
+
+func (t *Wrapper) newPeerShapers(lim ShapeLimits) *peerShapers {
+	ps := &peerShapers{limits: lim}
+	if lim.In > 0 {
+		ps.in = newShaper(lim.In, metricShapeInQueuedBytes, func(pkt []byte) {
+			if err := t.deliverShapedInbound(pkt); err != nil {
+				metricShapeInDrop.Add(1)
+			}
+		})
+	}
+	if lim.Out > 0 {
+		ps.out = newShaper(lim.Out, metricShapeOutQueuedBytes, func(pkt []byte) {
+			if err := t.InjectOutbound(pkt); err != nil {
+				metricShapeOutDrop.Add(1)
+			}
+		})
+	}
+	return ps
+}
+
+// deliverShapedInbound delivers pkt, an inbound packet that was queued by a
+// shaper, the way Write would have if it hadn't been: to the PostFilter hook,
+// which is netstack's, and to the tun device if the hook doesn't take it.
+func (t *Wrapper) deliverShapedInbound(pkt []byte) error {
+	buf := make([]byte, PacketStartOffset+len(pkt))
+	copy(buf[PacketStartOffset:], pkt)
+	if t.PostFilterPacketInboundFromWireGuard != nil {
+		p := parsedPacketPool.Get().(*packet.Parsed)
+		defer parsedPacketPool.Put(p)
+		p.Decode(buf[PacketStartOffset:])
+		if res := t.PostFilterPacketInboundFromWireGuard(p, t); res.IsDrop() {
+			return nil
+		}
+	}
+	t.noteActivity()
+	_, err := t.tdevWrite([][]byte{buf}, PacketStartOffset)
+	return err
+}
+
+// shapeInbound reports what to do with p, a packet from a peer that passed
+// the packet filter.
+func (t *Wrapper) shapeInbound(table *bart.Table[*peerShapers], p *packet.Parsed) shapeVerdict {
+	ps, ok := table.Lookup(p.Src.Addr())
+	if !ok || ps.in == nil {
+		return shapePass
+	}
+	v := ps.in.admit(t.now(), p.Buffer())
+	switch v {
+	case shapeDelayed:
+		metricShapeInDelayed.Add(1)
+	case shapeDrop:
+		metricShapeInDrop.Add(1)
+	}
+	return v
+}
+
+// shapeOutbound reports what to do with p, a packet to a peer that passed
+// the packet filter, before SNAT.
+func (t *Wrapper) shapeOutbound(table *bart.Table[*peerShapers], p *packet.Parsed) shapeVerdict {
+	ps, ok := table.Lookup(p.Dst.Addr())
+	if !ok || ps.out == nil {
+		return shapePass
+	}
+	v := ps.out.admit(t.now(), p.Buffer())
+	switch v {
+	case shapeDelayed:
+		metricShapeOutDelayed.Add(1)
+	case shapeDrop:
+		metricShapeOutDrop.Add(1)
+	}
+	return v
+}
+
+// shapeOutboundPacketBuffer reports what to do with pkt, a packet from
+// netstack to a peer. Delayed packets are injected with InjectOutbound.
+func (t *Wrapper) shapeOutboundPacketBuffer(table *bart.Table[*peerShapers], pkt *stack.PacketBuffer) shapeVerdict {
+	b := pkt.ToBuffer()
+	p := parsedPacketPool.Get().(*packet.Parsed)
+	defer parsedPacketPool.Put(p)
+	p.Decode(b.Flatten())
+	return t.shapeOutbound(table, p)
+}
+
+var (
+	metricShapeInDelayed      = clientmetric.NewCounter("tstun_shape_in_delayed")
+	metricShapeInDrop         = clientmetric.NewCounter("tstun_shape_in_drop")
+	metricShapeInQueuedBytes  = clientmetric.NewGauge("tstun_shape_in_queued_bytes")
+	metricShapeOutDelayed     = clientmetric.NewCounter("tstun_shape_out_delayed")
+	metricShapeOutDrop        = clientmetric.NewCounter("tstun_shape_out_drop")
+	metricShapeOutQueuedBytes = clientmetric.NewGauge("tstun_shape_out_queued_bytes")
+)
@@ -195,6 +195,13 @@ type Wrapper struct {
 	stats atomic.Pointer[connstats.Statistics]
 
 	captureHook syncs.AtomicValue[capture.Callback]
+
+	// shapeMu guards shape, the traffic shaping configuration.
+	shapeMu sync.Mutex
+	shape   shapeState
+	// shapeTable is the peer shapers by address, or nil if no traffic is
+	// shaped.
+	shapeTable atomic.Pointer[bart.Table[*peerShapers]]
 }
 
 // tunInjectedRead is an injected packet pretending to be a tun.Read().
@@ -329,6 +336,7 @@ func (t *Wrapper) Close() error {
 			close(t.startCh)
 		}
 		close(t.closed)
+		t.SetShaping(nil)
 		t.bufferConsumedMu.Lock()
 		t.bufferConsumedClosed = true
 		close(t.bufferConsumed)
@@ -791,6 +799,7 @@ func (t *Wrapper) SetWGConfig(wcfg *wgcfg.Config) {
 	if !reflect.DeepEqual(old, cfg) {
 		t.logf("peer config: %v", cfg)
 	}
+	t.setShapingPeers(wcfg)
 }
 
 var (
@@ -910,6 +919,7 @@ func (t *Wrapper) Read(buffs [][]byte, sizes []int, offset int) (int, error) {
 	defer parsedPacketPool.Put(p)
 	captHook := t.captureHook.Load()
 	pc := t.peerConfig.Load()
+	shapes := t.shapeTable.Load()
 	for _, data := range res.data {
 		p.Decode(data[res.dataOffset:])
 
@@ -927,6 +937,10 @@ func (t *Wrapper) Read(buffs [][]byte, sizes []int, offset int) (int, error) {
 				metricPacketOutDrop.Add(1)
 				continue
 			}
+			if shapes != nil && t.shapeOutbound(shapes, p) != shapePass {
+				// Queued to be injected later, or dropped.
+				continue
+			}
 		}
 
 		// Make sure to do SNAT after filtering, so that any flow tracking in
@@ -1056,12 +1070,23 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 
 	if outcome != filter.Accept {
 		metricPacketInDropFilter.Add(1)
+		if outcome == filter.DropRateLimited {
+			metricPacketInDropRateLimited.Add(1)
+			if captHook != nil {
+				meta := p.CaptureMeta
+				meta.DropReason = outcome.String()
+				captHook(capture.DroppedFromPeer, t.now(), p.Buffer(), meta)
+			}
+		}
 
 		// Tell them, via TSMP, we're dropping them due to the ACL.
 		// Their host networking stack can translate this into ICMP
 		// or whatnot as required. But notably, their GUI or tailscale CLI
 		// can show them a rejection history with reasons.
-		if p.IPVersion == 4 && p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSyn != 0 && !t.disableTSMPRejected {
+		//
+		// Rate limited connections aren't rejected by the ACL, so their
+		// SYNs are dropped silently and retried.
+		if outcome != filter.DropRateLimited && p.IPVersion == 4 && p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSyn != 0 && !t.disableTSMPRejected {
 			rj := packet.TailscaleRejectedHeader{
 				IPSrc:  p.Dst.Addr(),
 				IPDst:  p.Src.Addr(),
@@ -1082,6 +1107,13 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 		return filter.Drop
 	}
 
+	// Shape before the PostFilter hook, so that traffic netstack handles
+	// is shaped too.
+	if shapes := t.shapeTable.Load(); shapes != nil && t.shapeInbound(shapes, p) != shapePass {
+		// Queued to be delivered later, or dropped.
+		return filter.DropSilently
+	}
+
 	if t.PostFilterPacketInboundFromWireGuard != nil {
 		if res := t.PostFilterPacketInboundFromWireGuard(p, t); res.IsDrop() {
 			return res
@@ -1282,6 +1314,11 @@ func (t *Wrapper) InjectOutboundPacketBuffer(pkt *stack.PacketBuffer) error {
 		b := pkt.ToBuffer()
 		capt(capture.SynthesizedToPeer, t.now(), b.Flatten(), packet.CaptureMeta{})
 	}
+	if shapes := t.shapeTable.Load(); shapes != nil && t.shapeOutboundPacketBuffer(shapes, pkt) != shapePass {
+		// Queued to be injected later, or dropped.
+		pkt.DecRef()
+		return nil
+	}
 
 	t.injectOutbound(tunInjectedRead{packet: pkt})
 	return nil
@@ -1303,10 +1340,11 @@ func (t *Wrapper) SetStatistics(stats *connstats.Statistics) {
 }
 
 var (
-	metricPacketIn              = clientmetric.NewCounter("tstun_in_from_wg")
-	metricPacketInDrop          = clientmetric.NewCounter("tstun_in_from_wg_drop")
-	metricPacketInDropFilter    = clientmetric.NewCounter("tstun_in_from_wg_drop_filter")
-	metricPacketInDropSelfDisco = clientmetric.NewCounter("tstun_in_from_wg_drop_self_disco")
+	metricPacketIn                = clientmetric.NewCounter("tstun_in_from_wg")
+	metricPacketInDrop            = clientmetric.NewCounter("tstun_in_from_wg_drop")
+	metricPacketInDropFilter      = clientmetric.NewCounter("tstun_in_from_wg_drop_filter")
+	metricPacketInDropSelfDisco   = clientmetric.NewCounter("tstun_in_from_wg_drop_self_disco")
+	metricPacketInDropRateLimited = clientmetric.NewCounter("tstun_in_from_wg_drop_rate_limited")
 
 	metricPacketOut              = clientmetric.NewCounter("tstun_out_to_wg")
 	metricPacketOutDrop          = clientmetric.NewCounter("tstun_out_to_wg_drop")
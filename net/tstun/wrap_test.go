@@ -919,3 +919,160 @@ type captureRecord struct {
 			captured, want)
 	}
 }
+
+func TestShaper(t *testing.T) {
+	var released [][]byte
+	s := newShaper(8*100_000, metricShapeInQueuedBytes, func(pkt []byte) {
+		released = append(released, pkt)
+	})
+	defer s.close()
+	now := time.Unix(1e9, 0)
+	pkt := make([]byte, 1024)
+
+	// The burst, and then the queue, are shapeMinBytes at this rate.
+	const n = shapeMinBytes / 1024
+	counts := map[shapeVerdict]int{}
+	for range 3 * n {
+		counts[s.admit(now, pkt)]++
+	}
+	if want := (map[shapeVerdict]int{shapePass: n, shapeDelayed: n, shapeDrop: n}); !reflect.DeepEqual(counts, want) {
+		t.Errorf("verdicts = %v; want %v", counts, want)
+	}
+
+	// 15ms of tokens are enough for one queued packet, and the next needs
+	// another 548 bytes' worth.
+	pkts, wait := s.dequeue(now.Add(15 * time.Millisecond))
+	if len(pkts) != 1 {
+		t.Errorf("dequeued %d packets; want 1", len(pkts))
+	}
+	if want := 5480 * time.Microsecond; wait < want-time.Microsecond || wait > want+time.Microsecond {
+		t.Errorf("wait = %v; want %v", wait, want)
+	}
+	// Queued packets are sent before new ones.
+	if v := s.admit(now.Add(time.Second), pkt); v != shapeDelayed {
+		t.Errorf("admit with a queue = %v; want delayed", v)
+	}
+}
+
+func TestShaping(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	peer := key.NewNode().Public()
+	tun.SetWGConfig(&wgcfg.Config{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("1.2.3.4/32")},
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peer,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("5.6.7.8/32")},
+		}},
+	})
+	tun.SetShaping(map[key.NodePublic]ShapeLimits{peer: {In: 8 * 1000}})
+	ps, ok := tun.shapeTable.Load().Lookup(netip.MustParseAddr("5.6.7.8"))
+	if !ok || ps.in == nil || ps.out != nil {
+		t.Fatalf("peer shapers = %+v, %v; want inbound shaper", ps, ok)
+	}
+
+	// Empty the bucket, so that the next packet is queued and written
+	// once there are enough tokens.
+	ps.in.mu.Lock()
+	ps.in.tokens = 0
+	ps.in.last = time.Now()
+	ps.in.mu.Unlock()
+	pkt := udp4("5.6.7.8", "1.2.3.4", 89, 89)
+	n, err := tun.Write([][]byte{pkt}, 0)
+	if err != nil || n != 0 {
+		t.Fatalf("Write = %v, %v; want 0 packets written now", n, err)
+	}
+	select {
+	case got := <-chtun.Inbound:
+		if !bytes.Equal(got, pkt) {
+			t.Errorf("got packet %x; want %x", got, pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for queued packet")
+	}
+
+	// Removing the limit stops shaping.
+	tun.SetShaping(nil)
+	if tun.shapeTable.Load() != nil {
+		t.Error("shaping table still set after removing limits")
+	}
+}
+
+func TestShapingNetstack(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	// Netstack takes inbound packets in the PostFilter hook.
+	fromPeer := make(chan []byte, 1)
+	tun.PostFilterPacketInboundFromWireGuard = func(p *packet.Parsed, _ *Wrapper) filter.Response {
+		fromPeer <- bytes.Clone(p.Buffer())
+		return filter.DropSilently
+	}
+
+	peer := key.NewNode().Public()
+	tun.SetWGConfig(&wgcfg.Config{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("1.2.3.4/32")},
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peer,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("5.6.7.8/32")},
+		}},
+	})
+	tun.SetShaping(map[key.NodePublic]ShapeLimits{peer: {In: 8 * 1000, Out: 8 * 1000}})
+	ps, ok := tun.shapeTable.Load().Lookup(netip.MustParseAddr("5.6.7.8"))
+	if !ok {
+		t.Fatal("no shapers for peer")
+	}
+	// Empty a shaper's bucket, so that the next packet is queued.
+	drain := func(s *shaper) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.tokens = 0
+		s.last = time.Now()
+	}
+
+	// An inbound packet is queued, and then delivered to netstack rather
+	// than to the tun device.
+	in := udp4("5.6.7.8", "1.2.3.4", 89, 89)
+	drain(ps.in)
+	if n, err := tun.Write([][]byte{in}, 0); err != nil || n != 0 {
+		t.Fatalf("Write = %v, %v; want 0 packets written now", n, err)
+	}
+	select {
+	case got := <-fromPeer:
+		if !bytes.Equal(got, in) {
+			t.Errorf("netstack got %x; want %x", got, in)
+		}
+	case <-chtun.Inbound:
+		t.Fatal("queued netstack packet written to tun device")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for queued inbound packet")
+	}
+
+	// An outbound packet from netstack is queued, and then sent.
+	out := udp4("1.2.3.4", "5.6.7.8", 89, 89)
+	delayed := metricShapeOutDelayed.Value()
+	drain(ps.out)
+	tun.InjectOutboundPacketBuffer(stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(bytes.Clone(out)),
+	}))
+	if got := metricShapeOutDelayed.Value() - delayed; got != 1 {
+		t.Errorf("delayed outbound packets = %d; want 1", got)
+	}
+	sent := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		sizes := make([]int, 1)
+		if n, err := tun.Read([][]byte{buf}, sizes, 0); err == nil && n == 1 {
+			sent <- buf[:sizes[0]]
+		}
+	}()
+	select {
+	case got := <-sent:
+		if !bytes.Equal(got, out) {
+			t.Errorf("sent %x; want %x", got, out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for queued outbound packet")
+	}
+}
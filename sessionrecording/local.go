@@ -0,0 +1,394 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package sessionrecording stores SSH session recordings on local disk, in
+// the asciicast v2 format, and reads them back.
+package sessionrecording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/set"
+)
+
+// Modes of recording SSH sessions locally, for LocalPolicy.Mode.
+const (
+	ModeOff      = ipn.SSHRecordingOff
+	ModeFallback = ipn.SSHRecordingFallback
+	ModeAlways   = ipn.SSHRecordingAlways
+)
+
+// LocalPolicy says when SSH sessions are recorded to local disk, and how
+// many recordings are kept. It is set by ipn.Prefs.SSHRecordingPolicy.
+type LocalPolicy = ipn.SSHRecordingPolicy
+
+// maxAge returns p.MaxAge as a duration, or zero if there is no limit.
+func maxAge(p LocalPolicy) time.Duration {
+	d, _ := time.ParseDuration(p.MaxAge)
+	return d
+}
+
+// Dir returns the directory holding the local recordings of the tailscaled
+// with the state directory varRoot.
+func Dir(varRoot string) string {
+	return filepath.Join(varRoot, "ssh-sessions")
+}
+
+const (
+	filePrefix = "ssh-session-"
+	fileSuffix = ".cast"
+	partSep    = "-part" // between a recording's name and its part number
+)
+
+// active holds the paths of the recording files being written by Writers in
+// this process. prune never removes them.
+var (
+	activeMu sync.Mutex
+	active   set.Set[string]
+)
+
+func setActive(path string, on bool) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if on {
+		if active == nil {
+			active = set.Set[string]{}
+		}
+		active.Add(path)
+	} else {
+		active.Delete(path)
+	}
+}
+
+func isActive(path string) bool {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	return active.Contains(path)
+}
+
+// Writer writes a session recording to files in a directory, starting a new
+// file when the current one reaches LocalPolicy.MaxFileSize.
+//
+// The first line written must be the asciicast header, and each later write
+// must be one complete event line.
+type Writer struct {
+	dir    string
+	policy LocalPolicy
+	name   string // file name of the first part, without the suffix
+	now    func() time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64  // bytes written to f
+	part   int    // number of the part being written, from 1
+	header []byte // the header line, once written
+	offset float64
+	last   float64 // time of the last event, in seconds since the start
+}
+
+// NewWriter starts a recording in dir, which is created if needed, and
+// removes old recordings as policy says.
+func NewWriter(dir string, policy LocalPolicy, start time.Time) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, fmt.Sprintf("%s%v-*%s", filePrefix, start.UnixNano(), fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		dir:    dir,
+		policy: policy,
+		name:   strings.TrimSuffix(filepath.Base(f.Name()), fileSuffix),
+		now:    time.Now,
+		f:      f,
+		part:   1,
+	}
+	setActive(f.Name(), true)
+	w.prune()
+	return w, nil
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.header == nil {
+		w.header = bytes.Clone(p)
+	} else {
+		if t, ok := eventTime(p); ok {
+			w.last = t
+		}
+		if w.policy.MaxFileSize > 0 && w.size+int64(len(p)) > w.policy.MaxFileSize && w.size > int64(len(w.header)) {
+			if err := w.rotateLocked(); err != nil {
+				return 0, err
+			}
+		}
+		if w.offset > 0 {
+			p = shiftEvent(p, w.offset)
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotateLocked closes the current file, and starts the next part of the
+// recording in a new file, with a header whose timestamp is the start of
+// the part. Event times in the new part are relative to its start.
+func (w *Writer) rotateLocked() error {
+	setActive(w.f.Name(), false)
+	if err := w.f.Close(); err != nil {
+		w.f = nil
+		return err
+	}
+	w.part++
+	f, err := os.OpenFile(filepath.Join(w.dir, fmt.Sprintf("%s%s%d%s", w.name, partSep, w.part, fileSuffix)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		w.f = nil
+		return err
+	}
+	setActive(f.Name(), true)
+	w.f, w.size, w.offset = f, 0, w.last
+
+	header := w.header
+	var h map[string]any
+	if json.Unmarshal(w.header, &h) == nil {
+		if ts, ok := h["timestamp"].(float64); ok {
+			h["timestamp"] = int64(ts) + int64(w.offset)
+		}
+		if j, err := json.Marshal(h); err == nil {
+			header = append(j, '\n')
+		}
+	}
+	n, err := w.f.Write(header)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	go w.prune()
+	return nil
+}
+
+// Close implements io.Closer.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	setActive(w.f.Name(), false)
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// prune removes the recordings that are older than the policy's MaxAge, and
+// the oldest recordings while they take more than its MaxTotalSize. It never
+// removes the files being written, by w or by other Writers.
+func (w *Writer) prune() {
+	maxAge := maxAge(w.policy)
+	if maxAge == 0 && w.policy.MaxTotalSize == 0 {
+		return
+	}
+	infos, err := List(w.dir)
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, info := range infos {
+		total += info.Size
+	}
+	now := w.now()
+	for _, info := range infos { // oldest first
+		path := filepath.Join(w.dir, info.ID+fileSuffix)
+		if isActive(path) {
+			continue
+		}
+		old := maxAge > 0 && now.Sub(info.Start) > maxAge
+		if !old && (w.policy.MaxTotalSize == 0 || total <= w.policy.MaxTotalSize) {
+			continue
+		}
+		if os.Remove(path) == nil {
+			total -= info.Size
+		}
+	}
+}
+
+// eventTime returns the time of the asciicast event line p.
+func eventTime(p []byte) (float64, bool) {
+	var ev []json.RawMessage
+	if json.Unmarshal(p, &ev) != nil || len(ev) == 0 {
+		return 0, false
+	}
+	var t float64
+	if json.Unmarshal(ev[0], &t) != nil {
+		return 0, false
+	}
+	return t, true
+}
+
+// shiftEvent returns the asciicast event line p with offset seconds
+// subtracted from its time.
+func shiftEvent(p []byte, offset float64) []byte {
+	var ev []json.RawMessage
+	if json.Unmarshal(p, &ev) != nil || len(ev) == 0 {
+		return p
+	}
+	var t float64
+	if json.Unmarshal(ev[0], &t) != nil {
+		return p
+	}
+	ev[0], _ = json.Marshal(max(t-offset, 0))
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return p
+	}
+	return append(j, '\n')
+}
+
+// Info describes a local recording.
+type Info struct {
+	// ID identifies the recording. It is its file name, without the
+	// ".cast" suffix.
+	ID string
+
+	// Part is the part of the session the recording is of, starting at 1.
+	// Long sessions are split into several parts if the policy has a
+	// MaxFileSize.
+	Part int
+
+	Start    time.Time
+	Duration time.Duration // until the last event
+	Size     int64
+
+	// The following are from the recording's header.
+	SSHUser     string
+	LocalUser   string
+	SrcNode     string
+	SrcNodeUser string   `json:",omitempty"`
+	SrcNodeTags []string `json:",omitempty"`
+	Command     string   `json:",omitempty"`
+
+	// OriginalCommand is the command the client requested, if the SSH
+	// policy forced Command to run instead.
+	OriginalCommand string `json:",omitempty"`
+}
+
+// header is the part of the asciicast header used for Info.
+type header struct {
+	Version     int      `json:"version"`
+	Timestamp   int64    `json:"timestamp"`
+	Command     string   `json:"command"`
+	OrigCommand string   `json:"originalCommand"`
+	SrcNode     string   `json:"srcNode"`
+	SrcNodeUser string   `json:"srcNodeUser"`
+	SrcNodeTags []string `json:"srcNodeTags"`
+	SSHUser     string   `json:"sshUser"`
+	LocalUser   string   `json:"localUser"`
+}
+
+// List returns the recordings in dir, oldest first. A missing dir has no
+// recordings.
+func List(dir string) ([]Info, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var infos []Info
+	for _, de := range des {
+		name := de.Name()
+		if !de.Type().IsRegular() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		info, err := readInfo(filepath.Join(dir, name))
+		if err != nil {
+			continue // being written, or not a recording
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b Info) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return infos, nil
+}
+
+func readInfo(path string) (Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return Info{}, err
+	}
+	id := strings.TrimSuffix(filepath.Base(path), fileSuffix)
+	info := Info{ID: id, Part: 1, Size: fi.Size()}
+	if i := strings.LastIndex(id, partSep); i > 0 {
+		fmt.Sscanf(id[i+len(partSep):], "%d", &info.Part)
+	}
+
+	br := bufio.NewReader(f)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return Info{}, err
+	}
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil || h.Version != 2 {
+		return Info{}, fmt.Errorf("%s is not an asciicast v2 recording", path)
+	}
+	info.Start = time.Unix(h.Timestamp, 0)
+	info.SSHUser, info.LocalUser, info.Command = h.SSHUser, h.LocalUser, h.Command
+	info.OriginalCommand = h.OrigCommand
+	info.SrcNode, info.SrcNodeUser, info.SrcNodeTags = h.SrcNode, h.SrcNodeUser, h.SrcNodeTags
+
+	// Find the time of the last event from the end of the file.
+	const tail = 64 << 10
+	if fi.Size() > tail {
+		if _, err := f.Seek(-tail, io.SeekEnd); err == nil {
+			br.Reset(f)
+			br.ReadBytes('\n') // skip the partial line
+		}
+	}
+	for {
+		line, err := br.ReadBytes('\n')
+		if t, ok := eventTime(line); ok {
+			info.Duration = time.Duration(t * float64(time.Second))
+		}
+		if err != nil {
+			break
+		}
+	}
+	return info, nil
+}
+
+// Open opens the recording id in dir.
+func Open(dir, id string) (*os.File, error) {
+	if !strings.HasPrefix(id, filePrefix) || strings.ContainsAny(id, `/\`) || !filepath.IsLocal(id) {
+		return nil, fs.ErrNotExist
+	}
+	return os.Open(filepath.Join(dir, id+fileSuffix))
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sessionrecording
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRecording(t *testing.T, dir string, policy LocalPolicy, start time.Time, events int) *Writer {
+	t.Helper()
+	w, err := NewWriter(dir, policy, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(w, `{"version":2,"width":80,"height":24,"timestamp":%d,"sshUser":"alice","localUser":"alice","srcNode":"laptop"}`+"\n", start.Unix())
+	for i := range events {
+		fmt.Fprintf(w, "[%d,\"o\",\"line %d\\r\\n\"]\n", i, i)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestLocalPolicyCheck(t *testing.T) {
+	tests := []struct {
+		p    LocalPolicy
+		want bool
+	}{
+		{LocalPolicy{}, true},
+		{LocalPolicy{Mode: ModeAlways, MaxFileSize: 1 << 20, MaxAge: "720h"}, true},
+		{LocalPolicy{Mode: "sometimes"}, false},
+		{LocalPolicy{Mode: ModeFallback, MaxTotalSize: -1}, false},
+		{LocalPolicy{Mode: ModeFallback, MaxAge: "a month"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.p.Check(); (err == nil) != tt.want {
+			t.Errorf("%+v: Check = %v, want ok=%v", tt.p, err, tt.want)
+		}
+	}
+}
+
+func TestWriterRotates(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Unix(1700000000, 0)
+	writeRecording(t, dir, LocalPolicy{MaxFileSize: 200}, start, 10)
+
+	infos, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) < 2 {
+		t.Fatalf("got %d recordings, want the session split into several", len(infos))
+	}
+	var out bytes.Buffer
+	for i, info := range infos {
+		if info.Part != i+1 {
+			t.Errorf("recording %d is part %d", i, info.Part)
+		}
+		if info.SSHUser != "alice" || info.SrcNode != "laptop" {
+			t.Errorf("recording %d: wrong header fields in %+v", i, info)
+		}
+		if info.Size > 200 {
+			t.Errorf("recording %d is %d bytes, over the limit", i, info.Size)
+		}
+		f, err := Open(dir, info.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = play(&out, f, 1, 0, func(time.Duration) {})
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 10 {
+		if !strings.Contains(out.String(), fmt.Sprintf("line %d\r\n", i)) {
+			t.Errorf("line %d missing from the played parts", i)
+		}
+	}
+	if last := infos[len(infos)-1]; !last.Start.After(start) {
+		t.Errorf("last part starts at %v, want after the session start", last.Start)
+	}
+}
+
+func TestWriterPrunes(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeRecording(t, dir, LocalPolicy{}, now.Add(-48*time.Hour), 1)
+	writeRecording(t, dir, LocalPolicy{}, now.Add(-2*time.Hour), 100)
+	writeRecording(t, dir, LocalPolicy{}, now.Add(-time.Hour), 100)
+
+	infos, _ := List(dir)
+	if len(infos) != 3 {
+		t.Fatalf("got %d recordings, want 3", len(infos))
+	}
+	total := infos[1].Size + infos[2].Size - 1
+
+	// The day-old recording is removed by age, and the two-hour-old one
+	// to bring the total under the size limit. The new recording doesn't
+	// count towards the limit until the next one starts.
+	writeRecording(t, dir, LocalPolicy{MaxAge: "24h", MaxTotalSize: total}, now, 100)
+	infos, _ = List(dir)
+	if len(infos) != 2 {
+		t.Fatalf("got %d recordings after pruning, want 2", len(infos))
+	}
+	if got := infos[0].Start.Unix(); got != now.Add(-time.Hour).Unix() {
+		t.Errorf("oldest remaining recording started at %v", infos[0].Start)
+	}
+}
+
+func TestWriterKeepsActiveRecordings(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-48 * time.Hour)
+	w1, err := NewWriter(dir, LocalPolicy{}, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w1.Close()
+	fmt.Fprintf(w1, `{"version":2,"width":80,"height":24,"timestamp":%d}`+"\n", start.Unix())
+	fmt.Fprintf(w1, "[0,\"o\",\"still going\"]\n")
+
+	// A new session's writer must not remove the recording of the session
+	// that is still in progress, however old or large it is.
+	writeRecording(t, dir, LocalPolicy{MaxAge: "24h", MaxTotalSize: 1}, time.Now(), 1)
+	if _, err := os.Stat(w1.f.Name()); err != nil {
+		t.Fatalf("active recording was removed: %v", err)
+	}
+
+	// Once it ends, it can be.
+	name := w1.f.Name()
+	w1.Close()
+	writeRecording(t, dir, LocalPolicy{MaxAge: "24h"}, time.Now(), 1)
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("finished recording was not removed: %v", err)
+	}
+}
+
+func TestOpenRejectsPaths(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret.cast"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"secret", "../secret", "ssh-session-/../secret", "ssh-session-x/y"} {
+		if f, err := Open(dir, id); err == nil {
+			f.Close()
+			t.Errorf("Open(%q) succeeded", id)
+		}
+	}
+}
+
+func TestPlay(t *testing.T) {
+	rec := `{"version":2,"width":80,"height":24,"timestamp":1700000000}
+[0.5,"o","hello "]
+[1.0,"i","ignored"]
+[100.5,"o","world"]
+`
+	var out bytes.Buffer
+	var slept []time.Duration
+	if err := play(&out, strings.NewReader(rec), 2, 10*time.Second, func(d time.Duration) { slept = append(slept, d) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "hello world" {
+		t.Errorf("played %q", got)
+	}
+	want := []time.Duration{250 * time.Millisecond, 10 * time.Second}
+	if fmt.Sprint(slept) != fmt.Sprint(want) {
+		t.Errorf("slept %v, want %v", slept, want)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sessionrecording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Play writes the output of the asciicast v2 recording r to w, at the pace
+// it was recorded. The pace is multiplied by speed, if it's positive, and
+// pauses longer than maxIdle, if it's positive, are shortened to maxIdle.
+func Play(w io.Writer, r io.Reader, speed float64, maxIdle time.Duration) error {
+	return play(w, r, speed, maxIdle, time.Sleep)
+}
+
+func play(w io.Writer, r io.Reader, speed float64, maxIdle time.Duration, sleep func(time.Duration)) error {
+	if speed <= 0 {
+		speed = 1
+	}
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil || h.Version != 2 {
+		return errors.New("not an asciicast v2 recording")
+	}
+
+	var last float64
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var ev []json.RawMessage
+			var t float64
+			var kind, data string
+			if json.Unmarshal(line, &ev) != nil || len(ev) != 3 ||
+				json.Unmarshal(ev[0], &t) != nil ||
+				json.Unmarshal(ev[1], &kind) != nil ||
+				json.Unmarshal(ev[2], &data) != nil {
+				return fmt.Errorf("invalid event %q", line)
+			}
+			if kind == "o" {
+				d := time.Duration((t - last) / speed * float64(time.Second))
+				if maxIdle > 0 && d > maxIdle {
+					d = maxIdle
+				}
+				if d > 0 {
+					sleep(d)
+				}
+				last = t
+				if _, err := io.WriteString(w, data); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
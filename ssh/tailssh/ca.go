@@ -0,0 +1,353 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	xssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+)
+
+const (
+	defaultUserCertLifetime = 10 * time.Minute
+
+	// userCertClockSkew is how far before they are issued user
+	// certificates are valid from, to allow for clock skew between hosts.
+	userCertClockSkew = time.Minute
+
+	// agentChannelType is the SSH channel type of agent forwarding.
+	agentChannelType = "auth-agent@openssh.com"
+)
+
+// userCA returns the certificate authority to issue user certificates with,
+// from the SSHUserCA pref, and how long the certificates are valid. It
+// returns a nil ca if there is none.
+func (srv *server) userCA() (ca xssh.Signer, lifetime time.Duration, err error) {
+	pref := srv.lb.SSHUserCA()
+	if pref.KeyPath == "" {
+		return nil, 0, nil
+	}
+	lifetime = defaultUserCertLifetime
+	if pref.CertLifetime != "" {
+		lifetime, err = time.ParseDuration(pref.CertLifetime)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.userCASigner == nil || srv.userCAPath != pref.KeyPath {
+		signer, err := loadOrCreateUserCA(pref.KeyPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		srv.userCASigner = signer
+		srv.userCAPath = pref.KeyPath
+	}
+	return srv.userCASigner, lifetime, nil
+}
+
+// loadOrCreateUserCA reads the OpenSSH private key at path, generating it if
+// it doesn't exist.
+func loadOrCreateUserCA(path string) (xssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		b, err = createUserCA(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := xssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH user CA key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+func createUserCA(path string) ([]byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := xssh.MarshalPrivateKey(priv, "tailscale-ssh-user-ca")
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := xssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(block)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if err := os.WriteFile(path+".pub", xssh.MarshalAuthorizedKey(sshPub), 0644); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// userCertPrincipals returns the principals of the user certificates issued
+// for c: the local user the session runs as, and the Tailscale identity of
+// the connecting node, which is its user's login name or, for tagged nodes,
+// its tags.
+func (c *conn) userCertPrincipals() []string {
+	principals := []string{c.localUser.Username}
+	if c.info.node.IsTagged() {
+		principals = append(principals, c.info.node.Tags().AsSlice()...)
+	} else if c.info.uprof.LoginName != "" {
+		principals = append(principals, c.info.uprof.LoginName)
+	}
+	return principals
+}
+
+// newUserCert returns a user certificate for the key pub, issued by ca for
+// the session ss, that is valid from now for lifetime.
+func (ss *sshSession) newUserCert(ca xssh.Signer, pub xssh.PublicKey, now time.Time, lifetime time.Duration) (*xssh.Certificate, error) {
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	c := ss.conn
+	// Only allow further hops what this one is allowed.
+	ext := map[string]string{"permit-pty": ""}
+	if c.finalAction.AllowAgentForwarding {
+		ext["permit-agent-forwarding"] = ""
+	}
+	if c.finalAction.AllowLocalPortForwarding {
+		ext["permit-port-forwarding"] = ""
+	}
+	cert := &xssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        xssh.UserCert,
+		KeyId:           fmt.Sprintf("tailscale-ssh:%s:%s@%s", c.connID, c.info.sshUser, strings.TrimSuffix(c.info.node.Name(), ".")),
+		ValidPrincipals: c.userCertPrincipals(),
+		ValidAfter:      uint64(now.Add(-userCertClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(lifetime).Unix()),
+		Permissions:     xssh.Permissions{Extensions: ext},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// userCerts issues the user certificates of a session, and holds them in a
+// keyring until they expire.
+type userCerts struct {
+	ss       *sshSession
+	ca       xssh.Signer
+	key      ed25519.PrivateKey
+	pub      xssh.PublicKey
+	lifetime time.Duration
+	keyring  agent.ExtendedAgent
+
+	mu         sync.Mutex
+	validUntil time.Time // of the newest certificate
+}
+
+func newUserCerts(ss *sshSession, ca xssh.Signer, lifetime time.Duration) (*userCerts, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := xssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	uc := &userCerts{
+		ss:       ss,
+		ca:       ca,
+		key:      priv,
+		pub:      sshPub,
+		lifetime: lifetime,
+		keyring:  agent.NewKeyring().(agent.ExtendedAgent),
+	}
+	if err := uc.refresh(); err != nil {
+		return nil, err
+	}
+	return uc, nil
+}
+
+// refresh issues a new certificate if the newest one expires within half of
+// its lifetime. Older certificates stay in the keyring until they expire, in
+// case they were listed to a client that hasn't used them yet.
+func (uc *userCerts) refresh() error {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	now := uc.ss.conn.srv.now()
+	if uc.validUntil.Sub(now) > uc.lifetime/2 {
+		return nil
+	}
+	cert, err := uc.ss.newUserCert(uc.ca, uc.pub, now, uc.lifetime)
+	if err != nil {
+		return err
+	}
+	if err := uc.keyring.Add(agent.AddedKey{
+		PrivateKey:   uc.key,
+		Certificate:  cert,
+		Comment:      cert.KeyId,
+		LifetimeSecs: uint32(uc.lifetime / time.Second),
+	}); err != nil {
+		return err
+	}
+	uc.validUntil = time.Unix(int64(cert.ValidBefore), 0)
+	return nil
+}
+
+// sessionAgent is the agent served to a connection to a session's agent
+// socket when user certificates are issued. It offers the session's
+// certificates, followed by the keys of the client's forwarded agent, if
+// agent forwarding is allowed.
+type sessionAgent struct {
+	certs *userCerts
+	fwd   agent.ExtendedAgent // or nil
+}
+
+var errAgentReadOnly = errors.New("agent: not supported without agent forwarding")
+
+func (a *sessionAgent) List() ([]*agent.Key, error) {
+	if err := a.certs.refresh(); err != nil {
+		a.certs.ss.logf("ssh: issuing user certificate: %v", err)
+	}
+	keys, err := a.certs.keyring.List()
+	if err != nil {
+		return nil, err
+	}
+	if a.fwd != nil {
+		fwdKeys, err := a.fwd.List()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fwdKeys...)
+	}
+	return keys, nil
+}
+
+func (a *sessionAgent) Sign(key xssh.PublicKey, data []byte) (*xssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *sessionAgent) SignWithFlags(key xssh.PublicKey, data []byte, flags agent.SignatureFlags) (*xssh.Signature, error) {
+	sig, err := a.certs.keyring.SignWithFlags(key, data, flags)
+	if err != nil && a.fwd != nil {
+		return a.fwd.SignWithFlags(key, data, flags)
+	}
+	return sig, err
+}
+
+func (a *sessionAgent) Signers() ([]xssh.Signer, error) {
+	signers, err := a.certs.keyring.Signers()
+	if err != nil {
+		return nil, err
+	}
+	if a.fwd != nil {
+		fwdSigners, err := a.fwd.Signers()
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, fwdSigners...)
+	}
+	return signers, nil
+}
+
+func (a *sessionAgent) Add(key agent.AddedKey) error {
+	if a.fwd == nil {
+		return errAgentReadOnly
+	}
+	return a.fwd.Add(key)
+}
+
+func (a *sessionAgent) Remove(key xssh.PublicKey) error {
+	if a.fwd == nil {
+		return errAgentReadOnly
+	}
+	return a.fwd.Remove(key)
+}
+
+func (a *sessionAgent) RemoveAll() error {
+	if a.fwd == nil {
+		return errAgentReadOnly
+	}
+	return a.fwd.RemoveAll()
+}
+
+func (a *sessionAgent) Lock(passphrase []byte) error {
+	if a.fwd == nil {
+		return errAgentReadOnly
+	}
+	return a.fwd.Lock(passphrase)
+}
+
+func (a *sessionAgent) Unlock(passphrase []byte) error {
+	if a.fwd == nil {
+		return errAgentReadOnly
+	}
+	return a.fwd.Unlock(passphrase)
+}
+
+func (a *sessionAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if a.fwd == nil {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	return a.fwd.Extension(extensionType, contents)
+}
+
+// serveSessionAgent serves a sessionAgent with certs to each connection to
+// ln, until ln is closed. If forward is set, the client's agent is forwarded
+// behind it.
+func (ss *sshSession) serveSessionAgent(ln net.Listener, certs *userCerts, forward bool) {
+	sshConn, _ := ss.Context().Value(ssh.ContextKeyConn).(gossh.Conn)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			a := &sessionAgent{certs: certs}
+			if forward && sshConn != nil {
+				ch, reqs, err := sshConn.OpenChannel(agentChannelType, nil)
+				if err != nil {
+					ss.logf("ssh: opening forwarded agent: %v", err)
+				} else {
+					defer ch.Close()
+					go gossh.DiscardRequests(reqs)
+					a.fwd = agent.NewClient(ch)
+				}
+			}
+			agent.ServeAgent(a, c)
+		}()
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"bytes"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	xssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+func TestLoadOrCreateUserCA(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh", "user-ca")
+	ca, err := loadOrCreateUserCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := xssh.MarshalAuthorizedKey(ca.PublicKey()); !bytes.Equal(pub, want) {
+		t.Errorf("public key file = %q; want %q", pub, want)
+	}
+	ca2, err := loadOrCreateUserCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ca.PublicKey().Marshal(), ca2.PublicKey().Marshal()) {
+		t.Error("CA key changed when loaded again")
+	}
+}
+
+func TestUserCAFromPrefs(t *testing.T) {
+	dir := t.TempDir()
+	lb := &localState{}
+	srv := &server{lb: lb}
+	if ca, _, err := srv.userCA(); ca != nil || err != nil {
+		t.Fatalf("userCA without pref = %v, %v; want nil, nil", ca, err)
+	}
+
+	lb.userCA = ipn.SSHUserCA{KeyPath: filepath.Join(dir, "ca1")}
+	ca1, lifetime, err := srv.userCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime != defaultUserCertLifetime {
+		t.Errorf("lifetime = %v; want %v", lifetime, defaultUserCertLifetime)
+	}
+
+	lb.userCA = ipn.SSHUserCA{KeyPath: filepath.Join(dir, "ca2"), CertLifetime: "1h"}
+	ca2, lifetime, err := srv.userCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime != time.Hour {
+		t.Errorf("lifetime = %v; want 1h", lifetime)
+	}
+	if bytes.Equal(ca1.PublicKey().Marshal(), ca2.PublicKey().Marshal()) {
+		t.Error("CA key didn't change with KeyPath")
+	}
+}
+
+func TestUserCerts(t *testing.T) {
+	ca, err := loadOrCreateUserCA(filepath.Join(t.TempDir(), "user-ca"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	srv := &server{logf: logger.Discard, timeNow: func() time.Time { return now }}
+	ss := &sshSession{
+		logf: t.Logf,
+		conn: &conn{
+			srv:    srv,
+			connID: "conn1",
+			info: &sshConnInfo{
+				sshUser: "alice",
+				node:    (&tailcfg.Node{Name: "laptop.example.ts.net."}).View(),
+				uprof:   tailcfg.UserProfile{LoginName: "alice@example.com"},
+			},
+			localUser:   &userMeta{User: user.User{Username: "alice"}},
+			finalAction: &tailcfg.SSHAction{Accept: true, AllowAgentForwarding: true},
+		},
+	}
+	uc, err := newUserCerts(ss, ca, defaultUserCertLifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &sessionAgent{certs: uc}
+
+	certs := func() []*xssh.Certificate {
+		t.Helper()
+		keys, err := a.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var certs []*xssh.Certificate
+		for _, k := range keys {
+			pub, err := xssh.ParsePublicKey(k.Marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, ok := pub.(*xssh.Certificate)
+			if !ok {
+				t.Fatalf("agent offered %s key; want a certificate", pub.Type())
+			}
+			certs = append(certs, cert)
+		}
+		return certs
+	}
+	got := certs()
+	if len(got) != 1 {
+		t.Fatalf("agent offered %d certificates; want 1", len(got))
+	}
+	cert := got[0]
+	if want := []string{"alice", "alice@example.com"}; !slices.Equal(cert.ValidPrincipals, want) {
+		t.Errorf("principals = %q; want %q", cert.ValidPrincipals, want)
+	}
+	if _, ok := cert.Permissions.Extensions["permit-agent-forwarding"]; !ok {
+		t.Error("certificate doesn't permit agent forwarding, which the session allows")
+	}
+	if _, ok := cert.Permissions.Extensions["permit-port-forwarding"]; ok {
+		t.Error("certificate permits port forwarding, which the session doesn't allow")
+	}
+
+	checker := &xssh.CertChecker{
+		IsUserAuthority: func(auth xssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+		Clock: func() time.Time { return now },
+	}
+	if err := checker.CheckCert("alice", cert); err != nil {
+		t.Errorf("CheckCert(alice): %v", err)
+	}
+	if err := checker.CheckCert("root", cert); err == nil {
+		t.Error("certificate is valid for root")
+	}
+	checker.Clock = func() time.Time { return now.Add(defaultUserCertLifetime + time.Minute) }
+	if err := checker.CheckCert("alice", cert); err == nil {
+		t.Error("certificate is valid after its lifetime")
+	}
+
+	data := []byte("hello")
+	sig, err := a.Sign(cert, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Verify(data, sig); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+	if err := a.Add(agent.AddedKey{PrivateKey: uc.key}); err == nil {
+		t.Error("Add succeeded without a forwarded agent")
+	}
+
+	// A new certificate is issued once the first is half way through its
+	// lifetime.
+	now = now.Add(defaultUserCertLifetime/2 + time.Second)
+	if got := certs(); len(got) != 2 {
+		t.Errorf("agent offered %d certificates after refresh; want 2", len(got))
+	}
+}
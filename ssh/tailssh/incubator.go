@@ -62,6 +62,35 @@ func init() {
 	return nil
 }
 
+// setSessionRlimits lowers the resource limits of the incubator, which are
+// inherited by the processes of the session, to those in ia.
+// See setSessionRlimitsLinux.
+var setSessionRlimits = func(dlogf logger.Logf, ia incubatorArgs) error {
+	return nil
+}
+
+// sessionCgroup is a cgroup that enforces the limits of a session on its
+// processes.
+type sessionCgroup interface {
+	// Close removes the cgroup, killing any processes left in it.
+	io.Closer
+
+	// apply arranges for cmd to be started in the cgroup.
+	apply(cmd *exec.Cmd)
+
+	// limitsProcesses reports whether the cgroup enforces
+	// SSHSessionLimits.MaxProcesses.
+	limitsProcesses() bool
+}
+
+// newSessionCgroup creates a cgroup named name that enforces lim on the
+// processes of a session. It returns a nil sessionCgroup if cgroups aren't
+// supported.
+// See newSessionCgroupLinux.
+var newSessionCgroup = func(logf logger.Logf, name string, lim *tailcfg.SSHSessionLimits) (sessionCgroup, error) {
+	return nil, nil
+}
+
 // newIncubatorCommand returns a new exec.Cmd configured with
 // `tailscaled be-child ssh` as the entrypoint.
 //
@@ -77,13 +106,13 @@ func (ss *sshSession) newIncubatorCommand(logf logger.Logf) (cmd *exec.Cmd, err
 	}()
 
 	var isSFTP, isShell bool
-	switch ss.Subsystem() {
+	switch ss.subsystem() {
 	case "sftp":
 		isSFTP = true
 	case "":
-		isShell = ss.RawCommand() == ""
+		isShell = ss.rawCommand() == ""
 	default:
-		panic(fmt.Sprintf("unexpected subsystem: %v", ss.Subsystem()))
+		panic(fmt.Sprintf("unexpected subsystem: %v", ss.subsystem()))
 	}
 
 	if ss.conn.srv.tailscaledPath == "" {
@@ -94,7 +123,7 @@ func (ss *sshSession) newIncubatorCommand(logf logger.Logf) (cmd *exec.Cmd, err
 		}
 
 		loginShell := ss.conn.localUser.LoginShell()
-		args := shellArgs(isShell, ss.RawCommand())
+		args := shellArgs(isShell, ss.rawCommand())
 		logf("directly running %s %q", loginShell, args)
 		return exec.CommandContext(ss.ctx, loginShell, args...), nil
 	}
@@ -137,6 +166,17 @@ func (ss *sshSession) newIncubatorCommand(logf logger.Logf) (cmd *exec.Cmd, err
 		incubatorArgs = append(incubatorArgs, "--debug-test")
 	}
 
+	if lim := ss.conn.finalAction.SessionLimits; lim != nil {
+		// RLIMIT_NPROC counts all the processes of the local user, so only
+		// use it if the session's cgroup doesn't limit them.
+		if lim.MaxProcesses > 0 && (ss.cgroup == nil || !ss.cgroup.limitsProcesses()) {
+			incubatorArgs = append(incubatorArgs, fmt.Sprintf("--max-procs=%d", lim.MaxProcesses))
+		}
+		if lim.MaxOpenFiles > 0 {
+			incubatorArgs = append(incubatorArgs, fmt.Sprintf("--max-open-files=%d", lim.MaxOpenFiles))
+		}
+	}
+
 	switch {
 	case isSFTP:
 		// Note that we include both the `--sftp` flag and a command to launch
@@ -149,7 +189,7 @@ func (ss *sshSession) newIncubatorCommand(logf logger.Logf) (cmd *exec.Cmd, err
 	case isShell:
 		incubatorArgs = append(incubatorArgs, "--shell")
 	default:
-		incubatorArgs = append(incubatorArgs, "--cmd="+ss.RawCommand())
+		incubatorArgs = append(incubatorArgs, "--cmd="+ss.rawCommand())
 	}
 
 	return exec.CommandContext(ss.ctx, ss.conn.srv.tailscaledPath, incubatorArgs...), nil
@@ -189,6 +229,8 @@ type incubatorArgs struct {
 	forceV1Behavior    bool
 	debugTest          bool
 	isSELinuxEnforcing bool
+	maxProcs           int // or zero for no limit
+	maxOpenFiles       int // or zero for no limit
 }
 
 func parseIncubatorArgs(args []string) (incubatorArgs, error) {
@@ -211,6 +253,8 @@ func parseIncubatorArgs(args []string) (incubatorArgs, error) {
 	flags.BoolVar(&ia.forceV1Behavior, "force-v1-behavior", false, "allow falling back to the su command if login is unavailable")
 	flags.BoolVar(&ia.debugTest, "debug-test", false, "should debug in test mode")
 	flags.BoolVar(&ia.isSELinuxEnforcing, "is-selinux-enforcing", false, "whether SELinux is in enforcing mode")
+	flags.IntVar(&ia.maxProcs, "max-procs", 0, "the most processes local-user may run, or 0 for no limit")
+	flags.IntVar(&ia.maxOpenFiles, "max-open-files", 0, "the most files each process may have open, or 0 for no limit")
 	flags.Parse(args)
 
 	for _, g := range strings.Split(groups, ",") {
@@ -267,6 +311,12 @@ func beIncubator(args []string) error {
 		}
 	}
 
+	// The limits are inherited by login or su, and everything the session
+	// runs after that.
+	if err := setSessionRlimits(dlogf, ia); err != nil {
+		return fmt.Errorf("setting session resource limits: %w", err)
+	}
+
 	if !shouldAttemptLoginShell(dlogf, ia) {
 		dlogf("not attempting login shell")
 		return handleInProcess(dlogf, ia)
@@ -663,12 +713,25 @@ func doDropPrivileges(dlogf logger.Logf, wantUid, wantGid int, supplementaryGrou
 // It sets ss.cmd, stdin, stdout, and stderr.
 func (ss *sshSession) launchProcess() error {
 	var err error
+	if lim := ss.conn.finalAction.SessionLimits; lim != nil {
+		// Create the cgroup first, as the incubator only needs to enforce
+		// the limits that the cgroup doesn't.
+		ss.cgroup, err = newSessionCgroup(ss.logf, ss.sharedID, lim)
+		if err != nil {
+			// The limits enforced by the incubator still apply.
+			metricSessionCgroupErrors.Add(1)
+			ss.logf("not limiting session with a cgroup: %v", err)
+		}
+	}
 	ss.cmd, err = ss.newIncubatorCommand(ss.logf)
 	if err != nil {
 		return err
 	}
 
 	cmd := ss.cmd
+	if ss.cgroup != nil {
+		ss.cgroup.apply(cmd)
+	}
 	homeDir := ss.conn.localUser.HomeDir
 	if _, err := os.Stat(homeDir); err == nil {
 		cmd.Dir = homeDir
@@ -695,6 +758,9 @@ func (ss *sshSession) launchProcess() error {
 	if ss.agentListener != nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", ss.agentListener.Addr()))
 	}
+	if ss.conn.finalAction.ForceCommand != "" && ss.RawCommand() != "" {
+		cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+ss.RawCommand())
+	}
 
 	ptyReq, winCh, isPty := ss.Pty()
 	if !isPty {
@@ -878,10 +944,11 @@ func (ss *sshSession) startWithPTY() (ptyFile, tty *os.File, err error) {
 	if ctlErr != nil {
 		return nil, nil, fmt.Errorf("ptyRawConn.Control func: %w", ctlErr)
 	}
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setctty: true,
-		Setsid:  true,
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr) // may have been set by newSessionCgroup
 	}
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Setsid = true
 	updateStringInSlice(cmd.Args, "--has-tty=false", "--has-tty=true")
 	if ptyName, err := ptyName(ptyFile); err == nil {
 		updateStringInSlice(cmd.Args, "--tty-name=", "--tty-name="+ptyName)
@@ -6,20 +6,33 @@
 package tailssh
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 )
 
 func init() {
 	ptyName = ptyNameLinux
 	maybeStartLoginSession = maybeStartLoginSessionLinux
+	setSessionRlimits = setSessionRlimitsLinux
+	newSessionCgroup = newSessionCgroupLinux
 }
 
 func ptyNameLinux(f *os.File) (string, error) {
@@ -171,3 +184,322 @@ func maybeStartLoginSessionLinux(dlogf logger.Logf, ia incubatorArgs) func() err
 	}
 	return nil
 }
+
+// setSessionRlimitsLinux is the linux implementation of setSessionRlimits.
+//
+// Note that RLIMIT_NPROC counts all the processes of the local user, not
+// only those of the session; newSessionCgroupLinux limits those.
+func setSessionRlimitsLinux(dlogf logger.Logf, ia incubatorArgs) error {
+	if ia.maxProcs > 0 {
+		dlogf("limiting processes to %d", ia.maxProcs)
+		if err := lowerRlimit(unix.RLIMIT_NPROC, uint64(ia.maxProcs)); err != nil {
+			return fmt.Errorf("RLIMIT_NPROC: %w", err)
+		}
+	}
+	if ia.maxOpenFiles > 0 {
+		dlogf("limiting open files to %d", ia.maxOpenFiles)
+		if err := lowerRlimit(unix.RLIMIT_NOFILE, uint64(ia.maxOpenFiles)); err != nil {
+			return fmt.Errorf("RLIMIT_NOFILE: %w", err)
+		}
+	}
+	return nil
+}
+
+// lowerRlimit sets both the soft and hard limits of resource to n, unless
+// they are already lower, so that the session can't raise them again.
+//
+// It uses syscall.Setrlimit, rather than unix.Setrlimit, as otherwise the Go
+// runtime restores the RLIMIT_NOFILE it started with when exec'ing.
+func lowerRlimit(resource int, n uint64) error {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &rl); err != nil {
+		return err
+	}
+	rl.Cur = min(rl.Cur, n)
+	rl.Max = min(rl.Max, n)
+	return syscall.Setrlimit(resource, &rl)
+}
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// sessionCgroupControllers are the cgroup v2 controllers used to enforce
+// tailcfg.SSHSessionLimits.
+var sessionCgroupControllers = []string{"pids", "memory", "cpu"}
+
+var sessionCgroups struct {
+	mu          sync.Mutex
+	parent      string          // the cgroup session cgroups are created in, once set up
+	controllers map[string]bool // enabled in parent
+}
+
+// sessionCgroupParent returns the cgroup to create session cgroups in, with
+// the controllers enabled for its children.
+//
+// That is the cgroup tailscaled was started in, which must have been
+// delegated to it, such as with Delegate=yes in its systemd unit; other
+// cgroups belong to whoever manages them. As cgroup v2 doesn't allow
+// processes in a cgroup that has controllers enabled for its children, the
+// first call moves tailscaled and the sessions it started into a new child
+// of it named "tailscaled". If any other process is in the cgroup, it's
+// left alone and no session cgroups are made.
+func sessionCgroupParent() (string, map[string]bool, error) {
+	sessionCgroups.mu.Lock()
+	defer sessionCgroups.mu.Unlock()
+	if sessionCgroups.parent != "" {
+		return sessionCgroups.parent, sessionCgroups.controllers, nil
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", nil, fmt.Errorf("no cgroup v2 hierarchy at %s", cgroupRoot)
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return "", nil, err
+	}
+	parent := filepath.Join(cgroupRoot, own)
+	if !isDelegatedCgroup(parent) {
+		return "", nil, fmt.Errorf("cgroup %s is not delegated to tailscaled", parent)
+	}
+	procs, err := os.ReadFile(filepath.Join(parent, "cgroup.procs"))
+	if err != nil {
+		return "", nil, err
+	}
+	var move []string
+	for _, pid := range strings.Fields(string(procs)) {
+		n, err := strconv.Atoi(pid)
+		if err != nil {
+			return "", nil, fmt.Errorf("bad pid %q in %s", pid, parent)
+		}
+		if !isOwnProcess(n) {
+			return "", nil, fmt.Errorf("cgroup %s has process %d, which tailscaled didn't start", parent, n)
+		}
+		move = append(move, pid)
+	}
+	leaf := filepath.Join(parent, "tailscaled")
+	if err := os.Mkdir(leaf, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", nil, err
+	}
+	for _, pid := range move {
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0); err != nil && !errors.Is(err, unix.ESRCH) {
+			return "", nil, fmt.Errorf("moving process %s to %s: %w", pid, leaf, err)
+		}
+	}
+
+	available, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", nil, err
+	}
+	controllers := map[string]bool{}
+	var enable []string
+	for _, c := range strings.Fields(string(available)) {
+		for _, want := range sessionCgroupControllers {
+			if c == want {
+				controllers[c] = true
+				enable = append(enable, "+"+c)
+			}
+		}
+	}
+	if len(enable) > 0 {
+		if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0); err != nil {
+			return "", nil, fmt.Errorf("enabling controllers in %s: %w", parent, err)
+		}
+	}
+	sessionCgroups.parent = parent
+	sessionCgroups.controllers = controllers
+	return parent, controllers, nil
+}
+
+// isDelegatedCgroup reports whether systemd delegated the cgroup dir to the
+// processes in it, which it marks with a "trusted.delegate" extended
+// attribute (or "user.delegate" for user managers).
+func isDelegatedCgroup(dir string) bool {
+	for _, attr := range []string{"trusted.delegate", "user.delegate"} {
+		buf := make([]byte, 8)
+		n, err := unix.Getxattr(dir, attr, buf)
+		if err == nil && string(buf[:n]) == "1" {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnProcess reports whether pid is this process or one of its
+// descendants.
+func isOwnProcess(pid int) bool {
+	self := os.Getpid()
+	for pid > 1 {
+		if pid == self {
+			return true
+		}
+		b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return false
+		}
+		pid, err = parseStatPPID(b)
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// parseStatPPID returns the parent process ID in the contents of a
+// /proc/<pid>/stat file.
+func parseStatPPID(b []byte) (int, error) {
+	// The command name is in parentheses, and may itself contain spaces
+	// and parentheses, so look after the last ")". The state follows,
+	// then the parent's pid.
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, errors.New("malformed stat")
+	}
+	f := strings.Fields(string(b[i+1:]))
+	if len(f) < 2 {
+		return 0, errors.New("malformed stat")
+	}
+	return strconv.Atoi(f[1])
+}
+
+// ownCgroup returns the path of the cgroup v2 this process is in, relative to
+// cgroupRoot.
+func ownCgroup() (string, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	return parseProcCgroup(b)
+}
+
+// parseProcCgroup returns the cgroup v2 path in the contents of a
+// /proc/<pid>/cgroup file.
+func parseProcCgroup(b []byte) (string, error) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if path, ok := strings.CutPrefix(sc.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2")
+}
+
+// sessionCgroupSettings returns the cgroup interface files to write to
+// enforce lim, and their values, given the enabled controllers. It returns an
+// error if lim needs a controller that isn't enabled.
+func sessionCgroupSettings(lim *tailcfg.SSHSessionLimits, controllers map[string]bool) (map[string]string, error) {
+	settings := map[string]string{}
+	var missing []string
+	set := func(controller, file, value string) {
+		if controllers[controller] {
+			settings[file] = value
+		} else {
+			missing = append(missing, controller)
+		}
+	}
+	if lim.MaxProcesses > 0 {
+		set("pids", "pids.max", strconv.Itoa(lim.MaxProcesses))
+	}
+	if lim.MaxMemoryBytes > 0 {
+		set("memory", "memory.max", strconv.FormatInt(lim.MaxMemoryBytes, 10))
+		if controllers["memory"] {
+			// Don't let the session get around the limit by swapping.
+			settings["memory.swap.max"] = "0"
+		}
+	}
+	if lim.CPUWeight > 0 {
+		set("cpu", "cpu.weight", strconv.Itoa(min(max(lim.CPUWeight, 1), 10000)))
+	}
+	if len(missing) > 0 {
+		return settings, fmt.Errorf("cgroup controllers not available: %v", missing)
+	}
+	return settings, nil
+}
+
+// newSessionCgroupLinux is the linux implementation of newSessionCgroup.
+func newSessionCgroupLinux(logf logger.Logf, name string, lim *tailcfg.SSHSessionLimits) (sessionCgroup, error) {
+	if lim.MaxProcesses <= 0 && lim.MaxMemoryBytes <= 0 && lim.CPUWeight <= 0 {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, errors.New("not running as root")
+	}
+	parent, controllers, err := sessionCgroupParent()
+	if err != nil {
+		return nil, err
+	}
+	settings, err := sessionCgroupSettings(lim, controllers)
+	if err != nil {
+		// Enforce what we can.
+		logf("ssh: %v", err)
+	}
+
+	dir := filepath.Join(parent, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	cg := &linuxCgroup{logf: logf, dir: dir}
+	for file, value := range settings {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+			if errors.Is(err, fs.ErrNotExist) && file == "memory.swap.max" {
+				continue // no swap accounting
+			}
+			cg.Close()
+			return nil, fmt.Errorf("setting %s: %w", file, err)
+		}
+	}
+	cg.f, err = os.Open(dir)
+	if err != nil {
+		cg.Close()
+		return nil, err
+	}
+	_, cg.pidsMax = settings["pids.max"]
+	return cg, nil
+}
+
+// linuxCgroup is the cgroup v2 of a session.
+type linuxCgroup struct {
+	logf    logger.Logf
+	dir     string
+	f       *os.File // or nil
+	pidsMax bool     // whether pids.max is set
+}
+
+// apply starts cmd in the cgroup with clone3(CLONE_INTO_CGROUP), so that
+// there is no window in which it could fork outside of it.
+func (cg *linuxCgroup) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.f.Fd())
+}
+
+func (cg *linuxCgroup) limitsProcesses() bool {
+	return cg.pidsMax
+}
+
+// Close kills any processes left in the cgroup and removes it.
+func (cg *linuxCgroup) Close() error {
+	if cg.f != nil {
+		cg.f.Close()
+	}
+	// cgroup.kill needs Linux 5.14 or later. Without it, the cgroup can't be
+	// removed while processes remain in it.
+	os.WriteFile(filepath.Join(cg.dir, "cgroup.kill"), []byte("1"), 0)
+
+	// Killing is asynchronous, so retry for a bit.
+	err := os.Remove(cg.dir)
+	if !errors.Is(err, unix.EBUSY) {
+		return err
+	}
+	go func() {
+		for range 20 {
+			time.Sleep(50 * time.Millisecond)
+			if err = os.Remove(cg.dir); !errors.Is(err, unix.EBUSY) {
+				return
+			}
+		}
+		cg.logf("ssh: removing session cgroup %s: %v", cg.dir, err)
+	}()
+	return nil
+}
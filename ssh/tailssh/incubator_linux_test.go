@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package tailssh
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestParseProcCgroup(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "0::/system.slice/tailscaled.service\n", want: "/system.slice/tailscaled.service"},
+		{in: "12:pids:/\n4:memory:/foo\n0::/\n", want: "/"},
+		{in: "4:memory:/foo\n1:cpu:/\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProcCgroup([]byte(tt.in))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseProcCgroup(%q) = %q, %v; want %q, err=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseStatPPID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "1234 (tailscaled) S 1 1234 1234 0 -1", want: 1},
+		{in: "99 (a) b (c)) R 42 99 99 0 -1", want: 42},
+		{in: "99 (sh", wantErr: true},
+		{in: "99 (sh) S", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStatPPID([]byte(tt.in))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseStatPPID(%q) = %d, %v; want %d, err=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestIsOwnProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	if !isOwnProcess(cmd.Process.Pid) {
+		t.Error("child process is not our own")
+	}
+	if isOwnProcess(1) {
+		t.Error("init is our own")
+	}
+}
+
+func TestSessionCgroupSettings(t *testing.T) {
+	lim := &tailcfg.SSHSessionLimits{
+		MaxProcesses:   100,
+		MaxMemoryBytes: 512 << 20,
+		CPUWeight:      20000,
+		MaxOpenFiles:   1024, // not a cgroup setting
+	}
+	all := map[string]bool{"pids": true, "memory": true, "cpu": true}
+	got, err := sessionCgroupSettings(lim, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"pids.max":        "100",
+		"memory.max":      "536870912",
+		"memory.swap.max": "0",
+		"cpu.weight":      "10000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("settings = %v; want %v", got, want)
+	}
+
+	got, err = sessionCgroupSettings(lim, map[string]bool{"pids": true})
+	if err == nil {
+		t.Error("missing controllers not reported")
+	}
+	if want := map[string]string{"pids.max": "100"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("settings = %v; want %v", got, want)
+	}
+}
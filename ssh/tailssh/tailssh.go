@@ -23,6 +23,7 @@
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,13 +32,17 @@
 	"time"
 
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	xssh "golang.org/x/crypto/ssh"
 	"tailscale.com/envknob"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/sessionrecording"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tempfork/gliderlabs/ssh"
+	"tailscale.com/tstime"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -71,6 +76,8 @@ type ipnLocalBackend interface {
 	Dialer() *tsdial.Dialer
 	TailscaleVarRoot() string
 	NodeKey() key.NodePublic
+	SSHLocalRecordingPolicy() sessionrecording.LocalPolicy
+	SSHUserCA() ipn.SSHUserCA
 }
 
 type server struct {
@@ -88,6 +95,8 @@ type server struct {
 	activeConns          map[*conn]bool              // set; value is always true
 	fetchPublicKeysCache map[string]pubKeyCacheEntry // by https URL
 	shutdownCalled       bool
+	userCASigner         xssh.Signer // or nil if not yet loaded; see userCA
+	userCAPath           string      // the key path userCASigner was loaded from
 }
 
 func (srv *server) now() time.Time {
@@ -857,6 +866,7 @@ type sshSession struct {
 	rdStdout io.ReadCloser
 	rdStderr io.ReadCloser // rdStderr is nil for pty sessions
 	ptyReq   *ssh.Pty      // non-nil for pty sessions
+	cgroup   sessionCgroup // or nil if the session isn't in its own cgroup
 
 	// childPipes is a list of pipes that need to be closed when the process exits.
 	// For pty sessions, this is the tty fd.
@@ -1009,18 +1019,36 @@ func (c *conn) detachSession(ss *sshSession) {
 
 // handleSSHAgentForwarding starts a Unix socket listener and in the background
 // forwards agent connections between the listener and the ssh.Session.
+// If the final action has IssueUserCerts (see userCA), the listener
+// serves user certificates, in front of the forwarded agent if agent
+// forwarding is allowed, or on their own otherwise. Either needs the client
+// to request agent forwarding.
 // On success, it assigns ss.agentListener.
 func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *userMeta) error {
-	if !ssh.AgentRequested(ss) || !ss.conn.finalAction.AllowAgentForwarding {
-		return nil
-	}
-	if sshDisableForwarding() {
+	if !ssh.AgentRequested(ss) || sshDisableForwarding() {
 		// TODO(bradfitz): or do we want to return an error here instead so the user
 		// gets an error if they ran with ssh -A? But for now we just silently
 		// don't work, like the condition above.
 		return nil
 	}
-	ss.logf("ssh: agent forwarding requested")
+	forward := ss.conn.finalAction.AllowAgentForwarding
+	var certs *userCerts
+	if !ss.conn.finalAction.IssueUserCerts {
+		// No certificates.
+	} else if ca, lifetime, err := ss.conn.srv.userCA(); err != nil {
+		ss.logf("ssh: loading user CA: %v", err)
+	} else if ca != nil {
+		certs, err = newUserCerts(ss, ca, lifetime)
+		if err != nil {
+			ss.logf("ssh: issuing user certificate: %v", err)
+		}
+	}
+	if !forward && certs == nil {
+		return nil
+	}
+	if forward {
+		ss.logf("ssh: agent forwarding requested")
+	}
 	ln, err := ssh.NewAgentListener()
 	if err != nil {
 		return err
@@ -1053,11 +1081,99 @@ func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *userMeta) erro
 		return err
 	}
 
-	go ssh.ForwardAgentConnections(ln, s)
+	if certs != nil {
+		go ss.serveSessionAgent(ln, certs, forward)
+	} else {
+		go ssh.ForwardAgentConnections(ln, s)
+	}
 	ss.agentListener = ln
 	return nil
 }
 
+// checkCommandAllowed returns an error, to show the user, if the session
+// requests a command, login shell or subsystem that is not allowed by the
+// final action's AllowedCommands and AllowedSubsystems.
+func (ss *sshSession) checkCommandAllowed() error {
+	a := ss.conn.finalAction
+	if len(a.AllowedCommands) == 0 && len(a.AllowedSubsystems) == 0 {
+		return nil
+	}
+	if sub := ss.Subsystem(); sub != "" {
+		if !slices.Contains(a.AllowedSubsystems, sub) {
+			return fmt.Errorf("subsystem %q is not allowed by the Tailscale SSH policy", sub)
+		}
+		return nil
+	}
+	cmd := ss.RawCommand()
+	if cmd == "" {
+		return errors.New("interactive shells are not allowed by the Tailscale SSH policy")
+	}
+	for _, pattern := range a.AllowedCommands {
+		if commandMatches(pattern, cmd) {
+			return nil
+		}
+	}
+	return fmt.Errorf("command %q is not allowed by the Tailscale SSH policy", cmd)
+}
+
+// shellMetachars are the characters that may not be matched by a "*" in an
+// entry of SSHAction.AllowedCommands, as the command is run by a shell.
+const shellMetachars = "\n\r;&|`$(){}<>\\*?[]!#~\"'"
+
+// commandMatches reports whether cmd matches the pattern, an entry of
+// SSHAction.AllowedCommands.
+//
+// A pattern ending in "*" matches a command whose first words are the
+// words of the pattern before the "*", followed by one or more words that
+// are each safe to pass to the command as an argument: they may be wrapped
+// in single quotes, but may not otherwise contain quotes or shell
+// metacharacters, and may not start with "-", so that they can't add
+// options to the ones the pattern fixes.
+func commandMatches(pattern, cmd string) bool {
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	if !ok {
+		return cmd == pattern
+	}
+	fixed := splitWords(prefix)
+	words := splitWords(cmd)
+	if len(words) <= len(fixed) || !slices.Equal(words[:len(fixed)], fixed) {
+		return false
+	}
+	for _, w := range words[len(fixed):] {
+		if len(w) >= 2 && w[0] == '\'' && w[len(w)-1] == '\'' {
+			w = w[1 : len(w)-1]
+		}
+		if w == "" || w[0] == '-' || strings.ContainsAny(w, shellMetachars) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitWords splits cmd into words separated by spaces and tabs.
+func splitWords(cmd string) []string {
+	return strings.FieldsFunc(cmd, func(r rune) bool { return r == ' ' || r == '\t' })
+}
+
+// subsystem returns the subsystem the session runs, which is the one
+// requested unless the final action forces a command.
+func (ss *sshSession) subsystem() string {
+	if ss.conn.finalAction.ForceCommand != "" {
+		return ""
+	}
+	return ss.Subsystem()
+}
+
+// rawCommand returns the command the session runs, which is the one
+// requested unless the final action forces a command. It is empty for a
+// login shell.
+func (ss *sshSession) rawCommand() string {
+	if fc := ss.conn.finalAction.ForceCommand; fc != "" {
+		return fc
+	}
+	return ss.RawCommand()
+}
+
 // run is the entrypoint for a newly accepted SSH session.
 //
 // It handles ss once it's been accepted and determined
@@ -1096,12 +1212,23 @@ func (ss *sshSession) run() {
 		}
 	}
 
+	if err := ss.checkCommandAllowed(); err != nil {
+		metricCommandRejected.Add(1)
+		logf("rejecting session: %v", err)
+		fmt.Fprintf(ss.Stderr(), "%v\r\n", err)
+		ss.Exit(1)
+		return
+	}
+	if ss.conn.finalAction.ForceCommand != "" {
+		metricForcedCommand.Add(1)
+	}
+
 	// Take control of the PTY so that we can configure it below.
 	// See https://github.com/tailscale/tailscale/issues/4146
 	ss.DisablePTYEmulation()
 
 	var rec *recording // or nil if disabled
-	if ss.Subsystem() != "sftp" {
+	if ss.subsystem() != "sftp" {
 		if err := ss.handleSSHAgentForwarding(ss, lu); err != nil {
 			ss.logf("agent forwarding failed: %v", err)
 		} else if ss.agentListener != nil {
@@ -1131,6 +1258,9 @@ func (ss *sshSession) run() {
 	}
 
 	err := ss.launchProcess()
+	if ss.cgroup != nil {
+		defer ss.cgroup.Close()
+	}
 	if err != nil {
 		logf("start failed: %v", err.Error())
 		if errors.Is(err, context.Canceled) {
@@ -1145,10 +1275,16 @@ func (ss *sshSession) run() {
 	}
 	go ss.killProcessOnContextDone()
 
+	var idle *idleTimer // or nil if disabled
+	if lim := ss.conn.finalAction.SessionLimits; lim != nil && lim.IdleTimeout > 0 {
+		idle = ss.startIdleTimer(tstime.StdClock{}, lim.IdleTimeout)
+		defer idle.stop()
+	}
+
 	var processDone atomic.Bool
 	go func() {
 		defer ss.wrStdin.Close()
-		if _, err := io.Copy(rec.writer("i", ss.wrStdin), ss); err != nil {
+		if _, err := io.Copy(idle.writer(rec.writer("i", ss.wrStdin)), ss); err != nil {
 			logf("stdin copy: %v", err)
 			ss.cancelCtx(err)
 		}
@@ -1162,7 +1298,7 @@ func (ss *sshSession) run() {
 	}
 	go func() {
 		defer ss.rdStdout.Close()
-		_, err := io.Copy(rec.writer("o", ss), ss.rdStdout)
+		_, err := io.Copy(idle.writer(rec.writer("o", ss)), ss.rdStdout)
 		if err != nil && !errors.Is(err, io.EOF) {
 			isErrBecauseProcessExited := processDone.Load() && errors.Is(err, syscall.EIO)
 			if !isErrBecauseProcessExited {
@@ -1179,7 +1315,7 @@ func (ss *sshSession) run() {
 	if ss.rdStderr != nil {
 		go func() {
 			defer ss.rdStderr.Close()
-			_, err := io.Copy(ss.Stderr(), ss.rdStderr)
+			_, err := io.Copy(idle.writer(ss.Stderr()), ss.rdStderr)
 			if err != nil {
 				logf("stderr copy: %v", err)
 			}
@@ -1224,9 +1360,55 @@ func (ss *sshSession) run() {
 	return
 }
 
+// idleTimer terminates a session when no input or output has passed through
+// its writers for a while.
+type idleTimer struct {
+	d time.Duration
+	t tstime.TimerController
+}
+
+// startIdleTimer starts an idleTimer that cancels ss after d of inactivity,
+// as measured by clock.
+func (ss *sshSession) startIdleTimer(clock tstime.Clock, d time.Duration) *idleTimer {
+	return &idleTimer{
+		d: d,
+		t: clock.AfterFunc(d, func() {
+			metricIdleTimeouts.Add(1)
+			ss.cancelCtx(userVisibleError{
+				fmt.Sprintf("Session idle for %v.", d),
+				context.DeadlineExceeded,
+			})
+		}),
+	}
+}
+
+func (it *idleTimer) stop() {
+	it.t.Stop()
+}
+
+// writer returns a writer that writes to w, restarting the timer with each
+// write. If it is nil, it returns w.
+func (it *idleTimer) writer(w io.Writer) io.Writer {
+	if it == nil {
+		return w
+	}
+	return idleWriter{it, w}
+}
+
+type idleWriter struct {
+	it *idleTimer
+	w  io.Writer
+}
+
+func (w idleWriter) Write(p []byte) (int, error) {
+	w.it.t.Reset(w.it.d)
+	return w.w.Write(p)
+}
+
 // recordSSHToLocalDisk is a deprecated dev knob to allow recording SSH sessions
 // to local storage. It is only used if there is no recording configured by the
-// coordination server. This will be removed in the future.
+// coordination server. It is equivalent to a local recording policy with mode
+// sessionrecording.ModeFallback, which should be used instead.
 var recordSSHToLocalDisk = envknob.RegisterBool("TS_DEBUG_LOG_SSH")
 
 // recorders returns the list of recorders to use for this session.
@@ -1242,7 +1424,20 @@ func (ss *sshSession) recorders() ([]netip.AddrPort, *tailcfg.SSHRecorderFailure
 
 func (ss *sshSession) shouldRecord() bool {
 	recs, _ := ss.recorders()
-	return len(recs) > 0 || recordSSHToLocalDisk()
+	return len(recs) > 0 || ss.recordLocally()
+}
+
+// recordLocally reports whether the session should be recorded to local
+// disk, according to the node's local recording policy.
+func (ss *sshSession) recordLocally() bool {
+	recs, _ := ss.recorders()
+	switch ss.conn.srv.lb.SSHLocalRecordingPolicy().Mode {
+	case sessionrecording.ModeAlways:
+		return true
+	case sessionrecording.ModeFallback:
+		return len(recs) == 0
+	}
+	return len(recs) == 0 && recordSSHToLocalDisk()
 }
 
 type sshConnInfo struct {
@@ -1452,6 +1647,11 @@ type CastHeader struct {
 	// Typically empty for shell sessions.
 	Command string `json:"command,omitempty"`
 
+	// OriginalCommand is the command the client requested, if the SSH
+	// action forced a different Command to run instead. It is empty if
+	// the client requested a shell or subsystem.
+	OriginalCommand string `json:"originalCommand,omitempty"`
+
 	// Tailscale-specific fields:
 	// SrcNode is the FQDN of the node originating the connection.
 	// It is also the MagicDNS name for the node.
@@ -1488,15 +1688,7 @@ func (ss *sshSession) openFileForRecording(now time.Time) (_ io.WriteCloser, err
 	if varRoot == "" {
 		return nil, errors.New("no var root for recording storage")
 	}
-	dir := filepath.Join(varRoot, "ssh-sessions")
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, err
-	}
-	f, err := os.CreateTemp(dir, fmt.Sprintf("ssh-session-%v-*.cast", now.UnixNano()))
-	if err != nil {
-		return nil, err
-	}
-	return f, nil
+	return sessionrecording.NewWriter(sessionrecording.Dir(varRoot), ss.conn.srv.lb.SSHLocalRecordingPolicy(), now)
 }
 
 // startNewRecording starts a new SSH session recording.
@@ -1510,13 +1702,9 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 	}
 
 	recorders, onFailure := ss.recorders()
-	var localRecording bool
-	if len(recorders) == 0 {
-		if recordSSHToLocalDisk() {
-			localRecording = true
-		} else {
-			return nil, errors.New("no recorders configured")
-		}
+	localRecording := ss.recordLocally()
+	if len(recorders) == 0 && !localRecording {
+		return nil, errors.New("no recorders configured")
 	}
 
 	var w ssh.Window
@@ -1545,10 +1733,10 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		var errChan <-chan error
-		var attempts []*tailcfg.SSHRecordingAttempt
-		rec.out, attempts, errChan, err = ConnectToRecorder(ctx, recorders, ss.conn.srv.lb.Dialer().UserDial)
+	}
+	if len(recorders) > 0 {
+		local := rec.out
+		remote, attempts, errChan, err := ConnectToRecorder(ctx, recorders, ss.conn.srv.lb.Dialer().UserDial)
 		if err != nil {
 			if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
 				eventType := tailcfg.SSHSessionRecordingFailed
@@ -1560,42 +1748,54 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 
 			if onFailure != nil && onFailure.RejectSessionWithMessage != "" {
 				ss.logf("recording: error starting recording (rejecting session): %v", err)
+				if local != nil {
+					local.Close()
+				}
 				return nil, userVisibleError{
 					error: err,
 					msg:   onFailure.RejectSessionWithMessage,
 				}
 			}
 			ss.logf("recording: error starting recording (failing open): %v", err)
-			return nil, nil
-		}
-		go func() {
-			err := <-errChan
-			if err == nil {
-				// Success.
-				ss.logf("recording: finished uploading recording")
-				return
+			if local == nil {
+				return nil, nil
 			}
-			if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
-				lastAttempt := attempts[len(attempts)-1]
-				lastAttempt.FailureMessage = err.Error()
-
-				eventType := tailcfg.SSHSessionRecordingFailed
-				if onFailure.TerminateSessionWithMessage != "" {
-					eventType = tailcfg.SSHSessionRecordingTerminated
+			// Otherwise, the session is still recorded locally.
+		} else {
+			if local != nil {
+				rec.out = &teeRecording{ss: ss, local: local, remote: remote, failOpen: rec.failOpen}
+			} else {
+				rec.out = remote
+			}
+			go func() {
+				err := <-errChan
+				if err == nil {
+					// Success.
+					ss.logf("recording: finished uploading recording")
+					return
 				}
+				if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
+					lastAttempt := attempts[len(attempts)-1]
+					lastAttempt.FailureMessage = err.Error()
 
-				ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
-			}
-			if onFailure != nil && onFailure.TerminateSessionWithMessage != "" {
-				ss.logf("recording: error uploading recording (closing session): %v", err)
-				ss.cancelCtx(userVisibleError{
-					error: err,
-					msg:   onFailure.TerminateSessionWithMessage,
-				})
-				return
-			}
-			ss.logf("recording: error uploading recording (failing open): %v", err)
-		}()
+					eventType := tailcfg.SSHSessionRecordingFailed
+					if onFailure.TerminateSessionWithMessage != "" {
+						eventType = tailcfg.SSHSessionRecordingTerminated
+					}
+
+					ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
+				}
+				if onFailure != nil && onFailure.TerminateSessionWithMessage != "" {
+					ss.logf("recording: error uploading recording (closing session): %v", err)
+					ss.cancelCtx(userVisibleError{
+						error: err,
+						msg:   onFailure.TerminateSessionWithMessage,
+					})
+					return
+				}
+				ss.logf("recording: error uploading recording (failing open): %v", err)
+			}()
+		}
 	}
 
 	ch := CastHeader{
@@ -1603,7 +1803,7 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		Width:     w.Width,
 		Height:    w.Height,
 		Timestamp: now.Unix(),
-		Command:   strings.Join(ss.Command(), " "),
+		Command:   ss.rawCommand(),
 		Env: map[string]string{
 			"TERM": term,
 			// TODO(bradfitz): anything else important?
@@ -1621,6 +1821,9 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		SrcNodeID:    ss.conn.info.node.StableID(),
 		ConnectionID: ss.conn.connID,
 	}
+	if ss.conn.finalAction.ForceCommand != "" {
+		ch.OriginalCommand = ss.RawCommand()
+	}
 	if !ss.conn.info.node.IsTagged() {
 		ch.SrcNodeUser = ss.conn.info.uprof.LoginName
 		ch.SrcNodeUserID = ss.conn.info.node.User()
@@ -1696,6 +1899,45 @@ type recording struct {
 	out io.WriteCloser
 }
 
+// teeRecording is the output of a recording to both local disk and a
+// recorder. Its writes are guarded by recording.mu.
+type teeRecording struct {
+	ss     *sshSession
+	local  io.WriteCloser
+	remote io.WriteCloser // or nil, after failing open
+
+	// failOpen specifies whether to keep recording locally if writing to
+	// remote fails.
+	failOpen bool
+}
+
+func (t *teeRecording) Write(p []byte) (int, error) {
+	if _, err := t.local.Write(p); err != nil {
+		return 0, err
+	}
+	if t.remote != nil {
+		if _, err := t.remote.Write(p); err != nil {
+			if !t.failOpen {
+				return 0, err
+			}
+			t.ss.logf("recording: error writing to recorder (failing open, still recording locally): %v", err)
+			t.remote.Close()
+			t.remote = nil
+		}
+	}
+	return len(p), nil
+}
+
+func (t *teeRecording) Close() error {
+	err := t.local.Close()
+	if t.remote != nil {
+		if rerr := t.remote.Close(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
 func (r *recording) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -1802,6 +2044,10 @@ func envEq(a, b string) bool {
 	metricHolds               = clientmetric.NewCounter("ssh_holds")
 	metricPolicyChangeKick    = clientmetric.NewCounter("ssh_policy_change_kick")
 	metricSFTP                = clientmetric.NewCounter("ssh_sftp_sessions")
+	metricCommandRejected     = clientmetric.NewCounter("ssh_command_rejected")
+	metricForcedCommand       = clientmetric.NewCounter("ssh_forced_command_sessions")
+	metricIdleTimeouts        = clientmetric.NewCounter("ssh_idle_timeouts")
+	metricSessionCgroupErrors = clientmetric.NewCounter("ssh_session_cgroup_errors")
 	metricLocalPortForward    = clientmetric.NewCounter("ssh_local_port_forward_requests")
 	metricRemotePortForward   = clientmetric.NewCounter("ssh_remote_port_forward_requests")
 )
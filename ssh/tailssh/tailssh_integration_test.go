@@ -35,7 +35,9 @@
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"tailscale.com/ipn"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/sessionrecording"
 	"tailscale.com/tailcfg"
 	glider "tailscale.com/tempfork/gliderlabs/ssh"
 	"tailscale.com/types/key"
@@ -633,6 +635,14 @@ func (tb *testBackend) NodeKey() key.NodePublic {
 	return key.NodePublic{}
 }
 
+func (tb *testBackend) SSHLocalRecordingPolicy() sessionrecording.LocalPolicy {
+	return sessionrecording.LocalPolicy{}
+}
+
+func (tb *testBackend) SSHUserCA() ipn.SSHUserCA {
+	return ipn.SSHUserCA{}
+}
+
 type addressFakingConn struct {
 	net.Conn
 }
@@ -22,8 +22,10 @@
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,10 +34,12 @@
 	"time"
 
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/memnet"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/sessionrecording"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tempfork/gliderlabs/ssh"
 	"tailscale.com/tsd"
@@ -232,6 +236,10 @@ type localState struct {
 	// It is served for paths like https://unused/ssh-action/<action-name>.
 	// The action name is the last part of the action URL.
 	serverActions map[string]*tailcfg.SSHAction
+
+	varRoot         string
+	recordingPolicy sessionrecording.LocalPolicy
+	userCA          ipn.SSHUserCA
 }
 
 var (
@@ -314,13 +322,21 @@ func (ts *localState) DoNoiseRequest(req *http.Request) (*http.Response, error)
 }
 
 func (ts *localState) TailscaleVarRoot() string {
-	return ""
+	return ts.varRoot
 }
 
 func (ts *localState) NodeKey() key.NodePublic {
 	return key.NewNode().Public()
 }
 
+func (ts *localState) SSHLocalRecordingPolicy() sessionrecording.LocalPolicy {
+	return ts.recordingPolicy
+}
+
+func (ts *localState) SSHUserCA() ipn.SSHUserCA {
+	return ts.userCA
+}
+
 func newSSHRule(action *tailcfg.SSHAction) *tailcfg.SSHRule {
 	return &tailcfg.SSHRule{
 		SSHUsers: map[string]string{
@@ -642,6 +658,123 @@ func TestSSHRecordingNonInteractive(t *testing.T) {
 	}
 }
 
+// TestSSHRecordingLocal tests that a session is recorded to local disk when
+// the local recording policy asks for it and no recorders are configured.
+func TestSSHRecordingLocal(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	varRoot := t.TempDir()
+	s := &server{
+		logf: logger.Discard,
+		lb: &localState{
+			sshEnabled:      true,
+			matchingRule:    newSSHRule(&tailcfg.SSHAction{Accept: true}),
+			varRoot:         varRoot,
+			recordingPolicy: sessionrecording.LocalPolicy{Mode: sessionrecording.ModeFallback},
+		},
+	}
+	defer s.Shutdown()
+
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+
+	const sshUser = "alice"
+	cfg := &gossh.ClientConfig{
+		User:            sshUser,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		client := gossh.NewClient(c, chans, reqs)
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		defer session.Close()
+		if _, err := session.CombinedOutput("echo Ran echo!"); err != nil {
+			t.Errorf("client: %v", err)
+		}
+	}()
+	if err := s.HandleSSHConn(dc); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wg.Wait()
+
+	dir := sessionrecording.Dir(varRoot)
+	infos, err := sessionrecording.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("got %d local recordings; want 1", len(infos))
+	}
+	if infos[0].SSHUser != sshUser || infos[0].Command != "echo Ran echo!" {
+		t.Errorf("recording = %+v; want SSHUser %q and the command", infos[0], sshUser)
+	}
+	f, err := sessionrecording.Open(dir, infos[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	if err := sessionrecording.Play(&out, f, 1000, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Ran echo!") {
+		t.Errorf("recorded output = %q; want the command's output", out.String())
+	}
+
+	// A forced command is recorded as the command, along with the one
+	// the client requested.
+	s.lb.(*localState).matchingRule = newSSHRule(&tailcfg.SSHAction{Accept: true, ForceCommand: "echo Forced!"})
+	sc, dc = memnet.NewTCPConn(src, dst, 1024)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		client := gossh.NewClient(c, chans, reqs)
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+		defer session.Close()
+		if _, err := session.CombinedOutput("echo Ran echo!"); err != nil {
+			t.Errorf("client: %v", err)
+		}
+	}()
+	if err := s.HandleSSHConn(dc); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wg.Wait()
+	infos, err = sessionrecording.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("got %d local recordings; want 2", len(infos))
+	}
+	if got := infos[1]; got.Command != "echo Forced!" || got.OriginalCommand != "echo Ran echo!" {
+		t.Errorf("recording = %+v; want the forced command and the original one", got)
+	}
+}
+
 func TestSSHAuthFlow(t *testing.T) {
 	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
 		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
@@ -979,6 +1112,30 @@ func TestSSH(t *testing.T) {
 			t.Errorf("got %q; want %q", got, str)
 		}
 	})
+
+	t.Run("no_user_certs", func(t *testing.T) {
+		setUserCA := func(ca *ipn.SSHUserCA) {
+			t.Helper()
+			if _, err := lb.EditPrefs(&ipn.MaskedPrefs{Prefs: ipn.Prefs{SSHUserCA: ca}, SSHUserCASet: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setUserCA(&ipn.SSHUserCA{KeyPath: filepath.Join(dir, "user-ca")})
+		defer setUserCA(nil)
+		for _, issue := range []bool{false, true} {
+			sc.finalAction = &tailcfg.SSHAction{Accept: true, IssueUserCerts: issue}
+			// Without agent forwarding requested, there is no agent
+			// socket, even if certificates may be issued.
+			got, err := execSSH("echo", "SSH_AUTH_SOCK=$SSH_AUTH_SOCK").Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m := parseEnv(got); m["SSH_AUTH_SOCK"] != "" {
+				t.Errorf("IssueUserCerts=%v: SSH_AUTH_SOCK = %q; want none", issue, m["SSH_AUTH_SOCK"])
+			}
+		}
+		sc.finalAction = sc.action0
+	})
 }
 
 func parseEnv(out []byte) map[string]string {
@@ -1077,6 +1234,190 @@ func TestExpandPublicKeyURL(t *testing.T) {
 	}
 }
 
+// commandSession is an ssh.Session that requests a command or subsystem.
+type commandSession struct {
+	ssh.Session
+	cmd, subsystem string
+}
+
+func (s commandSession) RawCommand() string { return s.cmd }
+func (s commandSession) Subsystem() string  { return s.subsystem }
+
+func TestCheckCommandAllowed(t *testing.T) {
+	ciAction := &tailcfg.SSHAction{
+		Accept:            true,
+		AllowedCommands:   []string{"git-upload-pack *", "rsync --server --sender -vlogDtpre.iLsfxC . *", "uptime"},
+		AllowedSubsystems: []string{"sftp"},
+	}
+	tests := []struct {
+		name      string
+		action    *tailcfg.SSHAction
+		cmd       string
+		subsystem string
+		wantErr   bool
+	}{
+		{name: "unrestricted-shell", action: &tailcfg.SSHAction{Accept: true}},
+		{name: "unrestricted-cmd", action: &tailcfg.SSHAction{Accept: true}, cmd: "rm -rf /tmp/x"},
+		{name: "shell", action: ciAction, wantErr: true},
+		{name: "exact", action: ciAction, cmd: "uptime"},
+		{name: "exact-with-args", action: ciAction, cmd: "uptime -p", wantErr: true},
+		{name: "prefix", action: ciAction, cmd: "git-upload-pack 'repos/tailscale.git'"},
+		{name: "prefix-rsync", action: ciAction, cmd: "rsync --server --sender -vlogDtpre.iLsfxC . /srv/build/"},
+		{name: "prefix-injection", action: ciAction, cmd: "git-upload-pack 'x'; rm -rf /", wantErr: true},
+		{name: "prefix-subst", action: ciAction, cmd: "git-upload-pack $(id)", wantErr: true},
+		{name: "prefix-extra-space", action: ciAction, cmd: "git-upload-pack  'repos/tailscale.git'"},
+		{name: "prefix-no-args", action: ciAction, cmd: "git-upload-pack", wantErr: true},
+		{name: "prefix-word", action: ciAction, cmd: "git-upload-packx 'x'", wantErr: true},
+		{name: "prefix-newline", action: ciAction, cmd: "git-upload-pack\nid 'x'", wantErr: true},
+		{name: "option-injection", action: ciAction, cmd: "git-upload-pack --upload-pack=touch /tmp/pwned", wantErr: true},
+		{name: "quoted-option-injection", action: ciAction, cmd: "git-upload-pack '--upload-pack=id' x", wantErr: true},
+		{name: "rsync-option-injection", action: ciAction, cmd: "rsync --server --sender -vlogDtpre.iLsfxC . -e sh /srv/build/", wantErr: true},
+		{name: "rsync-dot-injection", action: ciAction, cmd: "rsync --server --sender -vlogDtpre.iLsfxC --rsh=sh . /srv/build/", wantErr: true},
+		{name: "quote-injection", action: ciAction, cmd: "git-upload-pack 'x' 'y'z'", wantErr: true},
+		{name: "double-quotes", action: ciAction, cmd: `git-upload-pack "x"`, wantErr: true},
+		{name: "other-cmd", action: ciAction, cmd: "git-receive-pack 'x'", wantErr: true},
+		{name: "subsystem", action: ciAction, subsystem: "sftp"},
+		{name: "only-subsystems-cmd", action: &tailcfg.SSHAction{Accept: true, AllowedSubsystems: []string{"sftp"}}, cmd: "uptime", wantErr: true},
+		{name: "only-cmds-subsystem", action: &tailcfg.SSHAction{Accept: true, AllowedCommands: []string{"uptime"}}, subsystem: "sftp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := &sshSession{
+				Session: commandSession{cmd: tt.cmd, subsystem: tt.subsystem},
+				conn:    &conn{finalAction: tt.action},
+			}
+			err := ss.checkCommandAllowed()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkCommandAllowed = %v; want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForceCommand(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &sshSession{
+		Session: commandSession{subsystem: "sftp"},
+		ctx:     context.Background(),
+		conn: &conn{
+			srv: &server{
+				lb:             &localState{},
+				tailscaledPath: "/usr/sbin/tailscaled",
+			},
+			info: &sshConnInfo{
+				src:  netip.MustParseAddrPort("100.100.100.101:2231"),
+				node: (&tailcfg.Node{}).View(),
+			},
+			localUser:   &userMeta{User: *u},
+			finalAction: &tailcfg.SSHAction{Accept: true, ForceCommand: "/usr/local/bin/ci-gate"},
+		},
+	}
+	cmd, err := ss.newIncubatorCommand(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(cmd.Args, "--cmd=/usr/local/bin/ci-gate") || slices.Contains(cmd.Args, "--sftp") {
+		t.Errorf("incubator args = %q; want the forced command instead of sftp", cmd.Args)
+	}
+}
+
+func TestSessionLimitsIncubatorArgs(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &sshSession{
+		Session: commandSession{},
+		ctx:     context.Background(),
+		conn: &conn{
+			srv: &server{
+				lb:             &localState{},
+				tailscaledPath: "/usr/sbin/tailscaled",
+			},
+			info: &sshConnInfo{
+				src:  netip.MustParseAddrPort("100.100.100.101:2231"),
+				node: (&tailcfg.Node{}).View(),
+			},
+			localUser:    &userMeta{User: *u},
+			userGroupIDs: []string{u.Gid},
+			finalAction: &tailcfg.SSHAction{
+				Accept: true,
+				SessionLimits: &tailcfg.SSHSessionLimits{
+					MaxProcesses:   64,
+					MaxOpenFiles:   1024,
+					MaxMemoryBytes: 1 << 30,
+				},
+			},
+		},
+	}
+	tests := []struct {
+		name         string
+		cgroup       sessionCgroup
+		wantMaxProcs int
+	}{
+		{"no_cgroup", nil, 64},
+		{"cgroup_without_pids", fakeCgroup{limitsProcs: false}, 64},
+		{"cgroup_with_pids", fakeCgroup{limitsProcs: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss.cgroup = tt.cgroup
+			cmd, err := ss.newIncubatorCommand(t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ia, err := parseIncubatorArgs(cmd.Args[3:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ia.maxProcs != tt.wantMaxProcs || ia.maxOpenFiles != 1024 {
+				t.Errorf("maxProcs, maxOpenFiles = %d, %d; want %d, 1024", ia.maxProcs, ia.maxOpenFiles, tt.wantMaxProcs)
+			}
+		})
+	}
+}
+
+type fakeCgroup struct {
+	limitsProcs bool
+}
+
+func (fakeCgroup) Close() error            { return nil }
+func (fakeCgroup) apply(*exec.Cmd)         {}
+func (c fakeCgroup) limitsProcesses() bool { return c.limitsProcs }
+
+func TestIdleTimer(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	ss := &sshSession{ctx: ctx, cancelCtx: cancel}
+
+	const d = time.Minute
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	idle := ss.startIdleTimer(clock, d)
+	defer idle.stop()
+	w := idle.writer(io.Discard)
+	for range 5 {
+		clock.Advance(d - time.Second)
+		io.WriteString(w, "x")
+	}
+	if err := context.Cause(ctx); err != nil {
+		t.Fatalf("session canceled while active: %v", err)
+	}
+
+	clock.Advance(d)
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("idle session not canceled")
+	}
+	var uve userVisibleError
+	if err := context.Cause(ctx); !errors.As(err, &uve) || !strings.Contains(uve.msg, "idle") {
+		t.Errorf("cause = %v; want an idle userVisibleError", err)
+	}
+}
+
 func TestAcceptEnvPair(t *testing.T) {
 	tests := []struct {
 		in   string
@@ -145,7 +145,10 @@
 //   - 100: 2024-06-18: Client supports filtertype.Match.SrcCaps (issue #12542)
 //   - 101: 2024-07-01: Client supports SSH agent forwarding when handling connections with /bin/su
 //   - 102: 2024-07-12: NodeAttrDisableMagicSockCryptoRouting support
-const CurrentCapabilityVersion CapabilityVersion = 102
+//   - 103: 2024-07-24: Client enforces SSHAction.ForceCommand, AllowedCommands and AllowedSubsystems
+//   - 104: 2024-07-29: Client enforces SSHAction.SessionLimits
+//   - 105: 2024-08-02: Client issues SSH user certificates for SSHAction.IssueUserCerts from Prefs.SSHUserCA
+const CurrentCapabilityVersion CapabilityVersion = 105
 
 type StableID string
 
@@ -2327,6 +2330,13 @@ type Oauth2Token struct {
 	// NodeAttrDisableMagicSockCryptoRouting disables the use of the
 	// magicsock cryptorouting hook. See tailscale/corp#20732.
 	NodeAttrDisableMagicSockCryptoRouting NodeCapability = "disable-magicsock-crypto-routing"
+
+	// NodeAttrTrafficShaping limits the rate of traffic between the node
+	// and its peers. Its values are JSON objects of the form of
+	// ipn.ShapeRule: {"Peer": "tag:backup", "In": 10000000}, with rates in
+	// bits per second. They're combined with the node's local rules, the
+	// lower limit winning.
+	NodeAttrTrafficShaping NodeCapability = "traffic-shaping"
 )
 
 // SetDNSRequest is a request to add a DNS record.
@@ -2516,6 +2526,78 @@ type SSHAction struct {
 	// OnRecorderFailure is the action to take if recording fails.
 	// If nil, the default action is to fail open.
 	OnRecordingFailure *SSHRecorderFailureAction `json:"onRecordingFailure,omitempty"`
+
+	// ForceCommand, if non-empty, is a command to run for accepted sessions
+	// instead of the command, login shell or subsystem the client requested,
+	// like OpenSSH's ForceCommand. A requested command is passed to it in
+	// the SSH_ORIGINAL_COMMAND environment variable.
+	ForceCommand string `json:"forceCommand,omitempty"`
+
+	// AllowedCommands and AllowedSubsystems, if either is non-empty,
+	// restrict accepted sessions to running the listed commands and
+	// subsystems (such as "sftp"). Interactive shells and anything else
+	// are rejected.
+	//
+	// A command is allowed if it equals an entry of AllowedCommands, or if
+	// the entry ends in "*" and the command starts with the words of the
+	// rest of the entry, such as "git-upload-pack *". The words of a
+	// command matched by "*" may be wrapped in single quotes, but may not
+	// otherwise contain quotes or shell metacharacters, and may not start
+	// with "-". So entries must name the command as the server runs it,
+	// with all of its options fixed, like
+	// "rsync --server --sender -logDtpre.iLsfxC . *", rather than leave
+	// options to the client.
+	//
+	// The restrictions are checked against the command the client
+	// requested, before any ForceCommand replaces it.
+	AllowedCommands   []string `json:"allowedCommands,omitempty"`
+	AllowedSubsystems []string `json:"allowedSubsystems,omitempty"`
+
+	// SessionLimits, if non-nil, limits the resources each accepted session
+	// may use.
+	SessionLimits *SSHSessionLimits `json:"sessionLimits,omitempty"`
+
+	// IssueUserCerts, if true, offers accepted sessions that request agent
+	// forwarding short-lived OpenSSH user certificates, signed by the
+	// client's user CA (see ipn.Prefs.SSHUserCA), through their agent
+	// socket. Like agent forwarding, it's disabled by
+	// TS_SSH_DISABLE_FORWARDING.
+	IssueUserCerts bool `json:"issueUserCerts,omitempty"`
+}
+
+// SSHSessionLimits are the limits on the resources used by a Tailscale SSH
+// session, so that one user can't exhaust a shared host. Zero values mean no
+// limit.
+//
+// They are only enforced on Linux. MaxMemoryBytes and CPUWeight, and
+// MaxProcesses counted per session rather than per local user, need
+// tailscaled to be running as root with a writable cgroup v2 hierarchy.
+type SSHSessionLimits struct {
+	// MaxProcesses is the most processes (and threads) the session may
+	// run at once.
+	MaxProcesses int `json:"maxProcesses,omitempty"`
+
+	// MaxOpenFiles is the most files each process of the session may have
+	// open.
+	MaxOpenFiles int `json:"maxOpenFiles,omitempty"`
+
+	// MaxMemoryBytes is the most memory the processes of the session may
+	// use together.
+	MaxMemoryBytes int64 `json:"maxMemoryBytes,omitempty"`
+
+	// CPUWeight is the share of CPU time the session gets when the CPU is
+	// contended, relative to other sessions and to the default weight of
+	// 100. It is from 1 to 10000.
+	//
+	// MaxProcesses, MaxMemoryBytes and CPUWeight are enforced with a
+	// cgroup v2 per session, on Linux, if tailscaled's cgroup is delegated
+	// to it (such as with Delegate=yes in its systemd unit). Otherwise
+	// only MaxProcesses is enforced, per user, with RLIMIT_NPROC.
+	CPUWeight int `json:"cpuWeight,omitempty"`
+
+	// IdleTimeout, if non-zero, is how long the session may go without any
+	// input or output before it is terminated.
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
 }
 
 // SSHRecorderFailureAction is the action to take if recording fails.
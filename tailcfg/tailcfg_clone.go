@@ -528,6 +528,11 @@ func (src *SSHAction) Clone() *SSHAction {
 	if dst.OnRecordingFailure != nil {
 		dst.OnRecordingFailure = ptr.To(*src.OnRecordingFailure)
 	}
+	dst.AllowedCommands = append(src.AllowedCommands[:0:0], src.AllowedCommands...)
+	dst.AllowedSubsystems = append(src.AllowedSubsystems[:0:0], src.AllowedSubsystems...)
+	if dst.SessionLimits != nil {
+		dst.SessionLimits = ptr.To(*src.SessionLimits)
+	}
 	return dst
 }
 
@@ -543,6 +548,11 @@ func (src *SSHAction) Clone() *SSHAction {
 	AllowRemotePortForwarding bool
 	Recorders                 []netip.AddrPort
 	OnRecordingFailure        *SSHRecorderFailureAction
+	ForceCommand              string
+	AllowedCommands           []string
+	AllowedSubsystems         []string
+	SessionLimits             *SSHSessionLimits
+	IssueUserCerts            bool
 }{})
 
 // Clone makes a deep copy of SSHPrincipal.
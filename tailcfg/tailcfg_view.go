@@ -1197,6 +1197,23 @@ func (v SSHActionView) OnRecordingFailure() *SSHRecorderFailureAction {
 	return &x
 }
 
+func (v SSHActionView) ForceCommand() string { return v.ж.ForceCommand }
+func (v SSHActionView) AllowedCommands() views.Slice[string] {
+	return views.SliceOf(v.ж.AllowedCommands)
+}
+func (v SSHActionView) AllowedSubsystems() views.Slice[string] {
+	return views.SliceOf(v.ж.AllowedSubsystems)
+}
+func (v SSHActionView) SessionLimits() *SSHSessionLimits {
+	if v.ж.SessionLimits == nil {
+		return nil
+	}
+	x := *v.ж.SessionLimits
+	return &x
+}
+
+func (v SSHActionView) IssueUserCerts() bool { return v.ж.IssueUserCerts }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _SSHActionViewNeedsRegeneration = SSHAction(struct {
 	Message                   string
@@ -1209,6 +1226,11 @@ func (v SSHActionView) OnRecordingFailure() *SSHRecorderFailureAction {
 	AllowRemotePortForwarding bool
 	Recorders                 []netip.AddrPort
 	OnRecordingFailure        *SSHRecorderFailureAction
+	ForceCommand              string
+	AllowedCommands           []string
+	AllowedSubsystems         []string
+	SessionLimits             *SSHSessionLimits
+	IssueUserCerts            bool
 }{})
 
 // View returns a readonly view of SSHPrincipal.
@@ -0,0 +1,462 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// The files of a bundle are received into a staging directory in Dir,
+// named like a partial file (the bundle name followed by the sender's
+// ClientID.partialSuffix). It holds the manifest and, under bundleFilesDir,
+// the files received so far, each with partialSuffix until it is complete
+// and matches the manifest. Once all files are, bundleFilesDir is renamed
+// into place, which delivers the bundle atomically.
+const (
+	bundleManifestName = "manifest.json"
+	bundleFilesDir     = "files"
+)
+
+var (
+	ErrBundleNotStarted = errors.New("bundle not started")
+	ErrBundleMismatch   = errors.New("file does not match the bundle manifest")
+)
+
+// CheckBundlePath reports whether p is acceptable as the path of a file in
+// a bundle, returning ErrInvalidFileName if not. It must be slash-separated
+// and relative, and each of its elements must be acceptable to
+// CheckFileName.
+func CheckBundlePath(p string) error {
+	if p == "" || len(p) > 4096 {
+		return ErrInvalidFileName
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if err := CheckFileName(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckManifest reports whether manifest is well-formed: it lists at least
+// one file, its paths are valid and distinct (ignoring case, for the sake of
+// case-insensitive file systems), and no path is both a file and a
+// directory.
+func CheckManifest(manifest apitype.BundleManifest) error {
+	if len(manifest.Files) == 0 {
+		return errors.New("bundle has no files")
+	}
+	seen := make(map[string]bool, len(manifest.Files))
+	for _, f := range manifest.Files {
+		if err := CheckBundlePath(f.Path); err != nil {
+			return fmt.Errorf("invalid bundle path %q: %w", f.Path, err)
+		}
+		if f.Size < 0 {
+			return fmt.Errorf("invalid size of %q", f.Path)
+		}
+		if b, err := hex.DecodeString(f.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid SHA-256 of %q", f.Path)
+		}
+		key := strings.ToLower(f.Path)
+		if seen[key] {
+			return fmt.Errorf("duplicate bundle path %q", f.Path)
+		}
+		seen[key] = true
+	}
+	for _, f := range manifest.Files {
+		for dir := path.Dir(f.Path); dir != "."; dir = path.Dir(dir) {
+			if seen[strings.ToLower(dir)] {
+				return fmt.Errorf("bundle path %q is both a file and a directory", dir)
+			}
+		}
+	}
+	return nil
+}
+
+// StartBundle prepares to receive the files described by manifest from the
+// given sender, to be delivered to [Manager.Dir] as a directory named
+// baseName. The files are then sent with PutBundleFile.
+//
+// The bundle must be accepted by the [ReceivePolicy] as for PutFile, with
+// the limit on file size applying to each of its files.
+//
+// If the client had started to send the same bundle before, the files it
+// already sent are kept and their paths returned, so that it need not send
+// them again. Files it sent partially may be resumed as with PutFile, using
+// HashPartialBundleFile. A bundle with a different manifest replaces any
+// earlier one of the same name from the client.
+func (m *Manager) StartBundle(from Sender, baseName string, manifest apitype.BundleManifest) (received []string, err error) {
+	if err := m.checkCanReceive(); err != nil {
+		return nil, err
+	}
+	dstPath, err := joinDir(m.opts.Dir, baseName)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckManifest(manifest); err != nil {
+		return nil, err
+	}
+	if err := checkSender(m.receivePolicy(), from); err != nil {
+		return nil, err
+	}
+	id := from.ID
+	if _, ok := m.incomingFiles.Load(incomingFileKey{id, baseName}); ok {
+		return nil, ErrFileExists
+	}
+
+	redactAndLogError := func(action string, err error) error {
+		err = redactError(err)
+		m.opts.Logf("bundle %v error: %v", action, err)
+		return err
+	}
+
+	staging := dstPath + id.partialSuffix()
+	m.deleter.Remove(filepath.Base(staging))
+	// Until the bundle is delivered, its staging directory is deleted if
+	// the client doesn't finish sending it.
+	defer m.deleter.Insert(filepath.Base(staging))
+	m.noteReceiving()
+
+	if old, err := readBundleManifest(staging); err == nil && slices.Equal(old.Files, manifest.Files) {
+		var receivedSize int64
+		for _, f := range manifest.Files {
+			if fi, err := os.Stat(bundleFilePath(staging, f.Path)); err == nil && fi.Size() == f.Size {
+				received = append(received, f.Path)
+				receivedSize += f.Size
+			}
+		}
+		if err := m.checkBundle(manifest, receivedSize); err != nil {
+			return nil, err
+		}
+		return received, nil
+	}
+
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, redactAndLogError("RemoveAll", err)
+	}
+	if err := m.checkBundle(manifest, 0); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(staging, bundleFilesDir), 0777); err != nil {
+		return nil, redactAndLogError("MkdirAll", err)
+	}
+	j, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(staging, bundleManifestName), j, 0666); err != nil {
+		return nil, redactAndLogError("WriteFile", err)
+	}
+	return nil, nil
+}
+
+// PutBundleFile stores the file at relPath in the bundle baseName from the
+// given sender, which must have been started with StartBundle. The
+// offset and length are as for PutFile.
+//
+// The file must match the size and SHA-256 in the manifest, or else
+// ErrBundleMismatch is returned and it is discarded. When the last file of
+// the bundle is received, the bundle is delivered and delivered is true.
+// If a file or directory named baseName already exists where it's
+// delivered, it is delivered with a name chosen by NextFilename.
+//
+// While a file is being received, [Manager.IncomingFiles] reports the
+// progress of the bundle as a whole, under baseName. The bundle is added to
+// the [Manager.History] when it's delivered, or when the receive policy
+// rejects one of its files. Other failures aren't, as the sender may resume
+// the bundle.
+func (m *Manager) PutBundleFile(from Sender, baseName, relPath string, r io.Reader, offset, length int64) (delivered bool, err error) {
+	if err := m.checkCanReceive(); err != nil {
+		return false, err
+	}
+	stagingBase, err := joinDir(m.opts.Dir, baseName)
+	if err != nil {
+		return false, err
+	}
+	if err := CheckBundlePath(relPath); err != nil {
+		return false, err
+	}
+	if err := checkSender(m.receivePolicy(), from); err != nil {
+		return false, err
+	}
+	dstDir, err := m.dstDir(from)
+	if err != nil {
+		return false, err
+	}
+	dstPath := filepath.Join(dstDir, baseName)
+	id := from.ID
+
+	redactAndLogError := func(action string, err error) error {
+		err = redactError(err)
+		m.opts.Logf("bundle put %v error: %v", action, err)
+		return err
+	}
+
+	staging := stagingBase + id.partialSuffix()
+	manifest, err := readBundleManifest(staging)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, ErrBundleNotStarted
+		}
+		return false, redactAndLogError("ReadManifest", err)
+	}
+	// The bundle is added to the history once delivered or rejected, as
+	// having started when StartBundle was called.
+	t0 := m.opts.Clock.Now()
+	if fi, err := os.Stat(filepath.Join(staging, bundleManifestName)); err == nil {
+		t0 = fi.ModTime()
+	}
+	defer func() {
+		if delivered || isRejection(err) {
+			var total int64
+			for _, f := range manifest.Files {
+				total += f.Size
+			}
+			m.recordReceive(from, baseName, t0, total, nil, err)
+		}
+	}()
+	i := slices.IndexFunc(manifest.Files, func(f apitype.BundleFile) bool { return f.Path == relPath })
+	if i < 0 {
+		return false, ErrBundleMismatch
+	}
+	want := manifest.Files[i]
+	filePath := bundleFilePath(staging, relPath)
+	partialPath := filePath + partialSuffix
+
+	inFileKey := incomingFileKey{id, baseName}
+	inFile, loaded := m.incomingFiles.LoadOrInit(inFileKey, func() *incomingFile {
+		var total, received int64
+		for _, f := range manifest.Files {
+			total += f.Size
+			if f.Path == relPath {
+				received += offset
+			} else if fi, err := os.Stat(bundleFilePath(staging, f.Path)); err == nil {
+				received += fi.Size()
+			}
+		}
+		inFile := &incomingFile{
+			clock:          m.opts.Clock,
+			started:        m.opts.Clock.Now(),
+			size:           total,
+			sendFileNotify: m.opts.SendFileNotify,
+			copied:         received,
+		}
+		if m.opts.DirectFileMode {
+			inFile.partialPath = staging
+			inFile.finalPath = dstPath
+		}
+		return inFile
+	})
+	if loaded {
+		return false, ErrFileExists
+	}
+	defer m.incomingFiles.Delete(inFileKey)
+	m.deleter.Remove(filepath.Base(staging)) // avoid deleting the bundle while receiving
+	defer func() {
+		if !delivered {
+			m.deleter.Insert(filepath.Base(staging))
+		}
+	}()
+
+	if err := os.MkdirAll(filepath.Dir(partialPath), 0777); err != nil {
+		return false, redactAndLogError("MkdirAll", err)
+	}
+	f, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return false, redactAndLogError("Create", err)
+	}
+	defer f.Close() // best-effort to cleanup dangling file handles
+	inFile.w = f
+
+	// A positive offset implies that we are resuming an existing file.
+	if offset != 0 {
+		currLength, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return false, redactAndLogError("Seek", err)
+		}
+		if offset < 0 || offset > currLength {
+			return false, redactAndLogError("Seek", errors.New("offset out of range"))
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return false, redactAndLogError("Seek", err)
+		}
+		if err := f.Truncate(offset); err != nil {
+			return false, redactAndLogError("Truncate", err)
+		}
+	}
+
+	r = &limitReader{r: r, n: max(want.Size-offset, 0), err: ErrBundleMismatch}
+	if m.receivePolicy().MaxPendingBytes > 0 {
+		res, err := m.reservePending(max(want.Size-offset, 0))
+		if err != nil {
+			return false, err
+		}
+		defer res.release()
+		r = &pendingReader{r: r, res: res}
+	}
+	copyLength, err := io.Copy(inFile, r)
+	if err == ErrBundleMismatch {
+		f.Close()
+		os.Remove(partialPath)
+		return false, err
+	} else if err != nil {
+		return false, redactAndLogError("Copy", err)
+	}
+	if length >= 0 && copyLength != length {
+		return false, redactAndLogError("Copy", errors.New("copied an unexpected number of bytes"))
+	}
+	if err := f.Close(); err != nil {
+		return false, redactAndLogError("Close", err)
+	}
+	sum, err := sha256File(partialPath)
+	if err != nil {
+		return false, redactAndLogError("Hash", err)
+	}
+	if offset+copyLength != want.Size || !strings.EqualFold(hex.EncodeToString(sum[:]), want.SHA256) {
+		os.Remove(partialPath)
+		return false, ErrBundleMismatch
+	}
+	if err := os.Rename(partialPath, filePath); err != nil {
+		return false, redactAndLogError("Rename", err)
+	}
+
+	for _, f := range manifest.Files {
+		if _, err := os.Stat(bundleFilePath(staging, f.Path)); err != nil {
+			return false, nil // more files to come
+		}
+	}
+
+	inFile.mu.Lock()
+	inFile.done = true
+	inFile.mu.Unlock()
+
+	// All files have been received, so rename the bundle into place. If a
+	// file or directory of that name already exists, then try multiple
+	// times with variations of the name.
+	if err := os.MkdirAll(dstDir, 0777); err != nil {
+		return false, redactAndLogError("MkdirAll", err)
+	}
+	maxRetries := 10
+	for ; maxRetries > 0; maxRetries-- {
+		err := func() error {
+			m.renameMu.Lock()
+			defer m.renameMu.Unlock()
+			switch _, err := os.Lstat(dstPath); {
+			case os.IsNotExist(err):
+				return os.Rename(filepath.Join(staging, bundleFilesDir), dstPath)
+			case err != nil:
+				return err
+			default:
+				return fs.ErrExist
+			}
+		}()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return false, redactAndLogError("Rename", err)
+		}
+		dstPath = NextFilename(dstPath)
+		inFile.finalPath = dstPath
+	}
+	if maxRetries <= 0 {
+		return false, errors.New("too many retries trying to rename bundle")
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		m.opts.Logf("bundle RemoveAll error: %v", redactError(err)) // non-fatal error
+	}
+	m.totalReceived.Add(1)
+	m.opts.SendFileNotify()
+	return true, nil
+}
+
+// HashPartialBundleFile is like HashPartialFile, but for the file at
+// relPath in the bundle baseName.
+func (m *Manager) HashPartialBundleFile(id ClientID, baseName, relPath string) (next func() (BlockChecksum, error), close func() error, err error) {
+	if m == nil || m.opts.Dir == "" {
+		return nil, nil, ErrNoTaildrop
+	}
+	dstPath, err := joinDir(m.opts.Dir, baseName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := CheckBundlePath(relPath); err != nil {
+		return nil, nil, err
+	}
+	return hashFileBlocks(bundleFilePath(dstPath+id.partialSuffix(), relPath) + partialSuffix)
+}
+
+// bundleFilePath returns the path of the file at relPath in the bundle
+// staging directory staging.
+func bundleFilePath(staging, relPath string) string {
+	return filepath.Join(staging, bundleFilesDir, filepath.FromSlash(relPath))
+}
+
+func readBundleManifest(staging string) (apitype.BundleManifest, error) {
+	var manifest apitype.BundleManifest
+	j, err := os.ReadFile(filepath.Join(staging, bundleManifestName))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(j, &manifest); err != nil {
+		return manifest, err
+	}
+	return manifest, CheckManifest(manifest)
+}
+
+// joinWaitingFile is like joinDir, but also accepts the names of the files
+// of delivered bundles, as listed by WaitingFiles.
+func joinWaitingFile(dir, name string) (fullPath string, err error) {
+	if !strings.Contains(name, "/") {
+		return joinDir(dir, name)
+	}
+	if err := CheckBundlePath(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// rangeBundleFiles calls fn for each regular file in the delivered bundle
+// directory dir of [Manager.Dir], with its name as listed by WaitingFiles.
+func rangeBundleFiles(root, dir string, fn func(name string, de fs.DirEntry) bool) error {
+	return filepath.WalkDir(filepath.Join(root, dir), func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.Type().IsRegular() || isPartialOrDeleted(de.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if !fn(filepath.ToSlash(rel), de) {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+}
+
+// removeEmptyParents removes the directories containing the file at p that
+// are empty, up to but not including root.
+func removeEmptyParents(root, p string) {
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
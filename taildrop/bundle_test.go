@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/util/must"
+)
+
+func TestCheckManifest(t *testing.T) {
+	sum := hex.EncodeToString(make([]byte, sha256.Size))
+	file := func(p string) apitype.BundleFile { return apitype.BundleFile{Path: p, SHA256: sum} }
+	tests := []struct {
+		name    string
+		files   []apitype.BundleFile
+		wantErr bool
+	}{
+		{"ok", []apitype.BundleFile{file("a"), file("sub/b"), file("sub/deeper/c")}, false},
+		{"empty", nil, true},
+		{"traversal", []apitype.BundleFile{file("../a")}, true},
+		{"inner-traversal", []apitype.BundleFile{file("sub/../../a")}, true},
+		{"absolute", []apitype.BundleFile{file("/etc/passwd")}, true},
+		{"dot", []apitype.BundleFile{file("./a")}, true},
+		{"trailing-slash", []apitype.BundleFile{file("a/")}, true},
+		{"backslash", []apitype.BundleFile{file(`a\b`)}, true},
+		{"partial", []apitype.BundleFile{file("a.partial")}, true},
+		{"duplicate", []apitype.BundleFile{file("a"), file("A")}, true},
+		{"file-and-dir", []apitype.BundleFile{file("a"), file("a/b")}, true},
+		{"bad-sum", []apitype.BundleFile{{Path: "a", SHA256: "abc"}}, true},
+		{"negative-size", []apitype.BundleFile{{Path: "a", Size: -1, SHA256: sum}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckManifest(apitype.BundleManifest{Files: tt.files})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckManifest() = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBundle(t *testing.T) {
+	oldBlockSize := blockSize
+	defer func() { blockSize = oldBlockSize }()
+	blockSize = 256
+
+	dir := t.TempDir()
+	m := ManagerOptions{Logf: t.Logf, Dir: dir}.New()
+	defer m.Shutdown()
+	from := Sender{ID: "id"}
+
+	contents := map[string][]byte{
+		"a.txt":         []byte("hello"),
+		"sub/b.bin":     bytes.Repeat([]byte("0123456789"), 100),
+		"sub/deep/c.md": {},
+	}
+	var manifest apitype.BundleManifest
+	for _, p := range []string{"a.txt", "sub/b.bin", "sub/deep/c.md"} {
+		sum := sha256.Sum256(contents[p])
+		manifest.Files = append(manifest.Files, apitype.BundleFile{
+			Path:   p,
+			Size:   int64(len(contents[p])),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	if _, err := m.PutBundleFile(from, "photos", "a.txt", bytes.NewReader(contents["a.txt"]), 0, 5); err != ErrBundleNotStarted {
+		t.Fatalf("put before start = %v, want ErrBundleNotStarted", err)
+	}
+	if got := must.Get(m.StartBundle(from, "photos", manifest)); len(got) != 0 {
+		t.Fatalf("new bundle has received files %q", got)
+	}
+	if _, err := m.PutBundleFile(from, "photos", "a.txt", strings.NewReader("jello"), 0, 5); err != ErrBundleMismatch {
+		t.Errorf("put of wrong contents = %v, want ErrBundleMismatch", err)
+	}
+	if _, err := m.PutBundleFile(from, "photos", "other", strings.NewReader("x"), 0, 1); err != ErrBundleMismatch {
+		t.Errorf("put of file not in manifest = %v, want ErrBundleMismatch", err)
+	}
+	if delivered := must.Get(m.PutBundleFile(from, "photos", "a.txt", bytes.NewReader(contents["a.txt"]), 0, 5)); delivered {
+		t.Fatalf("bundle delivered early")
+	}
+
+	// Fail partway through a file, then start the bundle again and
+	// resume it.
+	b := contents["sub/b.bin"]
+	r := io.MultiReader(bytes.NewReader(b[:600]), iotest.ErrReader(io.ErrClosedPipe))
+	if _, err := m.PutBundleFile(from, "photos", "sub/b.bin", r, 0, -1); err == nil {
+		t.Fatalf("put of failed reader succeeded")
+	}
+	if got := must.Get(m.StartBundle(from, "photos", manifest)); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("received files = %q, want [a.txt]", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photos")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("bundle delivered before all files were received")
+	}
+	next, close, err := m.HashPartialBundleFile("id", "photos", "sub/b.bin")
+	must.Do(err)
+	offset, rest, err := ResumeReader(bytes.NewReader(b), next)
+	must.Do(err)
+	must.Do(close())
+	if offset != 600 {
+		t.Errorf("resume offset = %d, want 600", offset)
+	}
+	if delivered := must.Get(m.PutBundleFile(from, "photos", "sub/b.bin", rest, offset, -1)); delivered {
+		t.Fatalf("bundle delivered early")
+	}
+	if delivered := must.Get(m.PutBundleFile(from, "photos", "sub/deep/c.md", bytes.NewReader(nil), 0, 0)); !delivered {
+		t.Fatalf("bundle not delivered after its last file")
+	}
+
+	for p, want := range contents {
+		got := must.Get(os.ReadFile(filepath.Join(dir, "photos", filepath.FromSlash(p))))
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content mismatches", p)
+		}
+	}
+	entries := must.Get(os.ReadDir(dir))
+	if len(entries) != 1 || entries[0].Name() != "photos" {
+		t.Errorf("Dir has %v, want only the bundle", entries)
+	}
+
+	if !m.HasFilesWaiting() {
+		t.Errorf("HasFilesWaiting = false with a bundle waiting")
+	}
+	wfs := must.Get(m.WaitingFiles())
+	var names []string
+	for _, wf := range wfs {
+		names = append(names, wf.Name)
+	}
+	if want := []string{"photos/a.txt", "photos/sub/b.bin", "photos/sub/deep/c.md"}; !slices.Equal(names, want) {
+		t.Errorf("WaitingFiles = %q, want %q", names, want)
+	}
+	rc, size, err := m.OpenFile("photos/sub/b.bin")
+	must.Do(err)
+	rc.Close()
+	if size != int64(len(b)) {
+		t.Errorf("OpenFile size = %d, want %d", size, len(b))
+	}
+	if _, _, err := m.OpenFile("photos/../../etc/passwd"); err == nil {
+		t.Errorf("OpenFile outside of Dir succeeded")
+	}
+	for _, name := range names {
+		must.Do(m.DeleteFile(name))
+	}
+	if entries := must.Get(os.ReadDir(dir)); len(entries) != 0 {
+		t.Errorf("Dir has %v after deleting all files, want nothing", entries)
+	}
+}
@@ -75,7 +75,9 @@ func (d *fileDeleter) Init(m *Manager, eventHook func(string)) {
 			switch {
 			case d.shutdownCtx.Err() != nil:
 				return false // terminate early
-			case !de.Type().IsRegular():
+			case de.IsDir() && !strings.HasSuffix(de.Name(), partialSuffix):
+				return true
+			case !de.IsDir() && !de.Type().IsRegular():
 				return true
 			case strings.HasSuffix(de.Name(), partialSuffix):
 				// Only enqueue the file for deletion if there is no active put.
@@ -155,7 +157,11 @@ func (d *fileDeleter) waitAndDelete(wait time.Duration) {
 					continue
 				}
 			}
-			if err := os.Remove(filepath.Join(d.dir, file.name)); err != nil && !os.IsNotExist(err) {
+			remove := os.Remove
+			if strings.HasSuffix(file.name, partialSuffix) {
+				remove = os.RemoveAll // partial files may be bundle staging directories
+			}
+			if err := remove(filepath.Join(d.dir, file.name)); err != nil && !os.IsNotExist(err) {
 				d.logf("could not delete: %v", redactError(err))
 				failed = append(failed, elem)
 				continue
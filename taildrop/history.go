@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+)
+
+// maxHistory is the number of finished transfers kept in the history.
+const maxHistory = 200
+
+// History returns the finished transfers, both sent and received, oldest
+// first. It has at most the last 200 transfers.
+func (m *Manager) History() []ipn.FileTransfer {
+	if m == nil {
+		return nil
+	}
+	m.historyMu.Lock()
+	defer m.historyMu.Unlock()
+	m.loadHistoryLocked()
+	return slices.Clone(m.history)
+}
+
+// RecordTransfer adds the finished transfer t to the history, stores the
+// history in [ManagerOptions.State] if there is one, and reports t to
+// [ManagerOptions.TransferDone].
+//
+// Received files are recorded by the Manager itself. Sent files are
+// recorded by the caller.
+func (m *Manager) RecordTransfer(t ipn.FileTransfer) {
+	m.historyMu.Lock()
+	m.loadHistoryLocked()
+	m.history = append(m.history, t)
+	if n := len(m.history) - maxHistory; n > 0 {
+		m.history = slices.Delete(m.history, 0, n)
+	}
+	if m.opts.State != nil {
+		if j, err := json.Marshal(m.history); err != nil {
+			m.opts.Logf("history Marshal error: %v", err)
+		} else if err := m.opts.State.WriteState(ipn.TaildropHistoryKey, j); err != nil {
+			m.opts.Logf("history WriteState error: %v", err) // non-fatal error
+		}
+	}
+	m.historyMu.Unlock()
+	m.opts.TransferDone(t)
+}
+
+// loadHistoryLocked loads the history from State, if it hasn't been already.
+// m.historyMu must be held.
+func (m *Manager) loadHistoryLocked() {
+	if m.historyLoaded {
+		return
+	}
+	m.historyLoaded = true
+	if m.opts.State == nil {
+		return
+	}
+	j, err := m.opts.State.ReadState(ipn.TaildropHistoryKey)
+	if err != nil {
+		if !errors.Is(err, ipn.ErrStateNotExist) {
+			m.opts.Logf("history ReadState error: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(j, &m.history); err != nil {
+		m.opts.Logf("history Unmarshal error: %v", err)
+		m.history = nil
+	}
+}
+
+// isRejection reports whether err, from receiving a file, is the receive
+// policy rejecting it. Unlike other failures once some of a file is
+// stored, which the sender may resume, a rejection ends the transfer.
+func isRejection(err error) bool {
+	return errors.Is(err, ErrSenderNotAllowed) || errors.Is(err, ErrFileTooLarge) || errors.Is(err, ErrPendingLimit)
+}
+
+// recordReceive records the end of receiving the file name from the sender,
+// which started at t0. On success, size is the file's size and sum its
+// SHA-256; on failure, size is the declared size or -1, and sum is nil.
+func (m *Manager) recordReceive(from Sender, name string, t0 time.Time, size int64, sum []byte, err error) {
+	t := ipn.FileTransfer{
+		PeerID:    tailcfg.StableNodeID(from.ID),
+		PeerName:  from.Name,
+		Name:      name,
+		Size:      size,
+		Started:   t0,
+		Duration:  m.opts.Clock.Since(t0),
+		Succeeded: err == nil,
+	}
+	if err != nil {
+		t.Error = err.Error()
+	} else if sum != nil {
+		t.SHA256 = hex.EncodeToString(sum)
+	}
+	m.RecordTransfer(t)
+}
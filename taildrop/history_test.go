@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	store := new(mem.Store)
+	var done []ipn.FileTransfer
+	opts := ManagerOptions{
+		Logf:          t.Logf,
+		Dir:           dir,
+		State:         store,
+		ReceivePolicy: ReceivePolicy{MaxFileSize: 10},
+		TransferDone:  func(ft ipn.FileTransfer) { done = append(done, ft) },
+	}
+	m := opts.New()
+	defer m.Shutdown()
+
+	from := Sender{ID: "n1", Name: "peer"}
+	if _, err := m.PutFile(from, "foo", strings.NewReader("hello"), 0, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.PutFile(from, "big", strings.NewReader("hello, world"), 0, 12); err == nil {
+		t.Fatal("PutFile of too large file succeeded")
+	}
+	// A broken transfer isn't recorded, as it may be resumed.
+	broken := io.MultiReader(strings.NewReader("he"), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := m.PutFile(from, "resumed", broken, 0, 5); err == nil {
+		t.Fatal("PutFile of broken transfer succeeded")
+	}
+	m.RecordTransfer(ipn.FileTransfer{Outgoing: true, PeerID: "n2", Name: "bar", Size: 3, Succeeded: true})
+
+	check := func(got []ipn.FileTransfer) {
+		t.Helper()
+		if len(got) != 3 {
+			t.Fatalf("got %d transfers, want 3: %+v", len(got), got)
+		}
+		sum := sha256.Sum256([]byte("hello"))
+		if g := got[0]; g.Outgoing || g.PeerID != tailcfg.StableNodeID("n1") || g.PeerName != "peer" ||
+			g.Name != "foo" || g.Size != 5 || !g.Succeeded || g.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("received transfer = %+v", g)
+		}
+		if g := got[1]; g.Name != "big" || g.Size != 12 || g.Succeeded || !strings.Contains(g.Error, "larger") || g.SHA256 != "" {
+			t.Errorf("failed transfer = %+v", g)
+		}
+		if g := got[2]; !g.Outgoing || g.Name != "bar" {
+			t.Errorf("sent transfer = %+v", g)
+		}
+	}
+	check(m.History())
+	check(done)
+
+	// The history is kept in State.
+	m2 := opts.New()
+	defer m2.Shutdown()
+	check(m2.History())
+
+	for range maxHistory {
+		m2.RecordTransfer(ipn.FileTransfer{Name: "x"})
+	}
+	if got := m2.History(); len(got) != maxHistory || got[0].Name != "x" {
+		t.Errorf("history has %d transfers, oldest %q; want %d, all x", len(got), got[0].Name, maxHistory)
+	}
+}
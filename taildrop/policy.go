@@ -0,0 +1,320 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/util/mak"
+)
+
+var (
+	ErrSenderNotAllowed = errors.New("sender is not allowed to send files to this node")
+	ErrFileTooLarge     = errors.New("file is larger than this node accepts")
+	ErrPendingLimit     = errors.New("too many bytes of files are waiting on this node")
+)
+
+// Sender identifies the peer sending files, for the [ReceivePolicy].
+type Sender struct {
+	// ID identifies the sending node, for resuming partial files.
+	// It is the node's tailcfg.StableNodeID.
+	ID ClientID
+
+	// Name is the sending node's name, for the transfer history.
+	Name string
+
+	// User is the login name of the user owning the sending node,
+	// or empty if the node is tagged.
+	User string
+
+	// Tags are the ACL tags of the sending node, like "tag:server".
+	Tags []string
+}
+
+// matches reports whether s is the user or has the tag named by
+// userOrTag.
+func (s Sender) matches(userOrTag string) bool {
+	return s.User != "" && s.User == userOrTag || slices.Contains(s.Tags, userOrTag)
+}
+
+// ReceivePolicy limits what files a [Manager] accepts and says where it puts
+// them, with [Manager.Dir] as the Taildrop directory. The zero value accepts
+// any file from any sender into [Manager.Dir].
+type ReceivePolicy = ipn.TaildropReceivePolicy
+
+// checkSender returns ErrSenderNotAllowed if from may not send files.
+func checkSender(p *ReceivePolicy, from Sender) error {
+	if len(p.AllowedSenders) == 0 || slices.ContainsFunc(p.AllowedSenders, from.matches) {
+		return nil
+	}
+	return ErrSenderNotAllowed
+}
+
+// senderDir returns the subdirectory of Dir for files from the sender, or
+// the empty string if they go in Dir itself.
+func senderDir(p *ReceivePolicy, from Sender) (string, error) {
+	sub, ok := p.SenderDirs[from.User]
+	if !ok || from.User == "" {
+		sub = ""
+		for _, tag := range from.Tags {
+			if sub, ok = p.SenderDirs[tag]; ok {
+				break
+			}
+		}
+	}
+	if sub == "" {
+		return "", nil
+	}
+	if err := CheckFileName(sub); err != nil {
+		return "", fmt.Errorf("invalid sender directory %q in receive policy", sub)
+	}
+	return sub, nil
+}
+
+// checkReceive reports whether a file of size bytes from the sender is
+// accepted by the receive policy, when receiving it from offset. A negative
+// size means the size is unknown.
+//
+// If it is, it returns r limited to the bytes the policy accepts, which
+// fails with an error wrapping ErrFileTooLarge or ErrPendingLimit if more
+// are sent. The returned release func must be called once the file is no
+// longer being received.
+func (m *Manager) checkReceive(from Sender, r io.Reader, offset, size int64) (_ io.Reader, release func(), err error) {
+	p := m.receivePolicy()
+	if err := checkSender(p, from); err != nil {
+		return nil, nil, err
+	}
+	if p.MaxFileSize > 0 {
+		if size > p.MaxFileSize {
+			return nil, nil, m.fileTooLarge()
+		}
+		r = &limitReader{r: r, n: max(p.MaxFileSize-offset, 0), err: m.fileTooLarge()}
+	}
+	if p.MaxPendingBytes <= 0 {
+		return r, func() {}, nil
+	}
+	res, err := m.reservePending(max(size-offset, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &pendingReader{r: r, res: res}, res.release, nil
+}
+
+// checkBundle reports whether a bundle with manifest is accepted by the
+// receive policy, when received bytes of it have already been received.
+// The space for each file is reserved when it's sent.
+func (m *Manager) checkBundle(manifest apitype.BundleManifest, received int64) error {
+	p := m.receivePolicy()
+	var total int64
+	for _, f := range manifest.Files {
+		if p.MaxFileSize > 0 && f.Size > p.MaxFileSize {
+			return m.fileTooLarge()
+		}
+		total += f.Size
+	}
+	if p.MaxPendingBytes > 0 {
+		m.pendingMu.Lock()
+		defer m.pendingMu.Unlock()
+		avail, err := m.pendingAvailLocked(total - received)
+		if err != nil {
+			return err
+		}
+		if total-received > avail {
+			return m.pendingLimit()
+		}
+	}
+	return nil
+}
+
+// pendingReservation is space reserved in [Manager.Dir] for a file being
+// received, counted against the MaxPendingBytes of the [ReceivePolicy].
+type pendingReservation struct {
+	m       *Manager
+	n       int64        // bytes reserved; guarded by m.pendingMu
+	written atomic.Int64 // bytes written so far, at most n
+}
+
+// reservePending reserves n bytes for a file being received, returning an
+// error wrapping ErrPendingLimit if they would exceed MaxPendingBytes.
+func (m *Manager) reservePending(n int64) (*pendingReservation, error) {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	avail, err := m.pendingAvailLocked(n)
+	if err != nil {
+		return nil, err
+	}
+	if n > avail {
+		return nil, m.pendingLimit()
+	}
+	res := &pendingReservation{m: m, n: n}
+	mak.Set(&m.pendingFiles, res, struct{}{})
+	return res, nil
+}
+
+// grow reserves up to n more bytes, for a file that turns out larger than
+// first reserved. It returns how many it reserved, which is zero if
+// MaxPendingBytes is reached.
+func (res *pendingReservation) grow(n int64) int64 {
+	m := res.m
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	avail, err := m.pendingAvailLocked(1)
+	if err != nil {
+		m.opts.Logf("counting pending bytes: %v", err)
+		return 0
+	}
+	n = min(n, avail)
+	res.n += n
+	return n
+}
+
+// release ends the reservation. The bytes written are counted as stored in
+// [Manager.Dir] from then on.
+func (res *pendingReservation) release() {
+	m := res.m
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	if m.pendingFiles.Contains(res) {
+		m.pendingFiles.Delete(res)
+		m.pendingStored += res.written.Load()
+	}
+}
+
+// pendingAvailLocked returns how many more bytes may be reserved under
+// MaxPendingBytes. The bytes stored in [Manager.Dir] are counted once and
+// then tracked as files are received. Files removed since only make that
+// count too high, so if fewer than want bytes are available, it counts
+// them again. m.pendingMu must be held.
+func (m *Manager) pendingAvailLocked(want int64) (int64, error) {
+	avail := func() int64 {
+		used := m.pendingStored
+		for res := range m.pendingFiles {
+			used += res.n
+		}
+		return max(m.receivePolicy().MaxPendingBytes-used, 0)
+	}
+	if m.pendingCounted {
+		if n := avail(); n >= want {
+			return n, nil
+		}
+	}
+	// The files being received are in Dir too, but their bytes are
+	// already counted by their reservations. Load how many they wrote
+	// before walking Dir, so that the count errs on the high side.
+	var inFlight int64
+	for res := range m.pendingFiles {
+		inFlight += res.written.Load()
+	}
+	stored, err := pendingBytes(m.opts.Dir)
+	if err != nil {
+		return 0, redactError(err)
+	}
+	m.pendingStored = max(stored-inFlight, 0)
+	m.pendingCounted = true
+	return avail(), nil
+}
+
+// pendingReader reads from r the bytes reserved by res, growing the
+// reservation if r has more.
+type pendingReader struct {
+	r   io.Reader
+	res *pendingReservation
+}
+
+func (pr *pendingReader) Read(p []byte) (int, error) {
+	res := pr.res
+	res.m.pendingMu.Lock()
+	left := res.n - res.written.Load()
+	res.m.pendingMu.Unlock()
+	if left <= 0 && len(p) > 0 {
+		if left = res.grow(int64(len(p))); left == 0 {
+			return 0, res.m.pendingLimit()
+		}
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := pr.r.Read(p)
+	res.written.Add(int64(n))
+	return n, err
+}
+
+// SetReceivePolicy replaces the receive policy, as set by
+// [ManagerOptions.ReceivePolicy]. A nil policy accepts any file.
+func (m *Manager) SetReceivePolicy(p *ReceivePolicy) {
+	if p == nil {
+		p = new(ReceivePolicy)
+	}
+	m.policy.Store(p.Clone())
+
+	// Files received while there was no MaxPendingBytes weren't counted.
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	m.pendingCounted = false
+}
+
+func (m *Manager) receivePolicy() *ReceivePolicy {
+	return m.policy.Load()
+}
+
+func (m *Manager) fileTooLarge() error {
+	return fmt.Errorf("%w (maximum %d bytes)", ErrFileTooLarge, m.receivePolicy().MaxFileSize)
+}
+
+func (m *Manager) pendingLimit() error {
+	return fmt.Errorf("%w (maximum %d bytes)", ErrPendingLimit, m.receivePolicy().MaxPendingBytes)
+}
+
+// pendingBytes returns the total size of the regular files in dir and its
+// subdirectories.
+func pendingBytes(dir string) (n int64, err error) {
+	err = filepath.WalkDir(dir, func(_ string, de fs.DirEntry, err error) error {
+		if err != nil || !de.Type().IsRegular() {
+			return err
+		}
+		fi, err := de.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // deleted since it was listed
+			}
+			return err
+		}
+		n += fi.Size()
+		return nil
+	})
+	return n, err
+}
+
+// limitReader is like io.LimitReader, but it fails with err if r has more
+// than n bytes, rather than stopping at n.
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, lr.err
+	}
+	// Read one byte more than the limit, to find whether r has more.
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n + int(lr.n), lr.err
+	}
+	return n, err
+}
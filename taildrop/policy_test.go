@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/util/must"
+)
+
+func TestReceivePolicy(t *testing.T) {
+	alice := Sender{ID: "n1", User: "alice@example.com"}
+	bob := Sender{ID: "n2", User: "bob@example.com"}
+	server := Sender{ID: "n3", Tags: []string{"tag:other", "tag:server"}}
+
+	tests := []struct {
+		name    string
+		policy  ReceivePolicy
+		from    Sender
+		content string
+		length  int64  // or -1 for unknown
+		wantErr error  // or nil
+		wantAt  string // path in Dir the file is put at, if no error
+	}{
+		{
+			name:    "zero",
+			from:    alice,
+			content: "hello",
+			length:  5,
+			wantAt:  "f",
+		},
+		{
+			name:    "allowed-user",
+			policy:  ReceivePolicy{AllowedSenders: []string{"alice@example.com", "tag:server"}},
+			from:    alice,
+			content: "hello",
+			length:  5,
+			wantAt:  "f",
+		},
+		{
+			name:    "allowed-tag",
+			policy:  ReceivePolicy{AllowedSenders: []string{"alice@example.com", "tag:server"}},
+			from:    server,
+			content: "hello",
+			length:  5,
+			wantAt:  "f",
+		},
+		{
+			name:    "not-allowed",
+			policy:  ReceivePolicy{AllowedSenders: []string{"alice@example.com", "tag:server"}},
+			from:    bob,
+			content: "hello",
+			length:  5,
+			wantErr: ErrSenderNotAllowed,
+		},
+		{
+			name:    "too-large",
+			policy:  ReceivePolicy{MaxFileSize: 4},
+			from:    alice,
+			content: "hello",
+			length:  5,
+			wantErr: ErrFileTooLarge,
+		},
+		{
+			name:    "too-large-unknown-length",
+			policy:  ReceivePolicy{MaxFileSize: 4},
+			from:    alice,
+			content: "hello",
+			length:  -1,
+			wantErr: ErrFileTooLarge,
+		},
+		{
+			name:    "max-size",
+			policy:  ReceivePolicy{MaxFileSize: 5},
+			from:    alice,
+			content: "hello",
+			length:  -1,
+			wantAt:  "f",
+		},
+		{
+			name:    "pending",
+			policy:  ReceivePolicy{MaxPendingBytes: 12},
+			from:    alice,
+			content: "hello",
+			length:  5,
+			wantErr: ErrPendingLimit, // "waiting" is already there
+		},
+		{
+			name:    "pending-unknown-length",
+			policy:  ReceivePolicy{MaxPendingBytes: 12},
+			from:    alice,
+			content: "hello",
+			length:  -1,
+			wantErr: ErrPendingLimit,
+		},
+		{
+			name:    "sender-dir-user",
+			policy:  ReceivePolicy{SenderDirs: map[string]string{"alice@example.com": "alice", "tag:server": "servers"}},
+			from:    alice,
+			content: "hello",
+			length:  5,
+			wantAt:  "alice/f",
+		},
+		{
+			name:    "sender-dir-tag",
+			policy:  ReceivePolicy{SenderDirs: map[string]string{"alice@example.com": "alice", "tag:server": "servers"}},
+			from:    server,
+			content: "hello",
+			length:  5,
+			wantAt:  "servers/f",
+		},
+		{
+			name:    "sender-dir-other",
+			policy:  ReceivePolicy{SenderDirs: map[string]string{"alice@example.com": "alice", "tag:server": "servers"}},
+			from:    bob,
+			content: "hello",
+			length:  5,
+			wantAt:  "f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			must.Do(os.WriteFile(filepath.Join(dir, "waiting"), []byte("12345678"), 0666))
+			m := ManagerOptions{Logf: t.Logf, Dir: dir, ReceivePolicy: tt.policy}.New()
+			defer m.Shutdown()
+
+			_, err := m.PutFile(tt.from, "f", strings.NewReader(tt.content), 0, tt.length)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("PutFile error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PutFile: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(tt.wantAt)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.content {
+				t.Errorf("file content = %q, want %q", got, tt.content)
+			}
+		})
+	}
+}
+
+func TestPendingReservations(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(os.WriteFile(filepath.Join(dir, "waiting"), []byte("1234"), 0666))
+	m := ManagerOptions{Logf: t.Logf, Dir: dir, ReceivePolicy: ReceivePolicy{MaxPendingBytes: 12}}.New()
+	defer m.Shutdown()
+
+	// Concurrent files may not together exceed the limit.
+	res1, err := m.reservePending(6)
+	if err != nil {
+		t.Fatalf("reservePending(6): %v", err)
+	}
+	if _, err := m.reservePending(6); !errors.Is(err, ErrPendingLimit) {
+		t.Fatalf("second reservePending(6) error = %v, want %v", err, ErrPendingLimit)
+	}
+
+	// A file larger than reserved may only grow up to the limit.
+	f := must.Get(os.Create(filepath.Join(dir, "receiving")))
+	n, err := io.Copy(f, &pendingReader{r: strings.NewReader("abcdefghi"), res: res1})
+	f.Close()
+	if !errors.Is(err, ErrPendingLimit) {
+		t.Fatalf("writing past the limit: error = %v, want %v", err, ErrPendingLimit)
+	}
+	if n != 8 {
+		t.Fatalf("wrote %d bytes, want 8", n)
+	}
+	res1.release()
+	if _, err := m.reservePending(1); !errors.Is(err, ErrPendingLimit) {
+		t.Fatalf("reservePending(1) with a full directory: error = %v, want %v", err, ErrPendingLimit)
+	}
+
+	// Files removed from Dir are noticed once space runs out.
+	must.Do(os.Remove(filepath.Join(dir, "waiting")))
+	if _, err := m.reservePending(4); err != nil {
+		t.Fatalf("reservePending(4) after removing a file: %v", err)
+	}
+}
+
+func TestSetReceivePolicy(t *testing.T) {
+	dir := t.TempDir()
+	m := ManagerOptions{Logf: t.Logf, Dir: dir}.New()
+	defer m.Shutdown()
+	alice := Sender{ID: "n1", User: "alice@example.com"}
+
+	// Files received with no limit are counted once there is one.
+	must.Get(m.PutFile(alice, "a", strings.NewReader("12345678"), 0, 8))
+	m.SetReceivePolicy(&ReceivePolicy{MaxPendingBytes: 12, AllowedSenders: []string{"bob@example.com"}})
+	if _, err := m.PutFile(alice, "b", strings.NewReader("hello"), 0, 5); !errors.Is(err, ErrSenderNotAllowed) {
+		t.Fatalf("PutFile from a sender no longer allowed: error = %v, want %v", err, ErrSenderNotAllowed)
+	}
+	m.SetReceivePolicy(&ReceivePolicy{MaxPendingBytes: 12})
+	if _, err := m.PutFile(alice, "b", strings.NewReader("hello"), 0, 5); !errors.Is(err, ErrPendingLimit) {
+		t.Fatalf("PutFile over the new limit: error = %v, want %v", err, ErrPendingLimit)
+	}
+	m.SetReceivePolicy(nil)
+	if _, err := m.PutFile(alice, "b", strings.NewReader("hello"), 0, 5); err != nil {
+		t.Fatalf("PutFile with no policy: %v", err)
+	}
+}
@@ -76,14 +76,20 @@ func (m *Manager) HashPartialFile(id ClientID, baseName string) (next func() (Bl
 	if m == nil || m.opts.Dir == "" {
 		return nil, nil, ErrNoTaildrop
 	}
-	noopNext := func() (BlockChecksum, error) { return BlockChecksum{}, io.EOF }
-	noopClose := func() error { return nil }
-
 	dstFile, err := joinDir(m.opts.Dir, baseName)
 	if err != nil {
 		return nil, nil, err
 	}
-	f, err := os.Open(dstFile + id.partialSuffix())
+	return hashFileBlocks(dstFile + id.partialSuffix())
+}
+
+// hashFileBlocks is the implementation of HashPartialFile for the partial
+// file at the given path, which need not exist.
+func hashFileBlocks(partialPath string) (next func() (BlockChecksum, error), close func() error, err error) {
+	noopNext := func() (BlockChecksum, error) { return BlockChecksum{}, io.EOF }
+	noopClose := func() error { return nil }
+
+	f, err := os.Open(partialPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return noopNext, noopClose, nil
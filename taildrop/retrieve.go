@@ -12,6 +12,7 @@
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"time"
 
 	"tailscale.com/client/tailscale/apitype"
@@ -38,6 +39,10 @@ func (m *Manager) HasFilesWaiting() (has bool) {
 	// Check whether there is at least one one waiting file.
 	err := rangeDir(m.opts.Dir, func(de fs.DirEntry) bool {
 		name := de.Name()
+		if de.IsDir() && !isPartialOrDeleted(name) {
+			has = true // a delivered bundle
+			return false
+		}
 		if isPartialOrDeleted(name) || !de.Type().IsRegular() {
 			return true
 		}
@@ -68,26 +73,41 @@ func (m *Manager) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 	if m.opts.DirectFileMode {
 		return nil, nil
 	}
-	if err := rangeDir(m.opts.Dir, func(de fs.DirEntry) bool {
-		name := de.Name()
-		if isPartialOrDeleted(name) || !de.Type().IsRegular() {
-			return true
-		}
-		_, err := os.Stat(filepath.Join(m.opts.Dir, name+deletedSuffix))
+	addFile := func(name string, de fs.DirEntry) bool {
+		_, err := os.Stat(filepath.Join(m.opts.Dir, filepath.FromSlash(name)+deletedSuffix))
 		if os.IsNotExist(err) {
 			fi, err := de.Info()
 			if err != nil {
 				return true
 			}
 			ret = append(ret, apitype.WaitingFile{
-				Name: filepath.Base(name),
+				Name: name,
 				Size: fi.Size(),
 			})
 		}
 		return true
+	}
+	var bundles []string
+	if err := rangeDir(m.opts.Dir, func(de fs.DirEntry) bool {
+		name := de.Name()
+		if de.IsDir() && !isPartialOrDeleted(name) {
+			bundles = append(bundles, name)
+			return true
+		}
+		if isPartialOrDeleted(name) || !de.Type().IsRegular() {
+			return true
+		}
+		return addFile(name, de)
 	}); err != nil {
 		return nil, redactError(err)
 	}
+	// The files of delivered bundles are listed by their paths within
+	// Dir, such as "photos/2024/a.jpg".
+	for _, dir := range bundles {
+		if err := rangeBundleFiles(m.opts.Dir, dir, addFile); err != nil {
+			return nil, redactError(err)
+		}
+	}
 	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
 	return ret, nil
 }
@@ -101,7 +121,7 @@ func (m *Manager) DeleteFile(baseName string) error {
 	if m.opts.DirectFileMode {
 		return errors.New("deletes not allowed in direct mode")
 	}
-	path, err := joinDir(m.opts.Dir, baseName)
+	path, err := joinWaitingFile(m.opts.Dir, baseName)
 	if err != nil {
 		return err
 	}
@@ -137,6 +157,9 @@ func (m *Manager) DeleteFile(baseName string) error {
 			logf("peerapi: failed to DeleteFile: %v", err)
 			return err
 		}
+		if strings.Contains(baseName, "/") {
+			removeEmptyParents(m.opts.Dir, path)
+		}
 		return nil
 	}
 }
@@ -158,7 +181,7 @@ func (m *Manager) OpenFile(baseName string) (rc io.ReadCloser, size int64, err e
 	if m.opts.DirectFileMode {
 		return nil, 0, errors.New("opens not allowed in direct mode")
 	}
-	path, err := joinDir(m.opts.Dir, baseName)
+	path, err := joinWaitingFile(m.opts.Dir, baseName)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -61,31 +61,63 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
-// PutFile stores a file into [Manager.Dir] from a given client id.
+// PutFile stores a file into [Manager.Dir] from a given sender.
 // The baseName must be a base filename without any slashes.
 // The length is the expected length of content to read from r,
 // it may be negative to indicate that it is unknown.
 // It returns the length of the entire file.
 //
+// The file must be accepted by the [ReceivePolicy], which may put it in a
+// subdirectory of [Manager.Dir] for the sender. Otherwise an error wrapping
+// ErrSenderNotAllowed, ErrFileTooLarge or ErrPendingLimit is returned.
+// Whether it succeeds or fails, the transfer is added to the
+// [Manager.History].
+//
 // If there is a failure reading from r, then the partial file is not deleted
 // for some period of time. The [Manager.PartialFiles] and [Manager.HashPartialFile]
 // methods may be used to list all partial files and to compute the hash for a
 // specific partial file. This allows the client to determine whether to resume
 // a partial file. While resuming, PutFile may be called again with a non-zero
 // offset to specify where to resume receiving data at.
-func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, length int64) (int64, error) {
-	switch {
-	case m == nil || m.opts.Dir == "":
-		return 0, ErrNoTaildrop
-	case !envknob.CanTaildrop():
-		return 0, ErrNoTaildrop
-	case distro.Get() == distro.Unraid && !m.opts.DirectFileMode:
-		return 0, ErrNotAccessible
+func (m *Manager) PutFile(from Sender, baseName string, r io.Reader, offset, length int64) (fileLength int64, err error) {
+	if err := m.checkCanReceive(); err != nil {
+		return 0, err
 	}
-	dstPath, err := joinDir(m.opts.Dir, baseName)
+	partialBase, err := joinDir(m.opts.Dir, baseName)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(-1)
+	if length >= 0 {
+		size = offset + length
+	}
+	t0 := m.opts.Clock.Now()
+	var sum []byte
+	var partial bool // whether the sender may resume a failed transfer
+	defer func() {
+		// Only record outcomes that end the transfer.
+		switch {
+		case err == nil:
+			m.recordReceive(from, baseName, t0, fileLength, sum, nil)
+		case errors.Is(err, ErrFileExists):
+			// Another put of the same file is in progress.
+		case partial && !isRejection(err):
+			// The sender may resume from the partial file.
+		default:
+			m.recordReceive(from, baseName, t0, size, nil, err)
+		}
+	}()
+	r, release, err := m.checkReceive(from, r, offset, size)
 	if err != nil {
 		return 0, err
 	}
+	defer release()
+	dstDir, err := m.dstDir(from)
+	if err != nil {
+		return 0, err
+	}
+	dstPath := filepath.Join(dstDir, baseName)
+	id := from.ID
 
 	redactAndLogError := func(action string, err error) error {
 		err = redactError(err)
@@ -94,7 +126,7 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 	}
 
 	// Check whether there is an in-progress transfer for the file.
-	partialPath := dstPath + id.partialSuffix()
+	partialPath := partialBase + id.partialSuffix()
 	inFileKey := incomingFileKey{id, baseName}
 	inFile, loaded := m.incomingFiles.LoadOrInit(inFileKey, func() *incomingFile {
 		inFile := &incomingFile{
@@ -120,6 +152,7 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 	if err != nil {
 		return 0, redactAndLogError("Create", err)
 	}
+	partial = true
 	defer func() {
 		f.Close() // best-effort to cleanup dangling file handles
 		if err != nil {
@@ -128,16 +161,7 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 	}()
 	inFile.w = f
 
-	// Record that we have started to receive at least one file.
-	// This is used by the deleter upon a cold-start to scan the directory
-	// for any files that need to be deleted.
-	if m.opts.State != nil {
-		if b, _ := m.opts.State.ReadState(ipn.TaildropReceivedKey); len(b) == 0 {
-			if err := m.opts.State.WriteState(ipn.TaildropReceivedKey, []byte{1}); err != nil {
-				m.opts.Logf("WriteState error: %v", err) // non-fatal error
-			}
-		}
-	}
+	m.noteReceiving()
 
 	// A positive offset implies that we are resuming an existing file.
 	// Seek to the appropriate offset and truncate the file.
@@ -157,8 +181,13 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 		}
 	}
 
-	// Copy the contents of the file.
-	copyLength, err := io.Copy(inFile, r)
+	// Copy the contents of the file, hashing it as we go, starting with
+	// what was received before.
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, offset)); err != nil {
+		return 0, redactAndLogError("Hash", err)
+	}
+	copyLength, err := io.Copy(io.MultiWriter(inFile, h), r)
 	if err != nil {
 		return 0, redactAndLogError("Copy", err)
 	}
@@ -168,7 +197,8 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 	if err := f.Close(); err != nil {
 		return 0, redactAndLogError("Close", err)
 	}
-	fileLength := offset + copyLength
+	fileLength = offset + copyLength
+	partialSum := [sha256.Size]byte(h.Sum(nil))
 
 	inFile.mu.Lock()
 	inFile.done = true
@@ -177,9 +207,9 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 	// File has been successfully received, rename the partial file
 	// to the final destination filename. If a file of that name already exists,
 	// then try multiple times with variations of the filename.
-	computePartialSum := sync.OnceValues(func() ([sha256.Size]byte, error) {
-		return sha256File(partialPath)
-	})
+	if err := os.MkdirAll(dstDir, 0777); err != nil {
+		return 0, redactAndLogError("MkdirAll", err)
+	}
 	maxRetries := 10
 	for ; maxRetries > 0; maxRetries-- {
 		// Atomically rename the partial file as the destination file if it doesn't exist.
@@ -210,10 +240,6 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 		// results in processing on the iOS side which means the size and shas of the
 		// same file can be different.
 		if dstLength == fileLength {
-			partialSum, err := computePartialSum()
-			if err != nil {
-				return 0, redactAndLogError("Rename", err)
-			}
 			dstSum, err := sha256File(dstPath)
 			if err != nil {
 				return 0, redactAndLogError("Rename", err)
@@ -233,11 +259,49 @@ func (m *Manager) PutFile(id ClientID, baseName string, r io.Reader, offset, len
 	if maxRetries <= 0 {
 		return 0, errors.New("too many retries trying to rename partial file")
 	}
+	sum = partialSum[:]
 	m.totalReceived.Add(1)
 	m.opts.SendFileNotify()
 	return fileLength, nil
 }
 
+// dstDir returns the directory that files from the sender are put in,
+// either [Manager.Dir] or a subdirectory of it chosen by the
+// [ReceivePolicy]. The subdirectory may not exist yet.
+func (m *Manager) dstDir(from Sender) (string, error) {
+	sub, err := senderDir(m.receivePolicy(), from)
+	if err != nil || sub == "" {
+		return m.opts.Dir, err
+	}
+	return filepath.Join(m.opts.Dir, sub), nil
+}
+
+// checkCanReceive reports whether m can receive files.
+func (m *Manager) checkCanReceive() error {
+	switch {
+	case m == nil || m.opts.Dir == "":
+		return ErrNoTaildrop
+	case !envknob.CanTaildrop():
+		return ErrNoTaildrop
+	case distro.Get() == distro.Unraid && !m.opts.DirectFileMode:
+		return ErrNotAccessible
+	}
+	return nil
+}
+
+// noteReceiving records that we have started to receive at least one file.
+// This is used by the deleter upon a cold-start to scan the directory
+// for any files that need to be deleted.
+func (m *Manager) noteReceiving() {
+	if m.opts.State != nil {
+		if b, _ := m.opts.State.ReadState(ipn.TaildropReceivedKey); len(b) == 0 {
+			if err := m.opts.State.WriteState(ipn.TaildropReceivedKey, []byte{1}); err != nil {
+				m.opts.Logf("WriteState error: %v", err) // non-fatal error
+			}
+		}
+	}
+}
+
 func sha256File(file string) (out [sha256.Size]byte, err error) {
 	h := sha256.New()
 	f, err := os.Open(file)
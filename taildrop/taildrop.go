@@ -30,6 +30,7 @@
 	"tailscale.com/tstime"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/multierr"
+	"tailscale.com/util/set"
 )
 
 var (
@@ -95,6 +96,15 @@ type ManagerOptions struct {
 	// to the function when reception completes.
 	// It is not called if nil.
 	SendFileNotify func()
+
+	// ReceivePolicy limits what files are accepted and from whom,
+	// and where they are put. It may be changed with
+	// [Manager.SetReceivePolicy].
+	ReceivePolicy ReceivePolicy
+
+	// TransferDone is called when a transfer finishes, after it has been
+	// added to the history. It is not called if nil.
+	TransferDone func(ipn.FileTransfer)
 }
 
 // Manager manages the state for receiving and managing taildropped files.
@@ -114,6 +124,19 @@ type Manager struct {
 	// emptySince specifies that there were no waiting files
 	// since this value of totalReceived.
 	emptySince atomic.Int64
+
+	policy atomic.Pointer[ReceivePolicy] // never nil
+
+	// pendingMu guards the count of bytes in Dir, for the MaxPendingBytes
+	// of the ReceivePolicy.
+	pendingMu      sync.Mutex
+	pendingCounted bool                         // whether pendingStored was counted
+	pendingStored  int64                        // bytes stored, not counting pendingFiles
+	pendingFiles   set.Set[*pendingReservation] // files being received
+
+	historyMu     sync.Mutex
+	historyLoaded bool               // whether history was loaded from State
+	history       []ipn.FileTransfer // oldest first
 }
 
 // New initializes a new taildrop manager.
@@ -126,7 +149,11 @@ func (opts ManagerOptions) New() *Manager {
 	if opts.SendFileNotify == nil {
 		opts.SendFileNotify = func() {}
 	}
+	if opts.TransferDone == nil {
+		opts.TransferDone = func(ipn.FileTransfer) {}
+	}
 	m := &Manager{opts: opts}
+	m.policy.Store(opts.ReceivePolicy.Clone())
 	m.deleter.Init(m, func(string) {})
 	m.emptySince.Store(-1) // invalidate this cache
 	return m
@@ -168,31 +195,40 @@ func isPartialOrDeleted(s string) bool {
 }
 
 func joinDir(dir, baseName string) (fullPath string, err error) {
+	if err := CheckFileName(baseName); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, baseName), nil
+}
+
+// CheckFileName reports whether baseName is acceptable as the name of a
+// received file, returning ErrInvalidFileName if not.
+func CheckFileName(baseName string) error {
 	if !utf8.ValidString(baseName) {
-		return "", ErrInvalidFileName
+		return ErrInvalidFileName
 	}
 	if strings.TrimSpace(baseName) != baseName {
-		return "", ErrInvalidFileName
+		return ErrInvalidFileName
 	}
 	if len(baseName) > 255 {
-		return "", ErrInvalidFileName
+		return ErrInvalidFileName
 	}
 	// TODO: validate unicode normalization form too? Varies by platform.
 	clean := path.Clean(baseName)
 	if clean != baseName ||
 		clean == "." || clean == ".." ||
 		isPartialOrDeleted(clean) {
-		return "", ErrInvalidFileName
+		return ErrInvalidFileName
 	}
 	for _, r := range baseName {
 		if !validFilenameRune(r) {
-			return "", ErrInvalidFileName
+			return ErrInvalidFileName
 		}
 	}
 	if !filepath.IsLocal(baseName) {
-		return "", ErrInvalidFileName
+		return ErrInvalidFileName
 	}
-	return filepath.Join(dir, baseName), nil
+	return nil
 }
 
 // rangeDir iterates over the contents of a directory, calling fn for each entry.
@@ -0,0 +1,267 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tka
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
+)
+
+// BundleVersion is the version of the Bundle format written by this package.
+const BundleVersion = 1
+
+// A Bundle carries unsigned or partially signed AUMs between machines, so
+// that they can be signed by keys kept on machines that are offline, such as
+// in key ceremonies with air-gapped signing keys.
+//
+// A Bundle is encoded as JSON, so that it can be reviewed before it is
+// signed. Its Changes describe its AUMs, and are checked against them when it
+// is parsed.
+type Bundle struct {
+	// Version is the version of the format, BundleVersion.
+	Version int
+
+	// Parent is the hash of the AUM the bundle's AUMs follow: the head of
+	// the authority when the bundle was prepared. The AUMs can only be
+	// applied if it is still the head.
+	Parent AUMHash
+
+	// Changes is a human-readable description of each AUM, in order.
+	Changes []string
+
+	// AUMs are the serialized AUMs, in order, each one the parent of the
+	// next.
+	AUMs []tkatype.MarshaledAUM
+}
+
+// NewBundle returns a Bundle carrying aums, which must be a chain of AUMs
+// following an existing AUM.
+func NewBundle(aums []AUM) (*Bundle, error) {
+	if len(aums) == 0 {
+		return nil, errors.New("no AUMs to bundle")
+	}
+	parent, ok := aums[0].Parent()
+	if !ok {
+		return nil, errors.New("cannot bundle a genesis AUM")
+	}
+	b := &Bundle{Version: BundleVersion, Parent: parent}
+	for _, aum := range aums {
+		b.AUMs = append(b.AUMs, aum.Serialize())
+		b.Changes = append(b.Changes, DescribeAUM(aum))
+	}
+	if _, err := b.Decode(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseBundle parses the JSON encoding of a Bundle, and checks that it is
+// well-formed: that its AUMs are a valid chain following its Parent, that
+// their signatures are valid, and that its Changes describe them.
+func ParseBundle(data []byte) (*Bundle, error) {
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("decoding bundle: %w", err)
+	}
+	if b.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d, want %d", b.Version, BundleVersion)
+	}
+	aums, err := b.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if len(b.Changes) != len(aums) {
+		return nil, fmt.Errorf("bundle describes %d changes but has %d AUMs", len(b.Changes), len(aums))
+	}
+	for i, aum := range aums {
+		if want := DescribeAUM(aum); b.Changes[i] != want {
+			return nil, fmt.Errorf("change %d is described as %q, but is %q", i+1, b.Changes[i], want)
+		}
+	}
+	return &b, nil
+}
+
+// Marshal returns the JSON encoding of b.
+func (b *Bundle) Marshal() ([]byte, error) {
+	return json.MarshalIndent(b, "", "\t")
+}
+
+// Decode returns the AUMs of b, checking that they are a valid chain
+// following b.Parent and that their signatures are valid.
+func (b *Bundle) Decode() ([]AUM, error) {
+	if len(b.AUMs) == 0 {
+		return nil, errors.New("bundle has no AUMs")
+	}
+	aums := make([]AUM, len(b.AUMs))
+	parent := b.Parent
+	for i, raw := range b.AUMs {
+		aum := &aums[i]
+		if err := aum.Unserialize(raw); err != nil {
+			return nil, fmt.Errorf("decoding AUM %d: %w", i+1, err)
+		}
+		if err := aum.StaticValidate(); err != nil {
+			return nil, fmt.Errorf("AUM %d: %w", i+1, err)
+		}
+		if p, ok := aum.Parent(); !ok || p != parent {
+			return nil, fmt.Errorf("AUM %d does not follow %v", i+1, parent)
+		}
+		sigHash := aum.SigHash()
+		for j, sig := range aum.Signatures {
+			// 25519 key IDs are the public key. Whether the key is
+			// trusted is up to the authority the AUMs are applied to.
+			k := Key{Kind: Key25519, Public: sig.KeyID}
+			if err := signatureVerify(&sig, sigHash, k); err != nil {
+				return nil, fmt.Errorf("AUM %d signature %d: %w", i+1, j+1, err)
+			}
+		}
+		parent = aum.Hash()
+	}
+	return aums, nil
+}
+
+// Signers returns the IDs of the keys that have signed all of b's AUMs.
+func (b *Bundle) Signers() ([]tkatype.KeyID, error) {
+	aums, err := b.Decode()
+	if err != nil {
+		return nil, err
+	}
+	var out []tkatype.KeyID
+	for _, sig := range aums[0].Signatures {
+		if signedAll(aums, sig.KeyID) {
+			out = append(out, sig.KeyID)
+		}
+	}
+	return out, nil
+}
+
+func signedAll(aums []AUM, keyID tkatype.KeyID) bool {
+	for _, aum := range aums {
+		if !slices.ContainsFunc(aum.Signatures, func(s tkatype.Signature) bool {
+			return bytes.Equal(s.KeyID, keyID)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sign adds signer's signatures to each of b's AUMs.
+//
+// As an AUM's hash covers its signatures, signing an AUM changes the parent
+// hash of the AUM after it, which must then be signed again. So a bundle of
+// more than one AUM can only be signed once; a bundle of one AUM can gather
+// signatures from several keys, such as for a recovery AUM.
+func (b *Bundle) Sign(signer Signer) error {
+	aums, err := b.Decode()
+	if err != nil {
+		return err
+	}
+	for i := range aums[1:] {
+		if len(aums[i+1].Signatures) > 0 {
+			return errors.New("bundle of several AUMs is already signed")
+		}
+	}
+
+	out := make([]tkatype.MarshaledAUM, len(aums))
+	for i := range aums {
+		aum := &aums[i]
+		if i > 0 {
+			prev := aums[i-1].Hash()
+			aum.PrevAUMHash = prev[:]
+		}
+		sigs, err := signer.SignAUM(aum.SigHash())
+		if err != nil {
+			return fmt.Errorf("signing AUM %d: %w", i+1, err)
+		}
+		for _, sig := range sigs {
+			if slices.ContainsFunc(aum.Signatures, func(s tkatype.Signature) bool {
+				return bytes.Equal(s.KeyID, sig.KeyID)
+			}) {
+				return fmt.Errorf("AUM %d is already signed by %s", i+1, keyIDString(sig.KeyID))
+			}
+		}
+		aum.Signatures = append(aum.Signatures, sigs...)
+		out[i] = aum.Serialize()
+	}
+	b.AUMs = out
+	return nil
+}
+
+// DescribeAUM returns a one-line, human-readable description of the change
+// made by aum.
+func DescribeAUM(aum AUM) string {
+	switch aum.MessageKind {
+	case AUMAddKey:
+		return "add key " + describeKey(*aum.Key)
+	case AUMRemoveKey:
+		return "remove key " + keyIDString(aum.KeyID)
+	case AUMUpdateKey:
+		var s strings.Builder
+		fmt.Fprintf(&s, "update key %s:", keyIDString(aum.KeyID))
+		if aum.Votes != nil {
+			fmt.Fprintf(&s, " votes=%d", *aum.Votes)
+		}
+		if aum.Meta != nil {
+			fmt.Fprintf(&s, " meta=%s", describeMeta(aum.Meta))
+		}
+		return s.String()
+	case AUMCheckpoint:
+		keys := make([]string, len(aum.State.Keys))
+		for i, k := range aum.State.Keys {
+			keys[i] = describeKey(k)
+		}
+		return fmt.Sprintf("checkpoint with %d disablement values and keys [%s]", len(aum.State.DisablementSecrets), strings.Join(keys, ", "))
+	default:
+		return aum.MessageKind.String()
+	}
+}
+
+func describeKey(k Key) string {
+	var s string
+	if k.Kind == Key25519 {
+		s = fmt.Sprintf("%s votes=%d", keyIDString(k.Public), k.Votes)
+	} else {
+		s = fmt.Sprintf("%v:%x votes=%d", k.Kind, k.Public, k.Votes)
+	}
+	if k.Meta != nil {
+		s += " meta=" + describeMeta(k.Meta)
+	}
+	return s
+}
+
+// describeMeta formats key metadata deterministically.
+func describeMeta(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var s strings.Builder
+	s.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			s.WriteByte(' ')
+		}
+		fmt.Fprintf(&s, "%q:%q", k, m[k])
+	}
+	s.WriteByte('}')
+	return s.String()
+}
+
+// keyIDString returns the ID of a 25519 key in the form used by the CLI.
+func keyIDString(id tkatype.KeyID) string {
+	if len(id) != 32 {
+		return fmt.Sprintf("%x", []byte(id))
+	}
+	return key.NLPublicFromEd25519Unsafe(ed25519.PublicKey(id)).CLIString()
+}
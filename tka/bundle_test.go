@@ -0,0 +1,186 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tka
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"tailscale.com/types/tkatype"
+)
+
+func TestBundleOfflineSigning(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	// Prepare unsigned updates, as a node without the signing key would.
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1, Meta: map[string]string{"b": "2", "a": "1"}}
+	u := a.NewUpdater(nil)
+	if err := u.AddKey(key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetKeyVote(key.MustID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	aums, err := u.Finalize(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBundle(aums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Parent != a.Head() {
+		t.Errorf("Parent = %v; want head %v", b.Parent, a.Head())
+	}
+	if len(b.Changes) != 2 || !strings.HasPrefix(b.Changes[0], "add key tlpub:") || !strings.HasSuffix(b.Changes[0], `votes=1 meta={"a":"1" "b":"2"}`) {
+		t.Errorf("Changes = %q", b.Changes)
+	}
+	data, err := b.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign it elsewhere.
+	b, err = ParseBundle(data)
+	if err != nil {
+		t.Fatalf("ParseBundle: %v", err)
+	}
+	if err := b.Sign(signer25519(priv)); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if signers, err := b.Signers(); err != nil || len(signers) != 1 || !bytes.Equal(signers[0], key.MustID()) {
+		t.Errorf("Signers = %x, %v; want [%x]", signers, err, key.MustID())
+	}
+	if err := b.Sign(signer25519(priv)); err == nil {
+		t.Error("signing a bundle of several AUMs twice succeeded")
+	}
+	data, err = b.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// And apply it.
+	b, err = ParseBundle(data)
+	if err != nil {
+		t.Fatalf("ParseBundle of signed bundle: %v", err)
+	}
+	signed, err := b.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Inform(storage, signed); err != nil {
+		t.Fatalf("applying signed updates: %v", err)
+	}
+	if k, err := a.state.GetKey(key.MustID()); err != nil || k.Votes != 3 {
+		t.Errorf("key votes = %d, %v; want 3", k.Votes, err)
+	}
+	if !a.KeyTrusted(key2.MustID()) {
+		t.Error("added key not trusted")
+	}
+}
+
+func TestBundleCosign(t *testing.T) {
+	pub1, priv1 := testingKey25519(t, 1)
+	pub2, priv2 := testingKey25519(t, 2)
+	key1 := Key{Kind: Key25519, Public: pub1, Votes: 1}
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key1, key2},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv1))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	u := a.NewUpdater(nil)
+	if err := u.SetKeyVote(key1.MustID(), 2); err != nil {
+		t.Fatal(err)
+	}
+	aums, err := u.Finalize(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBundle(aums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, priv := range []signer25519{signer25519(priv1), signer25519(priv2)} {
+		if err := b.Sign(priv); err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+	}
+	if err := b.Sign(signer25519(priv1)); err == nil {
+		t.Error("signing twice with the same key succeeded")
+	}
+	if signers, err := b.Signers(); err != nil || len(signers) != 2 {
+		t.Errorf("Signers = %x, %v; want 2 signers", signers, err)
+	}
+}
+
+func TestParseBundleRejectsTampering(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 1}
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	pub2, _ := testingKey25519(t, 2)
+	u := a.NewUpdater(nil)
+	if err := u.AddKey(Key{Kind: Key25519, Public: pub2, Votes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	aums, err := u.Finalize(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBundle(aums)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b *Bundle)
+	}{
+		{"version", func(b *Bundle) { b.Version = 2 }},
+		{"changes", func(b *Bundle) { b.Changes[0] = "remove key nothing important" }},
+		{"parent", func(b *Bundle) { b.Parent[0] ^= 1 }},
+		{"signature", func(b *Bundle) {
+			b.Sign(signer25519(priv))
+			b.AUMs[0][len(b.AUMs[0])-1] ^= 1
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b2 := *b
+			b2.Changes = append([]string(nil), b.Changes...)
+			b2.AUMs = []tkatype.MarshaledAUM{bytes.Clone(b.AUMs[0])}
+			tt.modify(&b2)
+			data, err := b2.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseBundle(data); err == nil {
+				t.Error("ParseBundle succeeded")
+			}
+		})
+	}
+}
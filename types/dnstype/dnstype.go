@@ -23,7 +23,9 @@ type Resolver struct {
 	//    known ahead of time, so bootstrap DNS resolution is not required.
 	//  - "http://node-address:port/path" for DNS over HTTP over WireGuard. This
 	//    is implemented in the PeerAPI for exit nodes and app connectors.
-	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
+	//  - "tls://resolver.com[:port]" or "tls://IP[:port]" for DNS over
+	//    TCP+TLS (DoT, RFC 7858). The port defaults to 853. If the host is
+	//    not an IP address, BootstrapResolution must be set.
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -33,7 +35,8 @@ type Resolver struct {
 	// look up the DoT/DoH server using their local "classic" DNS
 	// resolver.
 	//
-	// As of 2022-09-08, BootstrapResolution is not yet used.
+	// As of 2024-07, BootstrapResolution is only used for DoT resolvers,
+	// which require it when they're named by hostname.
 	BootstrapResolution []netip.Addr `json:",omitempty"`
 }
 
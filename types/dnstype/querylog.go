@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dnstype
+
+import (
+	"net/netip"
+	"time"
+)
+
+// QueryLogRouteMagicDNS is the QueryLogEntry.Route of a query that was
+// answered locally by MagicDNS rather than forwarded upstream.
+const QueryLogRouteMagicDNS = "magicdns"
+
+// QueryLogRouteFallback is the QueryLogEntry.Route of a query that matched
+// no configured route and was forwarded to the platform's fallback resolver
+// (such as the well-known resolver on cloud hosts).
+const QueryLogRouteFallback = "fallback"
+
+// QueryLogEntry is an entry in the quad-100 resolver's local query log.
+type QueryLogEntry struct {
+	// Time is when the query was received.
+	Time time.Time
+
+	// Name is the queried name, as a lowercase FQDN.
+	Name string
+
+	// Type is the query type, such as "A" or "AAAA".
+	Type string
+
+	// Route is how the query was resolved: QueryLogRouteMagicDNS,
+	// QueryLogRouteFallback, or the DNS suffix of the route it was
+	// forwarded via, with "." being the default route. It's empty if no
+	// resolver was available for the query.
+	Route string
+
+	// Cached is whether the response was served from the resolver's cache
+	// of upstream responses.
+	Cached bool `json:",omitempty"`
+
+	// RCode is the response code, such as "Success" or "NameError". It's
+	// empty if no response was sent.
+	RCode string `json:",omitempty"`
+
+	// Err is the error resolving the query, if any.
+	Err string `json:",omitempty"`
+
+	// Latency is how long it took to resolve the query.
+	Latency time.Duration
+
+	// Source is the address the query came from. It's the zero value if
+	// the address was redacted.
+	Source netip.AddrPort
+
+	// RedactedSource is the address the query came from, with the host
+	// part redacted as logtail does. It's set instead of Source for
+	// non-Tailscale addresses when tailscaled has TS_OBSCURE_LOGGED_IPS set.
+	RedactedSource string `json:",omitempty"`
+}
+
+// QueryStats are per-client counts of queries in the quad-100 resolver's
+// query log.
+type QueryStats struct {
+	Queries int64 // total queries
+	Cached  int64 // queries answered from the cache of upstream responses
+	Failed  int64 // queries that got SERVFAIL or no response at all
+}
+
+// QueryLog is a snapshot of the quad-100 resolver's query log.
+type QueryLog struct {
+	// Size is the maximum number of entries the log retains. Zero means
+	// the query log is disabled.
+	Size int
+
+	// Entries are the entries in the log, oldest first.
+	Entries []QueryLogEntry
+
+	// Clients are statistics for each client address seen since the
+	// query log was last resized. Redacted addresses are counted
+	// together, under the zero netip.Addr.
+	Clients map[netip.Addr]QueryStats `json:",omitempty"`
+}
@@ -8,8 +8,11 @@
 	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
+	"strings"
 	"sync"
 	"time"
 
@@ -37,14 +40,73 @@
 
 const flushPeriod = 100 * time.Millisecond
 
+// maxDropReasonLen is the maximum length of a DroppedFromPeer packet's
+// drop reason, which is length-prefixed by a single byte.
+const maxDropReasonLen = 255
+
+// linkTypeUser0 is the pcap link-layer type of captured packets: the first
+// user-defined type, decoded by ts-dissector.lua.
+const linkTypeUser0 = 147
+
+// Format is the file format of a capture output.
+type Format int
+
+const (
+	// PCAP is the classic pcap format, with the Tailscale metadata of each
+	// packet decoded by ts-dissector.lua.
+	PCAP Format = iota
+	// PCAPNG is the pcapng format, with each Path on its own interface.
+	// IP packets are written as raw IP, annotated with packet comments,
+	// and can be decoded without ts-dissector.lua.
+	PCAPNG
+)
+
+// Ext returns the conventional file name extension of f, including the dot.
+func (f Format) Ext() string {
+	if f == PCAPNG {
+		return ".pcapng"
+	}
+	return ".pcap"
+}
+
+// OutputOpts are options for an output registered with a Sink.
+type OutputOpts struct {
+	// Format is the format of the capture written to the output.
+	Format Format
+
+	// Filter, if non-nil, selects the packets written to the output.
+	Filter *Filter
+}
+
+// output is an output registered with a Sink.
+type output struct {
+	w    io.Writer
+	opts OutputOpts
+}
+
+func (o *output) match(path Path, data []byte, lookup func(netip.Addr) (NodeInfo, bool)) bool {
+	return o.opts.Filter == nil || o.opts.Filter.Match(path, data, lookup)
+}
+
+// writeHeader writes the file header for format to w, in a single write.
+func writeHeader(w io.Writer, format Format) {
+	var b bytes.Buffer
+	if format == PCAPNG {
+		writePcapngHeader(&b)
+	} else {
+		writePcapHeader(&b)
+	}
+	w.Write(b.Bytes())
+}
+
 func writePcapHeader(w io.Writer) {
-	binary.Write(w, binary.LittleEndian, uint32(0xA1B2C3D4)) // pcap magic number
-	binary.Write(w, binary.LittleEndian, uint16(2))          // version major
-	binary.Write(w, binary.LittleEndian, uint16(4))          // version minor
-	binary.Write(w, binary.LittleEndian, uint32(0))          // this zone
-	binary.Write(w, binary.LittleEndian, uint32(0))          // zone significant figures
-	binary.Write(w, binary.LittleEndian, uint32(65535))      // max packet len
-	binary.Write(w, binary.LittleEndian, uint32(147))        // link-layer ID - USER0
+	binary.Write(w, binary.LittleEndian, uint32(0xA1B2C3D4))    // pcap magic number
+	binary.Write(w, binary.LittleEndian, uint16(2))             // version major
+	binary.Write(w, binary.LittleEndian, uint16(4))             // version minor
+	binary.Write(w, binary.LittleEndian, uint32(0))             // this zone
+	binary.Write(w, binary.LittleEndian, uint32(0))             // zone significant figures
+	binary.Write(w, binary.LittleEndian, uint32(65535))         // max packet len
+	binary.Write(w, binary.LittleEndian, uint32(linkTypeUser0)) // link-layer ID - USER0
 }
 
 func writePktHeader(w *bytes.Buffer, when time.Time, length int) {
@@ -73,11 +135,42 @@ func writePktHeader(w *bytes.Buffer, when time.Time, length int) {
 	// SynthesizedToPeer indicates the packet was generated from within tailscaled,
 	// and is being routed to a remote Wireguard peer.
 	SynthesizedToPeer Path = 3
+	// DroppedFromPeer indicates the packet was received from a remote peer,
+	// and then dropped by the packet filter's rate limits. Such packets are
+	// also logged as FromPeer, before filtering, and carry the reason they
+	// were dropped.
+	DroppedFromPeer Path = 4
 
 	// PathDisco indicates the packet is information about a disco frame.
 	PathDisco Path = 254
 )
 
+var pathNames = map[Path]string{
+	FromLocal:          "FromLocal",
+	FromPeer:           "FromPeer",
+	SynthesizedToLocal: "SynthesizedToLocal",
+	SynthesizedToPeer:  "SynthesizedToPeer",
+	DroppedFromPeer:    "DroppedFromPeer",
+	PathDisco:          "Disco",
+}
+
+func (p Path) String() string {
+	if s, ok := pathNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("Path(%d)", uint8(p))
+}
+
+// parsePath returns the Path with the given name, case-insensitively.
+func parsePath(s string) (Path, bool) {
+	for p, name := range pathNames {
+		if strings.EqualFold(s, name) {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
 // New creates a new capture sink.
 func New() *Sink {
 	ctx, c := context.WithCancel(context.Background())
@@ -95,8 +188,9 @@ type Sink struct {
 	ctxCancel context.CancelFunc
 
 	mu         sync.Mutex
-	outputs    set.HandleSet[io.Writer]
-	flushTimer *time.Timer // or nil if none running
+	outputs    set.HandleSet[*output]
+	flushTimer *time.Timer                       // or nil if none running
+	lookupNode func(netip.Addr) (NodeInfo, bool) // or nil; see SetNodeLookup
 }
 
 // RegisterOutput connects an output to this sink, which
@@ -108,15 +202,24 @@ type Sink struct {
 // or when the sink is closed. If w implements http.Flusher,
 // it will be flushed periodically.
 func (s *Sink) RegisterOutput(w io.Writer) (unregister func()) {
+	return s.RegisterOutputOpts(w, OutputOpts{})
+}
+
+// RegisterOutputOpts is like RegisterOutput, but writes the capture in the
+// given format, and only the packets selected by opts.Filter.
+//
+// The file header is written to w in a single write, and each packet in a
+// single write after that.
+func (s *Sink) RegisterOutputOpts(w io.Writer, opts OutputOpts) (unregister func()) {
 	select {
 	case <-s.ctx.Done():
 		return func() {}
 	default:
 	}
 
-	writePcapHeader(w)
+	writeHeader(w, opts.Format)
 	s.mu.Lock()
-	hnd := s.outputs.Add(w)
+	hnd := s.outputs.Add(&output{w: w, opts: opts})
 	s.mu.Unlock()
 
 	return func() {
@@ -126,6 +229,15 @@ func (s *Sink) RegisterOutput(w io.Writer) (unregister func()) {
 	}
 }
 
+// SetNodeLookup sets the func that returns the node with a given Tailscale
+// IP address. It's used to match Filter's node primitives, and to annotate
+// packets in pcapng captures with the peer they're from or to.
+func (s *Sink) SetNodeLookup(lookup func(netip.Addr) (NodeInfo, bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lookupNode = lookup
+}
+
 // NumOutputs returns the number of outputs registered with the sink.
 func (s *Sink) NumOutputs() int {
 	s.mu.Lock()
@@ -146,8 +258,8 @@ func (s *Sink) Close() error {
 	}
 
 	for _, o := range s.outputs {
-		if o, ok := o.(io.Closer); ok {
-			o.Close()
+		if c, ok := o.w.(io.Closer); ok {
+			c.Close()
 		}
 	}
 	s.outputs = nil
@@ -160,7 +272,7 @@ func (s *Sink) WaitCh() <-chan struct{} {
 	return s.ctx.Done()
 }
 
-func customDataLen(meta packet.CaptureMeta) int {
+func customDataLen(path Path, meta packet.CaptureMeta) int {
 	length := 4
 	if meta.DidSNAT {
 		length += meta.OriginalSrc.Addr().BitLen() / 8
@@ -168,6 +280,9 @@ func customDataLen(meta packet.CaptureMeta) int {
 	if meta.DidDNAT {
 		length += meta.OriginalDst.Addr().BitLen() / 8
 	}
+	if path == DroppedFromPeer {
+		length += 1 + min(len(meta.DropReason), maxDropReasonLen)
+	}
 	return length
 }
 
@@ -181,44 +296,45 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 	default:
 	}
 
-	extraLen := customDataLen(meta)
-	b := bufferPool.Get().(*bytes.Buffer)
-	b.Reset()
-	b.Grow(16 + extraLen + len(data)) // 16b pcap header + len(metadata) + len(payload)
-	defer bufferPool.Put(b)
-
-	writePktHeader(b, when, len(data)+extraLen)
-
-	// Custom tailscale debugging data
-	binary.Write(b, binary.LittleEndian, uint16(path))
-	if meta.DidSNAT {
-		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalSrc.Addr().BitLen()/8))
-		b.Write(meta.OriginalSrc.Addr().AsSlice())
-	} else {
-		binary.Write(b, binary.LittleEndian, uint8(0)) // SNAT addr len == 0
-	}
-	if meta.DidDNAT {
-		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalDst.Addr().BitLen()/8))
-		b.Write(meta.OriginalDst.Addr().AsSlice())
-	} else {
-		binary.Write(b, binary.LittleEndian, uint8(0)) // DNAT addr len == 0
-	}
-
-	b.Write(data)
-
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Each format's record is encoded only if some output wants it.
+	var records [PCAPNG + 1]*bytes.Buffer
+	defer func() {
+		for _, b := range records {
+			if b != nil {
+				bufferPool.Put(b)
+			}
+		}
+	}()
+	record := func(format Format) []byte {
+		if records[format] == nil {
+			b := bufferPool.Get().(*bytes.Buffer)
+			b.Reset()
+			if format == PCAPNG {
+				writePcapngPacket(b, path, when, data, meta, s.lookupNode)
+			} else {
+				writePcapPacket(b, path, when, data, meta)
+			}
+			records[format] = b
+		}
+		return records[format].Bytes()
+	}
+
 	var hadError []set.Handle
 	for hnd, o := range s.outputs {
-		if _, err := o.Write(b.Bytes()); err != nil {
+		if !o.match(path, data, s.lookupNode) {
+			continue
+		}
+		if _, err := o.w.Write(record(o.opts.Format)); err != nil {
 			hadError = append(hadError, hnd)
 			continue
 		}
 	}
 	for _, hnd := range hadError {
-		if o, ok := s.outputs[hnd].(io.Closer); ok {
-			o.Close()
+		if c, ok := s.outputs[hnd].w.(io.Closer); ok {
+			c.Close()
 		}
 		delete(s.outputs, hnd)
 	}
@@ -228,7 +344,7 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 			s.mu.Lock()
 			defer s.mu.Unlock()
 			for _, o := range s.outputs {
-				if f, ok := o.(http.Flusher); ok {
+				if f, ok := o.w.(http.Flusher); ok {
 					f.Flush()
 				}
 			}
@@ -236,3 +352,35 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 		})
 	}
 }
+
+// writePcapPacket writes a pcap record of the packet data to b.
+func writePcapPacket(b *bytes.Buffer, path Path, when time.Time, data []byte, meta packet.CaptureMeta) {
+	extraLen := customDataLen(path, meta)
+	b.Grow(16 + extraLen + len(data)) // 16b pcap header + len(metadata) + len(payload)
+	writePktHeader(b, when, len(data)+extraLen)
+	writeCustomData(b, path, meta)
+	b.Write(data)
+}
+
+// writeCustomData writes the Tailscale debugging data that precedes each
+// packet with the USER0 link-layer type.
+func writeCustomData(b *bytes.Buffer, path Path, meta packet.CaptureMeta) {
+	binary.Write(b, binary.LittleEndian, uint16(path))
+	if meta.DidSNAT {
+		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalSrc.Addr().BitLen()/8))
+		b.Write(meta.OriginalSrc.Addr().AsSlice())
+	} else {
+		binary.Write(b, binary.LittleEndian, uint8(0)) // SNAT addr len == 0
+	}
+	if meta.DidDNAT {
+		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalDst.Addr().BitLen()/8))
+		b.Write(meta.OriginalDst.Addr().AsSlice())
+	} else {
+		binary.Write(b, binary.LittleEndian, uint8(0)) // DNAT addr len == 0
+	}
+	if path == DroppedFromPeer {
+		reason := meta.DropReason[:min(len(meta.DropReason), maxDropReasonLen)]
+		binary.Write(b, binary.LittleEndian, uint8(len(reason)))
+		b.WriteString(reason)
+	}
+}
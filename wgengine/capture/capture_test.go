@@ -0,0 +1,364 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
+)
+
+func udp4(src, dst string, sport, dport uint16) []byte {
+	return packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.UDP,
+			Src:     netip.MustParseAddr(src),
+			Dst:     netip.MustParseAddr(dst),
+		},
+		SrcPort: sport,
+		DstPort: dport,
+	}, []byte("hello"))
+}
+
+func TestFilter(t *testing.T) {
+	pkt := udp4("100.64.0.1", "100.64.0.2", 1234, 53)
+	lookup := func(ip netip.Addr) (NodeInfo, bool) {
+		if ip == netip.MustParseAddr("100.64.0.2") {
+			return NodeInfo{Name: "server.tail-scale.ts.net"}, true
+		}
+		return NodeInfo{}, false
+	}
+	tests := []struct {
+		expr string
+		path Path
+		want bool
+	}{
+		{"", FromPeer, true},
+		{"udp", FromPeer, true},
+		{"tcp", FromPeer, false},
+		{"proto 17", FromPeer, true},
+		{"host 100.64.0.2", FromPeer, true},
+		{"src host 100.64.0.2", FromPeer, false},
+		{"dst net 100.64.0.0/24", FromPeer, true},
+		{"port 53", FromPeer, true},
+		{"src port 53", FromPeer, false},
+		{"port 50-60 and udp", FromPeer, true},
+		{"path FromPeer", FromPeer, true},
+		{"path frompeer", FromLocal, false},
+		{"node server", FromPeer, true},
+		{"node server.tail-scale.ts.net.", FromPeer, true},
+		{"src node server", FromPeer, false},
+		{"node other", FromPeer, false},
+		{"not port 53", FromPeer, false},
+		{"!(tcp || port 443)", FromPeer, true},
+		{"path FromLocal or (udp and dst port 53)", FromPeer, true},
+		{"ip6", FromPeer, false},
+		{"udp port 53", FromPeer, true},
+		{"path Disco", PathDisco, true},
+		{"udp", PathDisco, false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match(tt.path, pkt, lookup); got != tt.want {
+			t.Errorf("%q.Match(%v) = %v; want %v", tt.expr, tt.path, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"host", "host nope", "port 70000", "port 9-8", "src tcp", "path Sideways", "(udp", "udp)", "frob"} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded; want error", expr)
+		}
+	}
+}
+
+func TestFileRotator(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "captures")
+	r, err := NewFileRotator(dir, PCAPNG, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := bytes.Repeat([]byte{'h'}, 10)
+	record := bytes.Repeat([]byte{'r'}, 40)
+	r.Write(header)
+	for range 5 {
+		if _, err := r.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two records fit in each file, so there were three files, of which
+	// the first was deleted.
+	files := r.Files()
+	if len(files) != 2 {
+		t.Fatalf("files = %q; want 2", files)
+	}
+	matches, _ := filepath.Glob(r.Pattern())
+	if len(matches) != 2 {
+		t.Errorf("files on disk = %q; want 2", matches)
+	}
+	for i, want := range []int{2, 1} {
+		b, err := os.ReadFile(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, header) || len(b) != len(header)+want*len(record) {
+			t.Errorf("file %d has %d bytes; want header and %d records", i, len(b), want)
+		}
+	}
+}
+
+func TestFileRotatorMaxDirSize(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "capture-20000101T000000Z-0001.pcapng")
+	if err := os.WriteFile(old, make([]byte, 150), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewFileRotator(dir, PCAPNG, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetMaxDirSize(250)
+	r.Write(bytes.Repeat([]byte{'h'}, 10))
+	for range 5 {
+		if _, err := r.Write(bytes.Repeat([]byte{'r'}, 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	// The earlier capture went first, then this capture's oldest file.
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("earlier capture not deleted: %v", err)
+	}
+	if files := r.Files(); len(files) != 2 {
+		t.Errorf("files = %q; want 2", files)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(matches) != 2 {
+		t.Errorf("files on disk = %q; want 2", matches)
+	}
+}
+
+func TestFileRotatorBuffering(t *testing.T) {
+	r, err := NewFileRotator(t.TempDir(), PCAPNG, 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := bytes.Repeat([]byte{'h'}, 10)
+	r.Write(header)
+	r.Write(bytes.Repeat([]byte{'r'}, 40))
+	file := r.Files()[0]
+	if b, _ := os.ReadFile(file); len(b) != 0 {
+		t.Errorf("file has %d bytes before Flush; want 0", len(b))
+	}
+	r.Flush()
+	if b, _ := os.ReadFile(file); len(b) != 50 {
+		t.Errorf("file has %d bytes after Flush; want 50", len(b))
+	}
+
+	// A write error fails later writes, and is reported by Err, Done and
+	// Close.
+	select {
+	case <-r.Done():
+		t.Fatal("Done closed before error")
+	default:
+	}
+	r.mu.Lock()
+	r.f.Close()
+	r.mu.Unlock()
+	r.Write(bytes.Repeat([]byte{'r'}, 40))
+	r.Flush()
+	select {
+	case <-r.Done():
+	default:
+		t.Fatal("Done not closed after write error")
+	}
+	if r.Err() == nil {
+		t.Error("Err = nil after write error")
+	}
+	if _, err := r.Write(bytes.Repeat([]byte{'r'}, 40)); err == nil {
+		t.Error("Write succeeded after write error")
+	}
+	if err := r.Close(); err == nil {
+		t.Error("Close = nil after write error")
+	}
+}
+
+func TestSinkOutputOpts(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	var all, dns bytes.Buffer
+	s.RegisterOutput(&all)
+	f, err := ParseFilter("port 53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterOutputOpts(&dns, OutputOpts{Format: PCAPNG, Filter: f})
+	headerLen := dns.Len()
+
+	now := time.Now()
+	s.LogPacket(FromPeer, now, udp4("100.64.0.1", "100.64.0.2", 1234, 53), packet.CaptureMeta{})
+	s.LogPacket(FromPeer, now, udp4("100.64.0.1", "100.64.0.2", 1234, 80), packet.CaptureMeta{})
+
+	if got := all.Len(); got != 24+2*(16+4+28+5) {
+		t.Errorf("pcap output has %d bytes; want header and 2 packets", got)
+	}
+	// The pcapng output has a single enhanced packet block.
+	epb := dns.Bytes()[headerLen:]
+	if len(epb) < 8 || epb[0] != pcapngEnhancedPacket {
+		t.Fatalf("pcapng output after header = %x; want an enhanced packet block", epb)
+	}
+	if n := int(epb[4]) | int(epb[5])<<8; n != len(epb) {
+		t.Errorf("pcapng output has %d bytes after header; want one %d byte block", len(epb), n)
+	}
+}
+
+// pcapngBlock is a block of a pcapng capture, as parsed by readPcapng.
+type pcapngBlock struct {
+	typ     uint32
+	body    []byte              // fixed part of the body, before any options
+	options map[uint16][]string // string values of options, by code
+}
+
+// readPcapng parses a pcapng capture of section header, interface
+// description and enhanced packet blocks.
+func readPcapng(t *testing.T, b []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < pcapngBlockOverhead {
+			t.Fatalf("truncated block: %x", b)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		total := int(binary.LittleEndian.Uint32(b[4:]))
+		if total%4 != 0 || total > len(b) || binary.LittleEndian.Uint32(b[total-4:]) != uint32(total) {
+			t.Fatalf("bad block length %d", total)
+		}
+		body := b[8 : total-4]
+		b = b[total:]
+
+		var fixed int
+		switch typ {
+		case pcapngSectionHeader:
+			fixed = 16
+		case pcapngInterfaceDesc:
+			fixed = 8
+		case pcapngEnhancedPacket:
+			n := int(binary.LittleEndian.Uint32(body[12:]))
+			fixed = pcapngEPBFixedBodyLen + n + (4-n%4)%4
+		default:
+			t.Fatalf("unexpected block type %#x", typ)
+		}
+		blk := pcapngBlock{typ: typ, body: body[:fixed], options: map[uint16][]string{}}
+		for opts := body[fixed:]; len(opts) >= 4; {
+			code := binary.LittleEndian.Uint16(opts)
+			n := int(binary.LittleEndian.Uint16(opts[2:]))
+			if code == pcapngOptEndOfOpt {
+				break
+			}
+			blk.options[code] = append(blk.options[code], string(opts[4:4+n]))
+			opts = opts[4+n+(4-n%4)%4:]
+		}
+		blocks = append(blocks, blk)
+	}
+	return blocks
+}
+
+func TestPcapng(t *testing.T) {
+	s := New()
+	defer s.Close()
+	peerKey := key.NewNode().Public()
+	s.SetNodeLookup(func(ip netip.Addr) (NodeInfo, bool) {
+		if ip == netip.MustParseAddr("100.64.0.2") {
+			return NodeInfo{Name: "server.tail-scale.ts.net", Key: peerKey}, true
+		}
+		return NodeInfo{}, false
+	})
+
+	var out bytes.Buffer
+	s.RegisterOutputOpts(&out, OutputOpts{Format: PCAPNG})
+	now := time.Now()
+	toPeer := udp4("100.64.0.1", "100.64.0.2", 1234, 53)
+	s.LogPacket(FromLocal, now, toPeer, packet.CaptureMeta{
+		DidSNAT:     true,
+		OriginalSrc: netip.MustParseAddrPort("10.0.0.1:1234"),
+	})
+	s.LogPacket(DroppedFromPeer, now, udp4("100.64.0.2", "100.64.0.1", 53, 1234), packet.CaptureMeta{DropReason: "new flow rate limited"})
+	s.LogPacket(FromPeer, now, udp4("100.64.0.3", "100.64.0.1", 53, 1234), packet.CaptureMeta{})
+	s.LogPacket(PathDisco, now, []byte("disco"), packet.CaptureMeta{})
+
+	blocks := readPcapng(t, out.Bytes())
+	if len(blocks) != 1+len(pcapngInterfaces)+4 {
+		t.Fatalf("got %d blocks; want section header, %d interfaces and 4 packets", len(blocks), len(pcapngInterfaces))
+	}
+	if blocks[0].typ != pcapngSectionHeader {
+		t.Errorf("first block type = %#x; want section header", blocks[0].typ)
+	}
+	var names []string
+	for i, blk := range blocks[1 : 1+len(pcapngInterfaces)] {
+		if blk.typ != pcapngInterfaceDesc {
+			t.Fatalf("block %d type = %#x; want interface description", i+1, blk.typ)
+		}
+		names = append(names, blk.options[pcapngOptIfName]...)
+		linkType := binary.LittleEndian.Uint16(blk.body)
+		if want := pcapngInterfaces[i].linkType; linkType != want {
+			t.Errorf("interface %d link type = %d; want %d", i, linkType, want)
+		}
+	}
+	if want := []string{"FromLocal", "FromPeer", "SynthesizedToLocal", "SynthesizedToPeer", "DroppedFromPeer", "Disco"}; !slices.Equal(names, want) {
+		t.Errorf("interface names = %q; want %q", names, want)
+	}
+
+	packets := blocks[1+len(pcapngInterfaces):]
+	tests := []struct {
+		path     Path
+		data     []byte // or nil to not check
+		comments []string
+	}{
+		{FromLocal, toPeer, []string{"peer: server.tail-scale.ts.net " + peerKey.String(), "pre-SNAT source: 10.0.0.1:1234"}},
+		{DroppedFromPeer, nil, []string{"peer: server.tail-scale.ts.net " + peerKey.String(), "drop reason: new flow rate limited"}},
+		{FromPeer, nil, nil},
+		{PathDisco, nil, nil},
+	}
+	for i, tt := range tests {
+		blk := packets[i]
+		if blk.typ != pcapngEnhancedPacket {
+			t.Fatalf("packet %d block type = %#x", i, blk.typ)
+		}
+		wantID, _ := pcapngInterfaceID(tt.path)
+		if id := binary.LittleEndian.Uint32(blk.body); id != wantID {
+			t.Errorf("packet %d interface = %d; want %d", i, id, wantID)
+		}
+		n := binary.LittleEndian.Uint32(blk.body[12:])
+		data := blk.body[pcapngEPBFixedBodyLen : pcapngEPBFixedBodyLen+n]
+		if tt.data != nil && !bytes.Equal(data, tt.data) {
+			t.Errorf("packet %d data = %x; want raw IP packet %x", i, data, tt.data)
+		}
+		if got := blk.options[pcapngOptComment]; !slices.Equal(got, tt.comments) {
+			t.Errorf("packet %d comments = %q; want %q", i, got, tt.comments)
+		}
+	}
+	// Disco frames keep the Tailscale debugging data prefix.
+	disco := packets[3].body[pcapngEPBFixedBodyLen:]
+	if path := binary.LittleEndian.Uint16(disco); Path(path) != PathDisco || !bytes.Contains(disco, []byte("disco")) {
+		t.Errorf("disco packet = %x; want Tailscale prefix and frame", disco)
+	}
+}
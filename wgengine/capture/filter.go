@@ -0,0 +1,380 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// Filter is a compiled capture filter expression, which selects the packets
+// written to an output.
+//
+// The syntax is a subset of tcpdump's, extended with Tailscale-specific
+// primitives:
+//
+//	[src|dst] host ADDR    packets to or from an IP address
+//	[src|dst] net PREFIX   packets to or from a CIDR prefix
+//	[src|dst] port N[-M]   packets to or from a TCP, UDP or SCTP port range
+//	[src|dst] node NAME    packets to or from a peer, by MagicDNS name
+//	tcp, udp, sctp, icmp, icmp6, ip, ip6, proto NAME|NUM
+//	path NAME              packets logged on a Path, such as FromPeer
+//
+// Primitives may be combined with "and", "or", "not" (or "&&", "||", "!")
+// and parentheses. Adjacent primitives without an operator are joined with
+// "and".
+type Filter struct {
+	expr  string
+	match matchFunc
+}
+
+// matchContext is a packet being matched against a filter.
+type matchContext struct {
+	path   Path
+	p      *packet.Parsed
+	lookup func(netip.Addr) (NodeInfo, bool) // or nil
+}
+
+type matchFunc func(*matchContext) bool
+
+// ParseFilter parses a capture filter expression. See Filter for the
+// syntax. An empty expression matches all packets.
+func ParseFilter(expr string) (*Filter, error) {
+	fp := &filterParser{toks: tokenizeFilter(expr)}
+	if len(fp.toks) == 0 {
+		return &Filter{expr: expr, match: func(*matchContext) bool { return true }}, nil
+	}
+	m, err := fp.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture filter %q: %w", expr, err)
+	}
+	if !fp.done() {
+		return nil, fmt.Errorf("invalid capture filter %q: unexpected %q", expr, fp.peek())
+	}
+	return &Filter{expr: expr, match: m}, nil
+}
+
+// String returns the expression f was parsed from.
+func (f *Filter) String() string { return f.expr }
+
+// Match reports whether the packet data, logged on path, matches f.
+//
+// lookup, if non-nil, returns the node with the given Tailscale IP address.
+// It's needed to match node primitives.
+func (f *Filter) Match(path Path, data []byte, lookup func(netip.Addr) (NodeInfo, bool)) bool {
+	var p packet.Parsed
+	if path != PathDisco {
+		// Disco frames aren't IP packets, and only match path
+		// primitives.
+		p.Decode(data)
+	}
+	return f.match(&matchContext{path: path, p: &p, lookup: lookup})
+}
+
+func tokenizeFilter(s string) []string {
+	var toks []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			toks = append(toks, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			toks = append(toks, string(c))
+		case c == '!' && (i+1 == len(s) || s[i+1] != '='):
+			flush()
+			toks = append(toks, "not")
+		case strings.HasPrefix(s[i:], "&&"):
+			flush()
+			toks = append(toks, "and")
+			i++
+		case strings.HasPrefix(s[i:], "||"):
+			flush()
+			toks = append(toks, "or")
+			i++
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return toks
+}
+
+type filterParser struct {
+	toks []string
+	pos  int
+}
+
+func (fp *filterParser) done() bool { return fp.pos >= len(fp.toks) }
+
+func (fp *filterParser) peek() string {
+	if fp.done() {
+		return ""
+	}
+	return fp.toks[fp.pos]
+}
+
+func (fp *filterParser) next() (string, error) {
+	if fp.done() {
+		return "", errors.New("unexpected end of expression")
+	}
+	tok := fp.toks[fp.pos]
+	fp.pos++
+	return tok, nil
+}
+
+func (fp *filterParser) parseOr() (matchFunc, error) {
+	left, err := fp.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(fp.peek(), "or") {
+		fp.pos++
+		right, err := fp.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(mc *matchContext) bool { return l(mc) || right(mc) }
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseAnd() (matchFunc, error) {
+	left, err := fp.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch tok := strings.ToLower(fp.peek()); tok {
+		case "", "or", ")":
+			return left, nil
+		case "and":
+			fp.pos++
+		}
+		right, err := fp.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(mc *matchContext) bool { return l(mc) && right(mc) }
+	}
+}
+
+func (fp *filterParser) parseNot() (matchFunc, error) {
+	switch fp.peek() {
+	case "not", "NOT":
+		fp.pos++
+		m, err := fp.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(mc *matchContext) bool { return !m(mc) }, nil
+	case "(":
+		fp.pos++
+		m, err := fp.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := fp.next(); err != nil || tok != ")" {
+			return nil, errors.New("missing )")
+		}
+		return m, nil
+	}
+	return fp.parsePrimitive()
+}
+
+// direction qualifiers of a primitive.
+const (
+	dirSrcOrDst = iota
+	dirSrc
+	dirDst
+)
+
+func (fp *filterParser) parsePrimitive() (matchFunc, error) {
+	tok, err := fp.next()
+	if err != nil {
+		return nil, err
+	}
+	tok = strings.ToLower(tok)
+	dir := dirSrcOrDst
+	switch tok {
+	case "src", "dst":
+		if tok == "src" {
+			dir = dirSrc
+		} else {
+			dir = dirDst
+		}
+		if tok, err = fp.next(); err != nil {
+			return nil, err
+		}
+		tok = strings.ToLower(tok)
+		switch tok {
+		case "host", "net", "port", "node":
+		default:
+			return nil, fmt.Errorf("%q can't follow src or dst", tok)
+		}
+	}
+
+	switch tok {
+	case "tcp":
+		return matchProto(ipproto.TCP), nil
+	case "udp":
+		return matchProto(ipproto.UDP), nil
+	case "sctp":
+		return matchProto(ipproto.SCTP), nil
+	case "icmp":
+		return matchProto(ipproto.ICMPv4), nil
+	case "icmp6":
+		return matchProto(ipproto.ICMPv6), nil
+	case "ip":
+		return func(mc *matchContext) bool { return mc.p.IPVersion == 4 }, nil
+	case "ip6":
+		return func(mc *matchContext) bool { return mc.p.IPVersion == 6 }, nil
+	}
+
+	arg, err := fp.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case "proto":
+		var proto ipproto.Proto
+		if err := proto.UnmarshalText([]byte(arg)); err != nil {
+			return nil, fmt.Errorf("unknown protocol %q", arg)
+		}
+		return matchProto(proto), nil
+	case "path":
+		path, ok := parsePath(arg)
+		if !ok {
+			return nil, fmt.Errorf("unknown path %q", arg)
+		}
+		return func(mc *matchContext) bool { return mc.path == path }, nil
+	case "host":
+		ip, err := netip.ParseAddr(arg)
+		if err != nil {
+			return nil, err
+		}
+		return matchAddr(dir, func(a netip.Addr) bool { return a == ip }), nil
+	case "net":
+		pfx, err := netip.ParsePrefix(arg)
+		if err != nil {
+			return nil, err
+		}
+		pfx = pfx.Masked()
+		return matchAddr(dir, pfx.Contains), nil
+	case "port":
+		lo, hi, err := parsePortRange(arg)
+		if err != nil {
+			return nil, err
+		}
+		return matchPort(dir, lo, hi), nil
+	case "node":
+		return matchNode(dir, strings.ToLower(strings.TrimSuffix(arg, "."))), nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", tok)
+}
+
+func matchProto(proto ipproto.Proto) matchFunc {
+	return func(mc *matchContext) bool {
+		return mc.p.IPVersion != 0 && mc.p.IPProto == proto
+	}
+}
+
+// matchAddr returns a matchFunc that reports whether the packet's source or
+// destination address, as selected by dir, satisfies ok.
+func matchAddr(dir int, ok func(netip.Addr) bool) matchFunc {
+	return matchAddrFunc(dir, func(_ *matchContext, a netip.Addr) bool { return ok(a) })
+}
+
+// matchNode returns a matchFunc that reports whether the packet's source or
+// destination address, as selected by dir, belongs to the named node.
+func matchNode(dir int, name string) matchFunc {
+	return matchAddrFunc(dir, func(mc *matchContext, a netip.Addr) bool {
+		if mc.lookup == nil {
+			return false
+		}
+		n, ok := mc.lookup(a)
+		return ok && nodeNameMatches(n.Name, name)
+	})
+}
+
+func matchAddrFunc(dir int, ok func(*matchContext, netip.Addr) bool) matchFunc {
+	return func(mc *matchContext) bool {
+		if mc.p.IPVersion == 0 {
+			return false
+		}
+		switch dir {
+		case dirSrc:
+			return ok(mc, mc.p.Src.Addr())
+		case dirDst:
+			return ok(mc, mc.p.Dst.Addr())
+		}
+		return ok(mc, mc.p.Src.Addr()) || ok(mc, mc.p.Dst.Addr())
+	}
+}
+
+// nodeNameMatches reports whether the MagicDNS name fqdn, without a
+// trailing dot, is name or has name as its first label.
+func nodeNameMatches(fqdn, name string) bool {
+	if fqdn == "" {
+		return false
+	}
+	fqdn = strings.ToLower(fqdn)
+	if fqdn == name {
+		return true
+	}
+	host, _, _ := strings.Cut(fqdn, ".")
+	return host == name
+}
+
+func matchPort(dir int, lo, hi uint16) matchFunc {
+	in := func(port uint16) bool { return port >= lo && port <= hi }
+	return func(mc *matchContext) bool {
+		switch mc.p.IPProto {
+		case ipproto.TCP, ipproto.UDP, ipproto.SCTP:
+		default:
+			return false
+		}
+		if mc.p.IPVersion == 0 {
+			return false
+		}
+		switch dir {
+		case dirSrc:
+			return in(mc.p.Src.Port())
+		case dirDst:
+			return in(mc.p.Dst.Port())
+		}
+		return in(mc.p.Src.Port()) || in(mc.p.Dst.Port())
+	}
+}
+
+func parsePortRange(s string) (lo, hi uint16, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	n, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	lo, hi = uint16(n), uint16(n)
+	if isRange {
+		n, err := strconv.ParseUint(last, 10, 16)
+		if err != nil || uint16(n) < lo {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+		hi = uint16(n)
+	}
+	return lo, hi, nil
+}
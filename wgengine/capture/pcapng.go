@@ -0,0 +1,198 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/key"
+)
+
+// pcapng block types and option codes.
+// See https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html.
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterfaceDesc   = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngBlockOverhead   = 12 // type, total length, and trailing total length
+	pcapngEPBFixedBodyLen = 20 // interface ID, timestamp, captured and original lengths
+
+	pcapngOptEndOfOpt   = 0
+	pcapngOptComment    = 1
+	pcapngOptIfName     = 2
+	pcapngOptIfDesc     = 3
+	pcapngOptShbUserApp = 4
+)
+
+// linkTypeRaw is the pcap link-layer type of raw IPv4 and IPv6 packets,
+// which Wireshark decodes without ts-dissector.lua.
+const linkTypeRaw = 101
+
+// NodeInfo describes the Tailscale node that a captured packet is from or
+// to, for annotating pcapng captures.
+type NodeInfo struct {
+	Name string         // MagicDNS name, without the trailing dot
+	Key  key.NodePublic // node key
+}
+
+// pcapngInterface is a pcapng interface description block. Each Path is
+// captured on its own interface, so that Wireshark shows the Path of each
+// packet and can filter on it with frame.interface_name.
+type pcapngInterface struct {
+	path     Path
+	linkType uint16
+	desc     string
+}
+
+// pcapngInterfaces are the interfaces written to each pcapng capture. A
+// packet's interface ID is the index of its Path.
+var pcapngInterfaces = []pcapngInterface{
+	{FromLocal, linkTypeRaw, "packets from the local system into the TUN"},
+	{FromPeer, linkTypeRaw, "packets received from peers"},
+	{SynthesizedToLocal, linkTypeRaw, "packets generated by tailscaled for the local system"},
+	{SynthesizedToPeer, linkTypeRaw, "packets generated by tailscaled for peers"},
+	{DroppedFromPeer, linkTypeRaw, "packets from peers dropped by the packet filter"},
+	// Disco frames aren't IP packets, so they keep the Tailscale debugging
+	// data decoded by ts-dissector.lua.
+	{PathDisco, linkTypeUser0, "disco frames"},
+}
+
+// pcapngInterfaceID returns the interface ID of path in pcapng captures.
+func pcapngInterfaceID(path Path) (uint32, bool) {
+	for i, iface := range pcapngInterfaces {
+		if iface.path == path {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// writePcapngBlock writes a pcapng block of the given type and body to w,
+// padding the body to a multiple of 4 bytes.
+func writePcapngBlock(w io.Writer, typ uint32, body []byte) {
+	pad := (4 - len(body)%4) % 4
+	total := uint32(pcapngBlockOverhead + len(body) + pad)
+	binary.Write(w, binary.LittleEndian, typ)
+	binary.Write(w, binary.LittleEndian, total)
+	w.Write(body)
+	w.Write(make([]byte, pad))
+	binary.Write(w, binary.LittleEndian, total)
+}
+
+// appendPcapngOption appends a pcapng option with a string value to b,
+// padded to a multiple of 4 bytes. Values longer than the maximum option
+// length are truncated.
+func appendPcapngOption(b []byte, code uint16, val string) []byte {
+	val = val[:min(len(val), 0xFFFF)]
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(val)))
+	b = append(b, val...)
+	return append(b, make([]byte, (4-len(val)%4)%4)...)
+}
+
+// appendPcapngEndOfOpt appends the option that ends a list of options.
+func appendPcapngEndOfOpt(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, pcapngOptEndOfOpt)
+}
+
+// writePcapngHeader writes a pcapng section header block, followed by an
+// interface description block for each Path.
+func writePcapngHeader(w io.Writer) {
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)                  // version major
+	shb = binary.LittleEndian.AppendUint16(shb, 0)                  // version minor
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF) // section length: unspecified
+	shb = appendPcapngOption(shb, pcapngOptShbUserApp, "tailscaled")
+	shb = appendPcapngEndOfOpt(shb)
+	writePcapngBlock(w, pcapngSectionHeader, shb)
+
+	for _, iface := range pcapngInterfaces {
+		idb := binary.LittleEndian.AppendUint16(nil, iface.linkType)
+		idb = binary.LittleEndian.AppendUint16(idb, 0)     // reserved
+		idb = binary.LittleEndian.AppendUint32(idb, 65535) // snap length
+		idb = appendPcapngOption(idb, pcapngOptIfName, iface.path.String())
+		idb = appendPcapngOption(idb, pcapngOptIfDesc, iface.desc)
+		idb = appendPcapngEndOfOpt(idb)
+		writePcapngBlock(w, pcapngInterfaceDesc, idb)
+	}
+}
+
+// writePcapngPacket writes an enhanced packet block of the packet data to b,
+// on the interface of path.
+//
+// IP packets are written as they are, with comments naming the peer they're
+// from or to, as returned by lookup, which may be nil, and the metadata that
+// ts-dissector.lua decodes from pcap captures. Disco frames are prefixed
+// with the Tailscale debugging data, like pcap records.
+func writePcapngPacket(b *bytes.Buffer, path Path, when time.Time, data []byte, meta packet.CaptureMeta, lookup func(netip.Addr) (NodeInfo, bool)) {
+	ifaceID, ok := pcapngInterfaceID(path)
+	if !ok {
+		return
+	}
+	pkt := data
+	var comments []string
+	if pcapngInterfaces[ifaceID].linkType == linkTypeUser0 {
+		var prefixed bytes.Buffer
+		writeCustomData(&prefixed, path, meta)
+		prefixed.Write(data)
+		pkt = prefixed.Bytes()
+	} else {
+		comments = pcapngComments(path, data, meta, lookup)
+	}
+
+	body := make([]byte, 0, pcapngEPBFixedBodyLen+len(pkt)+3)
+	// Timestamps are in microseconds, the default resolution.
+	us := uint64(when.UnixMicro())
+	body = binary.LittleEndian.AppendUint32(body, ifaceID)
+	body = binary.LittleEndian.AppendUint32(body, uint32(us>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(us))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt))) // captured length
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt))) // original length
+	body = append(body, pkt...)
+	body = append(body, make([]byte, (4-len(pkt)%4)%4)...)
+	if len(comments) > 0 {
+		for _, c := range comments {
+			body = appendPcapngOption(body, pcapngOptComment, c)
+		}
+		body = appendPcapngEndOfOpt(body)
+	}
+	writePcapngBlock(b, pcapngEnhancedPacket, body)
+}
+
+// pcapngComments returns the packet comments of an IP packet logged on path.
+func pcapngComments(path Path, data []byte, meta packet.CaptureMeta, lookup func(netip.Addr) (NodeInfo, bool)) []string {
+	var comments []string
+	if lookup != nil {
+		var p packet.Parsed
+		p.Decode(data)
+		if p.IPVersion != 0 {
+			// The peer is the remote end of the packet: its
+			// destination if it's going to a peer, else its source.
+			peer := p.Src.Addr()
+			if path == FromLocal || path == SynthesizedToPeer {
+				peer = p.Dst.Addr()
+			}
+			if n, ok := lookup(peer); ok {
+				comments = append(comments, fmt.Sprintf("peer: %s %s", n.Name, n.Key))
+			}
+		}
+	}
+	if meta.DidSNAT {
+		comments = append(comments, fmt.Sprintf("pre-SNAT source: %v", meta.OriginalSrc))
+	}
+	if meta.DidDNAT {
+		comments = append(comments, fmt.Sprintf("pre-DNAT destination: %v", meta.OriginalDst))
+	}
+	if meta.DropReason != "" {
+		comments = append(comments, "drop reason: "+meta.DropReason)
+	}
+	return comments
+}
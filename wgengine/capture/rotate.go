@@ -0,0 +1,269 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FileRotator is an output for a Sink that writes the capture to a ring of
+// size-limited files in a directory, so that a capture can run for a long
+// time in bounded space. When the current file would exceed the size limit,
+// a new file is started, and the oldest file is deleted if there are more
+// than the maximum number of files. If a limit on the total size of the
+// directory is set, the oldest capture files in it, including those of
+// earlier captures, are deleted to stay under it.
+//
+// The first write to a FileRotator must be the capture's file header, which
+// is repeated at the start of each file. Each subsequent write must be a
+// whole record. Outputs registered with a Sink are written to this way.
+//
+// Writes are buffered, and flushed when a file is finished, when Flush is
+// called (which a Sink does periodically) and on Close. After an error
+// writing a file, all writes fail and Done is closed.
+type FileRotator struct {
+	dir      string
+	prefix   string // of file names, including the capture's start time
+	ext      string
+	maxSize  int64
+	maxFiles int
+
+	done chan struct{} // closed by Close or on a write error
+
+	mu      sync.Mutex
+	dirSize int64         // limit on the total size of capture files in dir, or 0
+	header  []byte        // or nil before the first write
+	f       *os.File      // current file, or nil if closed
+	w       *bufio.Writer // buffers writes to f
+	size    int64         // of f, including what's buffered
+	seq     int           // sequence number of f
+	files   []string      // paths of the files written, oldest first
+	err     error         // the first write error, or nil
+	closed  bool
+}
+
+// NewFileRotator returns a FileRotator that writes files in dir, creating it
+// if needed. Files are named after the current time and their sequence
+// number, with the file name extension of format.
+func NewFileRotator(dir string, format Format, maxSize int64, maxFiles int) (*FileRotator, error) {
+	if maxSize <= 0 || maxFiles <= 0 {
+		return nil, errors.New("capture file size and count limits must be positive")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	r := &FileRotator{
+		dir:      dir,
+		prefix:   "capture-" + time.Now().UTC().Format("20060102T150405Z"),
+		ext:      format.Ext(),
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		done:     make(chan struct{}),
+	}
+	// Don't collide with a capture started in the same second. The
+	// suffix sorts after the files of that capture.
+	base := r.prefix
+	for i := 1; ; i++ {
+		if m, _ := filepath.Glob(r.Pattern()); len(m) == 0 {
+			break
+		}
+		r.prefix = fmt.Sprintf("%s.%d", base, i)
+	}
+	return r, nil
+}
+
+// SetMaxDirSize limits the total size of the capture files in r's directory
+// to n bytes, deleting the oldest ones as needed when r starts a new file.
+// Zero means no limit.
+func (r *FileRotator) SetMaxDirSize(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dirSize = n
+}
+
+// Pattern returns a glob pattern that matches the files written by r.
+func (r *FileRotator) Pattern() string {
+	return filepath.Join(r.dir, r.prefix+"-*"+r.ext)
+}
+
+// Files returns the paths of the files that r has written and not yet
+// deleted, oldest first.
+func (r *FileRotator) Files() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.files...)
+}
+
+// Done returns a channel that is closed when r is closed, or when writing
+// to it fails. Err then reports the write error, if any.
+func (r *FileRotator) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the first error writing r's files, or nil if there was none.
+func (r *FileRotator) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *FileRotator) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.header == nil {
+		r.header = bytes.Clone(b)
+		if err := r.rotateLocked(); err != nil {
+			return 0, r.failLocked(err)
+		}
+		return len(b), nil
+	}
+	if r.size+int64(len(b)) > r.maxSize && r.size > int64(len(r.header)) {
+		if err := r.rotateLocked(); err != nil {
+			return 0, r.failLocked(err)
+		}
+	}
+	n, err := r.w.Write(b)
+	r.size += int64(n)
+	if err != nil {
+		return n, r.failLocked(err)
+	}
+	return n, nil
+}
+
+// Flush writes any buffered data to the current file.
+func (r *FileRotator) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w != nil && r.err == nil {
+		if err := r.w.Flush(); err != nil {
+			r.failLocked(err)
+		}
+	}
+}
+
+// failLocked records the write error err, closing the current file and
+// r.done, and returns err.
+func (r *FileRotator) failLocked(err error) error {
+	if r.err == nil {
+		r.err = err
+	}
+	if r.f != nil {
+		r.f.Close()
+		r.f, r.w = nil, nil
+	}
+	r.closeDoneLocked()
+	return err
+}
+
+func (r *FileRotator) closeDoneLocked() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
+
+// closeFileLocked flushes and closes the current file, if any.
+func (r *FileRotator) closeFileLocked() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f, r.w = nil, nil
+	return err
+}
+
+// rotateLocked closes the current file, if any, and starts the next one,
+// deleting the oldest file if there are too many.
+func (r *FileRotator) rotateLocked() error {
+	if err := r.closeFileLocked(); err != nil {
+		return err
+	}
+	r.seq++
+	name := filepath.Join(r.dir, fmt.Sprintf("%s-%04d%s", r.prefix, r.seq, r.ext))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	r.w = bufio.NewWriter(f)
+	r.w.Write(r.header) // errors are reported by later writes or flushes
+	r.size = int64(len(r.header))
+	r.files = append(r.files, name)
+	for len(r.files) > r.maxFiles {
+		os.Remove(r.files[0])
+		r.files = r.files[1:]
+	}
+	if r.dirSize > 0 {
+		r.pruneDirLocked(name)
+	}
+	return nil
+}
+
+// pruneDirLocked deletes the oldest capture files in r.dir other than cur,
+// until their total size plus the maximum size of cur is at most r.dirSize.
+func (r *FileRotator) pruneDirLocked(cur string) {
+	// Capture file names start with the capture's start time and end
+	// with a sequence number, so this sorts them oldest first.
+	names, err := filepath.Glob(filepath.Join(r.dir, "capture-*"))
+	if err != nil {
+		return
+	}
+	slices.Sort(names)
+	sizes := make([]int64, len(names))
+	total := r.maxSize
+	for i, name := range names {
+		if name == cur {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+			sizes[i] = fi.Size()
+			total += fi.Size()
+		}
+	}
+	for i, name := range names {
+		if total <= r.dirSize {
+			break
+		}
+		if name == cur || sizes[i] == 0 {
+			continue
+		}
+		if os.Remove(name) == nil {
+			total -= sizes[i]
+			r.files = slices.DeleteFunc(r.files, func(f string) bool { return f == name })
+		}
+	}
+}
+
+// Close flushes and closes the current file. The files written are kept.
+// It returns the first error writing them, if any.
+func (r *FileRotator) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		if err := r.closeFileLocked(); err != nil {
+			r.failLocked(err)
+		}
+		r.closeDoneLocked()
+	}
+	return r.err
+}
@@ -8,7 +8,8 @@ SNAT_IP_4 = ProtoField.ipv4("tsdebug.SNAT_IP_4", "Pre-NAT Source IPv4 address")
 SNAT_IP_6 = ProtoField.ipv4("tsdebug.SNAT_IP_6", "Pre-NAT Source IPv6 address")
 DNAT_IP_4 = ProtoField.ipv4("tsdebug.DNAT_IP_4", "Pre-NAT Dest IPv4 address")
 DNAT_IP_6 = ProtoField.ipv4("tsdebug.DNAT_IP_6", "Pre-NAT Dest IPv6 address")
-tsdebug_ll.fields = {PATH, SNAT_IP_4, SNAT_IP_6, DNAT_IP_4, DNAT_IP_6}
+DROP_REASON = ProtoField.string("tsdebug.DROP_REASON", "Drop reason", base.ASCII)
+tsdebug_ll.fields = {PATH, SNAT_IP_4, SNAT_IP_6, DNAT_IP_4, DNAT_IP_6, DROP_REASON}
 
 function tsdebug_ll.dissector(buffer, pinfo, tree)
     pinfo.cols.protocol = tsdebug_ll.name
@@ -22,6 +23,7 @@ function tsdebug_ll.dissector(buffer, pinfo, tree)
     elseif path_id == 1   then subtree:add(PATH, "FromPeer")
     elseif path_id == 2   then subtree:add(PATH, "Synthesized (Inbound / ToLocal)")
     elseif path_id == 3   then subtree:add(PATH, "Synthesized (Outbound / ToPeer)")
+    elseif path_id == 4   then subtree:add(PATH, "Dropped (FromPeer)")
     elseif path_id == 254 then subtree:add(PATH, "Disco frame")
     end
     offset = offset + 2
@@ -40,6 +42,14 @@ function tsdebug_ll.dissector(buffer, pinfo, tree)
     end
     offset = offset + 1 + dnat_addr_len
 
+    -- -- Get drop reason
+    if path_id == 4 then
+        local reason_len = buffer:range(offset, 1):le_uint()
+        if reason_len > 0 then subtree:add(DROP_REASON, buffer:range(offset + 1, reason_len))
+        end
+        offset = offset + 1 + reason_len
+    end
+
     -- -- Handover rest of data to lower-level dissector
     local data_buffer = buffer:range(offset, packet_length-offset):tvb()
     if path_id == 254 then
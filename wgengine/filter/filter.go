@@ -22,6 +22,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/views"
+	"tailscale.com/util/limiter"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/slicesx"
 	"tailscale.com/wgengine/filter/filtertype"
@@ -64,6 +65,10 @@ type Filter struct {
 	// incoming packets don't get accepted by matches above.
 	state *filterState
 
+	// newFlows, if non-nil, limits the rate of new inbound flows. It's
+	// set by SetNewFlowLimit and owned by state.
+	newFlows *limiter.Limiter[newFlowKey]
+
 	shieldsUp bool
 }
 
@@ -71,19 +76,59 @@ type Filter struct {
 type filterState struct {
 	mu  sync.Mutex
 	lru *flowtrack.Cache[struct{}] // from flowtrack.Tuple -> struct{}
+
+	// newFlowLimit and newFlows are the new flow limit shared by all
+	// filters using this state, so that replacing the filter doesn't
+	// reset it.
+	newFlowLimit NewFlowLimit
+	newFlows     *limiter.Limiter[newFlowKey]
+
+	// rateLimited is the number of new flows dropped by newFlows, by
+	// source IP.
+	rateLimited map[netip.Addr]int64
+}
+
+const (
+	// lruMax is the size of the LRU cache in filterState.
+	lruMax = 512
+
+	// newFlowLimiterSize is the number of (source IP, destination port)
+	// pairs whose new flow rate is tracked precisely.
+	newFlowLimiterSize = 4096
+
+	// maxRateLimitedSources bounds the number of source IPs for which
+	// rate limited flow counts are kept.
+	maxRateLimitedSources = 1000
+)
+
+// NewFlowLimit limits the rate at which each source IP may open new inbound
+// TCP connections to each destination port. The zero value means no limit.
+type NewFlowLimit struct {
+	PerSecond float64 // sustained rate of new connections
+	Burst     int64   // connections allowed before the rate applies
+}
+
+// newFlowKey is the key of a new flow limit.
+type newFlowKey struct {
+	src     netip.Addr
+	dstPort uint16
 }
 
-// lruMax is the size of the LRU cache in filterState.
-const lruMax = 512
+// NewFlowLimitStats are statistics about a filter's new flow limit.
+type NewFlowLimitStats struct {
+	Limit       NewFlowLimit
+	RateLimited map[netip.Addr]int64 `json:",omitempty"` // dropped new flows, by source IP
+}
 
 // Response is a verdict from the packet filter.
 type Response int
 
 const (
-	Drop         Response = iota // do not continue processing packet.
-	DropSilently                 // do not continue processing packet, but also don't log
-	Accept                       // continue processing packet.
-	noVerdict                    // no verdict yet, continue running filter
+	Drop            Response = iota // do not continue processing packet.
+	DropSilently                    // do not continue processing packet, but also don't log
+	Accept                          // continue processing packet.
+	noVerdict                       // no verdict yet, continue running filter
+	DropRateLimited                 // do not continue processing packet; its source exceeded its NewFlowLimit
 )
 
 func (r Response) String() string {
@@ -96,13 +141,15 @@ func (r Response) String() string {
 		return "Accept"
 	case noVerdict:
 		return "noVerdict"
+	case DropRateLimited:
+		return "DropRateLimited"
 	default:
 		return "???"
 	}
 }
 
 func (r Response) IsDrop() bool {
-	return r == Drop || r == DropSilently
+	return r == Drop || r == DropSilently || r == DropRateLimited
 }
 
 // RunFlags controls the filter's debug log verbosity at runtime.
@@ -316,7 +363,7 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 	}
 
 	var verdict string
-	if r == Drop && (runflags&LogDrops) != 0 && dropBucket.Allow() {
+	if (r == Drop || r == DropRateLimited) && (runflags&LogDrops) != 0 && dropBucket.Allow() {
 		verdict = "Drop"
 		runflags &= HexdumpDrops
 	} else if r == Accept && (runflags&LogAccepts) != 0 && acceptBucket.Allow() {
@@ -363,7 +410,8 @@ func (f *Filter) Check(srcIP, dstIP netip.Addr, dstPort uint16, proto ipproto.Pr
 		pkt.TCPFlags = packet.TCPSyn
 	}
 
-	return f.RunIn(pkt, 0)
+	// Don't let synthesized checks count against the new flow limit.
+	return f.runIn(pkt, 0, false)
 }
 
 // CheckTCP determines whether TCP traffic from srcIP to dstIP:dstPort
@@ -405,9 +453,53 @@ func (f *Filter) CapsWithValues(srcIP, dstIP netip.Addr) tailcfg.PeerCapMap {
 // incoming) filter.
 func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
 
+// SetNewFlowLimit sets the limit on the rate at which each source IP may
+// open new inbound TCP connections to each destination port. The limit
+// applies in addition to the filter's matches.
+//
+// It must be called before f is in use. Filters that share state also
+// share the limit's token buckets, as long as the limit doesn't change.
+func (f *Filter) SetNewFlowLimit(l NewFlowLimit) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	if l.PerSecond <= 0 {
+		f.state.newFlowLimit = NewFlowLimit{}
+		f.state.newFlows = nil
+		f.newFlows = nil
+		return
+	}
+	if f.state.newFlows == nil || f.state.newFlowLimit != l {
+		f.state.newFlowLimit = l
+		f.state.newFlows = &limiter.Limiter[newFlowKey]{
+			Size:           newFlowLimiterSize,
+			Max:            max(l.Burst, 1),
+			RefillInterval: limiter.QPSInterval(l.PerSecond),
+		}
+	}
+	f.newFlows = f.state.newFlows
+}
+
+// NewFlowLimitStats returns the filter's new flow limit and the number of
+// new flows it has dropped.
+func (f *Filter) NewFlowLimitStats() NewFlowLimitStats {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	st := NewFlowLimitStats{Limit: f.state.newFlowLimit}
+	for ip, n := range f.state.rateLimited {
+		mak.Set(&st.RateLimited, ip, n)
+	}
+	return st
+}
+
 // RunIn determines whether this node is allowed to receive q from a
 // Tailscale peer.
 func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
+	return f.runIn(q, rf, true)
+}
+
+// runIn implements RunIn. If limitFlows is false, q doesn't count against
+// the filter's new flow limit.
+func (f *Filter) runIn(q *packet.Parsed, rf RunFlags, limitFlows bool) Response {
 	dir := in
 	r := f.pre(q, rf, dir)
 	if r == Accept || r == Drop {
@@ -424,10 +516,32 @@ func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
 	default:
 		r, why = Drop, "not-ip"
 	}
+	if r == Accept && limitFlows && f.newFlows != nil && !f.allowNewFlow(q) {
+		r, why = DropRateLimited, "new flow rate limited"
+	}
 	f.logRateLimit(rf, q, dir, r, why)
 	return r
 }
 
+// allowNewFlow reports whether q, which the filter otherwise accepts, is
+// within its source's new flow limit. Only TCP SYNs count as new flows;
+// other protocols have no way to tell a new flow from an existing one.
+func (f *Filter) allowNewFlow(q *packet.Parsed) bool {
+	if q.IPProto != ipproto.TCP || !q.IsTCPSyn() {
+		return true
+	}
+	if f.newFlows.Allow(newFlowKey{q.Src.Addr(), q.Dst.Port()}) {
+		return true
+	}
+	src := q.Src.Addr()
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	if _, ok := f.state.rateLimited[src]; ok || len(f.state.rateLimited) < maxRateLimitedSources {
+		mak.Set(&f.state.rateLimited, src, f.state.rateLimited[src]+1)
+	}
+	return false
+}
+
 // RunOut determines whether this node is allowed to send q to a
 // Tailscale peer.
 func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
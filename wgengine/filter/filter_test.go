@@ -236,6 +236,53 @@ func TestUDPState(t *testing.T) {
 	}
 }
 
+func TestNewFlowLimit(t *testing.T) {
+	acl := newFilter(t.Logf)
+	acl.SetNewFlowLimit(NewFlowLimit{PerSecond: 0.001, Burst: 2})
+
+	syn := parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 22)
+	for i := range 2 {
+		if got := acl.RunIn(&syn, 0); got != Accept {
+			t.Fatalf("SYN %d = %v; want Accept", i, got)
+		}
+	}
+	if got := acl.RunIn(&syn, 0); got != DropRateLimited {
+		t.Fatalf("SYN over limit = %v; want DropRateLimited", got)
+	}
+
+	// Established connections, other ports, other sources and
+	// synthesized checks aren't limited.
+	ack := parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 22)
+	ack.TCPFlags = packet.TCPAck
+	otherPort := parsed(ipproto.TCP, "8.1.1.1", "5.6.7.8", 999, 23)
+	otherSrc := parsed(ipproto.TCP, "8.2.2.2", "1.2.3.4", 999, 22)
+	for _, p := range []*packet.Parsed{&ack, &otherPort, &otherSrc} {
+		if got := acl.RunIn(p, 0); got != Accept {
+			t.Errorf("%v = %v; want Accept", p, got)
+		}
+	}
+	if got := acl.CheckTCP(mustIP("8.1.1.1"), mustIP("1.2.3.4"), 22); got != Accept {
+		t.Errorf("CheckTCP = %v; want Accept", got)
+	}
+
+	// A replacement filter with the same limit keeps its state.
+	acl2 := New(nil, nil, nil, nil, acl, t.Logf)
+	acl2.SetNewFlowLimit(NewFlowLimit{PerSecond: 0.001, Burst: 2})
+	if acl2.newFlows != acl.newFlows {
+		t.Error("new flow limiter not shared with replacement filter")
+	}
+
+	st := acl.NewFlowLimitStats()
+	if n := st.RateLimited[mustIP("8.1.1.1")]; n != 1 || len(st.RateLimited) != 1 {
+		t.Errorf("rate limited = %v; want 1 for 8.1.1.1", st.RateLimited)
+	}
+
+	acl.SetNewFlowLimit(NewFlowLimit{})
+	if got := acl.RunIn(&syn, 0); got != Accept {
+		t.Errorf("SYN without limit = %v; want Accept", got)
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
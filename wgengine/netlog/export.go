@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/net/flowexport"
+	"tailscale.com/types/netlogtype"
+	"tailscale.com/util/clientmetric"
+)
+
+// Exporter exports network traffic statistics to a destination other than
+// the Tailscale log service, such as a flow collector.
+type Exporter interface {
+	// Export exports the traffic in m. It must not retain m.
+	Export(m *netlogtype.Message) error
+
+	// Close releases the resources of the Exporter.
+	Close() error
+}
+
+// udpExporter is an Exporter that sends IPFIX or NetFlow v9 messages to a
+// flow collector over UDP.
+type udpExporter struct {
+	conn net.Conn
+
+	mu  sync.Mutex
+	enc *flowexport.Encoder
+}
+
+// NewUDPExporter returns an Exporter that sends traffic statistics to the
+// flow collector at collector, in the form accepted by
+// flowexport.ParseCollector.
+func NewUDPExporter(collector string) (Exporter, error) {
+	format, hostPort, err := flowexport.ParseCollector(collector)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("dialing flow collector: %w", err)
+	}
+	return &udpExporter{conn: conn, enc: flowexport.NewEncoder(format)}, nil
+}
+
+func (e *udpExporter) Export(m *netlogtype.Message) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, msg := range e.enc.Encode(time.Now(), flowexport.Records(m)) {
+		if _, err := e.conn.Write(msg); err != nil {
+			metricExportErrors.Add(1)
+			return err
+		}
+		metricExportMessages.Add(1)
+	}
+	return nil
+}
+
+func (e *udpExporter) Close() error {
+	return e.conn.Close()
+}
+
+var (
+	metricExportMessages = clientmetric.NewCounter("netlog_export_messages")
+	metricExportErrors   = clientmetric.NewCounter("netlog_export_errors")
+)
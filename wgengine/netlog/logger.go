@@ -2,12 +2,13 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // Package netlog provides a logger that monitors a TUN device and
-// periodically records any traffic into a log stream.
+// periodically records any traffic into a log stream, an Exporter, or both.
 package netlog
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -24,6 +25,7 @@
 	"tailscale.com/net/sockstats"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netlogtype"
 	"tailscale.com/util/multierr"
@@ -50,10 +52,11 @@ func (noopDevice) SetStatistics(*connstats.Statistics) {}
 type Logger struct {
 	mu sync.Mutex // protects all fields below
 
-	logger *logtail.Logger
-	stats  *connstats.Statistics
-	tun    Device
-	sock   Device
+	logger   *logtail.Logger // nil if not uploading to the log service
+	exporter Exporter        // nil if not exporting
+	stats    *connstats.Statistics
+	tun      Device
+	sock     Device
 
 	addrs    map[netip.Addr]bool
 	prefixes map[netip.Prefix]bool
@@ -63,7 +66,7 @@ type Logger struct {
 func (nl *Logger) Running() bool {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	return nl.logger != nil
+	return nl.stats != nil
 }
 
 var testClient *http.Client
@@ -93,33 +96,29 @@ func (nl *Logger) Running() bool {
 // The IP protocol and source port are always zero.
 // The sock is used to populated the PhysicalTraffic field in Message.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
-func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor, health *health.Tracker, logExitFlowEnabledEnabled bool) error {
+//
+// Messages are uploaded to the Tailscale log service unless nodeLogID is
+// zero, and passed to exporter if it's non-nil. The Logger takes ownership
+// of exporter, closing it on Shutdown.
+func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor, health *health.Tracker, logExitFlowEnabledEnabled bool, exporter Exporter) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger != nil {
-		return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
+	if nl.stats != nil {
+		if nl.logger != nil {
+			return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
+		}
+		return errors.New("network logger already running")
 	}
+	if nodeLogID.IsZero() && exporter == nil {
+		return errors.New("network logger has no log ID or exporter")
+	}
+	nl.exporter = exporter
 
-	// Startup a log stream to Tailscale's logging service.
+	// Startup a log stream to Tailscale's logging service, if logging.
 	logf := log.Printf
-	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
-	if testClient != nil {
-		httpc = testClient
+	if !nodeLogID.IsZero() {
+		nl.startLogtailLocked(nodeLogID, domainLogID, netMon, health, logf)
 	}
-	nl.logger = logtail.NewLogger(logtail.Config{
-		Collection:    "tailtraffic.log.tailscale.io",
-		PrivateID:     nodeLogID,
-		CopyPrivateID: domainLogID,
-		Stderr:        io.Discard,
-		CompressLogs:  true,
-		HTTPC:         httpc,
-		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
-
-		// Include process sequence numbers to identify missing samples.
-		IncludeProcID:       true,
-		IncludeProcSequence: true,
-	}, logf)
-	nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
 
 	// Startup a data structure to track per-connection statistics.
 	// There is a maximum size for individual log messages that logtail
@@ -131,7 +130,12 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 		addrs := nl.addrs
 		prefixes := nl.prefixes
 		nl.mu.Unlock()
-		recordStatistics(nl.logger, nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		m := recordStatistics(nl.logger, nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		if exporter != nil && m != nil {
+			if err := exporter.Export(m); err != nil {
+				logf("netlog: export: %v", err)
+			}
+		}
 	})
 
 	// Register the connection tracker into the TUN device.
@@ -151,7 +155,30 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	return nil
 }
 
-func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) {
+func (nl *Logger) startLogtailLocked(nodeLogID, domainLogID logid.PrivateID, netMon *netmon.Monitor, health *health.Tracker, logf logger.Logf) {
+	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
+	if testClient != nil {
+		httpc = testClient
+	}
+	nl.logger = logtail.NewLogger(logtail.Config{
+		Collection:    "tailtraffic.log.tailscale.io",
+		PrivateID:     nodeLogID,
+		CopyPrivateID: domainLogID,
+		Stderr:        io.Discard,
+		CompressLogs:  true,
+		HTTPC:         httpc,
+		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
+
+		// Include process sequence numbers to identify missing samples.
+		IncludeProcID:       true,
+		IncludeProcSequence: true,
+	}, logf)
+	nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
+}
+
+// recordStatistics uploads the traffic in connstats and sockStats to logger,
+// if it's non-nil, and returns it as a message, or nil if there's none.
+func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) *netlogtype.Message {
 	m := netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
 
 	classifyAddr := func(a netip.Addr) (isTailscale, withinRoute bool) {
@@ -201,13 +228,17 @@ func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start
 		m.PhysicalTraffic = append(m.PhysicalTraffic, netlogtype.ConnectionCounts{Connection: conn, Counts: cnts})
 	}
 
-	if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) > 0 {
+	if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) == 0 {
+		return nil
+	}
+	if logger != nil {
 		if b, err := json.Marshal(m); err != nil {
 			logger.Logf("json.Marshal error: %v", err)
 		} else {
 			logger.Logf("%s", b)
 		}
 	}
+	return &m
 }
 
 func makeRouteMaps(cfg *router.Config) (addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool) {
@@ -249,7 +280,7 @@ func (nl *Logger) ReconfigRoutes(cfg *router.Config) {
 func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger == nil {
+	if nl.stats == nil {
 		return nil
 	}
 
@@ -259,16 +290,23 @@ func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.sock.SetStatistics(nil)
 	nl.tun.SetStatistics(nil)
 	err1 := nl.stats.Shutdown(ctx)
-	err2 := nl.logger.Shutdown(ctx)
+	var err2, err3 error
+	if nl.logger != nil {
+		err2 = nl.logger.Shutdown(ctx)
+	}
+	if nl.exporter != nil {
+		err3 = nl.exporter.Close()
+	}
 	nl.mu.Lock()
 
 	// Purge state.
 	nl.logger = nil
+	nl.exporter = nil
 	nl.stats = nil
 	nl.tun = nil
 	nl.sock = nil
 	nl.addrs = nil
 	nl.prefixes = nil
 
-	return multierr.New(err1, err2)
+	return multierr.New(err1, err2, err3)
 }
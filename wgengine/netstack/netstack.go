@@ -922,6 +922,10 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 			return true
 		}
 	}
+	// Handle UDP to the Tailscale IP(s) on ports forwarded by serve.
+	if ns.lb != nil && p.IPProto == ipproto.UDP && isLocal && ns.lb.ShouldInterceptUDPPort(p.Dst.Port()) {
+		return true
+	}
 	if p.IPVersion == 6 && !isLocal && viaRange.Contains(dstIP) {
 		return ns.lb != nil && ns.lb.ShouldHandleViaIP(dstIP)
 	}
@@ -1425,6 +1429,13 @@ func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 		return
 	}
 
+	if ns.lb != nil {
+		if h := ns.lb.UDPHandlerForDst(srcAddr, dstAddr); h != nil {
+			go h(gonet.NewUDPConn(&wq, ep))
+			return
+		}
+	}
+
 	if get := ns.GetUDPHandlerForFlow; get != nil {
 		h, intercept := get(srcAddr, dstAddr)
 		if intercept {
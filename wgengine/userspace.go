@@ -42,6 +42,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
@@ -901,12 +902,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	newLogIDs := cfg.NetworkLogging
 	oldLogIDs := e.lastCfgFull.NetworkLogging
 	netLogIDsNowValid := !newLogIDs.NodeID.IsZero() && !newLogIDs.DomainID.IsZero()
-	netLogIDsWasValid := !oldLogIDs.NodeID.IsZero() && !oldLogIDs.DomainID.IsZero()
-	netLogIDsChanged := netLogIDsNowValid && netLogIDsWasValid && newLogIDs != oldLogIDs
-	netLogRunning := netLogIDsNowValid && !routerCfg.Equal(&router.Config{})
-	if envknob.NoLogsNoSupport() {
-		netLogRunning = false
-	}
+	netLogUploading := netLogIDsNowValid && !envknob.NoLogsNoSupport()
+	netLogRunning := (netLogUploading || newLogIDs.Collector != "") && !routerCfg.Equal(&router.Config{})
+	netLogChanged := netLogRunning && newLogIDs != oldLogIDs
 
 	// TODO(bradfitz,danderson): maybe delete this isDNSIPOverTailscale
 	// field and delete the resolver.ForwardLinkSelector hook and
@@ -957,9 +955,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		return err
 	}
 
-	// Shutdown the network logger because the IDs changed.
+	// Shutdown the network logger because the IDs or collector changed.
 	// Let it be started back up by subsequent logic.
-	if netLogIDsChanged && e.networkLogger.Running() {
+	if netLogChanged && e.networkLogger.Running() {
 		e.logf("wgengine: Reconfig: shutting down network logger")
 		ctx, cancel := context.WithTimeout(context.Background(), networkLoggerUploadTimeout)
 		defer cancel()
@@ -971,12 +969,25 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	// Startup the network logger.
 	// Do this before configuring the router so that we capture initial packets.
 	if netLogRunning && !e.networkLogger.Running() {
-		nid := cfg.NetworkLogging.NodeID
-		tid := cfg.NetworkLogging.DomainID
+		var nid, tid logid.PrivateID
+		if netLogUploading {
+			nid = cfg.NetworkLogging.NodeID
+			tid = cfg.NetworkLogging.DomainID
+		}
 		logExitFlowEnabled := cfg.NetworkLogging.LogExitFlowEnabled
-		e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
-		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon, e.health, logExitFlowEnabled); err != nil {
+		var exporter netlog.Exporter
+		if c := cfg.NetworkLogging.Collector; c != "" {
+			var err error
+			if exporter, err = netlog.NewUDPExporter(c); err != nil {
+				e.logf("wgengine: Reconfig: error creating flow exporter: %v", err)
+			}
+		}
+		e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s collector:%q)", nid.Public(), tid.Public(), cfg.NetworkLogging.Collector)
+		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon, e.health, logExitFlowEnabled, exporter); err != nil {
 			e.logf("wgengine: Reconfig: error starting up network logger: %v", err)
+			if exporter != nil {
+				exporter.Close()
+			}
 		}
 		e.networkLogger.ReconfigRoutes(routerCfg)
 	}
@@ -28,10 +28,14 @@ type Config struct {
 	// NetworkLogging enables network logging.
 	// It is disabled if either ID is the zero value.
 	// LogExitFlowEnabled indicates whether or not exit flows should be logged.
+	// Collector is the flow collector, as accepted by
+	// flowexport.ParseCollector, to export network logs to; it applies
+	// even if network logging to the log service is disabled.
 	NetworkLogging struct {
 		NodeID             logid.PrivateID
 		DomainID           logid.PrivateID
 		LogExitFlowEnabled bool
+		Collector          string
 	}
 }
 
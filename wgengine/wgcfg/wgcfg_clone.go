@@ -46,6 +46,7 @@ func (src *Config) Clone() *Config {
 		NodeID             logid.PrivateID
 		DomainID           logid.PrivateID
 		LogExitFlowEnabled bool
+		Collector          string
 	}
 }{})
 